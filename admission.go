@@ -0,0 +1,160 @@
+package corfs
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"sync"
+)
+
+// Admission decides whether a file read from the primary is worth caching
+// (see WithAdmission). Record is called for every read by ReadFile and
+// read-only OpenFile, whether it was served from the cache or not, so that
+// the policy can tell how often each path is read. Admit is called before
+// the cache is filled with name, of size bytes or -1 if the primary doesn't
+// report it, given how full the cache is. Both may be called concurrently,
+// sometimes with internal locks held, so they must be quick and must not
+// call back into the FileSystem.
+type Admission interface {
+	Record(name string)
+	Admit(name string, size int64, p Pressure) bool
+}
+
+// Pressure describes how full the cache is when a fill is considered.
+type Pressure struct {
+	Bytes      int64 // Total size of the complete and dirty cached copies
+	MaxBytes   int64 // Limit set by WithEviction, or zero
+	Entries    int   // Number of complete and dirty cached copies
+	MaxEntries int   // Limit set by WithMaxEntries, or zero
+
+	// The copy the eviction policy would remove first to make room, if
+	// caching the file would exceed a limit and there is one it may remove
+	Victim string
+}
+
+// Full reports whether caching size more bytes would exceed a limit, so
+// that copies would be evicted to make room.
+func (p Pressure) Full(size int64) bool {
+	return p.MaxBytes > 0 && p.Bytes+max(size, 0) > p.MaxBytes ||
+		p.MaxEntries > 0 && p.Entries+1 > p.MaxEntries
+}
+
+// AlwaysAdmit returns an Admission caching every file, as a FileSystem
+// without WithAdmission does.
+func AlwaysAdmit() Admission {
+	return alwaysAdmit{}
+}
+
+type alwaysAdmit struct{}
+
+func (alwaysAdmit) Record(string) {}
+
+func (alwaysAdmit) Admit(string, int64, Pressure) bool { return true }
+
+// TinyLFU returns an Admission estimating how often paths are read with a
+// count-min sketch of width counters per row, rounded up to a power of two,
+// in the manner of TinyLFU. While the cache has room, every file is
+// admitted. Once caching a file would evict another, it is only admitted if
+// it has been read more often than the copy that would be evicted first, so
+// a scan of files read once doesn't flush out the files read over and
+// over. Counts are halved every ten times width reads, so that the estimate
+// follows what is popular now. A width of a few times the number of paths
+// the cache holds keeps estimates accurate in a few kilobytes.
+func TinyLFU(width int) Admission {
+	width = max(width, 16)
+	width = 1 << bits.Len(uint(width-1))
+	t := &tinyLFU{
+		seed:    maphash.MakeSeed(),
+		mask:    uint64(width - 1),
+		resetAt: 10 * width,
+	}
+	for i := range t.rows {
+		t.rows[i] = make([]uint8, width)
+	}
+	return t
+}
+
+type tinyLFU struct {
+	seed    maphash.Seed
+	mask    uint64
+	resetAt int
+
+	mu      sync.Mutex
+	rows    [4][]uint8
+	samples int
+}
+
+// index returns the counter of name in row i, by double hashing.
+func (t *tinyLFU) index(h uint64, i int) uint64 {
+	return (h + uint64(i)*(h>>32|1)) & t.mask
+}
+
+func (t *tinyLFU) Record(name string) {
+	h := maphash.String(t.seed, name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.rows {
+		if c := &t.rows[i][t.index(h, i)]; *c < 255 {
+			*c++
+		}
+	}
+	if t.samples++; t.samples >= t.resetAt {
+		for _, row := range t.rows {
+			for j := range row {
+				row[j] /= 2
+			}
+		}
+		t.samples /= 2
+	}
+}
+
+// estimate returns how often name has been read, at least.
+func (t *tinyLFU) estimate(name string) uint8 {
+	h := maphash.String(t.seed, name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := uint8(255)
+	for i := range t.rows {
+		n = min(n, t.rows[i][t.index(h, i)])
+	}
+	return n
+}
+
+func (t *tinyLFU) Admit(name string, size int64, p Pressure) bool {
+	if !p.Full(size) || p.Victim == "" {
+		return true
+	}
+	return t.estimate(name) > t.estimate(p.Victim)
+}
+
+// admit consults the admission policy about filling the cache with name,
+// counting and reporting a rejection. Without WithAdmission, every file is
+// admitted.
+func (fs *FileSystem) admit(name string) bool {
+	if fs.admission == nil {
+		return true
+	}
+	size := int64(-1)
+	if info := fs.primaryInfo(name); info != nil {
+		size = info.Size()
+	}
+	p := Pressure{
+		Bytes:      fs.index.bytes(),
+		MaxBytes:   fs.maxBytes,
+		Entries:    fs.index.count(),
+		MaxEntries: fs.maxEntries,
+	}
+	if p.Full(size) {
+		if names, _ := fs.evictionOrder(name); len(names) > 0 {
+			p.Victim = names[0]
+		}
+	}
+	if !fs.admission.Admit(name, size, p) {
+		fs.stats.rejected.Add(1)
+		fs.decide(DecisionSkipAdmission, name, nil)
+		return false
+	}
+	fs.stats.admitted.Add(1)
+	return true
+}
@@ -0,0 +1,95 @@
+package corfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPressureFull(t *testing.T) {
+	tests := []struct {
+		p    Pressure
+		size int64
+		want bool
+	}{
+		{Pressure{}, 1 << 30, false},
+		{Pressure{Bytes: 10, MaxBytes: 20}, 10, false},
+		{Pressure{Bytes: 10, MaxBytes: 20}, 11, true},
+		{Pressure{Bytes: 10, MaxBytes: 20}, -1, false},
+		{Pressure{Entries: 1, MaxEntries: 2}, 0, false},
+		{Pressure{Entries: 2, MaxEntries: 2}, 0, true},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Full(tt.size); got != tt.want {
+			t.Errorf("%+v.Full(%d) = %v, expected %v", tt.p, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestAdmissionTinyLFU(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	for _, name := range []string{"/a.txt", "/b.txt", "/scan0.txt", "/scan1.txt", "/scan2.txt", "/new.txt"} {
+		writeMemFile(t, mem, name, "content")
+	}
+	rec := &decisionRecorder{}
+	fs := New(mem, cache, WithMaxEntries(2), WithAdmission(TinyLFU(64)), WithDecisionLogger(rec))
+	fs.cacheFirst = true
+
+	readTimes(t, fs, "/a.txt", 3)
+	readTimes(t, fs, "/b.txt", 3)
+
+	// A scan of files read once doesn't displace the popular ones
+	for i := 0; i < 3; i++ {
+		readTimes(t, fs, fmt.Sprintf("/scan%d.txt", i), 1)
+	}
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if st := fs.CacheStatus(name); !st.Complete {
+			t.Errorf("CacheStatus(%s) = %+v, expected the popular copy to be kept", name, st)
+		}
+	}
+	if _, err := cache.Stat("/scan0.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/scan0.txt) error = %v, expected a file read once not to be cached", err)
+	}
+	var skipped []string
+	for _, d := range rec.take() {
+		if strings.HasPrefix(d, "skip-admission ") {
+			skipped = append(skipped, d)
+		}
+	}
+	if len(skipped) != 3 {
+		t.Errorf("decisions %v, expected skip-admission for the 3 scanned files", skipped)
+	}
+
+	// A file read more often than the first copy to evict earns its place
+	readTimes(t, fs, "/new.txt", 4)
+	if st := fs.CacheStatus("/new.txt"); !st.Complete {
+		t.Errorf("CacheStatus(/new.txt) = %+v, expected a complete copy", st)
+	}
+	if st := fs.Stats(); st.Admitted != 3 || st.Rejected != 6 || st.Evictions != 1 {
+		t.Errorf("Stats() = %+v, expected 3 fills admitted, 6 rejected and 1 eviction", st)
+	}
+}
+
+func TestAdmissionAlwaysAdmit(t *testing.T) {
+	for _, a := range []Admission{nil, AlwaysAdmit()} {
+		mem, cache := newMemFilers(t)
+		writeMemFile(t, mem, "/a.txt", "content")
+		writeMemFile(t, mem, "/b.txt", "content")
+		fs := New(mem, cache, WithMaxEntries(1), WithAdmission(a))
+		fs.cacheFirst = true
+
+		readTimes(t, fs, "/a.txt", 3)
+		readTimes(t, fs, "/b.txt", 1)
+		if st := fs.CacheStatus("/b.txt"); !st.Complete {
+			t.Errorf("%T: CacheStatus(/b.txt) = %+v, expected a complete copy", a, st)
+		}
+		want := uint64(2)
+		if a == nil {
+			want = 0 // Counted only with a policy
+		}
+		if st := fs.Stats(); st.Admitted != want || st.Rejected != 0 {
+			t.Errorf("%T: Stats() = %+v, expected %d fills admitted and none rejected", a, st, want)
+		}
+	}
+}
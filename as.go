@@ -0,0 +1,83 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// As gives access to optional interfaces beyond absfs.Filer, such as a
+// primary's own Flusher or Copier, that the FileSystem doesn't implement
+// itself. target must be a non-nil pointer to a variable of interface type,
+// as for errors.As. As sets it to the FileSystem if the FileSystem
+// implements the interface, so that corfs keeps caching whatever it
+// already handles, such as absfs.SymLinker. Otherwise it sets it to the
+// primary if the primary does, or asks the primary's own As method, if it
+// has one, such as the FileSystem of the next tier of a chain. It reports
+// whether target was set, and panics if target is not a pointer to an
+// interface.
+//
+// Calls made through the primary's implementation bypass the cache
+// altogether: nothing they read is cached, and the FileSystem doesn't know
+// about anything they change. Call Invalidate on the paths such a call
+// changes, so that their stale copies aren't served.
+func (fs *FileSystem) As(target any) bool {
+	if target == nil {
+		panic("corfs: As target cannot be nil")
+	}
+	val := reflect.ValueOf(target)
+	if val.Kind() != reflect.Pointer || val.IsNil() {
+		panic("corfs: As target must be a non-nil pointer")
+	}
+	typ := val.Type().Elem()
+	if typ.Kind() != reflect.Interface {
+		panic("corfs: As target must be a pointer to an interface")
+	}
+	for _, v := range []any{fs, fs.primary} {
+		if reflect.TypeOf(v).Implements(typ) {
+			val.Elem().Set(reflect.ValueOf(v))
+			return true
+		}
+	}
+	if a, ok := fs.primary.(interface{ As(any) bool }); ok {
+		return a.As(target)
+	}
+	return false
+}
+
+// Invalidate drops the cached copies of name and of every file beneath it,
+// along with what the Stat and ReadDir caches hold about them and the
+// listings of the directories above name, so that they are read from the
+// primary again, and files created there are found (see ForgetNegative). It
+// is for changes made to the primary behind the FileSystem's back, such as
+// through an interface reached with As. Like Prune, it leaves dirty
+// write-back files and files open for writing alone. It returns the errors
+// of removing copies from the cache.
+func (fs *FileSystem) Invalidate(name string) error {
+	name = cleanPath(name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	fs.invalidateMetaTree(name)
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	var errs []error
+	for _, p := range fs.index.completePaths() {
+		if p != name && !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		var err error
+		pruned := fs.index.prune(p, func() {
+			err = cache.Remove(p)
+		})
+		if pruned {
+			fs.blocks.drop(cache, p)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	fs.blocks.drop(cache, name)
+	fs.blocks.dropTree(name)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,94 @@
+package corfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// copier is an optional interface a primary might implement.
+type copier interface {
+	Copy(src, dst string) error
+}
+
+// copyFiler is a primary copying files on its own.
+type copyFiler struct {
+	absfs.Filer
+}
+
+func (c copyFiler) Copy(src, dst string) error {
+	data, err := c.Filer.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f, err := c.Filer.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func TestAs(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/a.txt", "new")
+	writeMemFile(t, mem, "/b.txt", "old")
+	primary := copyFiler{mem}
+	fs := New(primary, cache, WithCacheFirst())
+
+	var c copier
+	if !fs.As(&c) || c != primary {
+		t.Fatalf("As(copier) = %v, expected the primary", c)
+	}
+	var l absfs.SymLinker
+	if !fs.As(&l) || l != fs {
+		t.Errorf("As(absfs.SymLinker) = %v, expected the FileSystem itself", l)
+	}
+	var s interface{ Unsupported() }
+	if fs.As(&s) {
+		t.Errorf("As() found %v, expected nothing to implement the interface", s)
+	}
+
+	// Changes made through the primary are seen once invalidated
+	readTimes(t, fs, "/b.txt", 1)
+	if err := c.Copy("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(fs, "/b.txt"); got != "old" {
+		t.Errorf("ReadFile() = %q, expected the stale copy before Invalidate", got)
+	}
+	if err := fs.Invalidate("/"); err != nil {
+		t.Fatalf("Invalidate() error = %v", err)
+	}
+	if got := readString(fs, "/b.txt"); got != "new" {
+		t.Errorf("ReadFile() = %q, expected %q after Invalidate", got, "new")
+	}
+}
+
+func TestAsChain(t *testing.T) {
+	top, middle := newTier(t), newTier(t)
+	bottom := copyFiler{newTier(t)}
+	fs := NewChain(top, middle, bottom)
+
+	var c copier
+	if !fs.As(&c) || c != bottom {
+		t.Errorf("As(copier) = %v, expected the bottom tier", c)
+	}
+}
+
+func TestAsPanics(t *testing.T) {
+	fs := New(newTier(t), newTier(t))
+	var c copier
+	for _, target := range []any{nil, c, (*copier)(nil), new(int)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("As(%T) didn't panic", target)
+				}
+			}()
+			fs.As(target)
+		}()
+	}
+}
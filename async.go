@@ -0,0 +1,210 @@
+package corfs
+
+import (
+	"path"
+	"sync"
+)
+
+// writeQueue performs cache fills in the background (see
+// WithAsyncCacheWrites). Each fill's writes are applied in order by one
+// worker at a time, and workers are started as work arrives and exit when
+// there is none left. A nil *writeQueue is valid and means fills are written
+// synchronously.
+type writeQueue struct {
+	workers int   // Maximum number of workers
+	limit   int64 // Maximum bytes buffered across all fills
+
+	mu      sync.Mutex
+	idle    sync.Cond    // Signalled whenever a fill finishes its queued work
+	ready   []*asyncFill // Fills with work waiting for a worker
+	running int          // Workers currently started
+	active  int          // Fills that are ready or being worked on
+	queued  int64        // Bytes buffered across all fills
+}
+
+func newWriteQueue(workers int, limit int64) *writeQueue {
+	q := &writeQueue{workers: workers, limit: limit}
+	q.idle.L = &q.mu
+	return q
+}
+
+// asyncFill is a cache fill whose writes are queued for a worker. Its
+// fields other than fill are guarded by the queue's mutex.
+type asyncFill struct {
+	fs   *FileSystem
+	fill *cacheFill
+	call *flight // Flight ended with the outcome of the fill
+	gen  uint64  // Cache generation the fill was started against
+
+	pending   [][]byte // Data not yet written
+	scheduled bool     // Queued or being worked on
+	ended     bool     // No more data will arrive
+	commit    bool     // Commit the fill once the data is written
+	dropped   bool     // Data was discarded; the fill can't be committed
+}
+
+// write queues a copy of b, or drops the fill if the queue is full.
+func (q *writeQueue) write(a *asyncFill, b []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if a.ended || a.dropped {
+		return
+	}
+	if q.queued+int64(len(b)) > q.limit {
+		a.dropped = true
+		for _, p := range a.pending {
+			q.queued -= int64(len(p))
+		}
+		a.pending = nil
+		return
+	}
+	a.pending = append(a.pending, append([]byte(nil), b...))
+	q.queued += int64(len(b))
+	q.schedule(a)
+}
+
+// end queues the commit or discard of the fill once its data is written.
+func (q *writeQueue) end(a *asyncFill, commit bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a.ended, a.commit = true, commit
+	q.schedule(a)
+}
+
+// schedule queues a for a worker, starting one if there is room. The caller
+// must hold q.mu.
+func (q *writeQueue) schedule(a *asyncFill) {
+	if a.scheduled {
+		return
+	}
+	a.scheduled = true
+	q.active++
+	q.ready = append(q.ready, a)
+	if q.running < q.workers {
+		q.running++
+		go q.work()
+	}
+}
+
+// work applies queued fills until none are ready.
+func (q *writeQueue) work() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.ready) > 0 {
+		a := q.ready[0]
+		q.ready = q.ready[1:]
+
+		for len(a.pending) > 0 {
+			chunks := a.pending
+			a.pending = nil
+			q.mu.Unlock()
+			a.apply(chunks)
+			q.mu.Lock()
+			for _, p := range chunks {
+				q.queued -= int64(len(p))
+			}
+		}
+		if a.ended {
+			commit := a.commit && !a.dropped
+			q.mu.Unlock()
+			a.finish(commit)
+			q.mu.Lock()
+		}
+
+		a.scheduled = false
+		q.active--
+		q.idle.Broadcast()
+	}
+	q.running--
+}
+
+// waitFill blocks until a has no queued work: its data has been written
+// and, if it has ended, it has been committed or discarded.
+func (q *writeQueue) waitFill(a *asyncFill) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for a.scheduled {
+		q.idle.Wait()
+	}
+}
+
+// syncFill waits for a's queued data to be written and syncs it to the
+// cache, unless a has ended, in which case it has been committed, synced
+// along the way, or discarded.
+func (q *writeQueue) syncFill(a *asyncFill) {
+	q.mu.Lock()
+	for a.scheduled {
+		q.idle.Wait()
+	}
+	if a.ended {
+		q.mu.Unlock()
+		return
+	}
+	// Keep workers off the fill while it's synced; data queued meanwhile
+	// waits for it to be scheduled again
+	a.scheduled = true
+	q.mu.Unlock()
+	a.sync()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	a.scheduled = false
+	if len(a.pending) > 0 || a.ended {
+		q.schedule(a)
+	}
+	q.idle.Broadcast()
+}
+
+// wait blocks until no fill has queued work.
+func (q *writeQueue) wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.active > 0 {
+		q.idle.Wait()
+	}
+}
+
+// apply writes chunks to the temporary file, unless the cache has been
+// replaced since the fill started.
+func (a *asyncFill) apply(chunks [][]byte) {
+	a.fs.cacheMu.RLock()
+	defer a.fs.cacheMu.RUnlock()
+	if a.fs.cacheGen != a.gen {
+		return
+	}
+	for _, p := range chunks {
+		a.fill.write(p)
+	}
+}
+
+// sync syncs the data written so far to the cache, unless the cache has
+// been replaced since the fill started.
+func (a *asyncFill) sync() {
+	a.fs.cacheMu.RLock()
+	defer a.fs.cacheMu.RUnlock()
+	if a.fs.cacheGen == a.gen {
+		a.fill.sync()
+	}
+}
+
+// finish commits or discards the fill and records the outcome.
+func (a *asyncFill) finish(commit bool) {
+	a.fs.cacheMu.RLock()
+	defer a.fs.cacheMu.RUnlock()
+	if a.fs.cacheGen != a.gen {
+		// The index was reset along with the cache; leave it alone
+		a.fill.abort()
+		a.fs.flight.end(path.Clean(a.fill.name), a.call, errFillAborted)
+		return
+	}
+	a.fs.finishFill(a.fill, a.call, commit)
+}
+
+// WaitForCacheFlush blocks until every cache write queued in the background
+// by WithAsyncCacheWrites has been applied. It returns immediately when
+// cache writes are synchronous.
+func (fs *FileSystem) WaitForCacheFlush() {
+	if fs.writes != nil {
+		fs.writes.wait()
+	}
+}
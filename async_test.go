@@ -0,0 +1,184 @@
+package corfs
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// slowWriteFiler holds writes to temporary cache files until gate is closed.
+type slowWriteFiler struct {
+	absfs.Filer
+	gate chan struct{}
+}
+
+func (s *slowWriteFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := s.Filer.OpenFile(name, flag, perm)
+	if err != nil || !isTempName(name[strings.LastIndex(name, "/")+1:]) {
+		return f, err
+	}
+	return &slowWriteFile{File: f, gate: s.gate}, nil
+}
+
+type slowWriteFile struct {
+	absfs.File
+	gate chan struct{}
+}
+
+func (s *slowWriteFile) Write(b []byte) (int, error) {
+	<-s.gate
+	return s.File.Write(b)
+}
+
+func TestAsyncCacheWrites(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "alpha")
+	writeMemFile(t, primary, "/b.txt", "beta")
+	cache := &slowWriteFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithAsyncCacheWrites(2, 1<<20))
+
+	// Reads return while the cache writes are still held
+	data, err := fs.ReadFile("/a.txt")
+	if err != nil || string(data) != "alpha" {
+		t.Fatalf("ReadFile() = %q, %v, expected %q", data, err, "alpha")
+	}
+	f, err := fs.OpenFile("/b.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "beta" {
+		t.Fatalf("ReadAll() = %q, %v, expected %q", data, err, "beta")
+	}
+
+	close(cache.gate)
+	f.Close()
+	fs.WaitForCacheFlush()
+
+	for name, content := range map[string]string{"/a.txt": "alpha", "/b.txt": "beta"} {
+		if got := readString(mem, name); got != content {
+			t.Errorf("cache %s = %q, expected %q", name, got, content)
+		}
+		if e, ok := fs.index.get(name); !ok || !e.complete || e.size != int64(len(content)) {
+			t.Errorf("index entry for %s = %+v, expected complete", name, e)
+		}
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestAsyncCacheWritesQueueFull(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	writeMemFile(t, primary, "/big.txt", string(testContent(4096)))
+	cache := &slowWriteFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithAsyncCacheWrites(1, 1024))
+
+	f, err := fs.OpenFile("/big.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || len(data) != 4096 {
+		t.Fatalf("ReadAll() = %d bytes, %v, expected 4096", len(data), err)
+	}
+	close(cache.gate)
+	f.Close()
+	fs.WaitForCacheFlush()
+
+	if _, err := mem.Stat("/big.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the dropped fill to leave no entry", err)
+	}
+	if e, ok := fs.index.get("/big.txt"); ok && e.complete {
+		t.Errorf("index entry = %+v, expected incomplete", e)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+// returnsAfter runs fn in a goroutine, fails the test if it returns before
+// release is called, and waits for it after calling release.
+func returnsAfter(t *testing.T, what string, fn func() error, release func()) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		t.Fatalf("%s = %v while cache writes were held", what, err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("%s error = %v", what, err)
+	}
+}
+
+func TestAsyncCacheWritesClose(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "alpha")
+	cache := &slowWriteFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithAsyncCacheWrites(1, 1<<20))
+
+	f, err := fs.OpenFile("/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	returnsAfter(t, "Close()", f.Close, func() { close(cache.gate) })
+
+	// Committed without waiting for the whole queue
+	if e, ok := fs.index.get("/a.txt"); !ok || !e.complete {
+		t.Errorf("index entry = %+v, expected complete once Close returned", e)
+	}
+}
+
+func TestAsyncCacheWritesSync(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	content := testContent(4096)
+	writeMemFile(t, primary, "/big.bin", string(content))
+	cache := &slowWriteFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithAsyncCacheWrites(1, 1<<20))
+
+	f, err := fs.OpenFile("/big.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.ReadFull(f, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	returnsAfter(t, "Sync()", f.Sync, func() { close(cache.gate) })
+
+	// The fill's temporary file holds what was read so far
+	entries, err := mem.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tmp int64 = -1
+	for _, entry := range entries {
+		if isTempName(entry.Name()) {
+			info, _ := entry.Info()
+			tmp = info.Size()
+		}
+	}
+	if tmp != 1000 {
+		t.Errorf("temporary file size = %d, expected 1000", tmp)
+	}
+
+	// Reading on after Sync still fills the cache
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got := readString(mem, "/big.bin"); got != string(content) {
+		t.Errorf("cache /big.bin = %d bytes, expected the content", len(got))
+	}
+}
+
+func TestWaitForCacheFlushSynchronous(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache)
+	fs.WaitForCacheFlush() // Returns immediately without a queue
+}
@@ -0,0 +1,266 @@
+package corfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// In block mode, read-only handles cache fixed-size blocks of a file as they
+// are read instead of the whole file. Blocks are stored at their natural
+// offsets in a sparse companion file next to where the whole-file entry
+// would live, so the fallback paths never mistake a partially populated
+// block file for a complete copy.
+const blockSuffix = ".blocks"
+
+// blockName returns the cache path of the block file for name.
+func blockName(name string) string {
+	return path.Join(path.Dir(name), tempPrefix+path.Base(name)+blockSuffix)
+}
+
+// isInternalName reports whether base names a file corfs keeps in the cache
+// for its own bookkeeping rather than a cached copy of a primary file.
+func isInternalName(base string) bool {
+	return strings.HasPrefix(base, tempPrefix)
+}
+
+// blockIndex tracks which blocks of each file are present in the cache. A
+// nil *blockIndex is valid and disables block caching.
+type blockIndex struct {
+	size int64               // Block size in bytes
+	key  func(string) string // Maps paths to their keys
+
+	mu   sync.Mutex
+	sets map[string]*blockSet
+}
+
+// blockSet records the blocks of one file present in its block file.
+type blockSet struct {
+	mu      sync.Mutex
+	present []uint64 // Bitmap of cached blocks
+	size    int64    // File size once the final block has been seen, or -1
+}
+
+func newBlockIndex(size int64) *blockIndex {
+	return &blockIndex{size: size, key: path.Clean, sets: make(map[string]*blockSet)}
+}
+
+// open returns the block set for name along with a handle to its block file
+// in cache. The file is opened under the index lock so that it always
+// matches the returned set, even if the entry is being dropped concurrently.
+// The caller must have created the file's directory in cache.
+func (x *blockIndex) open(cache absfs.Filer, name string) (*blockSet, absfs.File, error) {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	file, err := openFile(cache, blockName(key), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	set, ok := x.sets[key]
+	if !ok {
+		set = &blockSet{size: -1}
+		x.sets[key] = set
+	}
+	return set, file, nil
+}
+
+// current reports whether set is still the live set for name.
+func (x *blockIndex) current(name string, set *blockSet) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.sets[x.key(name)] == set
+}
+
+// drop forgets the cached blocks of name and removes its block file.
+func (x *blockIndex) drop(cache absfs.Filer, name string) {
+	if x == nil {
+		return
+	}
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.sets[key]; ok {
+		delete(x.sets, key)
+		cache.Remove(blockName(key))
+	}
+}
+
+// dropTree forgets the cached blocks of dir and everything beneath it. The
+// block files themselves are removed along with their directories.
+func (x *blockIndex) dropTree(dir string) {
+	if x == nil {
+		return
+	}
+	dir = x.key(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key := range x.sets {
+		if key == dir || strings.HasPrefix(key, prefix) {
+			delete(x.sets, key)
+		}
+	}
+}
+
+// reset forgets every block set, for example after the cache is replaced.
+func (x *blockIndex) reset() {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	x.sets = make(map[string]*blockSet)
+	x.mu.Unlock()
+}
+
+// covers reports whether blocks first through last are all present. The
+// caller must hold s.mu.
+func (s *blockSet) covers(first, last int64) bool {
+	for i := first; i <= last; i++ {
+		word := i / 64
+		if word >= int64(len(s.present)) || s.present[word]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mark records block i as present. The caller must hold s.mu.
+func (s *blockSet) mark(i int64) {
+	word := i / 64
+	for int64(len(s.present)) <= word {
+		s.present = append(s.present, 0)
+	}
+	s.present[word] |= 1 << (i % 64)
+}
+
+// readBlocks reads len(b) bytes at off through the block cache. Ranges whose
+// blocks are all cached are served from the block file; otherwise the
+// block-aligned range is fetched from the primary in one read and its
+// blocks are added to the cache.
+func (f *File) readBlocks(b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	f.lockCache()
+	defer f.unlockCache()
+	if f.cached {
+		// Caching was disabled for this handle
+		return f.readPrimaryAt(b, off)
+	}
+
+	set, file, err := f.blockFile()
+	if err == ErrCacheFull {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	if err != nil {
+		return f.readPrimaryAt(b, off)
+	}
+
+	bs := f.fs.blocks.size
+	first, last := off/bs, (off+int64(len(b))-1)/bs
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if set.covers(first, last) {
+		want := b
+		if set.size >= 0 {
+			// The block file may hold stale bytes past the known end
+			if off >= set.size {
+				return 0, io.EOF
+			}
+			if off+int64(len(want)) > set.size {
+				want = want[:set.size-off]
+			}
+		}
+		n, err := file.ReadAt(want, off)
+		if err == nil || err == io.EOF {
+			if n == len(b) {
+				return n, nil
+			}
+			if n == len(want) {
+				return n, io.EOF
+			}
+		}
+		// Fall back to the primary if the block file misbehaves
+	}
+
+	start := first * bs
+	buf := make([]byte, (last-first+1)*bs)
+	n, err := f.readPrimaryAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n < len(buf) {
+		set.size = start + int64(n)
+	}
+
+	// Store every block the read produced; a short block is the last one
+	for i := first; i <= last; i++ {
+		lo := (i - first) * bs
+		if lo > int64(n) {
+			break
+		}
+		hi := lo + bs
+		if hi > int64(n) {
+			hi = int64(n)
+		}
+		if hi > lo {
+			if _, werr := file.WriteAt(buf[lo:hi], i*bs); werr != nil {
+				break
+			}
+		}
+		set.mark(i)
+	}
+
+	if off-start >= int64(n) {
+		return 0, io.EOF
+	}
+	m := copy(b, buf[off-start:n])
+	if m < len(b) {
+		return m, io.EOF
+	}
+	return m, nil
+}
+
+// blockFile returns the block set and block file handle for the file,
+// reopening them if the set was dropped since they were last used. The
+// caller must hold the cache lock.
+func (f *File) blockFile() (*blockSet, absfs.File, error) {
+	if f.blocks != nil && f.fs.blocks.current(f.name, f.blocks) {
+		return f.blocks, f.blockCache, nil
+	}
+	f.closeBlockFile()
+
+	if err := f.fs.handles.acquire(); err != nil {
+		return nil, nil, err
+	}
+	f.fs.mkdirCache(f.fs.cache, path.Dir(f.name))
+	set, file, err := f.fs.blocks.open(f.fs.cache, f.name)
+	if err != nil {
+		f.fs.handles.release()
+		return nil, nil, err
+	}
+	f.blocks, f.blockCache = set, file
+	return set, file, nil
+}
+
+// closeBlockFile closes the file's block file handle, if it has one. The
+// caller must hold the cache lock.
+func (f *File) closeBlockFile() {
+	if f.blockCache == nil {
+		return
+	}
+	f.blockCache.Close()
+	f.fs.handles.release()
+	f.blocks, f.blockCache = nil, nil
+}
@@ -0,0 +1,188 @@
+package corfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// readAtCountFiler counts ReadAt calls made on its files.
+type readAtCountFiler struct {
+	absfs.Filer
+
+	mu      sync.Mutex
+	readAts int
+}
+
+func (c *readAtCountFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := c.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readAtCountFile{File: f, filer: c}, nil
+}
+
+func (c *readAtCountFiler) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readAts
+}
+
+type readAtCountFile struct {
+	absfs.File
+	filer *readAtCountFiler
+}
+
+func (f *readAtCountFile) ReadAt(b []byte, off int64) (int, error) {
+	f.filer.mu.Lock()
+	f.filer.readAts++
+	f.filer.mu.Unlock()
+	return f.File.ReadAt(b, off)
+}
+
+func TestBlockCacheReadAt(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	content := testContent(10*1024 + 100)
+	writeMemFile(t, mem, "/data.bin", string(content))
+	primary := &readAtCountFiler{Filer: mem}
+	fs := New(primary, cache, WithBlockSize(1024))
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1500)
+	if _, err := f.ReadAt(buf, 2000); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(buf, content[2000:3500]) {
+		t.Fatal("ReadAt() returned the wrong bytes")
+	}
+	if n := primary.count(); n != 1 {
+		t.Fatalf("primary ReadAt called %d times, expected 1", n)
+	}
+
+	// Blocks 1-3 are now cached, so a range inside them is a hit
+	buf = make([]byte, 2000)
+	if _, err := f.ReadAt(buf, 1024); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(buf, content[1024:3024]) {
+		t.Fatal("cached ReadAt() returned the wrong bytes")
+	}
+	if n := primary.count(); n != 1 {
+		t.Errorf("primary ReadAt called %d times, expected a cache hit", n)
+	}
+
+	// A range touching an uncached block goes to the primary
+	if _, err := f.ReadAt(buf, 3000); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(buf, content[3000:5000]) {
+		t.Fatal("ReadAt() returned the wrong bytes")
+	}
+	if n := primary.count(); n != 2 {
+		t.Errorf("primary ReadAt called %d times, expected 2", n)
+	}
+}
+
+func TestBlockCacheEOF(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	content := testContent(2500)
+	writeMemFile(t, mem, "/data.bin", string(content))
+	primary := &readAtCountFiler{Filer: mem}
+	fs := New(primary, cache, WithBlockSize(1024))
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, 1000)
+		n, err := f.ReadAt(buf, 2000)
+		if err != io.EOF || n != 500 {
+			t.Fatalf("ReadAt() past the end = %d, %v; expected 500, EOF", n, err)
+		}
+		if !bytes.Equal(buf[:n], content[2000:]) {
+			t.Fatal("ReadAt() returned the wrong bytes")
+		}
+	}
+	if n := primary.count(); n != 1 {
+		t.Errorf("primary ReadAt called %d times, expected the final block to be cached", n)
+	}
+}
+
+func TestBlockCacheSequentialRead(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	content := testContent(8*1024 + 17)
+	writeMemFile(t, primary, "/data.bin", string(content))
+	fs := New(primary, cache, WithBlockSize(1024))
+
+	for i := 0; i < 2; i++ {
+		f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(100, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(-50, io.SeekCurrent); err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		if !bytes.Equal(data, content[50:]) {
+			t.Fatalf("pass %d read %d bytes with mismatched content", i, len(data))
+		}
+	}
+
+	// Block mode never writes a whole-file entry
+	if _, err := cache.Stat("/data.bin"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+}
+
+func TestBlockCacheInvalidatedByWrite(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/data.bin", "aaaaaaaaaa")
+	fs := New(primary, cache, WithBlockSize(4))
+
+	read := func() string {
+		f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if got := read(); got != "aaaaaaaaaa" {
+		t.Fatalf("read %q", got)
+	}
+
+	w, err := fs.OpenFile("/data.bin", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("bbbbbb"))
+	w.Close()
+
+	if got := read(); got != "bbbbbb" {
+		t.Errorf("read %q after rewrite, expected %q", got, "bbbbbb")
+	}
+}
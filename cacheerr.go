@@ -0,0 +1,59 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+)
+
+// CacheError records an operation on the cache that failed while the
+// FileSystem carried on without it (see WithCacheErrorHandler and
+// WithStrictCache).
+type CacheError struct {
+	Op   string // Operation, such as "mkdir" or "fill"
+	Path string
+	Err  error
+}
+
+func (e *CacheError) Error() string {
+	return "corfs: cache " + e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// reportCacheError passes a failed best-effort cache operation to the
+// handler, if there is one, and returns it as a *CacheError. Errors for
+// paths missing from the cache are expected, since not every path is
+// cached, and are not reported; nor are fills skipped or refused at the
+// cache handle limit, which Stats counts instead.
+func (fs *FileSystem) reportCacheError(op, name string, err error) *CacheError {
+	if err == nil || errors.Is(err, os.ErrNotExist) || err == errHandleLimit || err == ErrCacheFull {
+		return nil
+	}
+	fs.stats.cacheErrors.Add(1)
+	ce := &CacheError{Op: op, Path: name, Err: err}
+	fs.decide(DecisionWriteError, name, ce)
+	if fs.onCacheError != nil {
+		fs.onCacheError(ce)
+	}
+	return ce
+}
+
+// cacheResult combines the primary's result err of an operation with the
+// error cacheErr of applying it to the cache on a best-effort basis. The
+// cache error is reported, and only returned with WithStrictCache, joined
+// with err if both failed. Offline, the cache's result is the operation's.
+func (fs *FileSystem) cacheResult(err error, op, name string, cacheErr error) error {
+	if fs.offline {
+		return cacheErr
+	}
+	ce := fs.reportCacheError(op, name, cacheErr)
+	if ce == nil || !fs.strictCache {
+		return err
+	}
+	if err == nil {
+		return ce
+	}
+	return errors.Join(err, ce)
+}
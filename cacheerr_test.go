@@ -0,0 +1,113 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cacheErrors collects the errors passed to a cache error handler.
+type cacheErrors struct {
+	mu   sync.Mutex
+	errs []*CacheError
+}
+
+func (c *cacheErrors) handle(err *CacheError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *cacheErrors) ops() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ops []string
+	for _, err := range c.errs {
+		ops = append(ops, err.Op)
+	}
+	return ops
+}
+
+var errCacheBroken = errors.New("cache broken")
+
+func TestCacheErrorsBestEffortByDefault(t *testing.T) {
+	primary, _ := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	fs := New(primary, &mockFilerWithError{err: errCacheBroken})
+
+	if err := fs.Chmod("/file.txt", 0600); err != nil {
+		t.Errorf("Chmod() error = %v, expected nil", err)
+	}
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Errorf("Mkdir() error = %v, expected nil", err)
+	}
+}
+
+func TestCacheErrorHandler(t *testing.T) {
+	primary, _ := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	var got cacheErrors
+	fs := New(primary, &mockFilerWithError{err: errCacheBroken}, WithCacheErrorHandler(got.handle))
+
+	if err := fs.Chmod("/file.txt", 0600); err != nil {
+		t.Errorf("Chmod() error = %v, expected nil", err)
+	}
+	if err := fs.Chtimes("/file.txt", time.Now(), time.Now()); err != nil {
+		t.Errorf("Chtimes() error = %v, expected nil", err)
+	}
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Errorf("ReadFile() error = %v, expected nil", err)
+	}
+
+	ops := got.ops()
+	if len(ops) != 3 || ops[0] != "chmod" || ops[1] != "chtimes" || ops[2] != "fill" {
+		t.Fatalf("reported ops = %v, expected [chmod chtimes fill]", ops)
+	}
+	for _, err := range got.errs {
+		if err.Path != "/file.txt" || !errors.Is(err, errCacheBroken) {
+			t.Errorf("reported %v, expected %v for /file.txt", err, errCacheBroken)
+		}
+	}
+}
+
+func TestCacheErrorHandlerIgnoresUncachedPaths(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	var got cacheErrors
+	fs := New(primary, cache, WithCacheErrorHandler(got.handle), WithStrictCache())
+
+	if err := fs.Chmod("/file.txt", 0600); err != nil {
+		t.Errorf("Chmod() error = %v, expected nil", err)
+	}
+	if err := fs.Truncate("/file.txt", 3); err != nil {
+		t.Errorf("Truncate() error = %v, expected nil", err)
+	}
+	if ops := got.ops(); len(ops) != 0 {
+		t.Errorf("reported ops = %v, expected none", ops)
+	}
+}
+
+func TestStrictCache(t *testing.T) {
+	primary, _ := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	fs := New(primary, &mockFilerWithError{err: errCacheBroken}, WithStrictCache())
+
+	err := fs.Chown("/file.txt", 1, 1)
+	var ce *CacheError
+	if !errors.As(err, &ce) || ce.Op != "chown" || !errors.Is(err, errCacheBroken) {
+		t.Errorf("Chown() error = %v, expected a chown *CacheError", err)
+	}
+
+	// The primary's error comes first when both fail
+	err = fs.Chmod("/missing.txt", 0600)
+	if !errors.Is(err, os.ErrNotExist) || !errors.Is(err, errCacheBroken) {
+		t.Errorf("Chmod() error = %v, expected both errors", err)
+	}
+
+	// Failed fills don't fail reads
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Errorf("ReadFile() error = %v, expected nil", err)
+	}
+}
@@ -0,0 +1,525 @@
+package corfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// Cache fills are written to a temporary file next to the final entry and
+// renamed into place once the copy is complete, so a partially written
+// entry is never visible under the real name.
+const (
+	tempPrefix = ".corfs-"
+	tempSuffix = ".tmp"
+)
+
+// errFillAborted is the result of a fill discarded before completion.
+var errFillAborted = errors.New("corfs: cache fill aborted")
+
+// errFillStale is the result of a fill discarded because a writer changed
+// the file while it was being copied, so its content can't be trusted.
+var errFillStale = errors.New("corfs: cache fill overlapped a write")
+
+// ErrNotCacheable is returned by CopyFile for files that are never cached,
+// because of their size or TTL, or because the cache is disabled.
+var ErrNotCacheable = errors.New("corfs: file not cacheable")
+
+// tempSeq makes temporary names unique within the process.
+var tempSeq atomic.Uint64
+
+// liveTemps holds the temporary names of fills in progress in the process,
+// which pruning must leave alone.
+var liveTemps sync.Map
+
+// tempName returns a unique temporary name in the same directory as name.
+func tempName(name string) string {
+	seq := strconv.FormatUint(tempSeq.Add(1), 10)
+	return path.Join(path.Dir(name), tempPrefix+path.Base(name)+"."+seq+tempSuffix)
+}
+
+// isTempName reports whether base is the name of a temporary cache file.
+func isTempName(base string) bool {
+	return strings.HasPrefix(base, tempPrefix) && strings.HasSuffix(base, tempSuffix)
+}
+
+// fillBufferSize is the size of the buffer a fill gathers small writes in
+// before writing them to the cache filer.
+const fillBufferSize = 64 * 1024
+
+// fillBuffers holds the write buffers of fills, shared across fills so that
+// short-lived ones don't each allocate their own.
+var fillBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, fillBufferSize)
+		return &b
+	},
+}
+
+// cacheFill streams content into a temporary cache file and commits it
+// under its final name.
+type cacheFill struct {
+	cache absfs.Filer
+	name  string     // Final cache path
+	tmp   string     // Temporary cache path
+	file  absfs.File // Handle to the temporary file
+	buf   *[]byte    // Content not yet written to file (from fillBuffers)
+	size  int64      // Bytes of content so far, buffered or written
+	hash  hash.Hash  // Running checksum of the content (may be nil)
+	err   error      // First write error; a failed fill is never committed
+
+	generation uint64      // Data generation the content was read in
+	modTime    time.Time   // The primary's modification time of the content, if known
+	mode       os.FileMode // The primary's mode of the file, if known
+	handles    *handleGate // Counts file while it is open
+	latency    *latency    // Times writes to file
+	progress   *flight     // Fill reporting the bytes written (may be nil)
+
+	sparse bool  // Leave blocks of zeros as holes (see WithSparseFiles)
+	offset int64 // Bytes of content passed to writeFile, holes included
+	hole   int64 // Bytes of zeros skipped since the last write
+
+	atime, mtime time.Time // Times to give the copy, unless mtime is zero (see WithPreserveTimes)
+	chown        bool      // Give the copy the owner uid and gid (see WithPreserveOwner)
+	uid, gid     int
+
+	report func(op string, err error) // Reports failures to give the copy its times or owner
+
+	index  *index // Index the fill is registered with (see index.beginFill)
+	epoch  uint64 // Write epoch the fill began in
+	writer bool   // The fill sets up the copy of a write handle open on name
+}
+
+// newFill starts a fill for name in the cache filer with content read from
+// the primary in generation. A fill on behalf of a read is limited: it
+// fails with errHandleLimit or ErrCacheFull if the cache handle limit has
+// been reached.
+// With WithChecksums the fill computes a SHA-256 of the content as it is
+// written; fills of a content-addressed cache always do. The fill records
+// the modification time of the primary's file, described by info if not
+// nil, and with WithPreservePermissions, WithPreserveTimes and
+// WithPreserveOwner gives the copy its permissions, times and owner.
+func (fs *FileSystem) newFill(cache absfs.Filer, name string, generation uint64, limited bool, info os.FileInfo) (*cacheFill, error) {
+	checksum := fs.checksums
+	if _, _, ok := blobsOf(cache); ok {
+		checksum = true
+	}
+	if !limited {
+		fs.handles.take()
+	} else if err := fs.handles.acquire(); err != nil {
+		return nil, err
+	}
+	fs.mkdirCache(cache, path.Dir(name))
+	if info != nil && !info.IsDir() {
+		fs.dropConflict(cache, name, false)
+	}
+
+	tmp := tempName(fs.key(name))
+	mode := fs.fillMode(name, info)
+	file, err := openFile(cache, tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		fs.handles.release()
+		return nil, err
+	}
+	if fs.preservePerm {
+		// Not narrowed by the umask, unlike the mode passed to OpenFile
+		fs.reportCacheError("chmod", name, cache.Chmod(tmp, mode))
+	}
+	liveTemps.Store(tmp, struct{}{})
+	fill := &cacheFill{
+		cache:      cache,
+		name:       name,
+		tmp:        tmp,
+		file:       file,
+		generation: generation,
+		handles:    &fs.handles,
+		latency:    &fs.stats.cacheWrites,
+		sparse:     fs.sparse,
+	}
+	if info == nil {
+		info, _ = fs.statCache.get(name)
+	}
+	if info != nil {
+		fill.modTime, fill.mode = info.ModTime(), info.Mode()
+		if fs.preserveTime {
+			fill.atime, fill.mtime = accessTime(info), info.ModTime()
+		}
+		if fs.preserveOwn {
+			fill.uid, fill.gid, fill.chown = fileOwner(info)
+		}
+	}
+	fill.report = func(op string, err error) {
+		fs.reportCacheError(op, name, err)
+	}
+	if checksum {
+		fill.hash = sha256.New()
+	}
+	fill.index, fill.epoch = fs.index, fs.index.beginFill(name)
+	return fill, nil
+}
+
+// fillMode returns the permissions of a fill's copy of name: those of the
+// primary's file with WithPreservePermissions, going by info if not nil,
+// and otherwise 0644.
+func (fs *FileSystem) fillMode(name string, info os.FileInfo) os.FileMode {
+	if !fs.preservePerm {
+		return 0644
+	}
+	if info == nil {
+		if info = fs.primaryInfo(name); info == nil {
+			return 0644
+		}
+	}
+	return info.Mode().Perm()
+}
+
+// write appends b to the content. Writes smaller than the buffer are
+// gathered in it and written to the temporary file together.
+func (c *cacheFill) write(b []byte) {
+	if c.err != nil {
+		return
+	}
+	if c.hash != nil {
+		c.hash.Write(b)
+	}
+	c.size += int64(len(b))
+	if c.progress != nil {
+		c.progress.cached.Store(c.size)
+	}
+	if c.buf == nil {
+		c.buf = fillBuffers.Get().(*[]byte)
+	}
+	if len(*c.buf)+len(b) > cap(*c.buf) {
+		c.flush()
+	}
+	if len(b) >= cap(*c.buf) {
+		c.writeFile(b)
+		return
+	}
+	*c.buf = append(*c.buf, b...)
+}
+
+// flush writes the buffered content to the temporary file.
+func (c *cacheFill) flush() {
+	if c.buf == nil || len(*c.buf) == 0 {
+		return
+	}
+	c.writeFile(*c.buf)
+	*c.buf = (*c.buf)[:0]
+}
+
+// writeFile writes b to the temporary file, recording any failure.
+func (c *cacheFill) writeFile(b []byte) {
+	if c.sparse {
+		c.writeSparse(b)
+		return
+	}
+	c.writeData(b)
+}
+
+// writeData writes b to the temporary file at its offset.
+func (c *cacheFill) writeData(b []byte) {
+	if c.err != nil {
+		return
+	}
+	start := time.Now()
+	n, err := c.file.Write(b)
+	c.latency.since(start)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	c.err = err
+}
+
+// sync writes the buffered content to the temporary file and syncs it.
+// A failure is recorded like a failed write.
+func (c *cacheFill) sync() {
+	c.flush()
+	if c.err == nil {
+		c.err = c.file.Sync()
+	}
+}
+
+// release returns the fill's buffer to fillBuffers.
+func (c *cacheFill) release() {
+	if c.buf != nil {
+		*c.buf = (*c.buf)[:0]
+		fillBuffers.Put(c.buf)
+		c.buf = nil
+	}
+}
+
+// Write adds b to the temporary file, so that a fill can be the destination
+// of io.Copy.
+func (c *cacheFill) Write(b []byte) (int, error) {
+	c.write(b)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(b), nil
+}
+
+// readerFunc adapts a read function to io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (r readerFunc) Read(b []byte) (int, error) {
+	return r(b)
+}
+
+// sum returns the hex checksum of the content, or "" without checksums.
+func (c *cacheFill) sum() string {
+	if c.hash == nil {
+		return ""
+	}
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// commit flushes and closes the temporary file and renames it into place,
+// or stores it as a blob in a content-addressed cache.
+func (c *cacheFill) commit() error {
+	c.flush()
+	c.endHole()
+	c.release()
+	if err := c.file.Sync(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if err := c.file.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	c.handles.release()
+	defer liveTemps.Delete(c.tmp)
+	if c.err != nil {
+		c.index.endFill(c.name)
+		c.cache.Remove(c.tmp)
+		return c.err
+	}
+	c.preserve()
+	err := c.index.commitFill(c.name, c.epoch, c.writer, c.rename)
+	if err != nil {
+		c.cache.Remove(c.tmp)
+	}
+	return err
+}
+
+// rename puts the temporary file in place of the copy.
+func (c *cacheFill) rename() error {
+	if b, key, ok := blobsOf(c.cache); ok {
+		return b.commit(key(c.tmp), key(c.name), c.sum())
+	}
+	err := c.cache.Rename(c.tmp, c.name)
+	if errors.Is(err, os.ErrExist) {
+		// The filer won't rename over the copy being replaced
+		c.cache.Remove(c.name)
+		err = c.cache.Rename(c.tmp, c.name)
+	}
+	return err
+}
+
+// complete records the committed copy as a complete entry, unless a writer
+// changed the path since the fill began or, for a fill not made for one,
+// has it open. It reports whether it did.
+func (c *cacheFill) complete() bool {
+	return c.index.completeFill(c.name, c.epoch, c.writer, c.size, c.sum(), c.generation, c.modTime, c.mode)
+}
+
+// preserve gives the temporary file the times and owner of the primary's
+// file, if the fill was told to. It is done once the file is closed, so
+// that no write changes the times again, and before it is renamed into
+// place, so that the copy never appears without them.
+func (c *cacheFill) preserve() {
+	if !c.mtime.IsZero() {
+		c.report("chtimes", c.cache.Chtimes(c.tmp, c.atime, c.mtime))
+	}
+	if c.chown {
+		c.report("chown", c.cache.Chown(c.tmp, c.uid, c.gid))
+	}
+}
+
+// abort discards the temporary file.
+func (c *cacheFill) abort() {
+	c.index.endFill(c.name)
+	c.release()
+	c.file.Close()
+	c.handles.release()
+	c.cache.Remove(c.tmp)
+	liveTemps.Delete(c.tmp)
+}
+
+// sizeLimited reports whether cached files are limited by size (see
+// WithMinCacheSize and WithMaxCacheSize).
+func (fs *FileSystem) sizeLimited() bool {
+	return fs.minCacheSize > 0 || fs.maxCacheSize > 0
+}
+
+// cacheable reports whether a file of size bytes is within the size limits.
+func (fs *FileSystem) cacheable(size int64) bool {
+	return size >= fs.minCacheSize && (fs.maxCacheSize <= 0 || size <= fs.maxCacheSize)
+}
+
+// finishFill commits or discards fill, records the outcome in the index, and
+// ends call with it. The caller must hold the cache.
+func (fs *FileSystem) finishFill(fill *cacheFill, call *flight, commit bool) error {
+	err := errFillAborted
+	if commit {
+		err = fill.commit()
+	} else {
+		fill.abort()
+	}
+	if err == nil && !fill.complete() {
+		err = errFillStale
+	}
+	if err == nil {
+		fs.evict(fill.cache, fill.name)
+	} else {
+		fs.index.abandon(fill.name)
+		if commit && err != errFillStale {
+			fs.reportCacheError("fill", fill.name, err)
+		}
+	}
+	fs.flight.end(path.Clean(fill.name), call, err)
+	return err
+}
+
+// writeCacheFile atomically stores data, read from the primary in
+// generation, as name in cache, records the complete entry, described by
+// info from the primary if not nil, and ends call
+// with the outcome. With background cache writes the data is queued and
+// call ends once it has been written. It returns the error of a fill that
+// couldn't be started. The caller must hold the cache.
+func (fs *FileSystem) writeCacheFile(cache absfs.Filer, name string, data []byte, generation uint64, call *flight, info os.FileInfo) error {
+	fill, err := fs.newFill(cache, name, generation, true, info)
+	if err != nil {
+		fs.reportCacheError("fill", name, err)
+		fs.flight.end(path.Clean(name), call, err)
+		return err
+	}
+	fill.progress = call
+	call.total.Store(int64(len(data)))
+	if fs.writes != nil {
+		a := &asyncFill{fs: fs, fill: fill, call: call, gen: fs.cacheGen}
+		fs.writes.write(a, data)
+		fs.writes.end(a, true)
+		return nil
+	}
+	fill.write(data)
+	fs.finishFill(fill, call, true)
+	return nil
+}
+
+// copyToCache atomically copies the primary's content of name into cache
+// through a bounded buffer, so the file is never held in memory, and
+// records the complete entry. It returns the number of bytes copied.
+// Primary reads are throttled under ctx. The
+// copy's progress is reported through call, if not nil. A limited copy is
+// subject to the cache handle limit, like the fill of a read, and is
+// abandoned with ErrNotCacheable once the content turns out to be outside
+// the size limits, such as when the file grows while it is copied. A copy
+// made while write handles are open on name is discarded, unless writer
+// tells that it sets up the copy of the one being opened. The caller must
+// hold the cache.
+func (fs *FileSystem) copyToCache(ctx context.Context, cache absfs.Filer, name string, call *flight, limited, writer bool) (int64, error) {
+	generation := fs.index.currentGeneration()
+	if err := fs.waitRequest(ctx); err != nil {
+		return 0, err
+	}
+	primary, err := fs.openPrimaryFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer primary.Close()
+	src := &File{primary: primary, name: name, fs: fs, ctx: ctx} // For throttled reads
+
+	var info os.FileInfo
+	if call != nil || fs.preservePerm || fs.preserveTime || fs.preserveOwn {
+		if stat, err := primary.Stat(); err == nil {
+			info = stat
+		}
+	}
+	fill, err := fs.newFill(cache, name, generation, limited, info)
+	if err != nil {
+		return 0, err
+	}
+	fill.writer = writer
+	if call != nil {
+		fill.progress = call
+		if info != nil {
+			call.total.Store(info.Size())
+		}
+	}
+	var r io.Reader = readerFunc(src.readPrimary)
+	if limited && fs.maxCacheSize > 0 {
+		r = io.LimitReader(r, fs.maxCacheSize+1) // Enough to tell it's too large
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	if _, err := io.CopyBuffer(fill, r, *buf); err != nil {
+		fill.abort()
+		return 0, err
+	}
+	if limited && !fs.cacheable(fill.size) {
+		fill.abort()
+		fs.decide(DecisionSkipSize, name, nil)
+		return 0, &os.PathError{Op: "copy", Path: name, Err: ErrNotCacheable}
+	}
+	if err := fill.commit(); err != nil {
+		return 0, err
+	}
+	if !fill.complete() {
+		return 0, &os.PathError{Op: "copy", Path: name, Err: errFillStale}
+	}
+	fs.evict(cache, name)
+	return fill.size, nil
+}
+
+// PruneTemp removes temporary files left in the cache filer by fills that
+// were interrupted, for example by a crash. Fills still in progress are
+// left alone. It returns the number of files removed.
+func (fs *FileSystem) PruneTemp() (int, error) {
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	return pruneTemp(cache, "/")
+}
+
+// pruneTemp recursively removes temporary cache files under dir.
+func pruneTemp(filer absfs.Filer, dir string) (int, error) {
+	entries, err := filer.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+		full := path.Join(dir, name)
+		if entry.IsDir() {
+			n, err := pruneTemp(filer, full)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+			continue
+		}
+		if _, live := liveTemps.Load(full); isTempName(name) && !live {
+			if err := filer.Remove(full); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,557 @@
+package corfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// unknownSizeFiler opens files whose size can't be determined up front, as
+// with a streamed response.
+type unknownSizeFiler struct {
+	absfs.Filer
+}
+
+type unknownSizeFile struct {
+	absfs.File
+}
+
+func (u unknownSizeFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := u.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return unknownSizeFile{f}, nil
+}
+
+func (unknownSizeFile) Stat() (os.FileInfo, error) {
+	return nil, errors.New("size unknown")
+}
+
+func TestFileReadCommitsOnEOF(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 5)
+	if _, err := f.Read(buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	// A partially read file must not be visible in the cache
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() during fill error = %v, expected not exist", err)
+	}
+
+	buf = make([]byte, 64)
+	for {
+		if _, err := f.Read(buf); err != nil {
+			break
+		}
+	}
+
+	data, err := cache.ReadFile("/file.txt")
+	if err != nil {
+		t.Fatalf("cache ReadFile() error = %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("cache contains %q, expected %q", data, "hello world")
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestFileCloseBeforeEOFDiscardsFill(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := f.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	f.Close()
+
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() after abandoned fill error = %v, expected not exist", err)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestReadFileLeavesNoTempFiles(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache)
+
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if data, err := cache.ReadFile("/file.txt"); err != nil || string(data) != "hello world" {
+		t.Errorf("cache ReadFile() = %q, %v", data, err)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestCacheSizeLimits(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	files := map[string]bool{"/tiny.txt": false, "/fits.txt": true, "/huge.txt": false}
+	writeMemFile(t, primary, "/tiny.txt", "ab")
+	writeMemFile(t, primary, "/fits.txt", "abcdef")
+	writeMemFile(t, primary, "/huge.txt", "abcdefghijkl")
+	fs := New(primary, cache, WithMinCacheSize(4), WithMaxCacheSize(8))
+
+	for name, cached := range files {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+		if _, err := cache.Stat(name); (err == nil) != cached {
+			t.Errorf("ReadFile(%s): cache Stat() error = %v, expected cached = %v", name, err, cached)
+		}
+		cache.Remove(name)
+
+		f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile(%s) error = %v", name, err)
+		}
+		io.ReadAll(f)
+		f.Close()
+		if _, err := cache.Stat(name); (err == nil) != cached {
+			t.Errorf("Read(%s): cache Stat() error = %v, expected cached = %v", name, err, cached)
+		}
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestCacheSizeLimitsUnknownSize(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/tiny.txt", "ab")
+	writeMemFile(t, primary, "/huge.txt", "abcdefghijkl")
+	fs := New(unknownSizeFiler{primary}, cache, WithMinCacheSize(4), WithMaxCacheSize(8))
+
+	f, err := fs.OpenFile("/huge.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	for i := 0; i < 2; i++ {
+		if _, err := f.Read(buf); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+	}
+	// The fill is discarded as soon as the file outgrows the limit
+	assertNoTempFiles(t, fs)
+	if data, err := io.ReadAll(f); err != nil || string(data) != "kl" {
+		t.Errorf("ReadAll() = %q, %v, expected %q", data, err, "kl")
+	}
+	if _, err := cache.Stat("/huge.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+
+	g, err := fs.OpenFile("/tiny.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	io.ReadAll(g)
+	g.Close()
+	if _, err := cache.Stat("/tiny.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestCacheSizeLimitsWriteThrough(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMaxCacheSize(8))
+
+	writeMemFile(t, fs, "/fits.txt", "abcdef")
+	writeMemFile(t, fs, "/huge.txt", "abcdefghijkl")
+	if got := readString(cache, "/fits.txt"); got != "abcdef" {
+		t.Errorf("cache /fits.txt = %q, expected %q", got, "abcdef")
+	}
+	if _, err := cache.Stat("/huge.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/huge.txt) error = %v, expected not exist", err)
+	}
+}
+
+func TestCacheSizeLimitsStreamThrough(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/huge.txt", "abcdefghijkl")
+	primary := &stallFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithMaxCacheSize(8))
+	primary.stalled.Store(true)
+
+	// Readers of a file too large to cache don't wait on each other
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := fs.ReadFile("/huge.txt")
+			done <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := fs.flight.lookup("/huge.txt"); ok {
+		t.Error("ReadFile() started a fill of a file too large to cache")
+	}
+	close(primary.gate)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("ReadFile() error = %v", err)
+		}
+	}
+	if _, err := cache.Stat("/huge.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+}
+
+func TestCopyToCacheOutgrowsLimit(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/huge.txt", string(testContent(1000)))
+	fs := New(primary, cache, WithMaxCacheSize(100))
+
+	// Copies for reads are abandoned once past the limit, even when the
+	// primary reported a size within it
+	if _, err := fs.copyToCache(context.Background(), cache, "/huge.txt", nil, true, false); !errors.Is(err, ErrNotCacheable) {
+		t.Errorf("copyToCache() error = %v, expected ErrNotCacheable", err)
+	}
+	if _, err := cache.Stat("/huge.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+	assertNoTempFiles(t, fs)
+
+	// Write-back copies are never abandoned
+	if n, err := fs.copyToCache(context.Background(), cache, "/huge.txt", nil, false, true); err != nil || n != 1000 {
+		t.Errorf("copyToCache() = %d, %v; expected 1000, nil", n, err)
+	}
+}
+
+func TestPruneTemp(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	if err := cache.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, cache, "/.corfs-a.txt.1.tmp", "partial")
+	writeMemFile(t, cache, "/dir/.corfs-b.txt.2.tmp", "partial")
+	writeMemFile(t, cache, "/dir/b.txt", "complete")
+	fs := New(primary, cache)
+
+	removed, err := fs.PruneTemp()
+	if err != nil {
+		t.Fatalf("PruneTemp() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("PruneTemp() removed %d files, expected 2", removed)
+	}
+	if _, err := cache.Stat("/dir/b.txt"); err != nil {
+		t.Errorf("PruneTemp() removed a complete entry: %v", err)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+// assertNoTempFiles fails the test if the cache holds temporary files.
+func assertNoTempFiles(t *testing.T, fs *FileSystem) {
+	t.Helper()
+	if n, err := pruneTemp(fs.cache, "/"); err != nil || n != 0 {
+		t.Errorf("found %d temporary cache files (err = %v)", n, err)
+	}
+}
+
+// wholeReadFailFiler fails ReadFile, so only reads through handles work.
+type wholeReadFailFiler struct {
+	absfs.Filer
+}
+
+func (w wholeReadFailFiler) ReadFile(name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "read", Path: name, Err: errReadFailed}
+}
+
+func TestReadFileStreamsLargeFiles(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	content := testContent(streamSize + 100)
+	writeMemFile(t, mem, "/large.bin", string(content))
+	fs := New(wholeReadFailFiler{mem}, cache)
+
+	// The file is streamed through a handle rather than read whole
+	data, err := fs.ReadFile("/large.bin")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("ReadFile() content doesn't match the primary")
+	}
+	if st := fs.CacheStatus("/large.bin"); !st.Complete || st.Size != int64(len(content)) {
+		t.Errorf("CacheStatus() = %+v, expected a complete entry", st)
+	}
+}
+
+// writeCountFiler counts the writes made to its files.
+type writeCountFiler struct {
+	absfs.Filer
+	writes atomic.Int64
+}
+
+func (w *writeCountFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := w.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &writeCountFile{File: f, filer: w}, nil
+}
+
+type writeCountFile struct {
+	absfs.File
+	filer *writeCountFiler
+}
+
+func (f *writeCountFile) Write(b []byte) (int, error) {
+	f.filer.writes.Add(1)
+	return f.File.Write(b)
+}
+
+func TestFillGathersSmallWrites(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	content := testContent(3*fillBufferSize + 100)
+	writeMemFile(t, primary, "/data.bin", string(content))
+	cache := &writeCountFiler{Filer: mem}
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1000)
+	for {
+		if _, err := f.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	if n := cache.writes.Load(); n != 4 {
+		t.Errorf("cache writes = %d, expected 4", n)
+	}
+	cached, err := mem.ReadFile("/data.bin")
+	if err != nil || !bytes.Equal(cached, content) {
+		t.Errorf("cached content differs from the primary (error %v)", err)
+	}
+	if st := fs.CacheStatus("/data.bin"); !st.Complete || st.Size != int64(len(content)) {
+		t.Errorf("CacheStatus() = %+v, expected a complete entry", st)
+	}
+}
+
+func TestPreservePermissions(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/small.txt", "content")
+	writeMemFile(t, primary, "/opened.txt", "content")
+	writeMemFile(t, primary, "/large.bin", string(testContent(streamSize)))
+	writeMemFile(t, primary, "/default.txt", "content")
+	for _, name := range []string{"/small.txt", "/opened.txt", "/large.bin", "/default.txt"} {
+		if err := primary.Chmod(name, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := New(primary, cache, WithPreservePermissions())
+	for _, name := range []string{"/small.txt", "/large.bin"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := fs.OpenFile("/opened.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, name := range []string{"/small.txt", "/opened.txt", "/large.bin"} {
+		if info, err := cache.Stat(name); err != nil {
+			t.Errorf("cache Stat(%s) error = %v", name, err)
+		} else if info.Mode().Perm() != 0600 {
+			t.Errorf("cached %s mode = %v, expected %v", name, info.Mode().Perm(), os.FileMode(0600))
+		}
+	}
+
+	// Without the option, cached copies are 0644 whatever the primary's mode
+	if _, err := New(primary, cache).ReadFile("/default.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := cache.Stat("/default.txt"); err != nil {
+		t.Errorf("cache Stat(/default.txt) error = %v", err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Errorf("cached /default.txt mode = %v, expected %v", info.Mode().Perm(), os.FileMode(0644))
+	}
+}
+
+// chownErrFiler is a cache filer without the privileges to change owners.
+type chownErrFiler struct {
+	absfs.Filer
+}
+
+func (chownErrFiler) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: os.ErrPermission}
+}
+
+func TestPreserveTimesAndOwner(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"/small.txt", "/large.bin", "/default.txt"} {
+		content := "content"
+		if name == "/large.bin" {
+			content = string(testContent(streamSize))
+		}
+		writeMemFile(t, primary, name, content)
+		if err := primary.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := primary.Chown(name, 1000, 2000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := New(primary, cache, WithPreserveTimes(), WithPreserveOwner())
+	for _, name := range []string{"/small.txt", "/large.bin"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+		info, err := cache.Stat(name)
+		if err != nil {
+			t.Fatalf("cache Stat(%s) error = %v", name, err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("cached %s modified %v, expected %v", name, info.ModTime(), mtime)
+		}
+		if uid, gid, ok := fileOwner(info); !ok || uid != 1000 || gid != 2000 {
+			t.Errorf("cached %s owner = %d:%d (%v), expected 1000:2000", name, uid, gid, ok)
+		}
+	}
+
+	// Without the options, cached copies get the times and owner of a new file
+	if _, err := New(primary, cache).ReadFile("/default.txt"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := cache.Stat("/default.txt")
+	if err != nil {
+		t.Fatalf("cache Stat(/default.txt) error = %v", err)
+	}
+	if info.ModTime().Equal(mtime) {
+		t.Errorf("cached /default.txt has the primary's modification time without WithPreserveTimes")
+	}
+	if uid, gid, _ := fileOwner(info); uid != 0 || gid != 0 {
+		t.Errorf("cached /default.txt owner = %d:%d without WithPreserveOwner, expected 0:0", uid, gid)
+	}
+}
+
+func TestPreserveOwnerFails(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "content")
+	if err := primary.Chown("/a.txt", 1000, 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []*CacheError
+	fs := New(primary, chownErrFiler{cache}, WithPreserveOwner(),
+		WithCacheErrorHandler(func(ce *CacheError) { errs = append(errs, ce) }))
+	if got := readString(fs, "/a.txt"); got != "content" {
+		t.Fatalf("ReadFile() = %q, expected %q", got, "content")
+	}
+	if len(errs) != 1 || errs[0].Op != "chown" || errs[0].Path != "/a.txt" {
+		t.Errorf("cache errors = %v, expected one chown error for /a.txt", errs)
+	}
+	if st := fs.CacheStatus("/a.txt"); !st.Complete {
+		t.Errorf("CacheStatus() = %+v, expected the copy cached regardless", st)
+	}
+}
+
+func TestCacheDirMode(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.Umask, cache.Umask = 0777, 0777 // Mask nothing
+	for dir, perm := range map[string]os.FileMode{"/shared": 0777, "/private": 0500, "/group": 0750} {
+		if err := primary.Mkdir(dir, perm); err != nil {
+			t.Fatal(err)
+		}
+		writeMemFile(t, primary, dir+"/file.txt", "content")
+	}
+
+	// Cache directories mirror the primary's, but never world-writable
+	fs := New(primary, cache)
+	for dir, want := range map[string]os.FileMode{"/shared": 0775, "/private": 0700, "/group": 0750} {
+		if _, err := fs.ReadFile(dir + "/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := cache.Stat(dir); err != nil {
+			t.Errorf("cache Stat(%s) error = %v", dir, err)
+		} else if info.Mode().Perm() != want {
+			t.Errorf("cache %s mode = %v, expected %v", dir, info.Mode().Perm(), want)
+		}
+	}
+
+	// The option overrides the primary's permissions
+	_, cache = newMemFilers(t)
+	cache.Umask = 0777
+	fs = New(primary, cache, WithCacheDirMode(0700))
+	if _, err := fs.ReadFile("/shared/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := cache.Stat("/shared"); err != nil {
+		t.Errorf("cache Stat(/shared) error = %v", err)
+	} else if info.Mode().Perm() != 0700 {
+		t.Errorf("cache /shared mode = %v, expected %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+}
+
+// BenchmarkFillSmallReads reads a file through a fresh cache in 4KB chunks,
+// as many programs read, reporting the writes made to the cache filer.
+func BenchmarkFillSmallReads(b *testing.B) {
+	primary, _ := newMemFilers(b)
+	content := testContent(4 << 20)
+	writeMemFile(b, primary, "/large.bin", string(content))
+	buf := make([]byte, 4096)
+
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	var writes int64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		_, mem := newMemFilers(b)
+		cache := &writeCountFiler{Filer: mem}
+		fs := New(primary, cache)
+		b.StartTimer()
+
+		f, err := fs.OpenFile("/large.bin", os.O_RDONLY, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := f.Read(buf); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+		f.Close()
+		if !fs.CacheStatus("/large.bin").Complete {
+			b.Fatal("the file wasn't cached")
+		}
+		writes += cache.writes.Load()
+	}
+	b.ReportMetric(float64(writes)/float64(b.N), "cachewrites/op")
+}
@@ -0,0 +1,36 @@
+package corfs
+
+import "github.com/absfs/absfs"
+
+// NewChain creates a FileSystem over an ordered list of tiers, fastest
+// first and the authoritative primary last, such as memory, local disk,
+// and remote storage. Each tier caches the tiers after it.
+//
+// Reads are served by the first tier holding a complete copy of the file
+// cached by this FileSystem, without consulting the slower tiers; a tier
+// without one reads from the next. Whatever is read from a slower tier is
+// cached in every faster tier on the way back, so hits are promoted
+// upward. Files are considered current once cached, so changes made to a
+// slower tier other than through the chain are not seen until the cached
+// copies are dropped.
+//
+// Writes go through to every tier: the primary is written and each cache
+// tier mirrors the write exactly as in WriteThrough mode, and directory and
+// metadata changes apply to every tier.
+//
+// The returned FileSystem's Cache is the first tier and its Primary is a
+// FileSystem chaining the remaining tiers. NewChain panics if given fewer
+// than two tiers.
+func NewChain(tiers ...absfs.Filer) *FileSystem {
+	if len(tiers) < 2 {
+		panic("corfs: NewChain requires at least two tiers")
+	}
+	var lower absfs.Filer = tiers[len(tiers)-1]
+	var fs *FileSystem
+	for i := len(tiers) - 2; i >= 0; i-- {
+		fs = New(lower, tiers[i])
+		fs.cacheFirst = true
+		lower = fs
+	}
+	return fs
+}
@@ -0,0 +1,107 @@
+package corfs
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// readCountFiler counts ReadFile calls and read-only opens.
+type readCountFiler struct {
+	absfs.Filer
+	reads atomic.Int64
+}
+
+func (r *readCountFiler) ReadFile(name string) ([]byte, error) {
+	r.reads.Add(1)
+	return r.Filer.ReadFile(name)
+}
+
+func (r *readCountFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		r.reads.Add(1)
+	}
+	return r.Filer.OpenFile(name, flag, perm)
+}
+
+func newTier(t *testing.T) *memfs.FileSystem {
+	t.Helper()
+	fs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestChainPromotesUpward(t *testing.T) {
+	ram, ssd, mem := newTier(t), newTier(t), newTier(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	remote := &readCountFiler{Filer: mem}
+	chain := NewChain(ram, ssd, remote)
+
+	for i := 0; i < 3; i++ {
+		if got := readString(chain, "/file.txt"); got != "content" {
+			t.Fatalf("ReadFile() = %q, expected %q", got, "content")
+		}
+	}
+	if n := remote.reads.Load(); n != 1 {
+		t.Errorf("remote read %d times, expected 1", n)
+	}
+	for name, tier := range map[string]absfs.Filer{"ram": ram, "ssd": ssd} {
+		if got := readString(tier, "/file.txt"); got != "content" {
+			t.Errorf("%s tier holds %q, expected %q", name, got, "content")
+		}
+	}
+
+	// With the fastest tier emptied, the next tier serves the file and it
+	// is promoted back up
+	chain.SetCache(newTier(t))
+	f, err := chain.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if data, _ := io.ReadAll(f); string(data) != "content" {
+		t.Errorf("Read() = %q, expected %q", data, "content")
+	}
+	f.Close()
+	if n := remote.reads.Load(); n != 1 {
+		t.Errorf("remote read %d times after promotion from ssd, expected 1", n)
+	}
+	if got := readString(chain.Cache(), "/file.txt"); got != "content" {
+		t.Errorf("new ram tier holds %q, expected %q", got, "content")
+	}
+}
+
+func TestChainWritesThrough(t *testing.T) {
+	ram, ssd, remote := newTier(t), newTier(t), newTier(t)
+	chain := NewChain(ram, ssd, remote)
+
+	writeMemFile(t, chain, "/file.txt", "written")
+	for name, tier := range map[string]absfs.Filer{"ram": ram, "ssd": ssd, "remote": remote} {
+		if got := readString(tier, "/file.txt"); got != "written" {
+			t.Errorf("%s tier holds %q, expected %q", name, got, "written")
+		}
+	}
+
+	if err := chain.Remove("/file.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	for name, tier := range map[string]absfs.Filer{"ram": ram, "ssd": ssd, "remote": remote} {
+		if _, err := tier.Stat("/file.txt"); !os.IsNotExist(err) {
+			t.Errorf("%s tier Stat() error = %v after Remove, expected not exist", name, err)
+		}
+	}
+}
+
+func TestNewChainRequiresTwoTiers(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewChain() with one tier did not panic")
+		}
+	}()
+	NewChain(newTier(t))
+}
@@ -0,0 +1,44 @@
+package corfs
+
+import "time"
+
+// Clock tells a FileSystem the current time (see WithClock).
+type Clock interface {
+	Now() time.Time
+}
+
+// timerClock is implemented by Clocks that can also tell when a wait is
+// over, like time.After (see WithClock).
+type timerClock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock reading the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// after returns a channel that receives the time once d has passed on the
+// clock of fs, if it can tell, and on the system clock otherwise.
+func (fs *FileSystem) after(d time.Duration) <-chan time.Time {
+	if c, ok := fs.clock.(timerClock); ok {
+		return c.After(d)
+	}
+	return time.After(d)
+}
+
+// setClock makes the parts of the FileSystem that keep time use fs.clock.
+func (fs *FileSystem) setClock() {
+	fs.index.clock = fs.clock
+	if fs.statCache != nil {
+		fs.statCache.clock = fs.clock
+	}
+	if fs.dirCache != nil {
+		fs.dirCache.clock = fs.clock
+	}
+	if fs.health != nil {
+		fs.health.clock = fs.clock
+	}
+}
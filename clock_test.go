@@ -0,0 +1,130 @@
+package corfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	changed *sync.Cond // Broadcast when a timer is added
+}
+
+// fakeTimer is a wait started by fakeClock.After.
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c
+	}
+	c.timers = append(c.timers, t)
+	c.changed.Broadcast()
+	return t.c
+}
+
+// advance moves the clock on by d, firing the timers that are then due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// waitForTimers waits until n timers are waiting for the clock to advance.
+func (c *fakeClock) waitForTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) != n {
+		c.changed.Wait()
+	}
+}
+
+func TestClockTTLBoundary(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "v1")
+	primary := &readCountFiler{Filer: mem}
+	clock := newFakeClock()
+	fs := New(primary, cache, WithTTL(time.Minute), WithClock(clock))
+	fs.cacheFirst = true
+
+	readString(fs, "/file.txt")
+	if st := fs.CacheStatus("/file.txt"); !st.LastFetched.Equal(clock.Now()) {
+		t.Errorf("LastFetched = %v, expected the clock's %v", st.LastFetched, clock.Now())
+	}
+
+	// Fresh until the TTL has passed exactly
+	clock.advance(time.Minute - time.Nanosecond)
+	readString(fs, "/file.txt")
+	if n := primary.reads.Load(); n != 1 {
+		t.Errorf("primary reads = %d just before expiry, expected 1", n)
+	}
+	clock.advance(time.Nanosecond)
+	readString(fs, "/file.txt")
+	if n := primary.reads.Load(); n != 2 {
+		t.Errorf("primary reads = %d at expiry, expected 2", n)
+	}
+}
+
+// nowClock is a Clock with nothing but Now.
+type nowClock struct {
+	clock *fakeClock
+}
+
+func (c nowClock) Now() time.Time {
+	return c.clock.Now()
+}
+
+func TestClockAfter(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	clock := newFakeClock()
+	fs := New(mem, cache, WithClock(clock))
+	c := fs.after(time.Hour)
+	select {
+	case <-c:
+		t.Fatal("after() fired before the clock advanced")
+	default:
+	}
+	clock.advance(time.Hour)
+	if got := <-c; !got.Equal(clock.Now()) {
+		t.Errorf("after() = %v, expected the clock's %v", got, clock.Now())
+	}
+
+	// Waits fall back to the system clock for a Clock without After
+	fs = New(mem, cache, WithClock(nowClock{newFakeClock()}))
+	select {
+	case <-fs.after(time.Millisecond):
+	case <-time.After(time.Second):
+		t.Error("after() didn't fire on the system clock")
+	}
+}
@@ -0,0 +1,32 @@
+package corfs
+
+import "github.com/absfs/absfs"
+
+// The cache can disagree with the primary about whether a path is a
+// directory, for instance after a file on the primary is replaced by a
+// directory of the same name behind the FileSystem's back. Wherever the
+// primary's kind of file is known, it takes precedence: the cache's
+// conflicting file or directory is removed rather than served, and rather
+// than left to make every fill beneath or over it fail.
+
+// dropConflict removes what cache holds at name if it isn't a directory
+// while dir reports that the primary has one there, or is a directory while
+// the primary has a file. A directory is removed along with everything
+// beneath it, but nothing holding writes yet to reach the primary is. It
+// reports whether cache no longer conflicts with the primary at name. The
+// caller must hold the cache.
+func (fs *FileSystem) dropConflict(cache absfs.Filer, name string, dir bool) bool {
+	info, err := cache.Stat(name)
+	if err != nil || info.IsDir() == dir {
+		return true
+	}
+	if fs.index.hasDirty(name) {
+		return false
+	}
+	fs.blocks.drop(cache, name)
+	fs.blocks.dropTree(name)
+	fs.index.removeTree(name)
+	err = removeTree(cache, name)
+	fs.reportCacheError("remove", name, err)
+	return err == nil
+}
@@ -0,0 +1,127 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// dirReadFiler fails ReadFile on directories with EISDIR, as the os does.
+type dirReadFiler struct {
+	absfs.Filer
+}
+
+func (d dirReadFiler) ReadFile(name string) ([]byte, error) {
+	if info, err := d.Filer.Stat(name); err == nil && info.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return d.Filer.ReadFile(name)
+}
+
+// writeErrors returns the write-error decisions rec has received.
+func writeErrors(rec *decisionRecorder) []string {
+	var errs []string
+	for _, d := range rec.take() {
+		if strings.HasPrefix(d, "write-error ") {
+			errs = append(errs, d)
+		}
+	}
+	return errs
+}
+
+func TestConflictFileOverDirectory(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/x", "file")
+	writeMemFile(t, mem, "/y", "file")
+	for _, dir := range []string{"/x", "/y"} {
+		if err := cache.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeMemFile(t, cache, dir+"/stale", "stale")
+	}
+	rec := &decisionRecorder{}
+	fs := New(mem, cache, WithDecisionLogger(rec))
+
+	// A fill replaces the stale directory
+	if got := readString(fs, "/x"); got != "file" {
+		t.Fatalf("ReadFile(/x) = %q, expected %q", got, "file")
+	}
+	if got := readString(cache, "/x"); got != "file" {
+		t.Errorf("cache /x = %q, expected the stale directory replaced by a copy", got)
+	}
+	if st := fs.CacheStatus("/x"); !st.Complete {
+		t.Errorf("CacheStatus(/x) = %+v, expected a complete copy", st)
+	}
+
+	// A listing the primary refuses isn't served from the stale directory
+	if _, err := fs.ReadDir("/y"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("ReadDir(/y) error = %v, expected the primary's ENOTDIR", err)
+	}
+	if _, err := cache.Stat("/y"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/y) error = %v, expected the stale directory to be removed", err)
+	}
+	if errs := writeErrors(rec); len(errs) != 0 {
+		t.Errorf("decisions %v, expected no cache errors", errs)
+	}
+}
+
+func TestConflictDirectoryOverFile(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	for _, dir := range []string{"/d", "/e"} {
+		if err := mem.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeMemFile(t, mem, dir+"/f", "inner")
+		writeMemFile(t, cache, dir, "stale")
+	}
+	rec := &decisionRecorder{}
+	fs := New(dirReadFiler{mem}, cache, WithDecisionLogger(rec))
+
+	// A fill beneath the stale file replaces it with a directory
+	if got := readString(fs, "/d/f"); got != "inner" {
+		t.Fatalf("ReadFile(/d/f) = %q, expected %q", got, "inner")
+	}
+	if got := readString(cache, "/d/f"); got != "inner" {
+		t.Errorf("cache /d/f = %q, expected the stale file replaced by a directory", got)
+	}
+
+	// A read the primary refuses isn't served from the stale file
+	if data, err := fs.ReadFile("/e"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("ReadFile(/e) = %q, %v, expected the primary's EISDIR", data, err)
+	}
+	if _, err := cache.Stat("/e"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/e) error = %v, expected the stale file to be removed", err)
+	}
+
+	// Mkdir replaces a stale file with the directory
+	writeMemFile(t, cache, "/g", "stale")
+	if err := fs.Mkdir("/g", 0755); err != nil {
+		t.Fatalf("Mkdir(/g) error = %v", err)
+	}
+	if info, err := cache.Stat("/g"); err != nil || !info.IsDir() {
+		t.Errorf("cache Stat(/g) = %v, %v, expected a directory", info, err)
+	}
+	if errs := writeErrors(rec); len(errs) != 0 {
+		t.Errorf("decisions %v, expected no cache errors", errs)
+	}
+}
+
+func TestConflictKeepsDirtyCopies(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	fs := New(mem, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/x", "unflushed")
+	if err := mem.Mkdir("/x", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/x", 0755); err == nil {
+		t.Error("Mkdir(/x) succeeded over a dirty file")
+	}
+	if got := readString(cache, "/x"); got != "unflushed" {
+		t.Errorf("cache /x = %q, expected the dirty copy to be kept", got)
+	}
+}
@@ -1,19 +1,46 @@
 package corfs
 
 import (
+	"context"
+	"errors"
+	"io"
 	"io/fs"
 	"os"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/absfs/absfs"
 )
 
 // File wraps files from both primary and cache filesystems.
 type File struct {
-	primary absfs.File // Primary file handle
+	primary absfs.File // Primary file handle (nil for write-back handles and cached copies)
 	cache   absfs.File // Cache file handle (may be nil)
 	name    string
 	fs      *FileSystem
-	cached  bool // Track if we've cached the content
+	cached  bool            // Track if we've cached the content
+	fill    *cacheFill      // In-progress cache fill for read-only handles
+	flight  *flight         // Registration of fill with the FileSystem
+	async   *asyncFill      // Background writes of fill (see WithAsyncCacheWrites)
+	queued  *asyncFill      // Last fill given background writes, ended or not
+	pos     int64           // Offset Read, Write and cache writes use; moved only by them and Seek
+	gen     uint64          // Cache generation the handle was opened against
+	ctx     context.Context // Context primary reads are throttled under
+	writer  bool            // Write handle counted by the index
+	appends bool            // Write handle opened with O_APPEND
+	rdwr    bool            // Write handle opened with O_RDWR, whose mirror may serve reads
+
+	generation uint64 // Data generation the handle was opened in (see FileSystem.Bump)
+
+	sequential int        // Consecutive primary reads since open or Seek
+	ahead      *readAhead // Background prefetch (see WithReadAhead)
+
+	entries []fs.DirEntry // Directory listing not yet returned (nil until read)
+
+	blockMode  bool       // Read-only handle caching blocks (see WithBlockSize)
+	blocks     *blockSet  // Block set in use by the handle
+	blockCache absfs.File // Handle to the block file matching blocks
 }
 
 // Name returns the name of the file.
@@ -21,105 +48,737 @@ func (f *File) Name() string {
 	return f.name
 }
 
+// source returns the handle reads are served from. Write-back handles work
+// on the cached copy alone.
+func (f *File) source() absfs.File {
+	if f.primary == nil {
+		return f.cache
+	}
+	return f.primary
+}
+
 // Read reads from the primary file and caches content to the cache file.
+// Read-only handles fill the cache through a temporary file that is renamed
+// into place once the primary reports io.EOF after a sequential read from
+// the start of the file. If a read from the primary fails, or outlasts the
+// primary timeout (see WithPrimaryTimeout), and the cache holds a complete,
+// intact copy, the handle carries on from the same offset in the cached
+// copy instead of returning the error.
 func (f *File) Read(b []byte) (int, error) {
-	n, err := f.primary.Read(b)
+	if f.primary == nil {
+		f.lockCache()
+		defer f.unlockCache()
+		defer f.lockPath(false)()
+		n, err := f.cache.Read(b)
+		f.pos += int64(n)
+		return n, err
+	}
+	if f.blockMode {
+		n, err := f.readBlocks(b, f.pos)
+		f.pos += int64(n)
+		return n, err
+	}
 
-	// On successful read, try to cache the data
-	if n > 0 && f.cache == nil && !f.cached {
-		// Open cache file for writing if not already open
-		if cacheFile, cacheErr := f.fs.cache.OpenFile(f.name, os.O_CREATE|os.O_WRONLY, 0644); cacheErr == nil {
-			f.cache = cacheFile
+	if f.rdwr {
+		n, err := f.readMirror(b, f.pos, true)
+		if err != errNoMirror {
+			f.pos += int64(n)
+			if n > 0 && err == io.EOF {
+				err = nil // Reported by the next Read, as the primary would
+			}
+			return n, err
 		}
 	}
 
-	// Write to cache if available
-	if n > 0 && f.cache != nil {
-		f.cache.Write(b[:n])
+	n, err := f.readSequential(b)
+	f.pos += int64(n)
+	if f.primary == nil {
+		// Switched to the cached copy at the primary timeout
+		return f.Read(b)
+	}
+	if err != nil && err != io.EOF && f.fs != nil && !f.writer && f.switchToCache() {
+		if n > 0 {
+			return n, nil
+		}
+		return f.Read(b)
+	}
+	if f.writer || f.fs == nil {
+		// Write handles never fill the cache; their mirrored copy already
+		// matches
+		return n, err
+	}
+
+	f.lockCache()
+	defer f.unlockCache()
+
+	// Start a fill on the first read from the beginning of the file
+	if !f.cached && f.pos == int64(n) && (n > 0 || err == io.EOF) {
+		if fillErr := f.startFill(); fillErr != nil {
+			return n, &os.PathError{Op: "read", Path: f.name, Err: fillErr}
+		}
+	}
+
+	if f.fill != nil {
+		if f.fs.maxCacheSize > 0 && f.pos > f.fs.maxCacheSize {
+			// Too large to cache; the partial entry is discarded
+			f.fs.decide(DecisionSkipSize, f.name, nil)
+			f.endFill(false)
+			return n, err
+		}
+		if n > 0 {
+			f.writeFill(b[:n])
+		}
+		if err == io.EOF {
+			ok := f.fs.cacheable(f.pos)
+			if !ok {
+				f.fs.decide(DecisionSkipSize, f.name, nil)
+			}
+			f.endFill(ok)
+		}
 	}
 
 	return n, err
 }
 
+// copyBufferSize is the buffer size WriteTo and ReadFrom stream through.
+const copyBufferSize = 128 * 1024
+
+// copyBuffers holds the buffers of copyBufferSize that files are streamed
+// through, so that each copy doesn't allocate its own.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// switchToCache carries a read-only handle whose primary failed mid-stream
+// over to the complete cached copy, if there is an intact one, at the
+// handle's offset. The handle then works on the cached copy alone, and its
+// primary is closed. It reports whether the handle was switched.
+func (f *File) switchToCache() bool {
+	f.lockCache()
+	defer f.unlockCache()
+	if e, ok := f.fs.index.get(f.name); !ok || !e.complete {
+		return false
+	}
+	cache, err := f.fs.openVerified(f.fs.cache, f.name, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	if _, err := cache.Seek(f.pos, io.SeekStart); err != nil {
+		cache.Close()
+		return false
+	}
+	if f.fill != nil {
+		f.endFill(false)
+	}
+	f.stopReadAhead() // Already ended by the error
+	f.primary.Close()
+	f.primary, f.cache = nil, cache
+	f.fs.hit(f.name)
+	return true
+}
+
+// WriteTo writes the remainder of the file to w, filling the cache exactly
+// as Read does but in large chunks. It lets io.Copy stream from a File
+// without going through its default small buffer.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+	buf := *bp
+	var written int64
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if m < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// ReadFrom writes everything read from r to the file, mirroring it to the
+// cache exactly as Write does but in large chunks. It lets io.Copy stream
+// into a File without going through its default small buffer.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+	buf := *bp
+	var read int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			m, werr := f.Write(buf[:n])
+			read += int64(m)
+			if werr != nil {
+				return read, werr
+			}
+		}
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
 // ReadAt reads from the primary file at a specific offset.
 func (f *File) ReadAt(b []byte, off int64) (int, error) {
-	return f.primary.ReadAt(b, off)
+	if f.blockMode {
+		return f.readBlocks(b, off)
+	}
+	if f.primary == nil {
+		f.lockCache()
+		defer f.unlockCache()
+		defer f.lockPath(false)()
+		return f.cache.ReadAt(b, off)
+	}
+	if f.rdwr {
+		if n, err := f.readMirror(b, off, false); err != errNoMirror {
+			return n, err
+		}
+	}
+	return f.readPrimaryAt(b, off)
+}
+
+// errNoMirror is returned by readMirror for reads the primary must serve.
+var errNoMirror = errors.New("corfs: no mirror to read")
+
+// readMirror serves a read at off through an O_RDWR write handle from the
+// cached copy its writes are mirrored into, which matches the primary's
+// while the handle is its only writer. It returns errNoMirror if the
+// handle has no mirror, another write handle has overlapped it, or the
+// mirror fails, and the read must go to the primary. If seek is set, the
+// primary's offset is moved past the bytes read, as reading it would.
+func (f *File) readMirror(b []byte, off int64, seek bool) (int, error) {
+	f.lockCache()
+	defer f.unlockCache()
+	if f.cache == nil || !f.fs.index.alone(f.name) {
+		return 0, errNoMirror
+	}
+	n, err := f.cache.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return 0, errNoMirror
+	}
+	if seek && n > 0 {
+		if _, err := f.primary.Seek(off+int64(n), io.SeekStart); err != nil {
+			return 0, errNoMirror
+		}
+	}
+	return n, err
 }
 
 // Write writes to both primary and cache files.
 func (f *File) Write(b []byte) (int, error) {
-	n, err := f.primary.Write(b)
+	if f.primary == nil {
+		return f.writeBack(func() (int, error) {
+			n, err := f.cache.Write(b)
+			f.advance(n)
+			return n, err
+		})
+	}
+	off := f.pos
+	n, err := f.writePrimary(func() (int, error) { return f.primary.Write(b) })
+	f.advance(n)
+
+	f.lockCache()
+	defer f.unlockCache()
+	f.invalidate()
 	if n > 0 && f.cache != nil {
-		f.cache.Write(b[:n])
+		f.mirror(n, func() (int, error) { return f.mirrorWrite(b[:n], off) })
 	}
 	return n, err
 }
 
 // WriteAt writes to both files at a specific offset.
 func (f *File) WriteAt(b []byte, off int64) (int, error) {
-	n, err := f.primary.WriteAt(b, off)
+	if f.primary == nil {
+		return f.writeBack(func() (int, error) { return f.cache.WriteAt(b, off) })
+	}
+	n, err := f.writePrimary(func() (int, error) { return f.primary.WriteAt(b, off) })
+
+	f.lockCache()
+	defer f.unlockCache()
+	f.invalidate()
 	if n > 0 && f.cache != nil {
-		f.cache.WriteAt(b[:n], off)
+		f.mirror(n, func() (int, error) { return f.cache.WriteAt(b[:n], off) })
 	}
 	return n, err
 }
 
 // WriteString writes a string to both files.
 func (f *File) WriteString(s string) (int, error) {
-	n, err := f.primary.WriteString(s)
+	if f.primary == nil {
+		return f.writeBack(func() (int, error) {
+			n, err := f.cache.WriteString(s)
+			f.advance(n)
+			return n, err
+		})
+	}
+	off := f.pos
+	n, err := f.writePrimary(func() (int, error) { return f.primary.WriteString(s) })
+	f.advance(n)
+
+	f.lockCache()
+	defer f.unlockCache()
+	f.invalidate()
 	if n > 0 && f.cache != nil {
-		f.cache.WriteString(s)
+		f.mirror(n, func() (int, error) { return f.mirrorWrite([]byte(s[:n]), off) })
 	}
 	return n, err
 }
 
-// Close closes both file handles.
-func (f *File) Close() error {
+// lockPath locks the handle's path, for a write to its cached copy if write
+// is set and for a read otherwise (see pathLocks), and returns the function
+// unlocking it.
+func (f *File) lockPath(write bool) func() {
+	if f.fs == nil {
+		return func() {}
+	}
+	l := f.fs.paths.of(f.fs.key(f.name))
+	if write {
+		l.Lock()
+		return l.Unlock
+	}
+	l.RLock()
+	return l.RUnlock
+}
+
+// writePrimary performs a write to the primary, retrying it with
+// WithRetryWrites if it wrote nothing.
+func (f *File) writePrimary(write func() (int, error)) (int, error) {
+	if f.fs == nil {
+		return write()
+	}
+	var n int
 	var err error
-	if f.primary != nil {
-		err = f.primary.Close()
+	f.fs.retryWrite(f.ctx, func() error {
+		n, err = write()
+		if n > 0 {
+			return nil // Part of b was written
+		}
+		return err
+	})
+	return n, err
+}
+
+// advance moves the handle's offset past a write of n bytes to the primary,
+// or to the cached copy for write-back handles. Appending writes leave the
+// file at its end, wherever the offset was.
+func (f *File) advance(n int) {
+	if !f.appends {
+		f.pos += int64(n)
+	} else if pos, err := f.source().Seek(0, io.SeekCurrent); err == nil {
+		f.pos = pos
+	}
+}
+
+// mirrorWrite writes b, written to the primary at off, to the cache handle.
+// The cache handle's own offset is never used except to append, so reads
+// and seeks through the handle can't make the mirror write elsewhere than
+// the primary did. The caller must hold the cache lock.
+func (f *File) mirrorWrite(b []byte, off int64) (int, error) {
+	if f.appends {
+		return f.cache.Write(b)
+	}
+	return f.cache.WriteAt(b, off)
+}
+
+// writeBack performs a write through a write-back handle and marks the file
+// dirty.
+func (f *File) writeBack(write func() (int, error)) (int, error) {
+	if err := f.readOnlyCopy("write"); err != nil {
+		return 0, err
+	}
+	f.lockCache()
+	defer f.unlockCache()
+	defer f.lockPath(true)()
+	n, err := write()
+	if n > 0 {
+		f.markDirty()
+	}
+	return n, err
+}
+
+// readOnlyCopy returns the error for op, a change through a handle reading
+// a cached copy without a primary, such as one opened while the primary was
+// unavailable. Nothing written through it could reach the primary, so it
+// is refused rather than left in the cache. It returns nil for write-back
+// handles.
+func (f *File) readOnlyCopy(op string) error {
+	if f.writer {
+		return nil
 	}
+	return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+}
+
+// Close closes both file handles. With WithAsyncCacheWrites, it waits for
+// the background cache writes of the handle's fill, so once Close returns
+// the fill has been committed, or discarded if the file wasn't read to the
+// end.
+//
+// If closing the cached copy a write handle mirrors its writes to fails,
+// the copy is removed, since it may be missing some of them, and the
+// failure is reported as a cache error: returned alongside the primary's
+// result with WithStrictCache, and otherwise only to the cache error
+// handler.
+func (f *File) Close() error {
+	if f.primary == nil {
+		f.lockCache()
+		defer f.unlockCache()
+		if f.writer {
+			f.fs.index.closeWriter(f.name)
+		}
+		return f.cache.Close()
+	}
+	f.stopReadAhead()
+	err := f.primary.Close()
+	defer f.waitFill() // Once the cache lock is released
+
+	f.lockCache()
+	defer f.unlockCache()
+	exclusive := f.writer && f.fs.index.closeWriter(f.name)
 	if f.cache != nil {
-		f.cache.Close()
+		cerr := f.cache.Close()
+		switch {
+		case cerr != nil:
+			// The mirrored writes may not all have reached the cached
+			// copy, so it can't be trusted
+			f.fs.index.remove(f.name)
+			f.fs.cache.Remove(f.name)
+			err = f.fs.cacheResult(err, "close", f.name, cerr)
+		case exclusive && err == nil:
+			// Every write was mirrored, so the cached copy matches the
+			// primary again
+			if info, err := f.fs.cache.Stat(f.name); err == nil {
+				if f.fs.cacheable(info.Size()) {
+					f.fs.index.complete(f.name, info.Size(), "", f.fs.index.currentGeneration(), time.Time{}, 0)
+					f.fs.evict(f.fs.cache, f.name)
+				} else {
+					f.fs.decide(DecisionSkipSize, f.name, nil)
+					f.fs.cache.Remove(f.name) // Outside the size limits
+				}
+			}
+		}
+	}
+	f.closeBlockFile()
+	if f.fill != nil {
+		// Closed before EOF; the partial entry is discarded
+		f.endFill(false)
 	}
 	return err
 }
 
 // Seek seeks in the primary file.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		f.entries = nil // A rewound directory is listed afresh
+	}
+	if f.primary == nil {
+		f.lockCache()
+		defer f.unlockCache()
+		ret, err := f.cache.Seek(offset, whence)
+		if err == nil {
+			f.pos = ret
+		}
+		return ret, err
+	}
+	ahead := f.ahead != nil
+	if ahead {
+		if offset == 0 && whence == io.SeekCurrent {
+			return f.pos, nil // Keep prefetching
+		}
+		f.stopReadAhead()
+	}
+	f.sequential = 0
+	if (f.blockMode || ahead) && whence == io.SeekCurrent {
+		// Block reads don't move the primary's offset, and read-ahead
+		// moves it past the handle's
+		offset, whence = f.pos+offset, io.SeekStart
+	}
+	prev := f.pos
 	ret, err := f.primary.Seek(offset, whence)
-	if f.cache != nil {
-		f.cache.Seek(offset, whence)
+	if err == nil {
+		f.pos = ret
+	} else if ahead {
+		f.primary.Seek(f.pos, io.SeekStart) // Undo the read-ahead
+	}
+
+	f.lockCache()
+	defer f.unlockCache()
+	if f.fill != nil && f.pos != prev {
+		// The fill only stays valid for sequential reads
+		f.endFill(false)
 	}
 	return ret, err
 }
 
 // Stat returns file info from the primary file.
 func (f *File) Stat() (os.FileInfo, error) {
-	return f.primary.Stat()
+	if f.primary == nil {
+		f.lockCache()
+		defer f.unlockCache()
+	}
+	return f.source().Stat()
 }
 
-// Sync syncs both files.
+// Sync syncs both files. A write-back handle only syncs its cached copy;
+// use FileSystem.FlushFile to write it to the primary. A read-only handle
+// syncs the part of the cached copy its fill has written so far, first
+// waiting for background cache writes (see WithAsyncCacheWrites), so that
+// once Sync returns the cache holds everything read through the handle.
 func (f *File) Sync() error {
+	if f.primary == nil {
+		f.lockCache()
+		defer f.unlockCache()
+		return f.cache.Sync()
+	}
 	err := f.primary.Sync()
+
+	f.lockCache()
+	a := f.queued
+	f.unlockCache()
+	if a != nil {
+		// Not under the cache lock, which the queue's workers need
+		f.fs.writes.syncFill(a)
+	}
+
+	f.lockCache()
+	defer f.unlockCache()
 	if f.cache != nil {
 		f.cache.Sync()
 	}
+	if f.fill != nil && f.async == nil {
+		f.fill.sync()
+	}
 	return err
 }
 
 // Truncate truncates both files.
 func (f *File) Truncate(size int64) error {
+	if f.primary == nil {
+		if err := f.readOnlyCopy("truncate"); err != nil {
+			return err
+		}
+		f.lockCache()
+		defer f.unlockCache()
+		defer f.lockPath(true)()
+		err := f.cache.Truncate(size)
+		if err == nil {
+			f.markDirty()
+		}
+		return err
+	}
 	err := f.primary.Truncate(size)
-	if f.cache != nil {
-		f.cache.Truncate(size)
+
+	f.lockCache()
+	defer f.unlockCache()
+	f.invalidate()
+	if f.cache != nil && (err != nil || f.cache.Truncate(size) != nil) {
+		f.dropMirror()
 	}
 	return err
 }
 
-// Readdir reads directory entries from the primary file.
+// mirror applies a write of n bytes that succeeded on the primary to the
+// cache handle, dropping the mirror if the cache doesn't take all of it. The
+// caller must hold the cache lock.
+func (f *File) mirror(n int, write func() (int, error)) {
+	if m, err := write(); err != nil || m != n {
+		f.dropMirror()
+	}
+}
+
+// dropMirror discards the cached copy of a write handle whose writes could
+// not be mirrored, so the diverged copy is never served. The caller must
+// hold the cache lock.
+func (f *File) dropMirror() {
+	f.cache.Close()
+	f.cache = nil
+	f.fs.cache.Remove(f.name)
+}
+
+// lockCache holds the FileSystem's cache for the duration of a cache-side
+// operation. If the cache was replaced since the handle was opened, the
+// handle's cache side is dropped first, except for write-back handles whose
+// cached copy is all they have. Callers must call unlockCache.
+func (f *File) lockCache() {
+	if f.fs == nil {
+		return
+	}
+	f.fs.cacheMu.RLock()
+	if f.gen != f.fs.cacheGen && f.primary != nil {
+		f.detachCache()
+	}
+}
+
+// unlockCache releases the cache held by lockCache.
+func (f *File) unlockCache() {
+	if f.fs != nil {
+		f.fs.cacheMu.RUnlock()
+	}
+}
+
+// detachCache drops the cache side of a handle opened against a replaced
+// cache. The caller must hold the cache lock.
+func (f *File) detachCache() {
+	if f.cache != nil {
+		f.cache.Close()
+		f.cache = nil
+		// Writes through this handle no longer reach the cache, so the
+		// new cache must not serve its own copy of the file
+		f.fs.cache.Remove(f.name)
+	}
+	if f.fill != nil {
+		f.endFill(false)
+	}
+	f.closeBlockFile()
+	f.cached = true
+	f.gen = f.fs.cacheGen
+}
+
+// startFill begins filling the cache from this handle unless another fill
+// for the same path is already in progress. It returns ErrCacheFull if the
+// fill was refused at the cache handle limit. The caller must hold the
+// cache lock.
+func (f *File) startFill() error {
+	f.cached = true // Whatever happens, this handle fills at most once
+	size := int64(-1)
+	info, err := f.primary.Stat()
+	if err == nil {
+		if !f.fs.cacheable(info.Size()) {
+			f.fs.decide(DecisionSkipSize, f.name, nil)
+			return nil
+		}
+		size = info.Size()
+	} else {
+		info = nil
+	}
+
+	key := path.Clean(f.name)
+	call, ok := f.fs.flight.begin(key, false)
+	if !ok {
+		return nil
+	}
+	fill, err := f.fs.newFill(f.fs.cache, f.name, f.generation, true, info)
+	if err != nil {
+		f.fs.reportCacheError("fill", f.name, err)
+		f.fs.flight.end(key, call, err)
+		if err == ErrCacheFull {
+			return err
+		}
+		return nil
+	}
+	fill.progress = call
+	call.total.Store(size)
+	f.fill = fill
+	f.flight = call
+	if f.fs.writes != nil {
+		f.async = &asyncFill{fs: f.fs, fill: fill, call: call, gen: f.gen}
+		f.queued = f.async
+	}
+	return nil
+}
+
+// waitFill waits for the background writes of the handle's last fill, if
+// it had any, to be done with. The caller must not hold the cache lock,
+// which the queue's workers need.
+func (f *File) waitFill() {
+	f.lockCache()
+	a := f.queued
+	f.unlockCache()
+	if a != nil {
+		f.fs.writes.waitFill(a)
+	}
+}
+
+// writeFill adds b to the handle's fill, directly or through the background
+// queue. The caller must hold the cache lock.
+func (f *File) writeFill(b []byte) {
+	if f.async != nil {
+		f.fs.writes.write(f.async, b)
+		return
+	}
+	f.fill.write(b)
+}
+
+// endFill commits or discards the handle's fill, recording the outcome in
+// the index. The caller must hold the cache lock.
+func (f *File) endFill(commit bool) {
+	if f.async != nil {
+		f.fs.writes.end(f.async, commit)
+	} else {
+		f.fs.finishFill(f.fill, f.flight, commit)
+	}
+	f.fill = nil
+	f.flight = nil
+	f.async = nil
+}
+
+// invalidate drops cached metadata and blocks for the file after a write.
+// The caller must hold the cache lock.
+func (f *File) invalidate() {
+	if f.fs != nil {
+		f.fs.invalidateMeta(f.name)
+		f.fs.blocks.drop(f.fs.cache, f.name)
+		f.fs.index.change(f.name)
+		f.fs.index.remove(f.name)
+	}
+}
+
+// markDirty records a write through a write-back handle. Writes to a cache
+// that has since been replaced are not recorded. The caller must hold the
+// cache lock.
+func (f *File) markDirty() {
+	f.fs.invalidateMeta(f.name)
+	if f.gen != f.fs.cacheGen {
+		return
+	}
+	var size int64
+	if info, err := f.cache.Stat(); err == nil {
+		size = info.Size()
+	}
+	f.fs.index.markDirty(f.name, size)
+}
+
+// Readdir reads the directory's entries as FileSystem.ReadDir lists them,
+// merging files written in WriteBack mode and not yet flushed, in order of
+// name. With n > 0 it returns at most n entries and, once there are none
+// left, io.EOF; with n <= 0 it returns all the remaining entries. The
+// listing is read on the first call and paged through by later ones, until
+// the handle is rewound with Seek.
 func (f *File) Readdir(n int) ([]os.FileInfo, error) {
-	entries, err := f.primary.Readdir(n)
+	if f.fs == nil {
+		return f.readdirSource(n)
+	}
+	entries, err := f.readEntries(n)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+// readdirSource reads directory entries from the handle's source file.
+func (f *File) readdirSource(n int) ([]os.FileInfo, error) {
+	entries, err := f.source().Readdir(n)
 	if err != nil {
 		return entries, err
 	}
@@ -135,9 +794,24 @@ func (f *File) Readdir(n int) ([]os.FileInfo, error) {
 	return filtered, nil
 }
 
-// Readdirnames reads directory entry names from the primary file.
+// Readdirnames reads the names of the directory's entries, paging through
+// them as Readdir does.
 func (f *File) Readdirnames(n int) ([]string, error) {
-	names, err := f.primary.Readdirnames(n)
+	if f.fs == nil {
+		return f.readdirnamesSource(n)
+	}
+	entries, err := f.readEntries(n)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, err
+}
+
+// readdirnamesSource reads directory entry names from the handle's source
+// file.
+func (f *File) readdirnamesSource(n int) ([]string, error) {
+	names, err := f.source().Readdirnames(n)
 	if err != nil {
 		return names, err
 	}
@@ -153,7 +827,11 @@ func (f *File) Readdirnames(n int) ([]string, error) {
 	return filtered, nil
 }
 
-// ReadDir reads directory entries from the primary file.
+// ReadDir reads the directory's entries, paging through them as Readdir
+// does.
 func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
-	return f.primary.ReadDir(n)
+	if f.fs == nil {
+		return f.source().ReadDir(n)
+	}
+	return f.readEntries(n)
 }
@@ -0,0 +1,839 @@
+package corfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// maxWriter records the largest single write it receives.
+type maxWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *maxWriter) Write(b []byte) (int, error) {
+	if len(b) > w.max {
+		w.max = len(b)
+	}
+	return w.Buffer.Write(b)
+}
+
+// writeSizeFiler records the largest single write made to its files.
+type writeSizeFiler struct {
+	absfs.Filer
+	max int
+}
+
+func (w *writeSizeFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := w.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &writeSizeFile{File: f, filer: w}, nil
+}
+
+type writeSizeFile struct {
+	absfs.File
+	filer *writeSizeFiler
+}
+
+func (f *writeSizeFile) Write(b []byte) (int, error) {
+	if len(b) > f.filer.max {
+		f.filer.max = len(b)
+	}
+	return f.File.Write(b)
+}
+
+// testContent returns n bytes of non-repeating test data.
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	return data
+}
+
+func TestFileWriteToFastPath(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	content := testContent(512 * 1024)
+	writeMemFile(t, primary, "/large.bin", string(content))
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/large.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var dst maxWriter
+	n, err := io.Copy(&dst, f)
+	if err != nil {
+		t.Fatalf("io.Copy() error = %v", err)
+	}
+	if n != int64(len(content)) || !bytes.Equal(dst.Bytes(), content) {
+		t.Fatalf("io.Copy() copied %d bytes with mismatched content", n)
+	}
+	// io.Copy's own buffer is 32KB; larger writes mean WriteTo was used
+	if dst.max <= 32*1024 {
+		t.Errorf("largest write was %d bytes, expected io.Copy to use WriteTo", dst.max)
+	}
+
+	cached, err := cache.ReadFile("/large.bin")
+	if err != nil {
+		t.Fatalf("cache ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(cached, content) {
+		t.Error("cached content differs from the primary")
+	}
+}
+
+func TestFileReadFromFastPath(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	primary := &writeSizeFiler{Filer: mem}
+	content := testContent(512 * 1024)
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/large.bin", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hide bytes.Reader's WriteTo so io.Copy has to use ReadFrom
+	src := struct{ io.Reader }{bytes.NewReader(content)}
+	n, err := io.Copy(f, src)
+	if err != nil {
+		t.Fatalf("io.Copy() error = %v", err)
+	}
+	f.Close()
+	if n != int64(len(content)) {
+		t.Fatalf("io.Copy() copied %d bytes, expected %d", n, len(content))
+	}
+	if primary.max <= 32*1024 {
+		t.Errorf("largest write was %d bytes, expected io.Copy to use ReadFrom", primary.max)
+	}
+
+	for name, filer := range map[string]absfs.Filer{"primary": mem, "cache": cache} {
+		data, err := filer.ReadFile("/large.bin")
+		if err != nil {
+			t.Fatalf("%s ReadFile() error = %v", name, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s content differs from the source", name)
+		}
+	}
+}
+
+func TestFileAppendMatchesCache(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/log.txt", "one\n")
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/log.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	f, err := fs.OpenFile("/log.txt", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := f.Read(buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if _, err := f.Write([]byte("two\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	f.Close()
+
+	want := "one\ntwo\n"
+	if got := readString(primary, "/log.txt"); got != want {
+		t.Errorf("primary content = %q, expected %q", got, want)
+	}
+	if got := readString(cache, "/log.txt"); got != want {
+		t.Errorf("cache content = %q, expected %q", got, want)
+	}
+}
+
+func TestFileAppendWithoutCachedCopy(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/log.txt", "one\n")
+	writeMemFile(t, cache, "/log.txt", "stale")
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/log.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte("two\n"))
+	f.Close()
+
+	// The cache never held the primary's content, so it must not keep a copy
+	if _, err := cache.Stat("/log.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the stale copy to be discarded", err)
+	}
+	if got := readString(fs, "/log.txt"); got != "one\ntwo\n" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "one\ntwo\n")
+	}
+}
+
+func TestFileTruncateFlagMatchesCache(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "old primary content")
+	writeMemFile(t, cache, "/file.txt", "old cached content")
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/file.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+
+	if got := readString(primary, "/file.txt"); got != "new" {
+		t.Errorf("primary content = %q, expected %q", got, "new")
+	}
+	if got := readString(cache, "/file.txt"); got != "new" {
+		t.Errorf("cache content = %q, expected %q", got, "new")
+	}
+}
+
+// failWriteAtFiler returns files whose WriteAt always fails.
+type failWriteAtFiler struct {
+	absfs.Filer
+}
+
+func (w *failWriteAtFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := w.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &failWriteAtFile{File: f}, nil
+}
+
+type failWriteAtFile struct {
+	absfs.File
+}
+
+func (f *failWriteAtFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestFileDropsDivergedMirror(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "abc")
+	fs := New(primary, &failWriteAtFiler{Filer: mem})
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	f, err := fs.OpenFile("/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 1); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	f.Close()
+
+	if _, err := mem.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the diverged copy to be removed", err)
+	}
+	if _, ok := fs.index.get("/file.txt"); ok {
+		t.Error("index entry present for a diverged copy")
+	}
+}
+
+// failCloseFiler returns write handles whose Close fails with
+// errCacheBroken once the file is closed.
+type failCloseFiler struct {
+	absfs.Filer
+}
+
+func (c *failCloseFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := c.Filer.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &failCloseFile{File: f}, nil
+}
+
+type failCloseFile struct {
+	absfs.File
+}
+
+func (f *failCloseFile) Close() error {
+	f.File.Close()
+	return errCacheBroken
+}
+
+func TestFileCloseCacheError(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		primary, mem := newMemFilers(t)
+		var errs cacheErrors
+		opts := []Option{WithCacheErrorHandler(errs.handle)}
+		if strict {
+			opts = append(opts, WithStrictCache())
+		}
+		fs := New(primary, &failCloseFiler{Filer: mem}, opts...)
+
+		f, err := fs.OpenFile("/file.txt", os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		if _, err := f.Write([]byte("content")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		err = f.Close()
+		if got := errors.Is(err, errCacheBroken); got != strict {
+			t.Errorf("strict=%v: Close() error = %v", strict, err)
+		}
+		if got := errs.ops(); len(got) != 1 || got[0] != "close" {
+			t.Errorf("strict=%v: cache errors = %q, expected a close error", strict, got)
+		}
+
+		// The copy may be missing writes, so is never served
+		if _, err := mem.Stat("/file.txt"); !os.IsNotExist(err) {
+			t.Errorf("strict=%v: cache Stat() error = %v, expected the copy to be removed", strict, err)
+		}
+		if st := fs.CacheStatus("/file.txt"); st.Cached {
+			t.Errorf("strict=%v: CacheStatus() = %+v, expected no entry", strict, st)
+		}
+		if got := readString(primary, "/file.txt"); got != "content" {
+			t.Errorf("strict=%v: primary content = %q, expected %q", strict, got, "content")
+		}
+	}
+}
+
+func TestFileOverlappingWritersLeaveEntryIncomplete(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "abc")
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	a, err := fs.OpenFile("/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	b, err := fs.OpenFile("/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	a.WriteAt([]byte("x"), 0)
+	b.WriteAt([]byte("y"), 1)
+	a.Close()
+	b.Close()
+
+	// The handles' writes may have reached the two sides in different
+	// orders, so neither can vouch for the cached copy
+	if e, ok := fs.index.get("/file.txt"); ok && e.complete {
+		t.Errorf("index entry = %+v after overlapping writers, expected incomplete", e)
+	}
+}
+
+func TestFileReaderFillOverlappingWriter(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "oldoldoldoldold")
+	fs := New(primary, cache, WithCacheFirst())
+
+	r, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	// A writer replaces the file while the reader's fill is under way
+	w, err := fs.OpenFile("/file.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(O_TRUNC) error = %v", err)
+	}
+	if _, err := w.Write([]byte("NEWNEWNEWNEWNEW")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	w.Close()
+
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	r.Close()
+
+	// The fill read across the write, so its copy mustn't replace the
+	// writer's
+	if got := readString(fs, "/file.txt"); got != "NEWNEWNEWNEWNEW" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "NEWNEWNEWNEWNEW")
+	}
+	if got := readString(cache, "/file.txt"); got != "NEWNEWNEWNEWNEW" && fs.CacheStatus("/file.txt").Complete {
+		t.Errorf("cached copy = %q is complete, expected the writer's", got)
+	}
+	if n, _ := pruneTemp(cache, "/"); n != 0 {
+		t.Errorf("%d temporary files left behind", n)
+	}
+}
+
+func TestReadFileFillWhileWriterOpen(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "old")
+	fs := New(primary, cache, WithCacheFirst())
+
+	w, err := fs.OpenFile("/file.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(O_TRUNC) error = %v", err)
+	}
+	if _, err := w.Write([]byte("bbbb")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	// A fill begun after the writer opened mustn't replace its mirror
+	if got := readString(fs, "/file.txt"); got != "bbbb" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "bbbb")
+	}
+	if _, err := w.Write([]byte("cccc")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := readString(fs, "/file.txt"); got != "bbbbcccc" {
+		t.Errorf("ReadFile() = %q after Close, expected %q", got, "bbbbcccc")
+	}
+	if st := fs.CacheStatus("/file.txt"); st.Complete && st.Size != 8 {
+		t.Errorf("CacheStatus() = %+v, expected any complete copy to hold all 8 bytes", st)
+	}
+	if n, _ := pruneTemp(cache, "/"); n != 0 {
+		t.Errorf("%d temporary files left behind", n)
+	}
+}
+
+func TestFileSeekAndReadKeepMirrorInStep(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		flag int
+		want string
+	}{
+		{"RDWR", os.O_RDWR, "01xy45ABcd"},
+		{"APPEND", os.O_RDWR | os.O_APPEND, "0123456789ABxycd"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, cache := newMemFilers(t)
+			writeMemFile(t, primary, "/file.txt", "0123456789")
+			fs := New(primary, cache)
+			if _, err := fs.ReadFile("/file.txt"); err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+
+			f, err := fs.OpenFile("/file.txt", tt.flag, 0)
+			if err != nil {
+				t.Fatalf("OpenFile() error = %v", err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(f, buf); err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if _, err := f.Seek(2, io.SeekCurrent); err != nil {
+				t.Fatalf("Seek() error = %v", err)
+			}
+			f.Write([]byte("AB"))
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatalf("Seek() error = %v", err)
+			}
+			if _, err := io.ReadFull(f, buf[:2]); err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			f.WriteString("xy")
+			if _, err := f.Seek(-2, io.SeekEnd); err != nil {
+				t.Fatalf("Seek() error = %v", err)
+			}
+			f.Write([]byte("cd"))
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if got := readString(primary, "/file.txt"); got != tt.want {
+				t.Errorf("primary content = %q, expected %q", got, tt.want)
+			}
+			if got := readString(cache, "/file.txt"); got != tt.want {
+				t.Errorf("cache content = %q, expected %q", got, tt.want)
+			}
+			if st := fs.CacheStatus("/file.txt"); !st.Complete {
+				t.Errorf("CacheStatus() = %+v, expected a complete entry", st)
+			}
+		})
+	}
+}
+
+// noSeekFiler's files can't seek, like write handles on some object stores.
+type noSeekFiler struct {
+	absfs.Filer
+}
+
+func (c *noSeekFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := c.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &noSeekFile{File: f}, nil
+}
+
+type noSeekFile struct {
+	absfs.File
+}
+
+func (f *noSeekFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("seek not supported")
+}
+
+func TestFileMirrorWithoutCacheSeek(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "0123456789")
+	cache := &noSeekFiler{Filer: mem}
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	f.Write([]byte("AB"))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	const want = "01234AB789"
+	if got := readString(mem, "/file.txt"); got != want {
+		t.Errorf("cache content = %q, expected %q", got, want)
+	}
+	if st := fs.CacheStatus("/file.txt"); !st.Complete {
+		t.Errorf("CacheStatus() = %+v, expected the mirror to be kept", st)
+	}
+}
+
+func TestFileSeekThenReadCachesAtOffset(t *testing.T) {
+	content := strings.Repeat("0123456789", 30)
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", content)
+	fs := New(primary, cache, WithBlockSize(64))
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != content[100:110] {
+		t.Errorf("Read() after Seek(100) and ReadAt(0) = %q, expected %q", got, content[100:110])
+	}
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 110 {
+		t.Errorf("Seek(0, io.SeekCurrent) = %d, %v, expected 110", pos, err)
+	}
+	if got := readString(cache, blockName("/file.txt")); len(got) < 110 || got[100:110] != content[100:110] {
+		t.Errorf("block file doesn't hold %q at offset 100", content[100:110])
+	}
+
+	// A write-back handle writes its cached copy at the same offset
+	fs = New(primary, cache, WithMode(WriteBack))
+	f, err = fs.OpenFile("/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(200); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("AB"))
+	f.WriteString("CD")
+	if got := readString(cache, "/file.txt"); len(got) != 200 || got[100:114] != content[100:110]+"ABCD" {
+		t.Errorf("cached copy = %q, expected ABCD written at offset 110", got)
+	}
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 114 || f.(*File).pos != 114 {
+		t.Errorf("Seek(0, io.SeekCurrent) = %d, %v, expected 114", pos, err)
+	}
+}
+
+func TestFileReadWriteReadsMirror(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "0123456789")
+	readAts := &readAtCountFiler{Filer: mem}
+	primary := &readBytesFiler{Filer: readAts}
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	read := primary.read.Load()
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "0123" {
+		t.Fatalf("Read() = %q, %v; expected 0123", buf, err)
+	}
+	f.Write([]byte("AB"))
+
+	// The handle reads back its own writes from the mirror
+	if _, err := f.ReadAt(buf[:2], 4); err != nil || string(buf[:2]) != "AB" {
+		t.Errorf("ReadAt(4) = %q, %v; expected AB", buf[:2], err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "0123AB6789" {
+		t.Errorf("ReadAll() = %q, %v; expected 0123AB6789", data, err)
+	}
+	if n, m := primary.read.Load()-read, readAts.count(); n != 0 || m != 0 {
+		t.Errorf("primary read %d bytes and ReadAt %d times, expected reads served by the mirror", n, m)
+	}
+
+	// Once another writer overlaps, the mirror can't be relied on
+	w, err := fs.OpenFile("/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("xy"), 8)
+	w.Close()
+	if _, err := f.ReadAt(buf, 6); err != nil || string(buf) != "67xy" {
+		t.Errorf("ReadAt(6) = %q, %v; expected the other writer's bytes from the primary", buf, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(mem, "/file.txt"); got != "0123AB67xy" {
+		t.Errorf("primary content = %q, expected 0123AB67xy", got)
+	}
+}
+
+func TestFileExclusiveCreateReplacesLeftoverCache(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		indexed bool // The leftover is recorded as a complete copy
+	}{
+		{"unindexed", false},
+		{"indexed", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, cache := newMemFilers(t)
+			fs := New(primary, cache)
+			if tt.indexed {
+				writeMemFile(t, primary, "/new.txt", "leftover")
+				if _, err := fs.ReadFile("/new.txt"); err != nil {
+					t.Fatal(err)
+				}
+				if err := primary.Remove("/new.txt"); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				writeMemFile(t, cache, "/new.txt", "leftover")
+			}
+
+			f, err := fs.OpenFile("/new.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatalf("OpenFile() error = %v", err)
+			}
+			f.Write([]byte("new"))
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if got := readString(cache, "/new.txt"); got != "new" {
+				t.Errorf("cache content = %q, expected %q", got, "new")
+			}
+			if st := fs.CacheStatus("/new.txt"); !st.Complete || st.Size != 3 {
+				t.Errorf("CacheStatus() = %+v, expected a complete entry", st)
+			}
+		})
+	}
+}
+
+var errConnectionLost = errors.New("connection lost")
+
+// dropAfterFiler's read-only files fail once limit bytes have been read
+// from them, like a connection dropped mid-transfer. A limit of zero or
+// less never fails.
+type dropAfterFiler struct {
+	absfs.Filer
+	limit int64
+}
+
+func (d *dropAfterFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := d.Filer.OpenFile(name, flag, perm)
+	if err != nil || d.limit <= 0 || flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return f, err
+	}
+	return &dropAfterFile{File: f, left: d.limit}, nil
+}
+
+type dropAfterFile struct {
+	absfs.File
+	left int64
+}
+
+func (f *dropAfterFile) Read(b []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, errConnectionLost
+	}
+	if int64(len(b)) > f.left {
+		b = b[:f.left]
+	}
+	n, err := f.File.Read(b)
+	f.left -= int64(n)
+	return n, err
+}
+
+func TestFileReadFallsBackToCacheMidStream(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	content := testContent(1000)
+	writeMemFile(t, mem, "/data.bin", string(content))
+	primary := &dropAfterFiler{Filer: mem}
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/data.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.limit = 300
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 128)
+	var got []byte
+	for {
+		n, err := f.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read() error = %v after %d bytes", err, len(got))
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("content read across the fallback doesn't match")
+	}
+	if pos, err := f.Seek(-10, io.SeekEnd); err != nil || pos != 990 {
+		t.Errorf("Seek() = %d, %v; expected 990 in the cached copy", pos, err)
+	}
+}
+
+func TestFileReadMidStreamErrorWithoutCache(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/data.bin", string(testContent(1000)))
+	fs := New(&dropAfterFiler{Filer: mem, limit: 300}, cache)
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.ReadAll(f); !errors.Is(err, errConnectionLost) {
+		t.Errorf("ReadAll() error = %v, expected %v", err, errConnectionLost)
+	}
+}
+
+func TestFileCacheFallbackIsWrapped(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	fs := New(mem, cache)
+	readString(fs, "/file.txt")
+	fs.primary = &mockFilerWithError{err: errors.New("primary unavailable")}
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(*File); !ok {
+		t.Fatalf("OpenFile() = %T, expected a *File", f)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "content" {
+		t.Errorf("ReadAll() = %q, %v; expected the cached copy", data, err)
+	}
+	if st := fs.Stats(); st.Hits != 1 {
+		t.Errorf("Stats().Hits = %d, expected the fallback to count as a hit", st.Hits)
+	}
+
+	// Nothing written could reach the primary
+	if _, err := f.Write([]byte("changed")); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Write() error = %v, expected %v", err, os.ErrPermission)
+	}
+	if err := f.Truncate(0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Truncate() error = %v, expected %v", err, os.ErrPermission)
+	}
+	if got := readString(cache, "/file.txt"); got != "content" {
+		t.Errorf("cache /file.txt = %q, expected it unchanged", got)
+	}
+	if st := fs.CacheStatus("/file.txt"); st.Dirty || !st.Complete {
+		t.Errorf("CacheStatus() = %+v, expected a complete, clean copy", st)
+	}
+}
+
+func TestFileFillOnOpen(t *testing.T) {
+	for _, fill := range []bool{false, true} {
+		mem, cache := newMemFilers(t)
+		writeMemFile(t, mem, "/file.txt", "hello world")
+		var opts []Option
+		if fill {
+			opts = append(opts, WithFillOnOpen())
+		}
+		fs := New(mem, cache, opts...)
+
+		f, err := fs.OpenFile("/file.txt", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte("HELLO"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readString(mem, "/file.txt"); got != "HELLO world" {
+			t.Errorf("fill=%v: primary /file.txt = %q, expected %q", fill, got, "HELLO world")
+		}
+		st := fs.CacheStatus("/file.txt")
+		if !fill {
+			if st.Cached {
+				t.Errorf("fill=%v: CacheStatus() = %+v, expected no copy of a file the cache didn't hold", fill, st)
+			}
+			continue
+		}
+		if got := readString(cache, "/file.txt"); !st.Complete || got != "HELLO world" {
+			t.Errorf("fill=%v: cache /file.txt = %q with %+v, expected a complete copy with the write", fill, got, st)
+		}
+	}
+}
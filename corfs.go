@@ -4,8 +4,16 @@
 package corfs
 
 import (
+	"context"
+	"errors"
+	"io"
 	"io/fs"
 	"os"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -17,168 +25,1099 @@ import (
 type FileSystem struct {
 	primary absfs.Filer // Primary filesystem to read from
 	cache   absfs.Filer // Secondary filesystem for caching
+
+	cacheMu  sync.RWMutex // Held for reading while the cache is in use
+	cacheGen uint64       // Incremented each time the cache is replaced
+
+	mode         Mode              // How writes are handled
+	index        *index            // State of cached entries
+	checksums    bool              // Record content checksums for cached entries
+	preservePerm bool              // Give cached copies the primary's permissions
+	preserveTime bool              // Give cached copies the primary's access and modification times
+	preserveOwn  bool              // Give cached copies the primary's owner and group
+	fillOnOpen   bool              // Copy files opened for writing into the cache first
+	verifyOnRead bool              // Check content checksums on every cache hit
+	verifyFlush  bool              // Check the primary's copy after each write-back flush
+	statCache    *statCache        // Recent primary Stat results (may be nil)
+	dirCache     *dirCache         // Recent primary ReadDir results (may be nil)
+	metadataOnly bool              // Never cache file contents (see WithMetadataOnly)
+	blocks       *blockIndex       // Cached blocks in block mode (may be nil)
+	memory       *memCache         // Small cached copies held in memory (may be nil)
+	flight       flightGroup       // Cache fills in progress, keyed by clean path
+	flushes      flightGroup       // Write-back flushes in progress, keyed by clean path
+	writes       *writeQueue       // Background cache writes (may be nil)
+	cacheFirst   bool              // Serve complete cached copies without the primary
+	minCacheSize int64             // Smallest file size cached
+	maxCacheSize int64             // Largest file size cached, if positive
+	readAhead    int64             // Bytes prefetched for sequential reads
+	handles      handleGate        // Open cache fill and block file handles
+	defaultTTL   time.Duration     // Lifetime of cached copies, if positive
+	ttls         ttlRules          // Per-path TTL overrides (see SetTTL)
+	onCacheError func(*CacheError) // Receives failed best-effort cache operations (may be nil)
+	strictCache  bool              // Return cache errors alongside primary results
+	decisions    DecisionLogger    // Receives cache decisions (may be nil)
+	access       *accessCounter    // Reads of paths not yet promoted (may be nil)
+	namespace    string            // Cache directory the FileSystem is confined to
+	dedup        bool              // Store cached content once per distinct content
+	sparse       bool              // Leave blocks of zeros in fills as holes
+	dirMode      os.FileMode       // Permissions of cache directories corfs creates, if not zero
+	maxBytes     int64             // Total size of cached copies kept, if positive (see WithEviction)
+	maxEntries   int               // Number of cached copies kept, if positive (see WithMaxEntries)
+	eviction     EvictionPolicy    // Order in which copies are removed past maxBytes or maxEntries
+	admission    Admission         // Decides which files are worth caching (may be nil)
+	health       *healthState      // Availability of the primary (may be nil)
+	timeout      time.Duration     // Wait for the primary before serving the cache, if positive
+	offline      bool              // Serve and write the cache alone (see WithOffline)
+	readOnly     bool              // Refuse changes to the primary (see WithReadOnlyPrimary)
+	cacheOff     atomic.Bool       // Bypass the cache (see DisableCache)
+	requestLimit Limiter           // Throttles primary read calls (may be nil)
+	byteLimit    Limiter           // Throttles bytes read from the primary (may be nil)
+	retry        *retrier          // Retries transient primary errors (may be nil)
+	retryWrites  bool              // Retry primary writes as well as reads
+	stats        counters          // Activity counters reported by Stats
+	paths        pathLocks         // Orders write-back writes against cache reads
+	clock        Clock             // Source of the current time (see WithClock)
+	idleFlush    *idleFlusher      // Flushes dirty files in the background (may be nil)
+
+	keyFunc func(string) string // Maps clean paths to cache keys (see WithKeyFunc)
 }
 
 // New creates a new CorFS that reads from primary and caches to cache.
-func New(primary, cache absfs.Filer) *FileSystem {
-	return &FileSystem{
+// Options are applied in order.
+func New(primary, cache absfs.Filer, opts ...Option) *FileSystem {
+	fs := &FileSystem{
 		primary: primary,
 		cache:   cache,
+		index:   newIndex(),
+		clock:   systemClock{},
+	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	if fs.offline {
+		fs.goOffline()
+	}
+	fs.setClock()
+	fs.index.key = fs.key
+	if fs.blocks != nil {
+		fs.blocks.key = fs.key
 	}
+	fs.cache = fs.wrapCache(cache)
+	fs.idleFlush.start(fs)
+	return fs
+}
+
+// Primary returns the primary filesystem.
+func (fs *FileSystem) Primary() absfs.Filer {
+	return fs.primary
+}
+
+// Cache returns the current cache filesystem. With WithNamespace, it is the
+// whole shared filer rather than the namespace within it, and with
+// WithDedup it holds blobs rather than cached paths.
+func (fs *FileSystem) Cache() absfs.Filer {
+	fs.cacheMu.RLock()
+	defer fs.cacheMu.RUnlock()
+	return unwrapCache(fs.cache)
+}
+
+// unwrapCache returns the filer cache, as the FileSystem uses it, wraps
+// (see wrapCache).
+func unwrapCache(cache absfs.Filer) absfs.Filer {
+	for {
+		switch c := cache.(type) {
+		case *blobFiler:
+			cache = c.Filer
+		case *namespaceFiler:
+			cache = c.Filer
+		case *keyFiler:
+			cache = c.Filer
+		default:
+			return cache
+		}
+	}
+}
+
+// wrapCache returns cache as the FileSystem uses it: confined to its
+// namespace, storing content by hash and keeping copies under their keys,
+// if configured.
+func (fs *FileSystem) wrapCache(cache absfs.Filer) absfs.Filer {
+	cache = fs.namespaced(cache)
+	if fs.dedup {
+		cache = newBlobFiler(cache)
+	}
+	if fs.keyFunc != nil {
+		cache = &keyFiler{Filer: cache, key: fs.key}
+	}
+	return cache
+}
+
+// SetCache replaces the cache filesystem. It waits for in-flight cache
+// operations to finish before swapping, and later operations use the new
+// cache.
+//
+// Files opened before the swap keep reading and writing the primary, but
+// their cache side is dropped on their next operation: partial cache fills
+// are discarded from the old cache, write handles stop mirroring and remove
+// their path from the new cache so it can't serve stale content, and
+// neither the old nor the new cache receives further writes through them.
+//
+// In WriteBack mode, dirty files that have not been flushed are forgotten;
+// call Sync before replacing the cache to keep them.
+//
+// With WithNamespace, the FileSystem uses the same namespace in the new
+// cache.
+func (fs *FileSystem) SetCache(cache absfs.Filer) {
+	fs.cacheMu.Lock()
+	defer fs.cacheMu.Unlock()
+	fs.replaceCache(cache)
+}
+
+// SwapCache replaces the cache filesystem and its index at once, such as
+// to cut over to a cache filled offline: index, from Index or ReadIndex,
+// describes the copies in cache, which are trusted from the moment of the
+// swap without being fetched again. Its entries are taken as ImportIndex
+// takes them, and a nil index leaves the new cache to be filled afresh, as
+// with SetCache. SwapCache first waits for background cache writes (see
+// WithAsyncCacheWrites) and for in-flight cache operations to finish, and
+// no operation sees the new cache with the old index or the other way
+// round.
+//
+// Files opened before the swap are treated as described for SetCache, and
+// so are dirty files in WriteBack mode. If closeOld is set and the old
+// cache filer, as returned by Cache, has a Close method, it is closed once
+// nothing uses it, and its error is returned.
+func (fs *FileSystem) SwapCache(cache absfs.Filer, index *Index, closeOld bool) error {
+	if fs.writes != nil {
+		fs.writes.wait()
+	}
+	fs.cacheMu.Lock()
+	old := unwrapCache(fs.cache)
+	fs.replaceCache(cache)
+	if index != nil {
+		fs.loadIndex(fs.cache, index.snapshot)
+	}
+	fs.cacheMu.Unlock()
+
+	if closer, ok := old.(io.Closer); ok && closeOld {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ClearCache empties the cache, such as between tests or to start afresh
+// after changes made behind the FileSystem's back. It first waits for
+// background cache writes (see WithAsyncCacheWrites) and for in-flight
+// cache operations to finish, then removes everything the cache holds
+// (with WithNamespace, only the namespace's content), forgets the index,
+// the Stat and ReadDir caches and the WithPromoteAfter counts, and resets
+// the counters reported by Stats. Later reads fill the cache from the
+// primary again, which ClearCache leaves alone.
+//
+// Files opened before ClearCache are treated as described for SetCache,
+// and so are dirty files in WriteBack mode: call Sync first to keep their
+// writes. The in-memory state is cleared even if removing some cached
+// files fails, so they are never served; the errors are returned joined.
+func (fs *FileSystem) ClearCache() error {
+	fs.WaitForCacheFlush()
+	fs.cacheMu.Lock()
+	defer fs.cacheMu.Unlock()
+
+	var errs []error
+	entries, err := fs.cache.ReadDir("/")
+	if !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != "." && name != ".." {
+			errs = append(errs, removeTree(fs.cache, path.Join("/", name)))
+		}
+	}
+	if b, _, ok := blobsOf(fs.cache); ok {
+		_, err = b.pruneBlobs()
+		errs = append(errs, err)
+	}
+
+	fs.forgetCache()
+	fs.invalidateMetaTree("/")
+	fs.stats.reset()
+	fs.handles.resetCounts()
+	return errors.Join(errs...)
+}
+
+// replaceCache makes cache the cache filesystem, with nothing known about
+// its content. The caller must hold cacheMu for writing.
+func (fs *FileSystem) replaceCache(cache absfs.Filer) {
+	fs.cache = fs.wrapCache(cache)
+	fs.forgetCache()
+}
+
+// forgetCache drops everything known about the content of the cache, and
+// the cache side of files opened before. The caller must hold cacheMu for
+// writing.
+func (fs *FileSystem) forgetCache() {
+	fs.cacheGen++
+	fs.index.reset()
+	fs.blocks.reset()
+	fs.access.reset()
+	fs.memory.reset()
+}
+
+// acquireCache returns the cache filesystem and holds it until releaseCache
+// is called, so SetCache waits for the operation in between to finish.
+func (fs *FileSystem) acquireCache() absfs.Filer {
+	fs.cacheMu.RLock()
+	return fs.cache
+}
+
+// releaseCache releases the cache acquired by acquireCache.
+func (fs *FileSystem) releaseCache() {
+	fs.cacheMu.RUnlock()
 }
 
 // OpenFile opens a file from the primary filesystem and caches it to the cache
-// filesystem on successful read operations.
+// filesystem on successful read operations. With WithCacheFirst, a handle
+// opened for reading is served from a complete, unexpired cached copy
+// without opening the primary.
+//
+// Only one handle fills the cache for a path at a time; handles opened
+// while another is filling read the primary without caching. A read-only
+// open that arrives during a ReadFile of the same path waits for it and is
+// then served from the cache. A cached copy is only ever served if its size
+// matches the size recorded for the file, so a truncated copy is never
+// mistaken for the whole file.
+//
+// How handles opened for writing treat the cache depends on the Mode. In
+// WriteThrough mode their writes are mirrored into the cached copy, which
+// is not trusted while the handle is open. It is trusted again on Close if
+// every write was mirrored and no other write handle overlapped, and is
+// discarded as soon as a write can't be mirrored. A file the cache doesn't
+// hold in full is only mirrored if it is empty or truncated, or with
+// WithFillOnOpen.
+//
+// A handle opened with os.O_RDWR in WriteThrough mode serves its reads from
+// the copy it mirrors into, for as long as it has one and no other write
+// handle has overlapped it, so a read-modify-write loop leaves the primary
+// to the writes. Since every write the handle made is in that copy, a read
+// sees exactly what reading the primary would, including the handle's own
+// writes, and Read moves the primary's offset as if it had read it. Once
+// the mirror is discarded or another write handle opens, reads go to the
+// primary.
+//
+// In WriteBack mode their writes go to the cached copy alone, and reads of
+// the path, through handles opened for reading or ReadFile, are served
+// from that copy from the moment a write handle is open, so readers see the
+// writer's content rather than a mix of it and the primary's. Each read
+// sees every write that returned before the read started and no part of a
+// write still in progress. Handles opened for reading before the write
+// handle keep reading the primary, whose copy doesn't change until the
+// file is flushed.
 func (fs *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	// Try to open from primary first
-	primaryFile, primaryErr := fs.primary.OpenFile(name, flag, perm)
+	return fs.OpenFileContext(context.Background(), name, flag, perm)
+}
+
+// CachedReader opens name for reading, serving it from a complete,
+// unexpired cached copy without opening the primary, as WithCacheFirst
+// does, whether or not the option is set. Otherwise the reader streams the
+// primary and fills the cache as it is read, exactly as a handle opened by
+// OpenFile with os.O_RDONLY. Close releases whichever handles it holds,
+// and must be called even if the reader isn't read to the end.
+func (fs *FileSystem) CachedReader(name string) (io.ReadCloser, error) {
+	return fs.OpenFile(name, os.O_RDONLY|oCacheFirst, 0)
+}
+
+// OpenFileContext is like OpenFile, but waits for the read limiters (see
+// WithRequestLimiter and WithByteLimiter) under ctx, both when opening a
+// file for reading and for every read from the primary through the
+// returned handle. If the limiters don't allow the open before ctx is done,
+// a cached copy is returned if there is one.
+func (fs *FileSystem) OpenFileContext(ctx context.Context, name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return fs.openFile(ctx, cleanPath(name), flag, perm, fs.bypass())
+}
+
+// openFile implements OpenFileContext, as if O_NOCACHE were given if off.
+func (fs *FileSystem) openFile(ctx context.Context, name string, flag int, perm os.FileMode, off bool) (absfs.File, error) {
+	noCache := flag&O_NOCACHE != 0 || off || fs.metadataOnly
+	cacheFirst := fs.cacheFirst || flag&oCacheFirst != 0
+	flag &^= O_NOCACHE | oCacheFirst
+	writing := flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR) != 0
+	if writing {
+		if err := fs.readOnlyError("open", name); err != nil {
+			return nil, err
+		}
+	}
+	if writing && fs.mode == WriteBack && (!off && !fs.metadataOnly || fs.dirty(name)) {
+		return fs.openWriteBack(name, flag, perm)
+	}
+	if !writing {
+		if fs.dirty(name) {
+			return fs.openCached(name, flag, perm)
+		}
+		if fs.writingBack(name) {
+			if f, err := fs.openCached(name, flag, perm); err == nil {
+				return f, nil
+			}
+		}
+		if noCache {
+			return fs.openUncached(ctx, name, flag, perm)
+		}
+		if !fs.health.up() {
+			f, err := fs.openCached(name, flag, perm)
+			if err != nil {
+				return nil, primaryDown("open", name)
+			}
+			return f, nil
+		}
+		if cacheFirst && fs.fresh(name) {
+			if f, err := fs.openCached(name, flag, perm); err == nil {
+				return f, nil
+			}
+		}
+		if call, ok := fs.flight.lookup(path.Clean(name)); ok && call.wait() {
+			cache := fs.acquireCache()
+			cacheFile, err := fs.openVerified(cache, name, flag, perm)
+			if err == nil {
+				fs.hit(name)
+				f := fs.cachedFile(cacheFile, name)
+				fs.releaseCache()
+				return f, nil
+			}
+			fs.releaseCache()
+		}
+	}
+
+	// Try to open from primary first; only reads are throttled
+	var primaryFile absfs.File
+	var primaryErr error
+	generation := fs.index.currentGeneration()
+	if !writing {
+		primaryErr = fs.waitRequest(ctx)
+	}
+	if primaryErr == nil && writing {
+		primaryErr = fs.retryWrite(ctx, func() (err error) {
+			primaryFile, err = openFile(fs.primary, name, flag, perm)
+			return err
+		})
+		fs.health.observe(primaryErr)
+	} else if primaryErr == nil {
+		var cacheFile absfs.File
+		primaryFile, cacheFile, primaryErr = fs.openPrimary(ctx, name, flag, perm)
+		if cacheFile != nil {
+			return cacheFile, nil
+		}
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
 
 	// If we're creating or writing, try both filesystems
-	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR) != 0 {
+	if writing {
+		fs.invalidateMeta(name)
 		if primaryErr != nil {
 			return primaryFile, primaryErr
 		}
-		// Try to open/create in cache as well for write operations
-		cacheFile, _ := fs.cache.OpenFile(name, flag, perm)
+		fs.blocks.drop(cache, name)
+		if fs.fillOnOpen && flag&(os.O_TRUNC|os.O_EXCL) == 0 && fs.mode != WriteAround && !noCache && !fs.uncacheable(name) {
+			fs.fillForWrite(ctx, cache, name)
+		}
+		e, _ := fs.index.get(name)
+		fs.index.remove(name)
+		fs.index.openWriter(name)
+		var cacheFile absfs.File
+		switch {
+		case fs.mode == WriteAround || noCache:
+			cache.Remove(name) // Cached again on the next read
+		case fs.uncacheable(name):
+			fs.decide(DecisionSkipExcluded, name, nil)
+			cache.Remove(name)
+		default:
+			cacheFile = fs.openMirror(cache, name, flag, perm, primaryFile, e.complete)
+		}
 		return &File{
 			primary: primaryFile,
 			cache:   cacheFile,
 			name:    name,
 			fs:      fs,
+			cached:  true, // Reads through write handles never start a fill
+			gen:     fs.cacheGen,
+			ctx:     ctx,
+			writer:  true,
+			appends: flag&os.O_APPEND != 0,
+			rdwr:    flag&os.O_RDWR != 0,
 		}, nil
 	}
 
 	// For read operations, return wrapped file
 	if primaryErr != nil {
 		// Try cache as fallback
-		cacheFile, cacheErr := fs.cache.OpenFile(name, flag, perm)
+		cacheFile, cacheErr := fs.openVerified(cache, name, flag, perm)
 		if cacheErr != nil {
 			return nil, primaryErr // Return original error
 		}
-		return cacheFile, nil
+		fs.hit(name)
+		return fs.cachedFile(cacheFile, name), nil
 	}
 
+	promoted := fs.promote(name)
+	return &File{
+		primary:    primaryFile,
+		cache:      nil,
+		name:       name,
+		fs:         fs,
+		cached:     !promoted, // Read straight through until promoted
+		gen:        fs.cacheGen,
+		ctx:        ctx,
+		blockMode:  fs.blocks != nil && promoted,
+		generation: generation,
+	}, nil
+}
+
+// openUncached opens name for reading from the primary alone (see
+// O_NOCACHE).
+func (fs *FileSystem) openUncached(ctx context.Context, name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if err := fs.waitRequest(ctx); err != nil {
+		return nil, err
+	}
+	primaryFile, err := fs.openPrimaryFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.miss(name)
 	return &File{
 		primary: primaryFile,
-		cache:   nil,
 		name:    name,
 		fs:      fs,
+		cached:  true, // Never fills the cache
+		gen:     fs.cacheGen,
+		ctx:     ctx,
 	}, nil
 }
 
-// Mkdir creates a directory in both filesystems.
+// openCached opens the cached copy of name for reading.
+func (fs *FileSystem) openCached(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	cacheFile, err := fs.openVerified(cache, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.hit(name)
+	return fs.cachedFile(cacheFile, name), nil
+}
+
+// cachedFile wraps cacheFile, a handle to the cached copy of name opened
+// for reading, so that it is read like any other File but never written.
+// The caller must hold the cache.
+func (fs *FileSystem) cachedFile(cacheFile absfs.File, name string) *File {
+	return &File{
+		cache:  cacheFile,
+		name:   name,
+		fs:     fs,
+		cached: true,
+		gen:    fs.cacheGen,
+	}
+}
+
+// fresh reports whether the cache holds a complete copy of name that has
+// not expired.
+func (fs *FileSystem) fresh(name string) bool {
+	e, ok := fs.index.get(name)
+	return ok && e.complete && !fs.expired(name, e)
+}
+
+// Mkdir creates a directory in the primary and mirrors it into the cache
+// along with any parents the cache lacks, so that files beneath it can be
+// cached, replacing stale files the cache holds in their place. The cache
+// is left alone if the primary fails for any reason other than the
+// directory existing.
 func (fs *FileSystem) Mkdir(name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if err := fs.readOnlyError("mkdir", name); err != nil {
+		return err
+	}
 	err := fs.primary.Mkdir(name, perm)
-	fs.cache.Mkdir(name, perm) // Best effort for cache
-	return err
+	fs.invalidateMeta(name)
+	if off {
+		return err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	if fs.offline {
+		return cache.Mkdir(name, perm)
+	}
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	fs.mkdirCache(cache, path.Dir(name))
+	fs.dropConflict(cache, name, true)
+	return fs.cacheResult(err, "mkdir", name, mkdirAll(cache, name, perm))
 }
 
-// Remove removes a file from both filesystems.
+// MkdirAll creates a directory along with any missing parents in the
+// primary, like os.MkdirAll, and mirrors the whole chain into the cache as
+// Mkdir does.
+func (fs *FileSystem) MkdirAll(name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if err := fs.readOnlyError("mkdir", name); err != nil {
+		return err
+	}
+	err := mkdirAll(fs.primary, name, perm)
+	fs.invalidateMeta(name)
+	if off {
+		return err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	if err != nil && !fs.offline {
+		return err
+	}
+	if !fs.offline {
+		fs.dropConflict(cache, name, true)
+	}
+	return fs.cacheResult(err, "mkdir", name, mkdirAll(cache, name, perm))
+}
+
+// Remove removes a file from both filesystems. A file that exists only in
+// the cache, such as one written in WriteBack mode and not yet flushed, is
+// removed without error.
 func (fs *FileSystem) Remove(name string) error {
+	name = cleanPath(name)
+	fs.bypass() // Counted, though the cache is kept up to date regardless
+	if err := fs.readOnlyError("remove", name); err != nil {
+		return err
+	}
 	err := fs.primary.Remove(name)
-	fs.cache.Remove(name) // Best effort for cache
-	return err
+	fs.invalidateMeta(name)
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.blocks.drop(cache, name)
+	fs.blocks.dropTree(name)
+	fs.index.removeTree(name)
+	return fs.bothResult(err, cache.Remove(name))
 }
 
-// Rename renames a file in both filesystems.
+// Rename renames a file in both filesystems. A file that exists only in the
+// cache, such as one written in WriteBack mode and not yet flushed, is
+// renamed without error.
 func (fs *FileSystem) Rename(oldpath, newpath string) error {
+	oldpath, newpath = cleanPath(oldpath), cleanPath(newpath)
+	fs.bypass() // Counted, though the cache is kept up to date regardless
+	if err := fs.readOnlyLinkError("rename", oldpath, newpath); err != nil {
+		return err
+	}
 	err := fs.primary.Rename(oldpath, newpath)
-	fs.cache.Rename(oldpath, newpath) // Best effort for cache
-	return err
+	fs.invalidateMetaTree(oldpath)
+	fs.invalidateMetaTree(newpath)
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.blocks.drop(cache, oldpath)
+	fs.blocks.drop(cache, newpath)
+	fs.blocks.dropTree(oldpath)
+	fs.blocks.dropTree(newpath)
+	cerr := cache.Rename(oldpath, newpath)
+	if cerr == nil {
+		fs.index.rename(oldpath, newpath)
+	} else {
+		fs.index.removeTree(oldpath)
+		fs.index.removeTree(newpath)
+	}
+	return fs.bothResult(err, cerr)
 }
 
-// Stat returns file info from the primary filesystem.
+// Stat returns file info from the primary filesystem. When the Stat cache
+// is enabled, recent primary results are served without consulting the
+// primary. Unrooted names, as passed by io/fs consumers, are resolved
+// against the root.
+//
+// When the primary is down or its Stat fails, Stat falls back to the cache.
+// For a complete cached copy, the size, mode and modification time are then
+// the primary's as recorded when the copy was fetched, and Sys returns nil;
+// the cache file's own are used for any the index doesn't have, such as for
+// copies written through a File, and for everything else the cache holds.
 func (fs *FileSystem) Stat(name string) (os.FileInfo, error) {
+	return fs.stat(rooted(name), fs.bypass())
+}
+
+// stat implements Stat, without falling back to the cache if off.
+func (fs *FileSystem) stat(name string, off bool) (os.FileInfo, error) {
+	if fs.dirty(name) {
+		cache := fs.acquireCache()
+		defer fs.releaseCache()
+		return cache.Stat(name)
+	}
+	if off {
+		info, err := fs.primary.Stat(name)
+		fs.health.observe(err)
+		return info, err
+	}
+	if info, ok := fs.statCache.get(name); ok {
+		return info, nil
+	}
+	if !fs.health.up() {
+		cache := fs.acquireCache()
+		defer fs.releaseCache()
+		info, err := cache.Stat(name)
+		if err != nil {
+			return nil, primaryDown("stat", name)
+		}
+		return fs.fallbackInfo(name, info), nil
+	}
+
 	info, err := fs.primary.Stat(name)
+	fs.health.observe(err)
 	if err != nil {
 		// Try cache as fallback
-		return fs.cache.Stat(name)
+		cache := fs.acquireCache()
+		defer fs.releaseCache()
+		info, cacheErr := cache.Stat(name)
+		if cacheErr != nil {
+			return nil, err // Return original error
+		}
+		return fs.fallbackInfo(name, info), nil
 	}
+	fs.statCache.put(name, info)
 	return info, nil
 }
 
-// Chmod changes the mode in both filesystems.
+// indexedInfo is the FileInfo of a cached copy carrying the primary's
+// metadata recorded in the index.
+type indexedInfo struct {
+	os.FileInfo
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i indexedInfo) Size() int64        { return i.size }
+func (i indexedInfo) Mode() os.FileMode  { return i.mode }
+func (i indexedInfo) ModTime() time.Time { return i.modTime }
+func (i indexedInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i indexedInfo) Sys() any           { return nil }
+
+// fallbackInfo returns info, the cache's FileInfo for name, with the
+// primary's size, mode and modification time where the index records them
+// for a complete copy.
+func (fs *FileSystem) fallbackInfo(name string, info os.FileInfo) os.FileInfo {
+	e, ok := fs.index.get(name)
+	if !ok || !e.complete || e.dirty || !info.Mode().IsRegular() {
+		return info
+	}
+	i := indexedInfo{FileInfo: info, size: e.size, mode: info.Mode(), modTime: info.ModTime()}
+	if e.mode != 0 {
+		i.mode = e.mode
+	}
+	if !e.modTime.IsZero() {
+		i.modTime = e.modTime
+	}
+	return i
+}
+
+// Exists reports whether name exists, looking it up the same way as Stat.
+// A missing file is reported as false with a nil error; any other failure
+// is returned as an error. Exists never caches file content.
+func (fs *FileSystem) Exists(name string) (bool, error) {
+	_, err := fs.Stat(name)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// IsDir reports whether name exists and is a directory, looking it up the
+// same way as Stat. A missing file is reported as false with a nil error.
+func (fs *FileSystem) IsDir(name string) (bool, error) {
+	info, err := fs.Stat(name)
+	if err == nil {
+		return info.IsDir(), nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Chmod changes the mode in both filesystems. A file only the cache holds,
+// such as one written in WriteBack mode and not yet flushed, is changed
+// there alone, and Chmod fails only if neither filesystem could change it.
 func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if err := fs.readOnlyError("chmod", name); err != nil {
+		return err
+	}
 	err := fs.primary.Chmod(name, mode)
-	fs.cache.Chmod(name, mode) // Best effort for cache
-	return err
+	fs.invalidateMeta(name)
+	if off && !fs.dirty(name) {
+		return err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	return fs.metaResult(err, "chmod", name, cache.Chmod(name, mode))
 }
 
 // Chtimes changes the access and modification times in both filesystems.
+// A file only the cache holds is changed there alone, as with Chmod.
 func (fs *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if err := fs.readOnlyError("chtimes", name); err != nil {
+		return err
+	}
 	err := fs.primary.Chtimes(name, atime, mtime)
-	fs.cache.Chtimes(name, atime, mtime) // Best effort for cache
-	return err
+	fs.invalidateMeta(name)
+	if off && !fs.dirty(name) {
+		return err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	return fs.metaResult(err, "chtimes", name, cache.Chtimes(name, atime, mtime))
 }
 
-// Chown changes the owner and group in both filesystems.
+// Chown changes the owner and group in both filesystems. A file only the
+// cache holds is changed there alone, as with Chmod.
 func (fs *FileSystem) Chown(name string, uid, gid int) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if err := fs.readOnlyError("chown", name); err != nil {
+		return err
+	}
 	err := fs.primary.Chown(name, uid, gid)
-	fs.cache.Chown(name, uid, gid) // Best effort for cache
-	return err
+	fs.invalidateMeta(name)
+	if off && !fs.dirty(name) {
+		return err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	return fs.metaResult(err, "chown", name, cache.Chown(name, uid, gid))
 }
 
-// Truncate truncates a file to the specified size in both filesystems.
+// Truncate changes the size of the named file, matching os.Truncate: the
+// file must already exist in the primary and is extended with zeros or cut
+// short to size. A complete cached copy is truncated to match; any other
+// cached copy is discarded so it can't be served stale. In WriteBack mode
+// only the cached copy is truncated and marked dirty.
 func (fs *FileSystem) Truncate(name string, size int64) error {
-	// Open file for writing (but don't truncate with O_TRUNC)
-	f, err := fs.OpenFile(name, os.O_WRONLY, 0666)
-	if err != nil {
+	name = cleanPath(name)
+	fs.bypass() // Counted, though the cache is kept up to date regardless
+	if err := fs.readOnlyError("truncate", name); err != nil {
+		return err
+	}
+	if fs.mode == WriteBack {
+		f, err := fs.openWriteBack(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(size)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
 		return err
 	}
-	defer f.Close()
 
-	// Truncate to the specified size
-	return f.Truncate(size)
-}
+	if err := truncate(fs.primary, name, size); err != nil {
+		return err
+	}
+	fs.invalidateMeta(name)
 
-// RemoveAll removes a path and any children it contains in both filesystems.
-func (fs *FileSystem) RemoveAll(path string) error {
-	// Remove from primary first
-	var err error
-	if remover, ok := fs.primary.(interface{ RemoveAll(string) error }); ok {
-		err = remover.RemoveAll(path)
-	} else {
-		err = removeAll(fs.primary, path)
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.blocks.drop(cache, name)
+	if e, ok := fs.index.get(name); ok && e.complete && fs.mode != WriteAround && truncate(cache, name, size) == nil {
+		// The old checksum no longer applies
+		fs.index.complete(name, size, "", fs.index.currentGeneration(), time.Time{}, 0)
+		fs.evict(cache, name)
+		return nil
 	}
+	fs.index.remove(name)
+	return fs.cacheResult(nil, "remove", name, cache.Remove(name))
+}
 
-	// Best effort removal from cache
-	if remover, ok := fs.cache.(interface{ RemoveAll(string) error }); ok {
-		remover.RemoveAll(path)
-	} else {
-		removeAll(fs.cache, path)
+// RemoveAll removes a path and any children it contains in both
+// filesystems. Like os.RemoveAll, it returns nil if the path doesn't exist
+// in either, and paths that exist only in the cache are removed without
+// error. On a filer without a RemoveAll of its own, a directory that
+// contains itself stops the removal with ErrDirCycle.
+func (fs *FileSystem) RemoveAll(path string) error {
+	path = cleanPath(path)
+	fs.bypass() // Counted, though the cache is kept up to date regardless
+	if err := fs.readOnlyError("remove", path); err != nil {
+		return err
 	}
+	// Remove from primary first
+	err := removeTree(fs.primary, path)
+	fs.invalidateMetaTree(path)
 
-	return err
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.blocks.drop(cache, path)
+	fs.blocks.dropTree(path)
+	fs.index.removeTree(path)
+	return fs.bothResult(err, removeTree(cache, path))
 }
 
 // ReadDir reads the named directory and returns a list of directory entries.
+// Files written in WriteBack mode and not yet flushed are listed from the
+// cache, and corfs' own bookkeeping files are never listed. With
+// WithDirCacheTTL, a recent listing of the primary's is used in place of
+// reading it again. Unrooted names are resolved against the root.
 func (fs *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
-	entries, err := fs.primary.ReadDir(name)
+	return fs.readDir(rooted(name), fs.bypass())
+}
+
+// readDir implements ReadDir, without involving the cache if off.
+func (fs *FileSystem) readDir(name string, off bool) ([]fs.DirEntry, error) {
+	if !off && !fs.health.up() {
+		cache := fs.acquireCache()
+		defer fs.releaseCache()
+		cached, err := cache.ReadDir(name)
+		if err != nil {
+			return nil, primaryDown("readdir", name)
+		}
+		return visibleEntries(cached), nil
+	}
+	entries, listed := fs.dirCache.get(name)
+	var err error
+	if off || !listed {
+		entries, err = fs.primary.ReadDir(name)
+		fs.health.observe(err)
+		if err != nil && off {
+			return nil, err
+		}
+		if err == nil && !off {
+			fs.dirCache.put(name, entries)
+		}
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
 	if err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			// The primary has a file; never list a stale directory
+			fs.dropConflict(cache, name, false)
+			return nil, err
+		}
 		// Try cache as fallback
-		return fs.cache.ReadDir(name)
+		cached, cacheErr := cache.ReadDir(name)
+		if cacheErr != nil {
+			return nil, err // Return original error
+		}
+		return visibleEntries(cached), nil
+	}
+	if !fs.index.hasDirty(name) {
+		return entries, nil
+	}
+
+	cached, err := cache.ReadDir(name)
+	if err != nil {
+		return entries, nil
 	}
-	return entries, nil
+	return mergeEntries(entries, visibleEntries(cached), func(base string) bool {
+		return fs.index.hasDirty(path.Join(name, base))
+	}), nil
 }
 
 // ReadFile reads the named file and returns its contents.
+//
+// Concurrent calls for the same uncached path are coalesced: one caller
+// reads the primary and fills the cache while the others wait and then read
+// the freshly cached copy. Files of a megabyte or more are streamed into
+// the cache and read back from it, rather than held in memory while they
+// are cached. Unrooted names are resolved against the root.
 func (fs *FileSystem) ReadFile(name string) ([]byte, error) {
-	data, err := fs.primary.ReadFile(name)
+	return fs.ReadFileContext(context.Background(), name)
+}
+
+// ReadFileContext is like ReadFile, but waits for the read limiters (see
+// WithRequestLimiter and WithByteLimiter) under ctx. If the limiters don't
+// allow the read before ctx is done, the cached copy is returned if there
+// is one. Bytes are charged once read: if ctx ends while waiting for them,
+// the data is still cached but ReadFileContext returns ctx's error.
+func (fs *FileSystem) ReadFileContext(ctx context.Context, name string) ([]byte, error) {
+	name = rooted(name)
+	off := fs.bypass()
+	if fs.dirty(name) {
+		cache := fs.acquireCache()
+		defer fs.releaseCache()
+		return fs.readCached(cache, name)
+	}
+	if fs.writingBack(name) {
+		cache := fs.acquireCache()
+		data, err := fs.readCached(cache, name)
+		fs.releaseCache()
+		if err == nil {
+			return data, nil
+		}
+	}
+	if off || fs.metadataOnly {
+		return fs.readUncached(ctx, name)
+	}
+	if !fs.health.up() {
+		cache := fs.acquireCache()
+		defer fs.releaseCache()
+		data, err := fs.readCached(cache, name)
+		if err != nil {
+			return nil, primaryDown("read", name)
+		}
+		return data, nil
+	}
+	if fs.cacheFirst && fs.fresh(name) {
+		cache := fs.acquireCache()
+		data, err := fs.readCached(cache, name)
+		fs.releaseCache()
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	if !fs.promote(name) {
+		return fs.readFile(ctx, name, nil)
+	}
+
+	key := path.Clean(name)
+	call, leader := fs.flight.begin(key, true)
+	if !leader {
+		if call.wait() {
+			cache := fs.acquireCache()
+			data, err := fs.readCached(cache, name)
+			fs.releaseCache()
+			if err == nil {
+				return data, nil
+			}
+		}
+		// The fill failed or can't be waited on; read without caching
+		return fs.readFile(ctx, name, nil)
+	}
+	return fs.readFile(ctx, name, call)
+}
+
+// streamSize is the size from which ReadFile streams a file into the cache
+// and reads it back instead of holding it in memory while caching it.
+const streamSize = 1 << 20
+
+// readFile reads name from the primary, falling back to the cache. Given a
+// call, it stores the data in the cache and ends the call with the outcome.
+// A file the primary reports outside the size limits is streamed through
+// instead: the call ends before the read, so readers waiting on it read
+// for themselves rather than wait for a fill that won't happen.
+func (fs *FileSystem) readFile(ctx context.Context, name string, call *flight) ([]byte, error) {
+	var info os.FileInfo
+	if call != nil {
+		info = fs.primaryInfo(name)
+		if info != nil && info.IsDir() {
+			// Directories are never cached as files
+			fs.flight.end(path.Clean(name), call, errFillAborted)
+			call = nil
+		} else if info != nil && info.Mode().IsRegular() && !fs.cacheable(info.Size()) {
+			fs.decide(DecisionSkipSize, name, nil)
+			fs.flight.end(path.Clean(name), call, errFillAborted)
+			call = nil
+		} else if fs.streamable(info) {
+			return fs.readFileStreamed(ctx, name, call)
+		}
+	}
+
+	var data []byte
+	generation := fs.index.currentGeneration()
+	err := fs.waitRequest(ctx)
+	if err == nil {
+		var cached bool
+		data, cached, err = fs.readPrimaryFile(ctx, name)
+		if cached {
+			if call != nil {
+				fs.flight.end(path.Clean(name), call, nil)
+			}
+			return data, nil
+		}
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
 	if err != nil {
+		if call != nil {
+			fs.flight.end(path.Clean(name), call, err)
+		}
+		if errors.Is(err, syscall.EISDIR) {
+			// The primary has a directory; never serve a stale file
+			fs.dropConflict(cache, name, true)
+			return nil, err
+		}
 		// Try cache as fallback
-		return fs.cache.ReadFile(name)
+		cached, cacheErr := fs.readCached(cache, name)
+		if cacheErr != nil {
+			return nil, err // Return original error
+		}
+		return cached, nil
 	}
 
-	// On successful read, cache the data
-	if err == nil && len(data) > 0 {
-		// Best effort cache write
-		fs.cache.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		if cacheFile, cacheErr := fs.cache.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); cacheErr == nil {
-			cacheFile.Write(data)
-			cacheFile.Close()
+	if call != nil {
+		if !fs.cacheable(int64(len(data))) {
+			fs.decide(DecisionSkipSize, name, nil)
+			fs.flight.end(path.Clean(name), call, errFillAborted)
+		} else {
+			// On successful read, cache the data; best effort
+			if err := fs.writeCacheFile(cache, name, data, generation, call, info); err == ErrCacheFull {
+				return nil, &os.PathError{Op: "read", Path: name, Err: err}
+			}
 		}
 	}
+	if err := fs.waitBytes(ctx, len(data)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// primaryInfo returns the primary's FileInfo for name, from the Stat cache
+// if it holds it, or nil if Stat fails.
+func (fs *FileSystem) primaryInfo(name string) os.FileInfo {
+	if info, ok := fs.statCache.get(name); ok {
+		return info
+	}
+	info, err := fs.primary.Stat(name)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// streamable reports whether info, from the primary, describes a cacheable
+// file of at least streamSize bytes.
+func (fs *FileSystem) streamable(info os.FileInfo) bool {
+	return info != nil && info.Mode().IsRegular() && info.Size() >= streamSize && fs.cacheable(info.Size())
+}
 
+// readFileStreamed streams name from the primary into the cache and reads
+// the data back from the fresh copy, then ends call with the outcome of the
+// fill. If either step fails, name is read as usual without caching.
+func (fs *FileSystem) readFileStreamed(ctx context.Context, name string, call *flight) ([]byte, error) {
+	cache := fs.acquireCache()
+	_, err := fs.copyToCache(ctx, cache, name, call, true, false)
+	fs.flight.end(path.Clean(name), call, err)
+	var data []byte
+	if err == nil {
+		data, err = cache.ReadFile(name)
+		if e, ok := fs.index.get(name); err == nil && (!ok || e.size != int64(len(data))) {
+			err = errSizeMismatch // Replaced in the meantime
+		}
+	}
+	fs.releaseCache()
+	if err == ErrCacheFull {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	if err != nil {
+		return fs.readFile(ctx, name, nil)
+	}
 	return data, nil
 }
 
@@ -197,7 +1136,7 @@ type subCorFS struct {
 }
 
 func (s *subCorFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	primaryFile, primaryErr := s.primary.OpenFile(name, flag, perm)
+	primaryFile, primaryErr := openFile(s.primary, name, flag, perm)
 
 	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR) != 0 {
 		if primaryErr != nil {
@@ -205,7 +1144,7 @@ func (s *subCorFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File
 		}
 		var cacheFile absfs.File
 		if s.cache != nil {
-			cacheFile, _ = s.cache.OpenFile(name, flag, perm)
+			cacheFile, _ = openFile(s.cache, name, flag, perm)
 		}
 		return &File{
 			primary: primaryFile,
@@ -217,11 +1156,11 @@ func (s *subCorFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File
 
 	if primaryErr != nil {
 		if s.cache != nil {
-			cacheFile, cacheErr := s.cache.OpenFile(name, flag, perm)
+			cacheFile, cacheErr := openFile(s.cache, name, flag, perm)
 			if cacheErr != nil {
 				return nil, primaryErr
 			}
-			return cacheFile, nil
+			return &File{cache: cacheFile, name: name, cached: true}, nil
 		}
 		return nil, primaryErr
 	}
@@ -310,10 +1249,239 @@ func (s *subCorFS) Sub(dir string) (fs.FS, error) {
 	return absfs.FilerToFS(s, dir)
 }
 
-// removeAll is a helper that recursively removes a path.
-func removeAll(filer absfs.Filer, path string) error {
+// cleanPath returns the shortest form of name, so that spellings of the
+// same path such as /a//b/../c and /a/c/ share one cache entry. Empty names
+// are left for the filers to reject.
+func cleanPath(name string) string {
+	if name == "" {
+		return name
+	}
+	return path.Clean(name)
+}
+
+// bothResult combines the errors of an operation applied to the primary and
+// then the cache. The operation succeeds if the primary succeeded, or if the
+// path was missing from the primary and the cache succeeded. The primary's
+// error stands alone when the cache succeeded or had nothing to act on;
+// otherwise both errors are returned joined. Offline, the cache's result is
+// the operation's.
+func (fs *FileSystem) bothResult(primaryErr, cacheErr error) error {
+	switch {
+	case fs.offline:
+		return cacheErr
+	case primaryErr == nil:
+		return nil
+	case cacheErr == nil:
+		if errors.Is(primaryErr, os.ErrNotExist) {
+			return nil
+		}
+		return primaryErr
+	case errors.Is(cacheErr, os.ErrNotExist):
+		return primaryErr
+	}
+	return errors.Join(primaryErr, cacheErr)
+}
+
+// metaResult combines the errors of a metadata change, such as Chmod,
+// applied to the primary and then the cache. A file the primary doesn't
+// hold, such as one written in WriteBack mode and not yet flushed, is
+// changed if the cache's copy is, as with bothResult. Otherwise the
+// primary's result is the operation's, and the cache's failure is handled
+// as by cacheResult.
+func (fs *FileSystem) metaResult(err error, op, name string, cacheErr error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fs.bothResult(err, cacheErr)
+	}
+	return fs.cacheResult(err, op, name, cacheErr)
+}
+
+// fillForWrite copies the primary's content of name into cache ahead of a
+// write handle mirroring its writes there (see WithFillOnOpen), unless the
+// cache already holds a complete copy. If the copy fails, the handle goes
+// without a mirror as it would have otherwise. The caller must hold the
+// cache.
+func (fs *FileSystem) fillForWrite(ctx context.Context, cache absfs.Filer, name string) {
+	if e, ok := fs.index.get(name); ok && e.complete {
+		return
+	}
+	if _, err := fs.copyToCache(ctx, cache, name, nil, true, false); err != nil && !errors.Is(err, ErrNotCacheable) && !errors.Is(err, errFillStale) {
+		fs.reportCacheError("fill", name, err)
+	}
+}
+
+// openMirror opens the cache handle a write-through handle mirrors its
+// writes into, with the caller's flags so that O_APPEND and O_TRUNC behave
+// the same on both sides. The cache is only mirrored when its copy starts
+// out identical to the primary's: the cache holds a complete copy, or the
+// file is being truncated or is empty. Otherwise the cached copy is
+// discarded and nil is returned. A file the primary created with O_EXCL is
+// new, so whatever the cache holds under its name is replaced.
+func (fs *FileSystem) openMirror(cache absfs.Filer, name string, flag int, perm os.FileMode, primary absfs.File, complete bool) absfs.File {
+	if flag&os.O_EXCL != 0 {
+		flag |= os.O_TRUNC
+		complete = false
+	}
+	if !complete {
+		if flag&os.O_TRUNC == 0 {
+			if info, err := primary.Stat(); err != nil || info.Size() != 0 {
+				cache.Remove(name)
+				return nil
+			}
+		}
+		// Replace whatever the cache held with an empty file
+		flag = flag&^os.O_EXCL | os.O_CREATE | os.O_TRUNC
+		fs.mkdirCache(cache, path.Dir(name))
+	}
+	cacheFile, err := openFile(cache, name, flag, perm)
+	if err != nil {
+		cache.Remove(name)
+		return nil
+	}
+	return cacheFile
+}
+
+// errNilFile is the error of an OpenFile that returned neither a file nor an
+// error.
+var errNilFile = errors.New("corfs: filer returned no file")
+
+// openFile opens name in filer like filer.OpenFile, but turns a nil file
+// returned without an error, which a misbehaving filer can return, into an
+// error, so that callers fall back instead of panicking on it.
+func openFile(filer absfs.Filer, name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := filer.OpenFile(name, flag, perm)
+	if err == nil && isNilFile(f) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errNilFile}
+	}
+	return f, err
+}
+
+// isNilFile reports whether f is nil or a nil pointer.
+func isNilFile(f absfs.File) bool {
+	if f == nil {
+		return true
+	}
+	v := reflect.ValueOf(f)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
+
+// truncate is a helper that truncates name in filer, using the filer's own
+// Truncate when it has one.
+func truncate(filer absfs.Filer, name string, size int64) error {
+	if truncater, ok := filer.(interface{ Truncate(string, int64) error }); ok {
+		return truncater.Truncate(name, size)
+	}
+
+	f, err := openFile(filer, name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// mkdirAll is a helper that creates dir along with any missing parents.
+// Filers providing their own MkdirAll are used directly; otherwise each
+// missing component is created with Mkdir.
+func mkdirAll(filer absfs.Filer, dir string, perm os.FileMode) error {
+	if mkaller, ok := filer.(interface {
+		MkdirAll(string, os.FileMode) error
+	}); ok {
+		return mkaller.MkdirAll(dir, perm)
+	}
+
+	dir = path.Clean(dir)
+	if info, err := filer.Stat(dir); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: dir, Err: ErrNotDir}
+	}
+
+	// Create the parent chain first
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAll(filer, parent, perm); err != nil {
+			return err
+		}
+	}
+
+	if err := filer.Mkdir(dir, perm); err != nil {
+		// Tolerate a directory created concurrently
+		if info, statErr := filer.Stat(dir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// mkdirCache creates the cache directory dir, along with any missing
+// parents, for something corfs is about to cache in it. Each directory gets
+// the permissions of cacheDirMode. Failures are left for whatever is
+// created in dir to report. The caller must hold the cache.
+func (fs *FileSystem) mkdirCache(cache absfs.Filer, dir string) {
+	dir = path.Clean(dir)
+	if info, err := cache.Stat(dir); err == nil {
+		if info.IsDir() || !fs.dropConflict(cache, dir, true) {
+			return
+		}
+	}
+	if parent := path.Dir(dir); parent != dir {
+		fs.mkdirCache(cache, parent)
+	}
+	cache.Mkdir(dir, fs.cacheDirMode(dir))
+}
+
+// cacheDirMode returns the permissions corfs creates the cache directory
+// dir with: those of WithCacheDirMode if set, or else those of the
+// primary's directory, always writable and searchable by the owner so the
+// cache can be filled, and never writable by others; or 0755 if the
+// primary has no such directory.
+func (fs *FileSystem) cacheDirMode(dir string) os.FileMode {
+	if fs.dirMode != 0 {
+		return fs.dirMode
+	}
+	info := fs.primaryInfo(dir)
+	if info == nil || !info.IsDir() {
+		return 0755
+	}
+	return (info.Mode().Perm() | 0700) &^ 0002
+}
+
+// removeTree removes path and everything beneath it from filer, with the
+// filer's own RemoveAll if it has one. A path that doesn't exist is not an
+// error, as with os.RemoveAll.
+func removeTree(filer absfs.Filer, path string) error {
+	var err error
+	if remover, ok := filer.(interface{ RemoveAll(string) error }); ok {
+		err = remover.RemoveAll(path)
+	} else {
+		err = removeAll(filer, path)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// removeAll is a helper that recursively removes name. A path that is
+// already gone is not an error. Child paths are joined with forward
+// slashes, as filers expect whatever the host's separator. A directory
+// containing itself stops the removal with ErrDirCycle.
+func removeAll(filer absfs.Filer, name string) error {
+	return removeAllBelow(filer, name, nil)
+}
+
+// removeAllBelow removes name, below the directories ancestors (see
+// descend).
+func removeAllBelow(filer absfs.Filer, name string, ancestors []os.FileInfo) error {
 	// Open the file to check if it's a directory
-	f, err := filer.OpenFile(path, os.O_RDONLY, 0)
+	f, err := openFile(filer, name, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -327,11 +1495,18 @@ func removeAll(filer absfs.Filer, path string) error {
 
 	// If it's not a directory, just remove it
 	if !info.IsDir() {
-		return filer.Remove(path)
+		if err := filer.Remove(name); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
 	}
 
 	// For directories, recursively remove contents
-	f, err = filer.OpenFile(path, os.O_RDONLY, 0)
+	ancestors, err = descend("removeall", name, info, ancestors)
+	if err != nil {
+		return err
+	}
+	f, err = openFile(filer, name, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
@@ -343,18 +1518,17 @@ func removeAll(filer absfs.Filer, path string) error {
 		return err
 	}
 
-	for _, name := range names {
-		if name == "." || name == ".." {
+	for _, child := range names {
+		if child == "." || child == ".." {
 			continue
 		}
-		fullPath := path + string(os.PathSeparator) + name
-		if err := removeAll(filer, fullPath); err != nil {
+		if err := removeAllBelow(filer, path.Join(name, child), ancestors); err != nil {
 			return err
 		}
 	}
 
 	// Finally, remove the directory itself
-	if err := filer.Remove(path); err != nil {
+	if err := filer.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 
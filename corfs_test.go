@@ -1,12 +1,18 @@
 package corfs
 
 import (
+	"errors"
+	"io"
 	"io/fs"
 	"os"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
 )
 
 // mockFiler is a minimal mock implementation for testing
@@ -51,15 +57,33 @@ func (f *mockFile) Read(b []byte) (int, error)                   { return 0, nil
 func (f *mockFile) Write(b []byte) (int, error)                  { f.data = append(f.data, b...); return len(b), nil }
 func (f *mockFile) Close() error                                 { return nil }
 func (f *mockFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
-func (f *mockFile) Stat() (os.FileInfo, error)                   { return nil, nil }
+func (f *mockFile) Stat() (os.FileInfo, error)                   { return mockFileInfo{f}, nil }
 func (f *mockFile) Sync() error                                  { return nil }
 func (f *mockFile) Readdir(n int) ([]os.FileInfo, error)         { return nil, nil }
 func (f *mockFile) Readdirnames(n int) ([]string, error)         { return nil, nil }
 func (f *mockFile) ReadAt(b []byte, off int64) (int, error)      { return 0, nil }
-func (f *mockFile) WriteAt(b []byte, off int64) (int, error)     { return len(b), nil }
-func (f *mockFile) WriteString(s string) (int, error)            { return len(s), nil }
-func (f *mockFile) Truncate(size int64) error                    { return nil }
-func (f *mockFile) ReadDir(n int) ([]fs.DirEntry, error)         { return nil, nil }
+func (f *mockFile) WriteAt(b []byte, off int64) (int, error) {
+	if end := off + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], b), nil
+}
+func (f *mockFile) WriteString(s string) (int, error) {
+	f.data = append(f.data, s...)
+	return len(s), nil
+}
+func (f *mockFile) Truncate(size int64) error            { return nil }
+func (f *mockFile) ReadDir(n int) ([]fs.DirEntry, error) { return nil, nil }
+
+// mockFileInfo describes a mockFile
+type mockFileInfo struct{ f *mockFile }
+
+func (i mockFileInfo) Name() string       { return i.f.name }
+func (i mockFileInfo) Size() int64        { return int64(len(i.f.data)) }
+func (i mockFileInfo) Mode() os.FileMode  { return 0644 }
+func (i mockFileInfo) ModTime() time.Time { return time.Time{} }
+func (i mockFileInfo) IsDir() bool        { return false }
+func (i mockFileInfo) Sys() interface{}   { return nil }
 
 func TestNew(t *testing.T) {
 	primary := newMockFiler()
@@ -103,6 +127,56 @@ func TestMkdir(t *testing.T) {
 	}
 }
 
+func TestMkdirMirrorsParents(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	if err := primary.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := New(primary, cache)
+
+	if err := fs.Mkdir("/a/b/c", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	if info, err := cache.Stat("/a/b/c"); err != nil || !info.IsDir() {
+		t.Errorf("cache Stat() = %v, %v; expected the directory with its parents", info, err)
+	}
+
+	// A failed Mkdir leaves the cache alone
+	if err := fs.Mkdir("/x/y", 0755); !os.IsNotExist(err) {
+		t.Errorf("Mkdir() without parents error = %v, expected %v", err, os.ErrNotExist)
+	}
+	if _, err := cache.Stat("/x"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected nothing created", err)
+	}
+}
+
+func TestFileSystemMkdirAll(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache)
+
+	if err := fs.MkdirAll("/a/b/c", 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	for name, filer := range map[string]absfs.Filer{"primary": primary, "cache": cache} {
+		if info, err := filer.Stat("/a/b/c"); err != nil || !info.IsDir() {
+			t.Errorf("%s Stat() = %v, %v; expected a directory", name, info, err)
+		}
+	}
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Errorf("MkdirAll() of an existing directory error = %v", err)
+	}
+
+	// Cache failures are reported
+	var got cacheErrors
+	fs = New(primary, &mockFilerWithError{err: errCacheBroken}, WithCacheErrorHandler(got.handle))
+	if err := fs.MkdirAll("/d/e", 0755); err != nil {
+		t.Errorf("MkdirAll() error = %v, expected cache failures to be ignored", err)
+	}
+	if ops := got.ops(); len(ops) != 1 || ops[0] != "mkdir" {
+		t.Errorf("reported ops = %v, expected [mkdir]", ops)
+	}
+}
+
 func TestRemove(t *testing.T) {
 	primary := newMockFiler()
 	cache := newMockFiler()
@@ -114,6 +188,128 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestRemoveAllMissing(t *testing.T) {
+	mem, memCache := newMemFilers(t)
+	for name, fs := range map[string]*FileSystem{
+		"own RemoveAll": New(mem, memCache),
+		// Filers without a RemoveAll of their own are walked by corfs
+		"walked": New(struct{ absfs.Filer }{mem}, struct{ absfs.Filer }{memCache}),
+	} {
+		for _, path := range []string{"/missing", "/missing/deeper"} {
+			if err := fs.RemoveAll(path); err != nil {
+				t.Errorf("%s: RemoveAll(%s) error = %v, expected nil", name, path, err)
+			}
+		}
+	}
+
+	// Trees are still removed from both filesystems
+	fs := New(struct{ absfs.Filer }{mem}, struct{ absfs.Filer }{memCache})
+	mem.MkdirAll("/dir/sub", 0755)
+	writeMemFile(t, mem, "/dir/sub/file.txt", "content")
+	readString(fs, "/dir/sub/file.txt")
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll(/dir) error = %v", err)
+	}
+	for _, filer := range []absfs.Filer{mem, memCache} {
+		if _, err := filer.Stat("/dir"); !os.IsNotExist(err) {
+			t.Errorf("Stat(/dir) error = %v, expected not exist", err)
+		}
+	}
+}
+
+// removeRecorder records the paths removed from a filer without a
+// RemoveAll of its own.
+type removeRecorder struct {
+	absfs.Filer
+	removed []string
+}
+
+func (r *removeRecorder) Remove(name string) error {
+	r.removed = append(r.removed, name)
+	return r.Filer.Remove(name)
+}
+
+func TestRemoveAllNested(t *testing.T) {
+	mem, memCache := newMemFilers(t)
+	primary, cache := &removeRecorder{Filer: mem}, &removeRecorder{Filer: memCache}
+	fs := New(primary, cache)
+	fs.cacheFirst = true
+	mem.MkdirAll("/dir/a/b", 0755)
+	mem.MkdirAll("/dir/c", 0755)
+	for _, name := range []string{"/dir/top.txt", "/dir/a/mid.txt", "/dir/a/b/deep.txt", "/dir/c/other.txt"} {
+		writeMemFile(t, mem, name, "content")
+		readString(fs, name)
+	}
+
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll(/dir) error = %v", err)
+	}
+	for _, r := range []*removeRecorder{primary, cache} {
+		if _, err := r.Stat("/dir"); !os.IsNotExist(err) {
+			t.Errorf("Stat(/dir) error = %v, expected not exist", err)
+		}
+		for _, name := range r.removed {
+			if strings.Contains(name, `\`) || path.Clean(name) != name {
+				t.Errorf("removed %q, expected a clean path joined with forward slashes", name)
+			}
+		}
+	}
+	if n := len(primary.removed); n != 8 {
+		t.Errorf("removed %d paths from the primary, expected 8: %q", n, primary.removed)
+	}
+	if st := fs.CacheStatus("/dir/a/b/deep.txt"); st.Cached {
+		t.Errorf("CacheStatus(/dir/a/b/deep.txt) = %+v, expected no entry", st)
+	}
+}
+
+// loopFiler reports every path beneath /loop as /loop itself, a directory
+// containing a directory named loop, like a link pointing to its parent.
+type loopFiler struct {
+	absfs.Filer
+}
+
+func newLoopFiler(t *testing.T) (*loopFiler, *memfs.FileSystem) {
+	t.Helper()
+	mem, cache := newMemFilers(t)
+	if err := mem.MkdirAll("/loop/loop", 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &loopFiler{Filer: mem}, cache
+}
+
+func (l *loopFiler) resolve(name string) string {
+	if strings.HasPrefix(name, "/loop/") {
+		return "/loop"
+	}
+	return name
+}
+
+func (l *loopFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return l.Filer.OpenFile(l.resolve(name), flag, perm)
+}
+
+func (l *loopFiler) Stat(name string) (os.FileInfo, error) {
+	return l.Filer.Stat(l.resolve(name))
+}
+
+func (l *loopFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	return l.Filer.ReadDir(l.resolve(name))
+}
+
+func TestRemoveAllCycle(t *testing.T) {
+	primary, cache := newLoopFiler(t)
+	fs := New(primary, cache)
+
+	err := fs.RemoveAll("/loop")
+	if !errors.Is(err, ErrDirCycle) {
+		t.Fatalf("RemoveAll(/loop) error = %v, expected ErrDirCycle", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Op != "removeall" || !strings.HasPrefix(pathErr.Path, "/loop/loop/") {
+		t.Errorf("RemoveAll(/loop) error = %v, expected a removeall error for a path beneath /loop", err)
+	}
+}
+
 func TestRename(t *testing.T) {
 	primary := newMockFiler()
 	cache := newMockFiler()
@@ -368,6 +564,63 @@ func TestFileReaddirnames(t *testing.T) {
 	}
 }
 
+func TestFileReaddirPages(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/dir", 0755)
+	for _, name := range []string{"a", "c", "e"} {
+		writeMemFile(t, primary, "/dir/"+name, name)
+	}
+	fs := New(primary, cache, WithMode(WriteBack))
+	for _, name := range []string{"b", "c", "d", "f"} {
+		writeMemFile(t, fs, "/dir/"+name, "unflushed "+name)
+	}
+
+	f, err := fs.OpenFile("/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var pages [][]string
+	for {
+		infos, err := f.Readdir(3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Readdir(3) error = %v", err)
+		}
+		var page []string
+		for _, info := range infos {
+			page = append(page, info.Name())
+		}
+		pages = append(pages, page)
+	}
+	expected := [][]string{{"a", "b", "c"}, {"d", "e", "f"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Readdir(3) pages = %v, expected %v", pages, expected)
+	}
+	if infos, err := f.Readdir(3); len(infos) != 0 || err != io.EOF {
+		t.Errorf("Readdir(3) after the end = %v, %v; expected io.EOF", infos, err)
+	}
+	if infos, err := f.Readdir(-1); len(infos) != 0 || err != nil {
+		t.Errorf("Readdir(-1) after the end = %v, %v; expected no entries", infos, err)
+	}
+
+	// Rewinding starts the listing over
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	names, err := f.Readdirnames(4)
+	if err != nil || !reflect.DeepEqual(names, []string{"a", "b", "c", "d"}) {
+		t.Errorf("Readdirnames(4) = %v, %v; expected [a b c d]", names, err)
+	}
+	entries, err := f.ReadDir(-1)
+	if err != nil || len(entries) != 2 || entries[0].Name() != "e" || entries[1].Name() != "f" {
+		t.Errorf("ReadDir(-1) = %v, %v; expected e and f", entries, err)
+	}
+}
+
 func TestFileName(t *testing.T) {
 	primary := newMockFiler()
 	cache := newMockFiler()
@@ -447,7 +700,184 @@ func (m *mockFilerWithError) Chtimes(name string, atime, mtime time.Time) error
 func (m *mockFilerWithError) Chown(name string, uid, gid int) error             { return m.err }
 func (m *mockFilerWithError) ReadDir(name string) ([]fs.DirEntry, error)        { return nil, m.err }
 func (m *mockFilerWithError) ReadFile(name string) ([]byte, error)              { return nil, m.err }
-func (m *mockFilerWithError) Sub(dir string) (fs.FS, error) { return nil, m.err }
+func (m *mockFilerWithError) Sub(dir string) (fs.FS, error)                     { return nil, m.err }
+
+// shortWriteFiler is a mock whose files accept at most limit bytes per write
+type shortWriteFiler struct {
+	*mockFiler
+	limit int
+}
+
+func (m *shortWriteFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return &shortWriteFile{mockFile: &mockFile{name: name}, limit: m.limit}, nil
+}
+
+type shortWriteFile struct {
+	*mockFile
+	limit int
+}
+
+func (f *shortWriteFile) WriteString(s string) (int, error) {
+	if len(s) > f.limit {
+		s = s[:f.limit]
+	}
+	f.data = append(f.data, s...)
+	return len(s), io.ErrShortWrite
+}
+
+func TestFileWriteStringShortWrite(t *testing.T) {
+	primary := &shortWriteFiler{mockFiler: newMockFiler(), limit: 4}
+	cache := newMockFiler()
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/test.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+
+	n, err := f.WriteString("test string")
+	if err != io.ErrShortWrite {
+		t.Errorf("WriteString() error = %v, expected %v", err, io.ErrShortWrite)
+	}
+	if n != 4 {
+		t.Errorf("WriteString() wrote %d bytes, expected 4", n)
+	}
+
+	cached := cache.files["/test.txt"]
+	if got := string(cached.data); got != "test" {
+		t.Errorf("cache contains %q, expected %q", got, "test")
+	}
+}
+
+func TestReadFileCreatesCacheParents(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	if err := primary.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/a/b/c.txt", "nested content")
+
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/a/b/c.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	data, err := cache.ReadFile("/a/b/c.txt")
+	if err != nil {
+		t.Fatalf("cache ReadFile() error = %v", err)
+	}
+	if string(data) != "nested content" {
+		t.Errorf("cache contains %q, expected %q", data, "nested content")
+	}
+}
+
+func TestReadFileCachesEmptyFiles(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		mem, cache := newMemFilers(t)
+		writeMemFile(t, mem, "/empty.txt", "")
+		primary := &readCountFiler{Filer: mem}
+		var opts []Option
+		if async {
+			opts = append(opts, WithAsyncCacheWrites(1, 1<<20))
+		}
+		fs := New(primary, cache, opts...)
+		fs.cacheFirst = true
+
+		if data, err := fs.ReadFile("/empty.txt"); err != nil || len(data) != 0 {
+			t.Fatalf("async=%v: ReadFile() = %q, %v; expected an empty file", async, data, err)
+		}
+		fs.WaitForCacheFlush()
+		if info, err := cache.Stat("/empty.txt"); err != nil || info.Size() != 0 {
+			t.Errorf("async=%v: cache Stat() = %v, %v; expected an empty copy", async, info, err)
+		}
+		if st := fs.CacheStatus("/empty.txt"); !st.Complete || st.Size != 0 {
+			t.Errorf("async=%v: CacheStatus() = %+v, expected a complete, empty copy", async, st)
+		}
+
+		primary.reads.Store(0)
+		if data, err := fs.ReadFile("/empty.txt"); err != nil || len(data) != 0 || primary.reads.Load() != 0 {
+			t.Errorf("async=%v: ReadFile() = %q, %v with %d primary reads, expected the empty copy from the cache",
+				async, data, err, primary.reads.Load())
+		}
+	}
+}
+
+func TestFileReadCreatesCacheParents(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	if err := primary.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/a/b/c.txt", "nested content")
+
+	fs := New(primary, cache)
+	f, err := fs.OpenFile("/a/b/c.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	f.Close()
+
+	data, err := cache.ReadFile("/a/b/c.txt")
+	if err != nil {
+		t.Fatalf("cache ReadFile() error = %v", err)
+	}
+	if string(data) != "nested content" {
+		t.Errorf("cache contains %q, expected %q", data, "nested content")
+	}
+}
+
+func TestMkdirAllWithoutMkdirAll(t *testing.T) {
+	_, cache := newMemFilers(t)
+
+	// Hide memfs's own MkdirAll to exercise the Mkdir fallback
+	filer := struct{ absfs.Filer }{cache}
+	if err := mkdirAll(filer, "/x/y/z", 0755); err != nil {
+		t.Fatalf("mkdirAll() error = %v", err)
+	}
+	info, err := cache.Stat("/x/y/z")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if !info.IsDir() {
+		t.Error("expected /x/y/z to be a directory")
+	}
+
+	// Existing directories are not an error
+	if err := mkdirAll(filer, "/x/y", 0755); err != nil {
+		t.Errorf("mkdirAll() on existing directory error = %v", err)
+	}
+}
+
+// newMemFilers returns an empty primary and cache memfs pair.
+func newMemFilers(t testing.TB) (*memfs.FileSystem, *memfs.FileSystem) {
+	t.Helper()
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return primary, cache
+}
+
+// writeMemFile creates name in filer with the given content.
+func writeMemFile(t testing.TB, filer absfs.Filer, name, content string) {
+	t.Helper()
+	f, err := filer.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
 
 // Benchmarks
 
@@ -524,3 +954,481 @@ func BenchmarkMkdir(b *testing.B) {
 		fs.Mkdir("/benchdir", 0755)
 	}
 }
+
+func TestPrimaryAndCacheAccessors(t *testing.T) {
+	primary := newMockFiler()
+	cache := newMockFiler()
+	fs := New(primary, cache)
+
+	if fs.Primary() != primary {
+		t.Error("Primary() returned the wrong filer")
+	}
+	if fs.Cache() != cache {
+		t.Error("Cache() returned the wrong filer")
+	}
+
+	replacement := newMockFiler()
+	fs.SetCache(replacement)
+	if fs.Cache() != replacement {
+		t.Error("Cache() after SetCache() returned the wrong filer")
+	}
+}
+
+func TestSetCacheWaitsForInFlightWrites(t *testing.T) {
+	fs := New(newMockFiler(), newMockFiler())
+
+	// Simulate an in-flight cache operation
+	fs.acquireCache()
+
+	swapped := make(chan struct{})
+	go func() {
+		fs.SetCache(newMockFiler())
+		close(swapped)
+	}()
+
+	select {
+	case <-swapped:
+		t.Fatal("SetCache() returned while a cache operation was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fs.releaseCache()
+	select {
+	case <-swapped:
+	case <-time.After(time.Second):
+		t.Fatal("SetCache() did not return after the cache operation finished")
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"Plain", nil},
+		{"Namespace", []Option{WithNamespace("/ns")}},
+		{"Dedup", []Option{WithDedup()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem, cache := newMemFilers(t)
+			mem.MkdirAll("/dir", 0755)
+			writeMemFile(t, mem, "/a.txt", "alpha")
+			writeMemFile(t, mem, "/dir/b.txt", "bravo")
+			writeMemFile(t, cache, "/other.txt", "another namespace")
+			primary := &readCountFiler{Filer: mem}
+			fs := New(primary, cache, tt.opts...)
+			fs.cacheFirst = true
+
+			for _, name := range []string{"/a.txt", "/dir/b.txt", "/a.txt"} {
+				if _, err := fs.ReadFile(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fs.ClearCache(); err != nil {
+				t.Fatalf("ClearCache() error = %v", err)
+			}
+
+			entries, err := fs.cache.ReadDir("/")
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("cache holds %v after ClearCache(), expected nothing", entryNames(entries))
+			}
+			if tt.name == "Namespace" && readString(cache, "/other.txt") != "another namespace" {
+				t.Error("ClearCache() removed content outside its namespace")
+			}
+			if st := fs.Stats(); st != (Stats{}) {
+				t.Errorf("Stats() = %+v after ClearCache(), expected zero", st)
+			}
+			if got := readString(mem, "/dir/b.txt"); got != "bravo" {
+				t.Errorf("primary /dir/b.txt = %q, expected it untouched", got)
+			}
+
+			// Reads fill the cache from the primary again
+			reads := primary.reads.Load()
+			readTimes(t, fs, "/dir/b.txt", 2)
+			if n := primary.reads.Load() - reads; n != 1 {
+				t.Errorf("primary read %d times after ClearCache(), expected once", n)
+			}
+			if st := fs.CacheStatus("/dir/b.txt"); !st.Complete {
+				t.Errorf("CacheStatus(/dir/b.txt) = %+v, expected a complete copy", st)
+			}
+			if st := fs.Stats(); st.Reads != 1 || st.Hits != 1 {
+				t.Errorf("Stats() = %+v, expected 1 read and 1 hit since ClearCache()", st)
+			}
+		})
+	}
+}
+
+func TestSetCacheDetachesOpenFiles(t *testing.T) {
+	primary, oldCache := newMemFilers(t)
+	_, newCache := newMemFilers(t)
+	writeMemFile(t, primary, "/read.txt", "read content")
+	writeMemFile(t, newCache, "/write.txt", "stale")
+	fs := New(primary, oldCache)
+
+	r, err := fs.OpenFile("/read.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w, err := fs.OpenFile("/write.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := r.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetCache(newCache)
+
+	// The fill started against the old cache is abandoned
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*memfs.FileSystem{oldCache, newCache} {
+		if _, err := c.Stat("/read.txt"); !os.IsNotExist(err) {
+			t.Errorf("cache Stat(/read.txt) error = %v, expected not exist", err)
+		}
+	}
+
+	// The write handle stops mirroring and the new cache drops its copy
+	if _, err := w.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCache.Stat("/write.txt"); !os.IsNotExist(err) {
+		t.Errorf("new cache Stat(/write.txt) error = %v, expected not exist", err)
+	}
+
+	// New opens use the new cache
+	if _, err := fs.ReadFile("/read.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := newCache.ReadFile("/read.txt"); err != nil || string(data) != "read content" {
+		t.Errorf("new cache ReadFile() = %q, %v", data, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		expected string
+	}{
+		{"shrink", 4, "hell"},
+		{"grow", 8, "hello\x00\x00\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, cache := newMemFilers(t)
+			writeMemFile(t, primary, "/file.txt", "hello")
+			fs := New(primary, cache)
+
+			// Populate a complete cache entry
+			if _, err := fs.ReadFile("/file.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.Truncate("/file.txt", tt.size); err != nil {
+				t.Fatalf("Truncate() error = %v", err)
+			}
+			for name, filer := range map[string]absfs.Filer{"primary": primary, "cache": cache} {
+				data, err := filer.ReadFile("/file.txt")
+				if err != nil {
+					t.Fatalf("%s ReadFile() error = %v", name, err)
+				}
+				if string(data) != tt.expected {
+					t.Errorf("%s contains %q, expected %q", name, data, tt.expected)
+				}
+			}
+			if e, ok := fs.index.get("/file.txt"); !ok || !e.complete || e.size != tt.size {
+				t.Errorf("entry = %+v, %v; expected complete with size %d", e, ok, tt.size)
+			}
+		})
+	}
+}
+
+func TestTruncateMissingFile(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache)
+
+	err := fs.Truncate("/missing.txt", 10)
+	if !os.IsNotExist(err) {
+		t.Errorf("Truncate() error = %v, expected not exist", err)
+	}
+	for name, filer := range map[string]absfs.Filer{"primary": primary, "cache": cache} {
+		if _, err := filer.Stat("/missing.txt"); !os.IsNotExist(err) {
+			t.Errorf("%s Stat() error = %v, expected not exist", name, err)
+		}
+	}
+}
+
+func TestTruncatePrimaryOnly(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello")
+	fs := New(primary, cache)
+
+	if err := fs.Truncate("/file.txt", 2); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	if data, _ := primary.ReadFile("/file.txt"); string(data) != "he" {
+		t.Errorf("primary contains %q, expected %q", data, "he")
+	}
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+}
+
+func TestTruncateDiscardsPartialCache(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello")
+	writeMemFile(t, cache, "/file.txt", "he")
+	fs := New(primary, cache)
+
+	if err := fs.Truncate("/file.txt", 3); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the unindexed copy to be discarded", err)
+	}
+}
+
+// statErrFiler fails every Stat with err.
+type statErrFiler struct {
+	absfs.Filer
+	err error
+}
+
+func (s *statErrFiler) Stat(name string) (os.FileInfo, error) { return nil, s.err }
+
+func TestExistsAndIsDir(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/dir", 0755)
+	writeMemFile(t, primary, "/file.txt", "content")
+	writeMemFile(t, cache, "/cached.txt", "content")
+	fs := New(primary, cache)
+
+	tests := []struct {
+		name   string
+		exists bool
+		isDir  bool
+	}{
+		{"/file.txt", true, false},
+		{"/dir", true, true},
+		{"/cached.txt", true, false}, // Found by the cache fallback
+		{"/missing.txt", false, false},
+	}
+	for _, tt := range tests {
+		exists, err := fs.Exists(tt.name)
+		if err != nil || exists != tt.exists {
+			t.Errorf("Exists(%q) = %v, %v; expected %v, nil", tt.name, exists, err, tt.exists)
+		}
+		isDir, err := fs.IsDir(tt.name)
+		if err != nil || isDir != tt.isDir {
+			t.Errorf("IsDir(%q) = %v, %v; expected %v, nil", tt.name, isDir, err, tt.isDir)
+		}
+	}
+
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected Exists not to cache content", err)
+	}
+}
+
+func TestExistsReportsPrimaryErrors(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	fs := New(&statErrFiler{Filer: mem, err: os.ErrPermission}, cache)
+
+	if exists, err := fs.Exists("/file.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Exists() = %v, %v; expected %v", exists, err, os.ErrPermission)
+	}
+	if isDir, err := fs.IsDir("/file.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("IsDir() = %v, %v; expected %v", isDir, err, os.ErrPermission)
+	}
+}
+
+func TestRemoveCombinesErrors(t *testing.T) {
+	errPrimary := errors.New("primary failed")
+	errCache := errors.New("cache failed")
+	fs := New(&mockFilerWithError{err: errPrimary}, &mockFilerWithError{err: errCache})
+
+	for op, err := range map[string]error{
+		"Remove":    fs.Remove("/file.txt"),
+		"Rename":    fs.Rename("/file.txt", "/other.txt"),
+		"RemoveAll": fs.RemoveAll("/file.txt"),
+	} {
+		if !errors.Is(err, errPrimary) || !errors.Is(err, errCache) {
+			t.Errorf("%s() error = %v, expected both errors", op, err)
+		}
+	}
+
+	// A cache with nothing to remove leaves the primary's error alone
+	fs = New(&mockFilerWithError{err: errPrimary}, &mockFilerWithError{err: os.ErrNotExist})
+	if err := fs.Remove("/file.txt"); err != errPrimary {
+		t.Errorf("Remove() error = %v, expected %v", err, errPrimary)
+	}
+}
+
+func TestEquivalentPathsShareCacheEntry(t *testing.T) {
+	primary := &readCountFiler{Filer: newTier(t)}
+	cache := newTier(t)
+	if err := primary.Mkdir("/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary.Filer, "/a/b.txt", "hello")
+	fs := NewChain(cache, primary) // Serve complete copies without the primary
+
+	if _, err := fs.ReadFile("/a/./b.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if st := fs.CacheStatus("/a/b.txt"); !st.Complete {
+		t.Fatalf("CacheStatus(/a/b.txt) = %+v, expected a complete entry", st)
+	}
+
+	for _, name := range []string{"/a/b.txt", "//a//b.txt", "/x/../a/b.txt"} {
+		f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile(%q) error = %v", name, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "hello" {
+			t.Errorf("read %q = %q, %v; expected %q", name, data, err, "hello")
+		}
+	}
+	if n := primary.reads.Load(); n != 1 {
+		t.Errorf("primary reads = %d, expected 1", n)
+	}
+
+	if err := fs.Remove("/a/./b.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if st := fs.CacheStatus("/a/b.txt"); st.Cached {
+		t.Errorf("CacheStatus(/a/b.txt) = %+v after Remove, expected no entry", st)
+	}
+	if _, err := cache.Stat("/a/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cache Stat() error = %v, expected %v", err, os.ErrNotExist)
+	}
+}
+
+func TestStatFallbackMetadata(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	if err := mem.Chmod("/file.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := mem.Chtimes("/file.txt", modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, cache, "/other.txt", "other")
+	fs := New(mem, cache)
+	readString(fs, "/file.txt")
+	fs.primary = &statErrFiler{Filer: mem, err: errors.New("primary unavailable")}
+
+	// The primary's metadata recorded for the copy
+	info, err := fs.Stat("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 7 || info.Mode().Perm() != 0600 || !info.ModTime().Equal(modified) || info.Sys() != nil {
+		t.Errorf("Stat() = %v %v %v, expected the primary's metadata", info.Size(), info.Mode(), info.ModTime())
+	}
+
+	// The cache file's own, without an index entry
+	want, err := cache.Stat("/other.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("/other.txt"); err != nil || info.Mode() != want.Mode() || !info.ModTime().Equal(want.ModTime()) {
+		t.Errorf("Stat() = %v, %v; expected the cache file's metadata", info, err)
+	}
+}
+
+func TestCacheFirst(t *testing.T) {
+	for _, first := range []bool{false, true} {
+		mem, cache := newMemFilers(t)
+		writeMemFile(t, mem, "/file.txt", "content")
+		primary := &readCountFiler{Filer: mem}
+		clock := newFakeClock()
+		opts := []Option{WithTTL(time.Hour), WithClock(clock)}
+		if first {
+			opts = append(opts, WithCacheFirst())
+		}
+		fs := New(primary, cache, opts...)
+		readString(fs, "/file.txt")
+
+		primary.reads.Store(0)
+		f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "content" {
+			t.Errorf("first=%v: ReadAll() = %q, %v; expected the content", first, data, err)
+		}
+		readString(fs, "/file.txt")
+		want := int64(2)
+		if first {
+			want = 0
+		}
+		if n := primary.reads.Load(); n != want {
+			t.Errorf("first=%v: %d primary reads, expected %d", first, n, want)
+		}
+
+		// An expired copy is fetched again
+		clock.advance(2 * time.Hour)
+		primary.reads.Store(0)
+		readString(fs, "/file.txt")
+		if n := primary.reads.Load(); n != 1 {
+			t.Errorf("first=%v: %d primary reads of an expired copy, expected 1", first, n)
+		}
+	}
+}
+
+func TestCachedReader(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &readCountFiler{Filer: mem}
+	fs := New(primary, cache)
+
+	// Closed early, the reader leaves nothing behind
+	r, err := fs.CachedReader("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if st := fs.CacheStatus("/file.txt"); st.Complete {
+		t.Errorf("CacheStatus() = %+v after a partial read, expected no complete copy", st)
+	}
+
+	// Read to the end, it fills the cache, which serves the next reader
+	for i, wantReads := range []int64{2, 2} {
+		r, err := fs.CachedReader("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil || string(data) != "content" {
+			t.Errorf("reader %d: ReadAll() = %q, %v; expected the content", i, data, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("reader %d: Close() error = %v", i, err)
+		}
+		if n := primary.reads.Load(); n != wantReads {
+			t.Errorf("reader %d: %d primary reads, expected %d", i, n, wantReads)
+		}
+	}
+	if st := fs.Stats(); st.Hits != 1 || st.CacheHandles != 0 {
+		t.Errorf("Stats() = %+v, expected 1 hit and no cache handles left open", st)
+	}
+}
@@ -0,0 +1,36 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrDirCycle is returned, wrapped in an *os.PathError, by recursive
+// operations such as RemoveAll and WalkDir on a directory that contains
+// itself, which a filer following links or a buggy one can report, or
+// that is nested deeper than any real tree.
+var ErrDirCycle = errors.New("corfs: directory cycle or nesting too deep")
+
+// maxTreeDepth is how many directories deep recursive operations go before
+// giving up with ErrDirCycle. Paths that deep exceed what operating systems
+// allow, so only a cycle reaches it.
+const maxTreeDepth = 1024
+
+// descend checks that the directory name, described by info if known, can
+// be recursed into below ancestors, the directories above it, and returns
+// its ancestors for its entries. A directory that is the same file as one
+// of its ancestors, as far as os.SameFile can tell, or that is too deep,
+// is reported as an ErrDirCycle for op.
+func descend(op, name string, info os.FileInfo, ancestors []os.FileInfo) ([]os.FileInfo, error) {
+	if len(ancestors) >= maxTreeDepth {
+		return nil, &os.PathError{Op: op, Path: name, Err: ErrDirCycle}
+	}
+	if info != nil {
+		for _, a := range ancestors {
+			if a != nil && os.SameFile(a, info) {
+				return nil, &os.PathError{Op: op, Path: name, Err: ErrDirCycle}
+			}
+		}
+	}
+	return append(ancestors[:len(ancestors):len(ancestors)], info), nil
+}
@@ -0,0 +1,93 @@
+package corfs
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Decision is a choice the FileSystem makes about caching a file, reported
+// to a DecisionLogger (see WithDecisionLogger).
+type Decision int
+
+const (
+	DecisionHit           Decision = iota // A read was served from the cache
+	DecisionMiss                          // A read went to the primary
+	DecisionSkipExcluded                  // A file with a zero TTL wasn't cached (see SetTTL)
+	DecisionSkipSize                      // A file outside the size limits wasn't cached
+	DecisionWriteError                    // A cache operation failed (see CacheError)
+	DecisionEvict                         // Prune, Reconcile or WithEviction removed a cached copy
+	DecisionSkipAdmission                 // The admission policy kept a file out of the cache (see WithAdmission)
+)
+
+var decisionNames = [...]string{
+	DecisionHit:           "hit",
+	DecisionMiss:          "miss",
+	DecisionSkipExcluded:  "skip-excluded",
+	DecisionSkipSize:      "skip-size",
+	DecisionWriteError:    "write-error",
+	DecisionEvict:         "evict",
+	DecisionSkipAdmission: "skip-admission",
+}
+
+func (d Decision) String() string {
+	if d >= 0 && int(d) < len(decisionNames) {
+		return decisionNames[d]
+	}
+	return "unknown"
+}
+
+// DecisionLogger receives the cache decisions of a FileSystem as they are
+// made. LogDecision is called with the path the decision is about, and for
+// DecisionWriteError with the *CacheError; err is nil otherwise. It is
+// called synchronously from the operation making the decision, sometimes
+// with internal locks held, so it must be quick, must not call back into
+// the FileSystem, and must be safe for concurrent use.
+type DecisionLogger interface {
+	LogDecision(d Decision, name string, err error)
+}
+
+// SlogDecisions returns a DecisionLogger writing a record at level to l for
+// each decision, with the attributes "decision", "path", and, for
+// DecisionWriteError, "error".
+func SlogDecisions(l *slog.Logger, level slog.Level) DecisionLogger {
+	return slogDecisions{l: l, level: level}
+}
+
+type slogDecisions struct {
+	l     *slog.Logger
+	level slog.Level
+}
+
+func (s slogDecisions) LogDecision(d Decision, name string, err error) {
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, s.level) {
+		return
+	}
+	attrs := []slog.Attr{slog.String("decision", d.String()), slog.String("path", name)}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	s.l.LogAttrs(ctx, s.level, "corfs cache decision", attrs...)
+}
+
+// decide reports the decision d about name to the DecisionLogger, if there
+// is one.
+func (fs *FileSystem) decide(d Decision, name string, err error) {
+	if fs.decisions != nil {
+		fs.decisions.LogDecision(d, name, err)
+	}
+}
+
+// skipped reports whether name, of size bytes, is kept out of the cache by
+// a zero TTL or the size limits, reporting the decision if so.
+func (fs *FileSystem) skipped(name string, size int64) bool {
+	switch {
+	case fs.uncacheable(name):
+		fs.decide(DecisionSkipExcluded, name, nil)
+	case !fs.cacheable(size):
+		fs.decide(DecisionSkipSize, name, nil)
+	default:
+		return false
+	}
+	return true
+}
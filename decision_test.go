@@ -0,0 +1,97 @@
+package corfs
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// decisionRecorder is a DecisionLogger recording decisions as
+// "decision path".
+type decisionRecorder struct {
+	mu        sync.Mutex
+	decisions []string
+}
+
+func (r *decisionRecorder) LogDecision(d Decision, name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decisions = append(r.decisions, d.String()+" "+name)
+}
+
+// take returns the decisions recorded since the last call.
+func (r *decisionRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.decisions
+	r.decisions = nil
+	return d
+}
+
+func TestDecisionLogger(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/small.txt", "content")
+	writeMemFile(t, mem, "/large.txt", "content too large to cache")
+	writeMemFile(t, mem, "/tmp.txt", "temporary")
+	rec := &decisionRecorder{}
+	fs := New(mem, cache, WithMaxCacheSize(10), WithDecisionLogger(rec))
+	fs.cacheFirst = true
+	if err := fs.SetTTL("/tmp.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		op   func()
+		want []string
+	}{
+		{func() { fs.ReadFile("/small.txt") }, []string{"miss /small.txt"}},
+		{func() { fs.ReadFile("/small.txt") }, []string{"hit /small.txt"}},
+		{func() { fs.ReadFile("/large.txt") }, []string{"miss /large.txt", "skip-size /large.txt"}},
+		{func() { fs.ReadFile("/tmp.txt") }, []string{"miss /tmp.txt", "skip-excluded /tmp.txt"}},
+		{func() {
+			mem.Remove("/small.txt")
+			fs.Prune()
+		}, []string{"evict /small.txt"}},
+	}
+	for i, step := range steps {
+		step.op()
+		if got := rec.take(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %d: decisions = %q, expected %q", i, got, step.want)
+		}
+	}
+}
+
+func TestDecisionLoggerCacheError(t *testing.T) {
+	primary, _ := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	rec := &decisionRecorder{}
+	fs := New(primary, &mockFilerWithError{err: errCacheBroken}, WithDecisionLogger(rec))
+
+	fs.Chmod("/file.txt", 0600)
+	if got, want := rec.take(), []string{"write-error /file.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("decisions = %q, expected %q", got, want)
+	}
+}
+
+func TestSlogDecisions(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	SlogDecisions(l, slog.LevelInfo).LogDecision(DecisionWriteError, "/file.txt", errCacheBroken)
+	SlogDecisions(l, slog.LevelDebug).LogDecision(DecisionHit, "/file.txt", nil)
+	got := strings.TrimSpace(buf.String())
+	want := `level=INFO msg="corfs cache decision" decision=write-error path=/file.txt error="` + errCacheBroken.Error() + `"`
+	if got != want {
+		t.Errorf("log = %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,382 @@
+package corfs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// In content-addressed mode (see WithDedup), complete cached copies are
+// stored once per distinct content as blobs named by their SHA-256, under
+// blobDir in the cache filer. Cached paths exist only as references to
+// blobs, kept in memory. blobDir is an internal name, so it never appears
+// in listings.
+const blobDir = "/" + tempPrefix + "blobs"
+
+// blobPath returns the cache path of the blob with the hex checksum sum.
+func blobPath(sum string) string {
+	return path.Join(blobDir, sum[:2], sum)
+}
+
+// blobFiler presents a cache filer in which complete copies are shared
+// blobs as an ordinary filer, so the rest of corfs reads and writes cached
+// paths as usual.
+//
+// Each path referring to a blob holds one reference to it, and a blob is
+// removed along with its last reference. References are dropped whenever
+// the path stops referring to the blob: the path is removed (by Remove,
+// RemoveAll, or Prune), replaced by a newer fill or a rename, or opened for
+// writing or truncated, in which case the path first gets a private copy
+// of the content so writes never reach the shared blob.
+type blobFiler struct {
+	absfs.Filer
+
+	mu    sync.Mutex
+	paths map[string]string // Blob checksum of each cached path
+	refs  map[string]int    // Number of paths referring to each blob
+}
+
+func newBlobFiler(cache absfs.Filer) *blobFiler {
+	return &blobFiler{
+		Filer: cache,
+		paths: make(map[string]string),
+		refs:  make(map[string]int),
+	}
+}
+
+// commit stores the complete fill in the temporary file tmp, whose content
+// has the checksum sum, as the blob for sum and points name at it. If the
+// blob already exists, tmp is discarded.
+func (b *blobFiler) commit(tmp, name, sum string) error {
+	key := path.Clean(name)
+	blob := blobPath(sum)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.Filer.Stat(blob); err == nil {
+		b.Filer.Remove(tmp)
+	} else {
+		mkdirAll(b.Filer, path.Dir(blob), 0755)
+		if err := b.Filer.Rename(tmp, blob); err != nil {
+			b.Filer.Remove(tmp)
+			return err
+		}
+	}
+	b.unlink(key)
+	b.Filer.Remove(key) // A private copy the blob now replaces
+	b.paths[key] = sum
+	b.refs[sum]++
+	return nil
+}
+
+// unlink drops the reference key holds, removing the blob if it was the
+// last one. The caller must hold b.mu.
+func (b *blobFiler) unlink(key string) {
+	sum, ok := b.paths[key]
+	if !ok {
+		return
+	}
+	delete(b.paths, key)
+	if b.refs[sum]--; b.refs[sum] <= 0 {
+		delete(b.refs, sum)
+		b.Filer.Remove(blobPath(sum))
+	}
+}
+
+// unlinkTree drops the references of dir and every path beneath it. The
+// caller must hold b.mu.
+func (b *blobFiler) unlinkTree(dir string) bool {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	found := false
+	for key := range b.paths {
+		if key == dir || strings.HasPrefix(key, prefix) {
+			b.unlink(key)
+			found = true
+		}
+	}
+	return found
+}
+
+// privatize replaces the reference key holds with a private copy of the
+// blob's content. The caller must hold b.mu.
+func (b *blobFiler) privatize(key string) error {
+	src, err := openFile(b.Filer, blobPath(b.paths[key]), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openFile(b.Filer, key, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		b.Filer.Remove(key)
+		return err
+	}
+	b.unlink(key)
+	return nil
+}
+
+func (b *blobFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	key := path.Clean(name)
+
+	b.mu.Lock()
+	sum, ok := b.paths[key]
+	if !ok {
+		b.mu.Unlock()
+		return b.Filer.OpenFile(name, flag, perm)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		defer b.mu.Unlock()
+		return b.Filer.OpenFile(blobPath(sum), flag, 0)
+	}
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		b.mu.Unlock()
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if flag&os.O_TRUNC != 0 {
+		b.unlink(key)
+		flag |= os.O_CREATE // The path has no file of its own yet
+	} else if err := b.privatize(key); err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	b.mu.Unlock()
+	return b.Filer.OpenFile(name, flag, perm)
+}
+
+func (b *blobFiler) Remove(name string) error {
+	key := path.Clean(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.paths[key]; ok {
+		b.unlink(key)
+		return nil
+	}
+	return b.Filer.Remove(name)
+}
+
+func (b *blobFiler) RemoveAll(name string) error {
+	key := path.Clean(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	found := b.unlinkTree(key)
+	var err error
+	if remover, ok := b.Filer.(interface{ RemoveAll(string) error }); ok {
+		err = remover.RemoveAll(name)
+	} else {
+		err = removeAll(b.Filer, name)
+	}
+	if found && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *blobFiler) Rename(oldpath, newpath string) error {
+	oldKey, newKey := path.Clean(oldpath), path.Clean(newpath)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sum, ok := b.paths[oldKey]; ok {
+		b.unlink(newKey)
+		b.Filer.Remove(newKey)
+		mkdirAll(b.Filer, path.Dir(newKey), 0755)
+		delete(b.paths, oldKey)
+		b.paths[newKey] = sum
+		return nil
+	}
+	if err := b.Filer.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	b.unlinkTree(newKey)
+	oldPrefix := strings.TrimSuffix(oldKey, "/") + "/"
+	newPrefix := strings.TrimSuffix(newKey, "/") + "/"
+	for key, sum := range b.paths {
+		if strings.HasPrefix(key, oldPrefix) {
+			delete(b.paths, key)
+			b.paths[newPrefix+strings.TrimPrefix(key, oldPrefix)] = sum
+		}
+	}
+	return nil
+}
+
+func (b *blobFiler) Stat(name string) (os.FileInfo, error) {
+	key := path.Clean(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sum, ok := b.paths[key]; ok {
+		return b.blobInfo(key, sum)
+	}
+	return b.Filer.Stat(name)
+}
+
+// blobInfo returns file info for key describing the blob it refers to. The
+// caller must hold b.mu.
+func (b *blobFiler) blobInfo(key, sum string) (os.FileInfo, error) {
+	info, err := b.Filer.Stat(blobPath(sum))
+	if err != nil {
+		return nil, err
+	}
+	return namedInfo{FileInfo: info, name: path.Base(key)}, nil
+}
+
+// namedInfo is file info reported under another name.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i namedInfo) Name() string {
+	return i.name
+}
+
+func (b *blobFiler) Truncate(name string, size int64) error {
+	key := path.Clean(name)
+
+	b.mu.Lock()
+	if _, ok := b.paths[key]; ok {
+		if err := b.privatize(key); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	b.mu.Unlock()
+	return truncate(b.Filer, name, size)
+}
+
+// Blobs are shared, so metadata changes to a path referring to one are
+// ignored.
+
+func (b *blobFiler) Chmod(name string, mode os.FileMode) error {
+	if b.shared(name) {
+		return nil
+	}
+	return b.Filer.Chmod(name, mode)
+}
+
+func (b *blobFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if b.shared(name) {
+		return nil
+	}
+	return b.Filer.Chtimes(name, atime, mtime)
+}
+
+func (b *blobFiler) Chown(name string, uid, gid int) error {
+	if b.shared(name) {
+		return nil
+	}
+	return b.Filer.Chown(name, uid, gid)
+}
+
+// shared reports whether name refers to a blob.
+func (b *blobFiler) shared(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.paths[path.Clean(name)]
+	return ok
+}
+
+func (b *blobFiler) ReadFile(name string) ([]byte, error) {
+	key := path.Clean(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sum, ok := b.paths[key]; ok {
+		return b.Filer.ReadFile(blobPath(sum))
+	}
+	return b.Filer.ReadFile(name)
+}
+
+// ReadDir lists dir with the paths in it that refer to blobs, hiding the
+// blobs themselves.
+func (b *blobFiler) ReadDir(name string) ([]iofs.DirEntry, error) {
+	dir := path.Clean(name)
+	entries, err := b.Filer.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]iofs.DirEntry, len(entries))
+	for _, e := range entries {
+		if path.Join(dir, e.Name()) != blobDir {
+			byName[e.Name()] = e
+		}
+	}
+
+	b.mu.Lock()
+	for key, sum := range b.paths {
+		if path.Dir(key) != dir || key == dir {
+			continue
+		}
+		if info, err := b.blobInfo(key, sum); err == nil {
+			byName[info.Name()] = iofs.FileInfoToDirEntry(info)
+		}
+	}
+	b.mu.Unlock()
+
+	listed := make([]iofs.DirEntry, 0, len(byName))
+	for _, e := range byName {
+		listed = append(listed, e)
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].Name() < listed[j].Name()
+	})
+	return listed, nil
+}
+
+func (b *blobFiler) Sub(dir string) (iofs.FS, error) {
+	return absfs.FilerToFS(b, dir)
+}
+
+// pruneBlobs removes blobs no path refers to, such as those left by an
+// earlier process. It returns the number of blobs removed.
+func (b *blobFiler) pruneBlobs() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	shards, err := b.Filer.ReadDir(blobDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, shard := range shards {
+		if !shard.IsDir() || shard.Name() == "." || shard.Name() == ".." {
+			continue
+		}
+		dir := path.Join(blobDir, shard.Name())
+		blobs, err := b.Filer.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+		for _, blob := range blobs {
+			if blob.IsDir() || b.refs[blob.Name()] > 0 {
+				continue
+			}
+			n, err := removed1(b.Filer.Remove(path.Join(dir, blob.Name())))
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,135 @@
+package corfs
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// blobCount returns the number of blobs stored in the cache filer.
+func blobCount(t *testing.T, cache absfs.Filer) int {
+	t.Helper()
+	shards, err := cache.ReadDir(blobDir)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, shard := range shards {
+		blobs, err := cache.ReadDir(path.Join(blobDir, shard.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(blobs)
+	}
+	return n
+}
+
+func TestDedupSharesIdenticalContent(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "same")
+	writeMemFile(t, primary, "/b.txt", "same")
+	writeMemFile(t, primary, "/c.txt", "different")
+	fs := New(primary, cache, WithDedup())
+
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		readString(fs, name)
+	}
+	if n := blobCount(t, cache); n != 2 {
+		t.Errorf("cache holds %d blobs, expected 2", n)
+	}
+	if _, err := cache.Stat("/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/a.txt) error = %v, expected the path to exist only as a reference", err)
+	}
+
+	// Both aliases are served from the shared blob
+	primary.Remove("/a.txt")
+	primary.Remove("/b.txt")
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if got := readString(fs, name); got != "same" {
+			t.Errorf("ReadFile(%s) = %q, expected %q", name, got, "same")
+		}
+		info, err := fs.Stat(name)
+		if err != nil || info.Name() != path.Base(name) || info.Size() != 4 {
+			t.Errorf("Stat(%s) = %v, %v", name, info, err)
+		}
+	}
+	entries, err := fs.cache.ReadDir("/")
+	if err != nil || len(entries) != 3 {
+		t.Errorf("cache ReadDir() = %v, %v, expected the three cached paths", entries, err)
+	}
+}
+
+func TestDedupReferenceCounting(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "same")
+	writeMemFile(t, primary, "/b.txt", "same")
+	fs := New(primary, cache, WithDedup())
+	readString(fs, "/a.txt")
+	readString(fs, "/b.txt")
+
+	if err := fs.Remove("/a.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if n := blobCount(t, cache); n != 1 {
+		t.Fatalf("cache holds %d blobs after removing one alias, expected 1", n)
+	}
+	if err := fs.Rename("/b.txt", "/c.txt"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	primary.Remove("/c.txt")
+	if got := readString(fs, "/c.txt"); got != "same" {
+		t.Errorf("ReadFile() after Rename = %q, expected %q", got, "same")
+	}
+	if err := fs.RemoveAll("/c.txt"); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if n := blobCount(t, cache); n != 0 {
+		t.Errorf("cache holds %d blobs after removing every alias, expected 0", n)
+	}
+}
+
+func TestDedupWritesDontReachSharedBlob(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "same")
+	writeMemFile(t, primary, "/b.txt", "same")
+	fs := New(primary, cache, WithDedup())
+	readString(fs, "/a.txt")
+	readString(fs, "/b.txt")
+
+	f, err := fs.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte(" plus more"))
+	f.Close()
+
+	primary.Remove("/a.txt")
+	primary.Remove("/b.txt")
+	if got := readString(fs, "/a.txt"); got != "same plus more" {
+		t.Errorf("ReadFile(/a.txt) = %q, expected %q", got, "same plus more")
+	}
+	if got := readString(fs, "/b.txt"); got != "same" {
+		t.Errorf("ReadFile(/b.txt) = %q, expected %q", got, "same")
+	}
+}
+
+func TestDedupPruneRemovesOrphanedBlobs(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "content")
+	fs := New(primary, cache, WithDedup())
+	readString(fs, "/a.txt")
+
+	// A new FileSystem over the same cache knows none of the references
+	fs = New(primary, cache, WithDedup())
+	if removed, err := fs.Prune(); err != nil || removed != 1 {
+		t.Errorf("Prune() = %d, %v, expected the orphaned blob removed", removed, err)
+	}
+	if n := blobCount(t, cache); n != 0 {
+		t.Errorf("cache holds %d blobs after Prune, expected 0", n)
+	}
+}
@@ -0,0 +1,131 @@
+package corfs
+
+import (
+	iofs "io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirCache holds primary ReadDir results for a short window (see
+// WithDirCacheTTL). A nil *dirCache is valid and caches nothing.
+type dirCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dirEntry
+	clock   Clock
+}
+
+type dirEntry struct {
+	list    []iofs.DirEntry
+	expires time.Time
+}
+
+func newDirCache(ttl time.Duration) *dirCache {
+	return &dirCache{ttl: ttl, entries: make(map[string]dirEntry), clock: systemClock{}}
+}
+
+// get returns a copy of the cached listing of dir if it hasn't expired.
+func (c *dirCache) get(dir string) ([]iofs.DirEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := path.Clean(dir)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.clock.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return append([]iofs.DirEntry(nil), entry.list...), true
+}
+
+// put records list as the listing of dir. The caller keeps list, which is
+// copied.
+func (c *dirCache) put(dir string, list []iofs.DirEntry) {
+	if c == nil {
+		return
+	}
+	list = append([]iofs.DirEntry(nil), list...)
+	c.mu.Lock()
+	c.entries[path.Clean(dir)] = dirEntry{list: list, expires: c.clock.Now().Add(c.ttl)}
+	c.mu.Unlock()
+}
+
+// invalidate drops the listings of names and of every directory above
+// them, which a change to name may have added to, such as MkdirAll.
+func (c *dirCache) invalidate(names ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for _, name := range names {
+		c.dropAncestors(path.Clean(name))
+	}
+	c.mu.Unlock()
+}
+
+// invalidateTree drops the listings of dir, of everything beneath it, and
+// of every directory above it.
+func (c *dirCache) invalidateTree(dir string) {
+	if c == nil {
+		return
+	}
+	dir = path.Clean(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	c.mu.Lock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+	c.dropAncestors(dir)
+	c.mu.Unlock()
+}
+
+// dropAncestors drops the listings of the clean path name and its parents.
+// The caller must hold c.mu.
+func (c *dirCache) dropAncestors(name string) {
+	for {
+		delete(c.entries, name)
+		parent := path.Dir(name)
+		if parent == name {
+			return
+		}
+		name = parent
+	}
+}
+
+// invalidateMeta drops what the Stat and ReadDir caches hold about names
+// after a change made through the FileSystem.
+func (fs *FileSystem) invalidateMeta(names ...string) {
+	fs.statCache.invalidate(names...)
+	fs.dirCache.invalidate(names...)
+}
+
+// invalidateMetaTree drops what the Stat and ReadDir caches hold about dir
+// and everything beneath it.
+func (fs *FileSystem) invalidateMetaTree(dir string) {
+	fs.statCache.invalidateTree(dir)
+	fs.dirCache.invalidateTree(dir)
+}
+
+// ForgetNegative drops what the FileSystem has cached that says name
+// doesn't exist, so that the next Stat, ReadDir or read finds it on the
+// primary, such as after creating it there behind the FileSystem's back.
+// The Stat cache never records missing files, but the listings of the
+// ReadDir cache (see WithDirCacheTTL) leave out files created since they
+// were read: ForgetNegative drops the listings of the directories above
+// name, along with any Stat result for name. Files created or written
+// through the FileSystem don't need it, and neither does a path passed to
+// Invalidate, which does the same.
+func (fs *FileSystem) ForgetNegative(name string) {
+	fs.invalidateMeta(cleanPath(name))
+}
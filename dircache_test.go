@@ -0,0 +1,240 @@
+package corfs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// readDirCountFiler counts ReadDir calls made against the wrapped filer.
+type readDirCountFiler struct {
+	absfs.Filer
+	readDirs atomic.Int64
+}
+
+func (c *readDirCountFiler) ReadDir(name string) ([]iofs.DirEntry, error) {
+	c.readDirs.Add(1)
+	return c.Filer.ReadDir(name)
+}
+
+// entryNames returns the names of entries.
+func entryNames(entries []iofs.DirEntry) []string {
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names
+}
+
+func TestDirCache(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	mem.MkdirAll("/dir", 0755)
+	writeMemFile(t, mem, "/dir/a.txt", "alpha")
+	primary := &readDirCountFiler{Filer: mem}
+	clock := newFakeClock()
+	fs := New(primary, cache, WithDirCacheTTL(time.Minute), WithClock(clock))
+
+	for _, name := range []string{"/dir", "/dir/", "/./dir"} {
+		entries, err := fs.ReadDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entryNames(entries); !reflect.DeepEqual(got, []string{"a.txt"}) {
+			t.Errorf("ReadDir(%s) = %v, expected [a.txt]", name, got)
+		}
+	}
+	if n := primary.readDirs.Load(); n != 1 {
+		t.Errorf("primary ReadDir called %d times, expected 1", n)
+	}
+
+	// Changes behind the FileSystem's back show once the listing expires
+	writeMemFile(t, mem, "/dir/b.txt", "bravo")
+	clock.advance(time.Minute + time.Second)
+	entries, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryNames(entries); !reflect.DeepEqual(got, []string{"a.txt", "b.txt"}) {
+		t.Errorf("ReadDir() = %v after the TTL, expected [a.txt b.txt]", got)
+	}
+}
+
+func TestDirCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		dir    string
+		mode   Mode
+		mutate func(t *testing.T, fs *FileSystem)
+	}{
+		{"Create", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) { writeMemFile(t, fs, "/dir/new.txt", "new") }},
+		{"ForgetNegative", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) {
+			writeMemFile(t, fs.Primary(), "/dir/new.txt", "out of band")
+			fs.ForgetNegative("/dir/new.txt")
+		}},
+		{"ForgetNegativeDeep", "/", WriteThrough, func(t *testing.T, fs *FileSystem) {
+			fs.Primary().Mkdir("/other", 0755)
+			writeMemFile(t, fs.Primary(), "/other/new.txt", "out of band")
+			fs.ForgetNegative("/other/new.txt")
+		}},
+		{"Invalidate", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) {
+			writeMemFile(t, fs.Primary(), "/dir/new.txt", "out of band")
+			fs.Invalidate("/dir/new.txt")
+		}},
+		{"Remove", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.Remove("/dir/a.txt") }},
+		{"RenameOut", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.Rename("/dir/a.txt", "/a.txt") }},
+		{"RenameIn", "/", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.Rename("/dir/a.txt", "/a.txt") }},
+		{"Mkdir", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.Mkdir("/dir/sub", 0755) }},
+		{"MkdirAll", "/", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.MkdirAll("/other/sub", 0755) }},
+		{"RemoveAll", "/", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.RemoveAll("/dir") }},
+		{"Truncate", "/dir", WriteThrough, func(t *testing.T, fs *FileSystem) { fs.Truncate("/dir/a.txt", 2) }},
+		{"Flush", "/", WriteBack, func(t *testing.T, fs *FileSystem) {
+			writeMemFile(t, fs, "/new/deep/file.txt", "deferred")
+			if err := fs.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem, cache := newMemFilers(t)
+			mem.MkdirAll("/dir", 0755)
+			writeMemFile(t, mem, "/dir/a.txt", "alpha")
+			fs := New(mem, cache, WithDirCacheTTL(time.Hour), WithMode(tt.mode))
+			if _, err := fs.ReadDir(tt.dir); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.mutate(t, fs)
+			want, err := mem.ReadDir(tt.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := fs.ReadDir(tt.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entryNames(got), entryNames(want)) {
+				t.Errorf("ReadDir(%s) = %v, expected %v", tt.dir, entryNames(got), entryNames(want))
+			}
+			for i := range want {
+				wi, _ := want[i].Info()
+				gi, _ := got[i].Info()
+				if wi != nil && gi != nil && wi.Size() != gi.Size() {
+					t.Errorf("ReadDir(%s) lists %s with size %d, expected %d", tt.dir, want[i].Name(), gi.Size(), wi.Size())
+				}
+			}
+		})
+	}
+}
+
+func TestDirCacheOutOfBandCreate(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	mem.MkdirAll("/dir", 0755)
+	fs := New(mem, cache, WithDirCacheTTL(time.Hour), WithStatCacheTTL(time.Hour))
+	if _, err := fs.ReadDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached listing leaves out a file created behind its back, though
+	// the file itself is found
+	writeMemFile(t, mem, "/dir/new.txt", "out of band")
+	if got, _ := fs.ReadDir("/dir"); len(got) != 0 {
+		t.Errorf("ReadDir() = %v before ForgetNegative, expected the cached listing", entryNames(got))
+	}
+	if _, err := fs.Stat("/dir/new.txt"); err != nil {
+		t.Errorf("Stat() error = %v, expected the file found", err)
+	}
+
+	fs.ForgetNegative("/dir/new.txt")
+	if got, _ := fs.ReadDir("/dir"); !reflect.DeepEqual(entryNames(got), []string{"new.txt"}) {
+		t.Errorf("ReadDir() = %v after ForgetNegative, expected [new.txt]", entryNames(got))
+	}
+}
+
+func TestDirCacheDisabledCache(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	mem.MkdirAll("/dir", 0755)
+	primary := &readDirCountFiler{Filer: mem}
+	fs := New(primary, cache, WithDirCacheTTL(time.Hour))
+	fs.ReadDir("/dir")
+
+	fs.DisableCache()
+	writeMemFile(t, mem, "/dir/a.txt", "alpha")
+	entries, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryNames(entries); !reflect.DeepEqual(got, []string{"a.txt"}) || primary.readDirs.Load() != 2 {
+		t.Errorf("ReadDir() = %v after %d primary calls, expected the primary's listing while the cache is disabled",
+			got, primary.readDirs.Load())
+	}
+}
+
+func TestMetadataOnly(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	mem.MkdirAll("/dir", 0755)
+	writeMemFile(t, mem, "/dir/a.txt", "alpha")
+	readDirs := &readDirCountFiler{Filer: mem}
+	stats := &statCountFiler{Filer: readDirs}
+	primary := &readCountFiler{Filer: stats}
+	fs := New(primary, cache, WithMetadataOnly(time.Minute), WithMode(WriteBack))
+
+	for i := 0; i < 2; i++ {
+		if _, err := fs.Stat("/dir/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.ReadDir("/dir"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, r := stats.stats.Load(), readDirs.readDirs.Load(); s != 1 || r != 1 {
+		t.Errorf("primary Stat called %d times and ReadDir %d times, expected once each", s, r)
+	}
+
+	// Contents are always read from the primary and never cached
+	readTimes(t, fs, "/dir/a.txt", 2)
+	f, err := fs.OpenFile("/dir/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "alpha" {
+		t.Errorf("Read() = %q, %v, expected alpha", data, err)
+	}
+	f.Close()
+	if n := primary.reads.Load(); n != 3 {
+		t.Errorf("primary read %d times, expected 3", n)
+	}
+	if _, err := fs.CopyFile("/dir/a.txt"); !errors.Is(err, ErrNotCacheable) {
+		t.Errorf("CopyFile() error = %v, expected ErrNotCacheable", err)
+	}
+	if err := fs.Prewarm("/", func(string, iofs.DirEntry, error) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes go to the primary alone, whatever the Mode, and drop what
+	// changed from the metadata caches
+	writeMemFile(t, fs, "/dir/b.txt", "bravo")
+	if got := readString(mem, "/dir/b.txt"); got != "bravo" {
+		t.Errorf("primary /dir/b.txt = %q, expected the write to reach it", got)
+	}
+	entries, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryNames(entries); !reflect.DeepEqual(got, []string{"a.txt", "b.txt"}) {
+		t.Errorf("ReadDir() = %v after a write, expected [a.txt b.txt]", got)
+	}
+	for _, name := range []string{"/dir/a.txt", "/dir/b.txt"} {
+		if _, err := cache.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("cache Stat(%s) error = %v, expected no cached copy", name, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package corfs
+
+import (
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// EvictionPolicy chooses which cached copies to remove once the cache holds
+// more than WithEviction allows. Less reports whether the copy with status
+// a should be removed before the one with status b. The statuses passed to
+// Less are all taken at the same moment, so their frequencies are aged
+// alike.
+type EvictionPolicy interface {
+	Less(a, b CacheStatus) bool
+}
+
+// LRU returns an EvictionPolicy removing the copies read least recently
+// first.
+func LRU() EvictionPolicy {
+	return lru{}
+}
+
+type lru struct{}
+
+func (lru) Less(a, b CacheStatus) bool {
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+// LFU returns an EvictionPolicy removing the copies read least frequently
+// first, and of those read as often, the ones read least recently. With
+// WithFrequencyHalfLife, reads count for less as they age, so a file that
+// was popular once gives way to files popular now.
+func LFU() EvictionPolicy {
+	return lfu{}
+}
+
+type lfu struct{}
+
+func (lfu) Less(a, b CacheStatus) bool {
+	if a.Frequency != b.Frequency {
+		return a.Frequency < b.Frequency
+	}
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+// evictionOrder returns the paths of the copies evict may remove, other
+// than keep, with their statuses, in the order the eviction policy removes
+// them.
+func (fs *FileSystem) evictionOrder(keep string) ([]string, []CacheStatus) {
+	policy := fs.eviction
+	if policy == nil {
+		policy = LRU()
+	}
+	names, statuses := fs.index.candidates(keep, fs.clock.Now())
+	sort.Stable(byPolicy{names, statuses, policy})
+	return names, statuses
+}
+
+// byPolicy sorts paths and their statuses by an eviction policy.
+type byPolicy struct {
+	names    []string
+	statuses []CacheStatus
+	policy   EvictionPolicy
+}
+
+func (b byPolicy) Len() int { return len(b.names) }
+
+func (b byPolicy) Less(i, j int) bool { return b.policy.Less(b.statuses[i], b.statuses[j]) }
+
+func (b byPolicy) Swap(i, j int) {
+	b.names[i], b.names[j] = b.names[j], b.names[i]
+	b.statuses[i], b.statuses[j] = b.statuses[j], b.statuses[i]
+}
+
+// evict removes cached copies in the order of the eviction policy until
+// the cache holds no more than WithEviction and WithMaxEntries allow. The
+// copy of keep, just cached, is never removed, and neither are dirty copies
+// or those open for writing. The caller must hold the cache.
+func (fs *FileSystem) evict(cache absfs.Filer, keep string) {
+	var overBytes int64
+	var overEntries int
+	if fs.maxBytes > 0 {
+		overBytes = fs.index.bytes() - fs.maxBytes
+	}
+	if fs.maxEntries > 0 {
+		overEntries = fs.index.count() - fs.maxEntries
+	}
+	if overBytes <= 0 && overEntries <= 0 {
+		return
+	}
+
+	names, statuses := fs.evictionOrder(keep)
+	for i, name := range names {
+		if overBytes <= 0 && overEntries <= 0 {
+			return
+		}
+		var err error
+		pruned := fs.index.prune(name, func() {
+			err = cache.Remove(name)
+		})
+		if !pruned {
+			continue
+		}
+		fs.blocks.drop(cache, name)
+		if overEntries > 0 {
+			fs.stats.entryEvicts.Add(1)
+		}
+		overBytes -= statuses[i].Size
+		overEntries--
+		fs.stats.evictions.Add(1)
+		fs.decide(DecisionEvict, name, nil)
+		fs.reportCacheError("evict", name, err)
+	}
+}
@@ -0,0 +1,126 @@
+package corfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// readTimes reads name n times through fs.
+func readTimes(t *testing.T, fs *FileSystem, name string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		writeMemFile(t, mem, name, "content")
+	}
+	fs := New(mem, cache, WithEviction(14, LRU()))
+	fs.cacheFirst = true
+
+	readTimes(t, fs, "/a.txt", 1)
+	readTimes(t, fs, "/b.txt", 1)
+	readTimes(t, fs, "/a.txt", 1)
+	readTimes(t, fs, "/c.txt", 1)
+
+	if _, err := cache.Stat("/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/b.txt) error = %v, expected the least recently read copy to be evicted", err)
+	}
+	for _, name := range []string{"/a.txt", "/c.txt"} {
+		if st := fs.CacheStatus(name); !st.Complete {
+			t.Errorf("CacheStatus(%s) = %+v, expected a complete copy", name, st)
+		}
+	}
+	if st := fs.Stats(); st.CacheBytes != 14 || st.Evictions != 1 {
+		t.Errorf("Stats() = %+v, expected 14 bytes cached after 1 eviction", st)
+	}
+}
+
+func TestEvictionLFUAging(t *testing.T) {
+	for _, halfLife := range []time.Duration{0, time.Hour} {
+		mem, cache := newMemFilers(t)
+		for _, name := range []string{"/once.txt", "/now.txt", "/new.txt"} {
+			writeMemFile(t, mem, name, "content")
+		}
+		clock := newFakeClock()
+		fs := New(mem, cache, WithEviction(14, LFU()), WithFrequencyHalfLife(halfLife), WithClock(clock))
+		fs.cacheFirst = true
+
+		// Popular once, then nobody reads it while another file is popular
+		readTimes(t, fs, "/once.txt", 10)
+		clock.advance(2 * halfLife)
+		readTimes(t, fs, "/now.txt", 3)
+		if f, want := fs.CacheStatus("/once.txt").Frequency, 10.0; halfLife == 0 && f != want || halfLife > 0 && f != want/4 {
+			t.Errorf("halfLife=%v: Frequency = %v, expected 10 fetches and reads aged by two half-lives", halfLife, f)
+		}
+		readTimes(t, fs, "/new.txt", 1)
+
+		// Without aging, past popularity keeps the file cached for good
+		evicted, kept := "/once.txt", "/now.txt"
+		if halfLife == 0 {
+			evicted, kept = kept, evicted
+		}
+		if _, err := cache.Stat(evicted); !os.IsNotExist(err) {
+			t.Errorf("halfLife=%v: cache Stat(%s) error = %v, expected it to be evicted", halfLife, evicted, err)
+		}
+		for _, name := range []string{kept, "/new.txt"} {
+			if st := fs.CacheStatus(name); !st.Complete {
+				t.Errorf("halfLife=%v: CacheStatus(%s) = %+v, expected a complete copy", halfLife, name, st)
+			}
+		}
+	}
+}
+
+func TestEvictionKeepsDirtyFiles(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/clean.txt", "content")
+	fs := New(primary, cache, WithMode(WriteBack), WithEviction(7, nil))
+	fs.cacheFirst = true
+
+	writeMemFile(t, fs, "/dirty.txt", "deferred")
+	readTimes(t, fs, "/clean.txt", 1)
+	if got := readString(cache, "/dirty.txt"); got != "deferred" {
+		t.Errorf("cache /dirty.txt = %q, expected the unflushed copy to be kept", got)
+	}
+	if st := fs.CacheStatus("/clean.txt"); !st.Complete {
+		t.Errorf("CacheStatus(/clean.txt) = %+v, expected the copy just cached to be kept", st)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		writeMemFile(t, mem, name, "content")
+	}
+	fs := New(mem, cache, WithMaxEntries(2), WithEviction(1<<20, LFU()))
+	fs.cacheFirst = true
+
+	readTimes(t, fs, "/a.txt", 3)
+	readTimes(t, fs, "/b.txt", 1)
+	readTimes(t, fs, "/c.txt", 2)
+
+	if _, err := cache.Stat("/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/b.txt) error = %v, expected the least frequently read copy to be evicted", err)
+	}
+	if st := fs.Stats(); st.CacheEntries != 2 || st.Evictions != 1 || st.EntryEvictions != 1 {
+		t.Errorf("Stats() = %+v, expected 2 entries cached after 1 eviction for the entry limit", st)
+	}
+
+	// Without WithEviction, the default policy is LRU
+	fs = New(mem, cache, WithMaxEntries(1))
+	fs.cacheFirst = true
+	readTimes(t, fs, "/a.txt", 3)
+	readTimes(t, fs, "/b.txt", 1)
+	if st := fs.CacheStatus("/a.txt"); st.Complete {
+		t.Errorf("CacheStatus(/a.txt) = %+v, expected the least recently read copy to be evicted", st)
+	}
+	if st := fs.Stats(); st.CacheEntries != 1 || st.EntryEvictions != 1 {
+		t.Errorf("Stats() = %+v, expected 1 entry cached after 1 eviction", st)
+	}
+}
@@ -0,0 +1,48 @@
+package corfs
+
+import "expvar"
+
+// PublishExpvar publishes the FileSystem's Stats as the expvar variable
+// name, a map of the Stats fields along with HitRatio and MemoryHitRatio,
+// each Latency given as its count and its durations in seconds. The values
+// are read whenever the variable is, so they are always current. Like
+// expvar.Publish, it panics if name is already in use.
+func (fs *FileSystem) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		s := fs.Stats()
+		return map[string]any{
+			"reads":            s.Reads,
+			"hits":             s.Hits,
+			"hitRatio":         s.HitRatio(),
+			"promotions":       s.Promotions,
+			"pending":          s.Pending,
+			"cacheBytes":       s.CacheBytes,
+			"evictions":        s.Evictions,
+			"cacheErrors":      s.CacheErrors,
+			"cacheEntries":     s.CacheEntries,
+			"entryEvictions":   s.EntryEvictions,
+			"cacheHandles":     s.CacheHandles,
+			"peakCacheHandles": s.PeakCacheHandles,
+			"cacheFullSkips":   s.CacheFullSkips,
+			"disabledOps":      s.DisabledOps,
+			"admitted":         s.Admitted,
+			"rejected":         s.Rejected,
+			"memoryHits":       s.MemoryHits,
+			"memoryMisses":     s.MemoryMisses,
+			"memoryHitRatio":   s.MemoryHitRatio(),
+			"memoryBytes":      s.MemoryBytes,
+			"flushes":          s.Flushes,
+			"idleFlushes":      s.IdleFlushes,
+			"flushErrors":      s.FlushErrors,
+
+			"primaryReadCount":      s.PrimaryReadLatency.Count,
+			"primaryReadSeconds":    s.PrimaryReadLatency.Total.Seconds(),
+			"primaryReadMinSeconds": s.PrimaryReadLatency.Min.Seconds(),
+			"primaryReadMaxSeconds": s.PrimaryReadLatency.Max.Seconds(),
+			"cacheWriteCount":       s.CacheWriteLatency.Count,
+			"cacheWriteSeconds":     s.CacheWriteLatency.Total.Seconds(),
+			"cacheWriteMinSeconds":  s.CacheWriteLatency.Min.Seconds(),
+			"cacheWriteMaxSeconds":  s.CacheWriteLatency.Max.Seconds(),
+		}
+	}))
+}
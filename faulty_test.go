@@ -0,0 +1,119 @@
+package corfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// faultyFiler is a cache filer whose OpenFile misbehaves by returning a nil
+// file without an error: an untyped nil, or with typed set, a nil pointer.
+type faultyFiler struct {
+	absfs.Filer
+	typed bool
+}
+
+// nilFile is the file type of faultyFiler's nil pointers.
+type nilFile struct {
+	absfs.File
+}
+
+func (f *faultyFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if f.typed {
+		return (*nilFile)(nil), nil
+	}
+	return nil, nil
+}
+
+func TestFaultyCacheDegrades(t *testing.T) {
+	configs := map[string][]Option{
+		"default":    nil,
+		"cacheFirst": {WithCacheFirst()},
+		"blocks":     {WithBlockSize(4)},
+		"dedup":      {WithDedup()},
+		"memory":     {WithCacheFirst(), WithMemoryCache(1<<10, 0)},
+		"fillOnOpen": {WithFillOnOpen()},
+	}
+	for name, opts := range configs {
+		for _, typed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/typed=%v", name, typed), func(t *testing.T) {
+				mem, cache := newMemFilers(t)
+				if err := mem.Mkdir("/dir", 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeMemFile(t, mem, "/dir/a.txt", "primary content")
+				fs := New(mem, &faultyFiler{Filer: cache, typed: typed}, opts...)
+
+				// Reads are served by the primary
+				for i := 0; i < 2; i++ {
+					if got := readString(fs, "/dir/a.txt"); got != "primary content" {
+						t.Errorf("ReadFile() = %q, expected %q", got, "primary content")
+					}
+				}
+				f, err := fs.OpenFile("/dir/a.txt", os.O_RDONLY, 0)
+				if err != nil {
+					t.Fatalf("OpenFile() error = %v", err)
+				}
+				buf := make([]byte, 7)
+				if n, err := f.ReadAt(buf, 8); err != nil || string(buf[:n]) != "content" {
+					t.Errorf("ReadAt() = %q, %v, expected %q", buf[:n], err, "content")
+				}
+				if data, err := io.ReadAll(f); err != nil || string(data) != "primary content" {
+					t.Errorf("Read() = %q, %v, expected %q", data, err, "primary content")
+				}
+				f.Close()
+
+				// Writes reach the primary
+				writeMemFile(t, fs, "/dir/b.txt", "written")
+				if got := readString(mem, "/dir/b.txt"); got != "written" {
+					t.Errorf("primary /dir/b.txt = %q, expected %q", got, "written")
+				}
+				f, err = fs.OpenFile("/dir/b.txt", os.O_RDWR, 0)
+				if err != nil {
+					t.Fatalf("OpenFile(O_RDWR) error = %v", err)
+				}
+				if _, err := f.WriteAt([]byte("W"), 0); err != nil {
+					t.Errorf("WriteAt() error = %v", err)
+				}
+				if data, err := io.ReadAll(f); err != nil || string(data) != "Written" {
+					t.Errorf("Read() through O_RDWR = %q, %v, expected %q", data, err, "Written")
+				}
+				f.Close()
+				if err := fs.Truncate("/dir/b.txt", 3); err != nil {
+					t.Errorf("Truncate() error = %v", err)
+				}
+
+				// Explicit cache operations fail without panicking
+				if _, err := fs.CopyFile("/dir/a.txt"); err == nil {
+					t.Error("CopyFile() succeeded without a usable cache")
+				}
+				if err := fs.Seed("/dir/c.txt", strings.NewReader("seeded"), nil); err == nil {
+					t.Error("Seed() succeeded without a usable cache")
+				}
+				fs.Verify(true)
+				fs.Prune()
+				if err := fs.RemoveAll("/dir"); err != nil {
+					t.Errorf("RemoveAll() error = %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestFaultyCacheWriteBack(t *testing.T) {
+	for _, typed := range []bool{false, true} {
+		mem, cache := newMemFilers(t)
+		fs := New(mem, &faultyFiler{Filer: cache, typed: typed}, WithMode(WriteBack))
+
+		if _, err := fs.OpenFile("/a.txt", os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			t.Errorf("typed=%v: OpenFile() succeeded without a cache to write back from", typed)
+		}
+		if err := fs.Sync(); err != nil {
+			t.Errorf("typed=%v: Sync() error = %v", typed, err)
+		}
+	}
+}
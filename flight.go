@@ -0,0 +1,77 @@
+package corfs
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup tracks cache fills in progress so concurrent readers of the
+// same path don't each fetch it from the primary and race to fill the
+// cache. A separate group tracks write-back flushes so that those of the
+// same path take turns.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a single cache fill in progress.
+type flight struct {
+	done chan struct{} // Closed when the fill ends
+	err  error         // Result of the fill, valid once done is closed
+
+	// waitable is set for fills that run to completion on their own, such
+	// as ReadFile. Fills driven by a File handle depend on the caller
+	// reading to EOF, so other readers must not wait for them.
+	waitable bool
+
+	cached atomic.Int64 // Bytes of content filled so far (see FillProgress)
+	total  atomic.Int64 // Size of the file, or -1 if unknown
+}
+
+// begin registers a fill for key. If a fill for key is already in progress
+// it returns that fill and false; otherwise the caller owns the new fill and
+// must call end.
+func (g *flightGroup) begin(key string, waitable bool) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	c := &flight{done: make(chan struct{}), waitable: waitable}
+	c.total.Store(-1)
+	g.calls[key] = c
+	return c, true
+}
+
+// lookup returns the fill in progress for key, if any.
+func (g *flightGroup) lookup(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.calls[key]
+	return c, ok
+}
+
+// end records the result of a fill started with begin and releases any
+// waiters.
+func (g *flightGroup) end(key string, c *flight, err error) {
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	c.err = err
+	close(c.done)
+}
+
+// wait blocks until a waitable fill ends and reports whether it succeeded.
+// It returns false immediately for fills that can't be waited on.
+func (c *flight) wait() bool {
+	if !c.waitable {
+		return false
+	}
+	<-c.done
+	return c.err == nil
+}
@@ -0,0 +1,167 @@
+package corfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// gatedFiler counts primary reads and holds them until gate is closed.
+type gatedFiler struct {
+	absfs.Filer
+	gate chan struct{}
+
+	mu    sync.Mutex
+	reads int
+	opens int
+}
+
+func (g *gatedFiler) ReadFile(name string) ([]byte, error) {
+	g.mu.Lock()
+	g.reads++
+	g.mu.Unlock()
+	<-g.gate
+	return g.Filer.ReadFile(name)
+}
+
+func (g *gatedFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	g.mu.Lock()
+	g.opens++
+	g.mu.Unlock()
+	return g.Filer.OpenFile(name, flag, perm)
+}
+
+// tempCountFiler counts temporary files created in the cache.
+type tempCountFiler struct {
+	absfs.Filer
+
+	mu    sync.Mutex
+	temps int
+}
+
+func (c *tempCountFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if isTempName(name[strings.LastIndex(name, "/")+1:]) {
+		c.mu.Lock()
+		c.temps++
+		c.mu.Unlock()
+	}
+	return c.Filer.OpenFile(name, flag, perm)
+}
+
+func TestReadFileCoalescesConcurrentReads(t *testing.T) {
+	mem, memCache := newMemFilers(t)
+	writeMemFile(t, mem, "/cold.txt", "cold content")
+	primary := &gatedFiler{Filer: mem, gate: make(chan struct{})}
+	cache := &tempCountFiler{Filer: memCache}
+	fs := New(primary, cache)
+
+	const readers = 50
+	var wg sync.WaitGroup
+	results := make([][]byte, readers)
+	errs := make([]error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = fs.ReadFile("/cold.txt")
+		}(i)
+	}
+
+	// Let every reader arrive before the primary responds
+	time.Sleep(50 * time.Millisecond)
+	close(primary.gate)
+	wg.Wait()
+
+	for i := 0; i < readers; i++ {
+		if errs[i] != nil || string(results[i]) != "cold content" {
+			t.Fatalf("reader %d got %q, %v", i, results[i], errs[i])
+		}
+	}
+	if primary.reads != 1 {
+		t.Errorf("primary ReadFile called %d times, expected 1", primary.reads)
+	}
+	if cache.temps != 1 {
+		t.Errorf("cache filled %d times, expected 1", cache.temps)
+	}
+}
+
+func TestOpenFileWaitsForReadFile(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/cold.txt", "cold content")
+	primary := &gatedFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fs.ReadFile("/cold.txt")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	opened := make(chan absfs.File)
+	go func() {
+		f, err := fs.OpenFile("/cold.txt", os.O_RDONLY, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- f
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(primary.gate)
+	<-done
+
+	f := <-opened
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "cold content" {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+	if primary.opens != 0 {
+		t.Errorf("primary OpenFile called %d times, expected the cache to serve the open", primary.opens)
+	}
+}
+
+func TestConcurrentHandlesFillOnce(t *testing.T) {
+	primary, memCache := newMemFilers(t)
+	content := strings.Repeat("0123456789", 1000)
+	writeMemFile(t, primary, "/file.txt", content)
+	cache := &tempCountFiler{Filer: memCache}
+	fs := New(primary, cache)
+
+	// Both handles are mid-read at the same time
+	a, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	a.Read(buf)
+	b.Read(buf)
+
+	for _, f := range []absfs.File{a, b} {
+		rest, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, []byte(content[100:])) {
+			t.Error("handle read unexpected content")
+		}
+		f.Close()
+	}
+
+	if cache.temps != 1 {
+		t.Errorf("cache filled %d times, expected 1", cache.temps)
+	}
+	if data, err := memCache.ReadFile("/file.txt"); err != nil || string(data) != content {
+		t.Errorf("cache holds %d bytes, %v", len(data), err)
+	}
+}
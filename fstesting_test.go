@@ -2,6 +2,7 @@ package corfs_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/absfs/absfs"
 	"github.com/absfs/corfs"
@@ -142,3 +143,80 @@ func TestCorFS_QuickCheck(t *testing.T) {
 
 	suite.QuickCheck(t)
 }
+
+// TestCorFS_StatCacheQuickCheck runs the quick sanity check with the Stat
+// cache enabled to verify that mutations invalidate cached results.
+func TestCorFS_StatCacheQuickCheck(t *testing.T) {
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.MkdirAll(primary.TempDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.MkdirAll(cache.TempDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	corFilesystem := corfs.New(primary, cache, corfs.WithStatCacheTTL(time.Minute))
+	fs := absfs.ExtendFiler(corFilesystem)
+
+	suite := &fstesting.Suite{
+		FS: fs,
+		Features: fstesting.Features{
+			Permissions:   true,
+			Timestamps:    true,
+			CaseSensitive: true,
+			AtomicRename:  true,
+			LargeFiles:    true,
+		},
+		TestDir: "/",
+	}
+
+	suite.QuickCheck(t)
+}
+
+// TestCorFS_SparseQuickCheck runs the quick sanity check with sparse fills
+// enabled to verify that cached copies read back the primary's content.
+func TestCorFS_SparseQuickCheck(t *testing.T) {
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.MkdirAll(primary.TempDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.MkdirAll(cache.TempDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	corFilesystem := corfs.New(primary, cache, corfs.WithSparseFiles())
+	fs := absfs.ExtendFiler(corFilesystem)
+
+	suite := &fstesting.Suite{
+		FS: fs,
+		Features: fstesting.Features{
+			Permissions:   true,
+			Timestamps:    true,
+			CaseSensitive: true,
+			AtomicRename:  true,
+			SparseFiles:   true, // Fills leave blocks of zeros as holes
+			LargeFiles:    true,
+		},
+		TestDir: "/",
+	}
+
+	suite.QuickCheck(t)
+}
@@ -0,0 +1,20 @@
+package corfs
+
+// Bump starts a new data generation, invalidating every cached copy at
+// once without touching the cache: copies fetched in an earlier generation
+// are treated as missing, so they are neither served nor reported by
+// CacheStatus, and are replaced as their files are read again or removed by
+// Prune. Copies with unflushed WriteBack writes are kept. Cached blocks
+// (see WithBlockSize) are fetched again as well. Bump returns the new
+// generation.
+func (fs *FileSystem) Bump() uint64 {
+	generation := fs.index.bump()
+	fs.blocks.reset()
+	return generation
+}
+
+// Generation returns the current data generation, which starts at zero and
+// is incremented by each Bump.
+func (fs *FileSystem) Generation() uint64 {
+	return fs.index.currentGeneration()
+}
@@ -0,0 +1,86 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestBumpInvalidatesCachedCopies(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/data.txt", "v1")
+	primary := &readCountFiler{Filer: mem}
+	fs := NewChain(cache, primary)
+
+	for i := 0; i < 2; i++ {
+		if _, err := fs.ReadFile("/data.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, mem, "/data.txt", "v2")
+
+	if g := fs.Bump(); g != 1 || fs.Generation() != 1 {
+		t.Fatalf("Bump() = %d, Generation() = %d; expected 1", g, fs.Generation())
+	}
+	if st := fs.CacheStatus("/data.txt"); st.Cached {
+		t.Errorf("CacheStatus() = %+v after Bump, expected no entry", st)
+	}
+	for i := 0; i < 2; i++ {
+		data, err := fs.ReadFile("/data.txt")
+		if err != nil || string(data) != "v2" {
+			t.Fatalf("ReadFile() = %q, %v; expected %q", data, err, "v2")
+		}
+	}
+	// The first read after Bump refetched the file and cached it again
+	if n := primary.reads.Load(); n != 2 {
+		t.Errorf("primary reads = %d, expected 2", n)
+	}
+}
+
+func TestBumpedCopiesNotServedAsFallback(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "a")
+	writeMemFile(t, primary, "/b.txt", "b")
+	fs := New(primary, cache)
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Bump()
+
+	primary.Remove("/a.txt")
+	if _, err := fs.ReadFile("/a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadFile() error = %v, expected %v", err, os.ErrNotExist)
+	}
+
+	if n, err := fs.Prune(); err != nil || n != 1 {
+		t.Errorf("Prune() = %d, %v; expected 1 file removed", n, err)
+	}
+	if _, err := cache.Stat("/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cache Stat(/b.txt) error = %v, expected it pruned", err)
+	}
+}
+
+func TestBumpKeepsDirtyCopies(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	f, err := fs.OpenFile("/dirty.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("unflushed"))
+	f.Close()
+
+	fs.Bump()
+	data, err := fs.ReadFile("/dirty.txt")
+	if err != nil || string(data) != "unflushed" {
+		t.Errorf("ReadFile() = %q, %v; expected %q", data, err, "unflushed")
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if st := fs.CacheStatus("/dirty.txt"); !st.Complete || st.Dirty {
+		t.Errorf("CacheStatus() = %+v after Sync, expected a clean complete entry", st)
+	}
+}
@@ -0,0 +1,151 @@
+package corfs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errHandleLimit is the result of a cache fill skipped because the cache
+// handle limit was reached (see WithMaxCacheHandles).
+var errHandleLimit = errors.New("corfs: too many open cache handles")
+
+// ErrCacheFull is returned by reads that would fill the cache while the
+// cache handle limit is reached, with the FailWhenFull policy.
+var ErrCacheFull = errors.New("corfs: cache full")
+
+// CacheFullPolicy is what a read does when it would fill the cache but the
+// cache handle limit has been reached (see WithCacheFullPolicy).
+type CacheFullPolicy int
+
+const (
+	SkipWhenFull CacheFullPolicy = iota // Read without caching (the default)
+	WaitWhenFull                        // Wait for a handle, up to a timeout, then skip
+	FailWhenFull                        // Fail with ErrCacheFull
+)
+
+func (p CacheFullPolicy) String() string {
+	switch p {
+	case SkipWhenFull:
+		return "skip"
+	case WaitWhenFull:
+		return "wait"
+	case FailWhenFull:
+		return "fail"
+	}
+	return "unknown"
+}
+
+// handleGate counts the cache files a FileSystem holds open for fills and
+// block caching, and caps those opened on behalf of reads.
+type handleGate struct {
+	max    int64           // Maximum handles opened for reads, if positive
+	policy CacheFullPolicy // What reads do at the limit
+	wait   time.Duration   // Longest wait for a handle with WaitWhenFull
+	open   atomic.Int64
+	peak   atomic.Int64
+	full   atomic.Uint64 // Reads that found the limit reached and didn't wait for a handle
+
+	mu    sync.Mutex
+	freed chan struct{} // Closed when a handle is released, then replaced
+}
+
+// acquire counts a handle about to be opened for a read. If the limit has
+// been reached, it applies the policy: it fails with errHandleLimit, or
+// ErrCacheFull with FailWhenFull, after waiting for a handle to be released
+// with WaitWhenFull.
+func (g *handleGate) acquire() error {
+	if g.tryAcquire() {
+		return nil
+	}
+	if g.policy == WaitWhenFull && g.wait > 0 {
+		timer := time.NewTimer(g.wait)
+		defer timer.Stop()
+		for {
+			// Take the channel before retrying, so a release in between
+			// isn't missed
+			freed := g.released()
+			if g.tryAcquire() {
+				return nil
+			}
+			select {
+			case <-freed:
+			case <-timer.C:
+				g.full.Add(1)
+				return errHandleLimit
+			}
+		}
+	}
+	g.full.Add(1)
+	if g.policy == FailWhenFull {
+		return ErrCacheFull
+	}
+	return errHandleLimit
+}
+
+// tryAcquire counts a handle about to be opened for a read, unless the
+// limit has been reached.
+func (g *handleGate) tryAcquire() bool {
+	for {
+		n := g.open.Load()
+		if g.max > 0 && n >= g.max {
+			return false
+		}
+		if g.open.CompareAndSwap(n, n+1) {
+			g.raisePeak(n + 1)
+			return true
+		}
+	}
+}
+
+// released returns a channel closed when a handle is next released.
+func (g *handleGate) released() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.freed == nil {
+		g.freed = make(chan struct{})
+	}
+	return g.freed
+}
+
+// take counts a handle that must be opened regardless of the limit.
+func (g *handleGate) take() {
+	g.raisePeak(g.open.Add(1))
+}
+
+// release uncounts a closed handle, waking reads waiting for one.
+func (g *handleGate) release() {
+	g.open.Add(-1)
+	if g.policy != WaitWhenFull {
+		return
+	}
+	g.mu.Lock()
+	if g.freed != nil {
+		close(g.freed)
+		g.freed = nil
+	}
+	g.mu.Unlock()
+}
+
+// resetCounts restarts the peak from the handles open now and forgets the
+// reads that found the limit reached.
+func (g *handleGate) resetCounts() {
+	g.peak.Store(g.open.Load())
+	g.full.Store(0)
+}
+
+func (g *handleGate) raisePeak(n int64) {
+	for {
+		peak := g.peak.Load()
+		if n <= peak || g.peak.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+// CacheFullPolicy returns what reads do when they would fill the cache but
+// the cache handle limit has been reached.
+func (fs *FileSystem) CacheFullPolicy() CacheFullPolicy {
+	return fs.handles.policy
+}
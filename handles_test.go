@@ -0,0 +1,188 @@
+package corfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+func TestMaxCacheHandles(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "first")
+	writeMemFile(t, primary, "/b.txt", "second")
+	var got cacheErrors
+	fs := New(primary, cache, WithMaxCacheHandles(1), WithCacheErrorHandler(got.handle))
+
+	a, err := fs.OpenFile("/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := fs.Stats(); s.CacheHandles != 1 {
+		t.Errorf("CacheHandles = %d, expected 1 while /a.txt fills", s.CacheHandles)
+	}
+
+	// Reads past the limit succeed without caching
+	b, err := fs.OpenFile("/b.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(b)
+	if err != nil || string(data) != "second" {
+		t.Errorf("ReadAll() = %q, %v; expected \"second\"", data, err)
+	}
+	b.Close()
+	if fs.CacheStatus("/b.txt").Complete {
+		t.Error("/b.txt was cached past the handle limit")
+	}
+	if ops := got.ops(); len(ops) != 0 {
+		t.Errorf("reported ops = %v, expected none", ops)
+	}
+
+	if _, err := io.ReadAll(a); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if !fs.CacheStatus("/a.txt").Complete {
+		t.Error("/a.txt wasn't cached")
+	}
+	s := fs.Stats()
+	if s.CacheHandles != 0 || s.PeakCacheHandles != 1 || s.CacheFullSkips != 1 {
+		t.Errorf("CacheHandles, PeakCacheHandles, CacheFullSkips = %d, %d, %d; expected 0, 1, 1",
+			s.CacheHandles, s.PeakCacheHandles, s.CacheFullSkips)
+	}
+
+	// Once the handle is released, reads cache again
+	if _, err := fs.ReadFile("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.CacheStatus("/b.txt").Complete {
+		t.Error("/b.txt wasn't cached after the handle was released")
+	}
+}
+
+func TestMaxCacheHandlesBlocks(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.bin", string(testContent(100)))
+	writeMemFile(t, primary, "/b.bin", string(testContent(100)))
+	fs := New(primary, cache, WithBlockSize(16), WithMaxCacheHandles(1))
+
+	a, err := fs.OpenFile("/a.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := fs.OpenFile("/b.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	buf := make([]byte, 10)
+	if _, err := a.ReadAt(buf, 20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ReadAt(buf, 20); err != nil {
+		t.Fatalf("ReadAt() past the handle limit error = %v", err)
+	}
+	if s := fs.Stats(); s.CacheHandles != 1 {
+		t.Errorf("CacheHandles = %d, expected 1", s.CacheHandles)
+	}
+	a.Close()
+	if s := fs.Stats(); s.CacheHandles != 0 {
+		t.Errorf("CacheHandles = %d after Close, expected 0", s.CacheHandles)
+	}
+}
+
+// holdCacheHandle opens name and reads from it, so that its fill holds a
+// cache handle until the returned file is read to the end.
+func holdCacheHandle(t *testing.T, fs *FileSystem, name string) absfs.File {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCacheFullPolicyFail(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "first")
+	writeMemFile(t, primary, "/b.txt", "second")
+	fs := New(primary, cache, WithMaxCacheHandles(1), WithCacheFullPolicy(FailWhenFull, 0))
+	if p := fs.CacheFullPolicy(); p != FailWhenFull {
+		t.Errorf("CacheFullPolicy() = %v, expected %v", p, FailWhenFull)
+	}
+
+	a := holdCacheHandle(t, fs, "/a.txt")
+	defer a.Close()
+	if _, err := fs.ReadFile("/b.txt"); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("ReadFile() error = %v, expected ErrCacheFull", err)
+	}
+	b, err := fs.OpenFile("/b.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := io.ReadAll(b); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("ReadAll() error = %v, expected ErrCacheFull", err)
+	}
+	if n := fs.Stats().CacheFullSkips; n != 2 {
+		t.Errorf("CacheFullSkips = %d, expected 2", n)
+	}
+}
+
+func TestCacheFullPolicyWait(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "first")
+	writeMemFile(t, primary, "/b.txt", "second")
+	fs := New(primary, cache, WithMaxCacheHandles(1), WithCacheFullPolicy(WaitWhenFull, time.Minute))
+
+	a := holdCacheHandle(t, fs, "/a.txt")
+	done := make(chan error, 1)
+	go func() {
+		_, err := fs.ReadFile("/b.txt")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("ReadFile() = %v before a cache handle was released", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if _, err := io.ReadAll(a); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !fs.CacheStatus("/b.txt").Complete {
+		t.Error("/b.txt wasn't cached once a handle was released")
+	}
+	if n := fs.Stats().CacheFullSkips; n != 0 {
+		t.Errorf("CacheFullSkips = %d, expected 0", n)
+	}
+
+	// Waits give up at the timeout
+	fs.handles.wait = time.Millisecond
+	a = holdCacheHandle(t, fs, "/a.txt")
+	defer a.Close()
+	fs.Remove("/b.txt")
+	writeMemFile(t, primary, "/b.txt", "second")
+	if data, err := fs.ReadFile("/b.txt"); err != nil || string(data) != "second" {
+		t.Errorf("ReadFile() = %q, %v; expected %q", data, err, "second")
+	}
+	if n := fs.Stats().CacheFullSkips; n != 1 {
+		t.Errorf("CacheFullSkips = %d, expected 1", n)
+	}
+}
@@ -0,0 +1,168 @@
+package corfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrPrimaryDown is returned for reads that can't be served from the cache
+// while the primary is marked down (see WithHealthCheck).
+var ErrPrimaryDown = errors.New("corfs: primary unavailable")
+
+// HealthCheck configures how a FileSystem detects that its primary is down
+// and when it is back.
+type HealthCheck struct {
+	// Probe reports whether the primary is reachable. If nil, the primary
+	// is probed with Stat("/").
+	Probe func() error
+
+	// IsOutage reports whether an error returned by the primary means it is
+	// down. If nil, every error is treated as an outage except the io/fs
+	// sentinel errors, io.EOF, context.Canceled, and errors for paths that
+	// aren't directories or are.
+	IsOutage func(err error) bool
+
+	// Interval is how long to wait between probes while the primary is
+	// down. It defaults to five seconds.
+	Interval time.Duration
+}
+
+// defaultProbeInterval is the HealthCheck Interval used when none is set.
+const defaultProbeInterval = 5 * time.Second
+
+// Health describes the availability of a FileSystem's primary.
+type Health struct {
+	Down  bool      // Reads are being served from the cache alone
+	Since time.Time // When the primary last went down or came back up
+	Err   error     // Error that marked the primary down, or the latest failed probe
+}
+
+// healthState tracks the availability of the primary. A nil *healthState
+// is valid and always reports the primary as up.
+type healthState struct {
+	probe    func() error
+	isOutage func(error) bool
+	interval time.Duration
+	pinned   bool // Down for good, never probed (see WithOffline)
+	clock    Clock
+
+	mu        sync.Mutex
+	health    Health
+	lastProbe time.Time // When the primary was last probed or marked down
+	probing   bool      // A probe is in progress
+}
+
+func newHealthState(hc HealthCheck, fs *FileSystem) *healthState {
+	h := &healthState{probe: hc.Probe, isOutage: hc.IsOutage, interval: hc.Interval, clock: systemClock{}}
+	if h.probe == nil {
+		h.probe = func() error {
+			_, err := fs.primary.Stat("/")
+			return err
+		}
+	}
+	if h.isOutage == nil {
+		h.isOutage = isOutage
+	}
+	if h.interval <= 0 {
+		h.interval = defaultProbeInterval
+	}
+	return h
+}
+
+// isOutage is the default HealthCheck IsOutage. Errors that describe the
+// request rather than the primary's availability are not outages.
+func isOutage(err error) bool {
+	for _, target := range []error{
+		io.EOF,
+		iofs.ErrNotExist,
+		iofs.ErrExist,
+		iofs.ErrPermission,
+		iofs.ErrInvalid,
+		iofs.ErrClosed,
+		context.Canceled,
+		syscall.ENOTDIR,
+		syscall.EISDIR,
+	} {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
+// up reports whether the primary should be used. While it is down, the
+// first call after each interval probes it, and other calls don't wait for
+// the probe.
+func (h *healthState) up() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	if !h.health.Down {
+		h.mu.Unlock()
+		return true
+	}
+	if h.pinned || h.probing || h.clock.Now().Sub(h.lastProbe) < h.interval {
+		h.mu.Unlock()
+		return false
+	}
+	h.probing = true
+	h.mu.Unlock()
+
+	err := h.probe()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing = false
+	h.lastProbe = h.clock.Now()
+	if err != nil {
+		h.health.Err = err
+		return false
+	}
+	h.health = Health{Since: h.lastProbe}
+	return true
+}
+
+// observe marks the primary down if err, returned by the primary, means it
+// is unavailable.
+func (h *healthState) observe(err error) {
+	if h == nil || err == nil || !h.isOutage(err) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.health.Down {
+		return
+	}
+	now := h.clock.Now()
+	h.health = Health{Down: true, Since: now, Err: err}
+	h.lastProbe = now
+}
+
+// get returns the current health.
+func (h *healthState) get() Health {
+	if h == nil {
+		return Health{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+// Health reports the availability of the primary. Without WithHealthCheck
+// the primary is always reported up.
+func (fs *FileSystem) Health() Health {
+	return fs.health.get()
+}
+
+// primaryDown returns the error for a read of name that the cache can't
+// serve while the primary is down.
+func primaryDown(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: ErrPrimaryDown}
+}
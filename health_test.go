@@ -0,0 +1,152 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+var errUnreachable = errors.New("primary unreachable")
+
+// outageFiler fails every read with errUnreachable while down is set, and
+// counts the reads it is asked for.
+type outageFiler struct {
+	absfs.Filer
+	down  atomic.Bool
+	calls atomic.Int64
+}
+
+func (o *outageFiler) check() error {
+	o.calls.Add(1)
+	if o.down.Load() {
+		return errUnreachable
+	}
+	return nil
+}
+
+func (o *outageFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	return o.Filer.OpenFile(name, flag, perm)
+}
+
+func (o *outageFiler) ReadFile(name string) ([]byte, error) {
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	return o.Filer.ReadFile(name)
+}
+
+func (o *outageFiler) Stat(name string) (os.FileInfo, error) {
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	return o.Filer.Stat(name)
+}
+
+func TestHealthServesCacheWhileDown(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/cached.txt", "cached")
+	writeMemFile(t, primary, "/uncached.txt", "uncached")
+	outage := &outageFiler{Filer: primary}
+	fs := New(outage, cache, WithHealthCheck(HealthCheck{Interval: time.Hour}))
+
+	readString(fs, "/cached.txt")
+	if h := fs.Health(); h.Down {
+		t.Fatalf("Health() = %+v before any outage", h)
+	}
+
+	// The failure that marks the primary down is served from the cache
+	outage.down.Store(true)
+	if got := readString(fs, "/cached.txt"); got != "cached" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "cached")
+	}
+	h := fs.Health()
+	if !h.Down || !errors.Is(h.Err, errUnreachable) || h.Since.IsZero() {
+		t.Fatalf("Health() = %+v, expected down with %v", h, errUnreachable)
+	}
+
+	calls := outage.calls.Load()
+	if got := readString(fs, "/cached.txt"); got != "cached" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "cached")
+	}
+	if _, err := fs.ReadFile("/uncached.txt"); !errors.Is(err, ErrPrimaryDown) {
+		t.Errorf("ReadFile() of an uncached file error = %v, expected ErrPrimaryDown", err)
+	}
+	if _, err := fs.Stat("/cached.txt"); err != nil {
+		t.Errorf("Stat() error = %v", err)
+	}
+	f, err := fs.OpenFile("/cached.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Close()
+	if entries, err := fs.ReadDir("/"); err != nil || len(entries) != 1 {
+		t.Errorf("ReadDir() = %v, %v, expected the cached file", entries, err)
+	}
+	if n := outage.calls.Load() - calls; n != 0 {
+		t.Errorf("primary called %d times while down, expected none", n)
+	}
+}
+
+func TestHealthProbesUntilRecovered(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	outage := &outageFiler{Filer: primary}
+	var probes atomic.Int64
+	clock := newFakeClock()
+	fs := New(outage, cache, WithHealthCheck(HealthCheck{
+		Probe: func() error {
+			probes.Add(1)
+			if outage.down.Load() {
+				return errUnreachable
+			}
+			return nil
+		},
+		Interval: time.Minute,
+	}), WithClock(clock))
+
+	outage.down.Store(true)
+	fs.Stat("/file.txt")
+	if !fs.Health().Down {
+		t.Fatal("primary not marked down")
+	}
+	fs.Stat("/file.txt")
+	if n := probes.Load(); n != 0 {
+		t.Fatalf("%d probes within the interval, expected none", n)
+	}
+	clock.advance(time.Minute)
+	fs.Stat("/file.txt")
+	if n := probes.Load(); n != 1 || !fs.Health().Down {
+		t.Fatalf("after a failed probe: %d probes, Health() = %+v", n, fs.Health())
+	}
+
+	outage.down.Store(false)
+	clock.advance(time.Minute)
+	if got := readString(fs, "/file.txt"); got != "content" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "content")
+	}
+	if h := fs.Health(); h.Down || h.Err != nil {
+		t.Errorf("Health() = %+v after recovery, expected up", h)
+	}
+}
+
+func TestHealthIgnoresRequestErrors(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithHealthCheck(HealthCheck{}))
+
+	if _, err := fs.ReadFile("/missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("ReadFile() error = %v, expected not exist", err)
+	}
+	if _, err := fs.Stat("/missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat() error = %v, expected not exist", err)
+	}
+	if h := fs.Health(); h.Down {
+		t.Errorf("Health() = %+v, expected missing files not to mark the primary down", h)
+	}
+}
@@ -0,0 +1,92 @@
+package corfs
+
+import (
+	"sync"
+	"time"
+)
+
+// idleFlusher flushes dirty files in the background once they have gone
+// unwritten for a while (see WithIdleFlush). A nil *idleFlusher is valid and
+// flushes nothing.
+type idleFlusher struct {
+	idle     time.Duration // How long a dirty file must go unwritten
+	interval time.Duration // How often dirty files are looked at
+
+	once sync.Once
+	stop chan struct{} // Closed to stop the worker
+	done chan struct{} // Closed once the worker has returned
+}
+
+func newIdleFlusher(idle time.Duration) *idleFlusher {
+	interval := idle / 2
+	if interval <= 0 {
+		interval = idle
+	}
+	return &idleFlusher{
+		idle:     idle,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start starts the worker flushing the dirty files of fs.
+func (w *idleFlusher) start(fs *FileSystem) {
+	if w == nil {
+		return
+	}
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-fs.after(w.interval):
+				fs.flushIdle(w.idle, w.stop)
+			}
+		}
+	}()
+}
+
+// close stops the worker, waiting for the flush it is making, if any, to
+// finish.
+func (w *idleFlusher) close() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+// flushIdle flushes the dirty files that haven't been written for idle,
+// unless the primary is down, stopping early once stop is closed. Files
+// that fail to flush stay dirty and are tried again by the next call.
+func (fs *FileSystem) flushIdle(idle time.Duration, stop <-chan struct{}) {
+	if !fs.health.up() {
+		return
+	}
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	for _, name := range fs.index.idlePaths(fs.clock.Now().Add(-idle)) {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if flushed, _ := fs.flush(cache, name); flushed {
+			fs.stats.idleFlushes.Add(1)
+		}
+	}
+}
+
+// Close stops the background flushing of WithIdleFlush, waiting for a flush
+// in progress to finish, and then flushes every dirty file as Sync does,
+// returning its error. The FileSystem stays usable, but dirty files are
+// only flushed by Sync and FlushFile from then on. Close doesn't close the
+// primary or the cache.
+func (fs *FileSystem) Close() error {
+	fs.idleFlush.close()
+	return fs.Sync()
+}
@@ -0,0 +1,127 @@
+package corfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// idleLook waits for the idle flusher to wait on clock, advances clock by
+// d and waits for the flusher to finish the look for idle files it makes
+// then, if any.
+func idleLook(clock *fakeClock, d time.Duration) {
+	clock.waitForTimers(1)
+	clock.advance(d)
+	clock.waitForTimers(1)
+}
+
+func TestIdleFlush(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	clock := newFakeClock()
+	fs := New(mem, cache, WithMode(WriteBack), WithIdleFlush(10*time.Millisecond), WithClock(clock))
+	defer fs.Close()
+
+	writeMemFile(t, fs, "/a.txt", "idle")
+	writeMemFile(t, fs, "/b.txt", "busy")
+
+	// Nothing has been idle long enough yet
+	idleLook(clock, 5*time.Millisecond)
+	if got := fs.DirtyEntries(); len(got) != 2 {
+		t.Fatalf("DirtyEntries() = %v, expected both files dirty", got)
+	}
+
+	// Only the file left alone is flushed
+	writeMemFile(t, fs, "/b.txt", "busy again")
+	idleLook(clock, 5*time.Millisecond)
+	if got := fs.DirtyEntries(); len(got) != 1 || got[0] != "/b.txt" {
+		t.Errorf("DirtyEntries() = %v, expected [/b.txt]", got)
+	}
+	if got := readString(mem, "/a.txt"); got != "idle" {
+		t.Errorf("primary /a.txt = %q, expected %q", got, "idle")
+	}
+
+	idleLook(clock, 10*time.Millisecond)
+	if got := fs.DirtyEntries(); len(got) != 0 {
+		t.Errorf("DirtyEntries() = %v, expected them flushed", got)
+	}
+	if got := readString(mem, "/b.txt"); got != "busy again" {
+		t.Errorf("primary /b.txt = %q, expected %q", got, "busy again")
+	}
+	if s := fs.Stats(); s.Flushes != 2 || s.IdleFlushes != 2 || s.FlushErrors != 0 {
+		t.Errorf("Stats() flushes = %d, idle %d, errors %d, expected 2, 2, 0", s.Flushes, s.IdleFlushes, s.FlushErrors)
+	}
+
+	// Explicit flushes count apart from idle ones
+	writeMemFile(t, fs, "/c.txt", "synced")
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if s := fs.Stats(); s.Flushes != 3 || s.IdleFlushes != 2 {
+		t.Errorf("Stats() flushes = %d, idle %d after Sync, expected 3, 2", s.Flushes, s.IdleFlushes)
+	}
+}
+
+func TestIdleFlushFailure(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	primary := &openFailFiler{Filer: mem, name: "/a.txt", err: errors.New("primary unavailable")}
+	clock := newFakeClock()
+	fs := New(primary, cache, WithMode(WriteBack), WithIdleFlush(10*time.Millisecond), WithClock(clock))
+
+	writeMemFile(t, fs, "/a.txt", "content")
+	idleLook(clock, time.Minute)
+
+	// The file stays dirty and is tried again
+	idleLook(clock, 5*time.Millisecond)
+	if n := fs.Stats().FlushErrors; n != 2 {
+		t.Errorf("Stats() FlushErrors = %d, expected 2", n)
+	}
+	if got := fs.DirtyEntries(); len(got) != 1 {
+		t.Errorf("DirtyEntries() = %v, expected /a.txt to stay dirty", got)
+	}
+
+	// Close returns the failure of its final flush
+	var syncErr *SyncError
+	if err := fs.Close(); !errors.As(err, &syncErr) {
+		t.Fatalf("Close() error = %v, expected a *SyncError", err)
+	}
+	primary.name = ""
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got := readString(mem, "/a.txt"); got != "content" {
+		t.Errorf("primary /a.txt = %q, expected %q", got, "content")
+	}
+}
+
+func TestIdleFlushClose(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	clock := newFakeClock()
+	fs := New(mem, cache, WithMode(WriteBack), WithIdleFlush(10*time.Millisecond), WithClock(clock))
+	clock.waitForTimers(1)
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Nothing is flushed in the background once closed
+	writeMemFile(t, fs, "/a.txt", "content")
+	clock.advance(time.Minute)
+	if got := fs.DirtyEntries(); len(got) != 1 {
+		t.Fatalf("DirtyEntries() = %v, expected /a.txt dirty after Close", got)
+	}
+
+	// Closing again flushes what is dirty
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := readString(mem, "/a.txt"); got != "content" {
+		t.Errorf("primary /a.txt = %q, expected %q", got, "content")
+	}
+	if s := fs.Stats(); s.Flushes != 1 || s.IdleFlushes != 0 {
+		t.Errorf("Stats() flushes = %d, idle %d, expected 1, 0", s.Flushes, s.IdleFlushes)
+	}
+
+	// Close is a Sync without WithIdleFlush
+	if err := New(mem, cache).Close(); err != nil {
+		t.Errorf("Close() without WithIdleFlush error = %v", err)
+	}
+}
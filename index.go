@@ -0,0 +1,610 @@
+package corfs
+
+import (
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is what corfs knows about one cached file.
+type entry struct {
+	size     int64       // Size of the complete entry
+	complete bool        // The cached copy holds the whole file
+	checksum string      // Hex SHA-256 of the content, if checksums are enabled
+	dirty    bool        // The cached copy has writes not yet flushed to the primary
+	version  uint64      // Incremented by every write to a dirty entry
+	filled   uint64      // Sequence number of the fill or write that produced the content
+	fetched  time.Time   // When the entry last became complete
+	written  time.Time   // When the dirty copy was last written
+	modTime  time.Time   // The primary's modification time of the content, if known
+	mode     os.FileMode // The primary's mode of the file, if known
+	hits     int         // Reads served from the cached copy
+	accessed time.Time   // When the copy was last fetched or read
+	freq     float64     // Accesses, aged as of accessed (see frequency)
+
+	generation uint64 // Data generation the copy was fetched in (see FileSystem.Bump)
+	name       string // Path the copy was last filled or written through, if not its key
+}
+
+// path returns the path the entry stored under key was last filled or
+// written through, which is what flushes and removals go to.
+func (e *entry) path(key string) string {
+	if e.name != "" {
+		return e.name
+	}
+	return key
+}
+
+// frequency returns the entry's accesses as of now, each counting for half
+// as much every halfLife after it was made, or fully if halfLife is zero.
+func (e *entry) frequency(now time.Time, halfLife time.Duration) float64 {
+	if halfLife <= 0 || e.freq == 0 {
+		return e.freq
+	}
+	return e.freq * math.Exp2(-float64(now.Sub(e.accessed))/float64(halfLife))
+}
+
+// access records an access to the entry at now.
+func (e *entry) access(now time.Time, halfLife time.Duration) {
+	e.freq = e.frequency(now, halfLife) + 1
+	e.accessed = now
+}
+
+// current reports whether the entry belongs to generation. Dirty entries
+// always do, since their writes are yet to reach the primary.
+func (e *entry) current(generation uint64) bool {
+	return e.dirty || e.generation == generation
+}
+
+// index records the state of entries in the cache, keyed by cache key (see
+// WithKeyFunc), which is the clean path by default.
+// Entries from an earlier data generation are kept until they are
+// overwritten or pruned, but are otherwise treated as absent.
+type index struct {
+	mu         sync.Mutex
+	entries    map[string]*entry
+	writers    map[string]*writers // Write handles open on each path
+	generation uint64              // Current data generation
+	seq        uint64              // Last sequence number given to a fill or write
+	halfLife   time.Duration       // Aging of access frequencies (see WithFrequencyHalfLife)
+	clock      Clock
+	key        func(string) string // Maps paths to their keys
+
+	epoch   uint64            // Last write epoch given to a change by a writer
+	fills   map[string]int    // Fills in progress on each key
+	changed map[string]uint64 // Epoch of the last change to keys with fills in progress
+}
+
+// writers counts the write handles open on a path.
+type writers struct {
+	open   int
+	shared bool // Handles have overlapped since the count was last zero
+}
+
+func newIndex() *index {
+	return &index{
+		entries: make(map[string]*entry),
+		writers: make(map[string]*writers),
+		fills:   make(map[string]int),
+		changed: make(map[string]uint64),
+		clock:   systemClock{},
+		key:     path.Clean,
+	}
+}
+
+// get returns a copy of the entry for name.
+func (x *index) get(name string) (entry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[x.key(name)]
+	if !ok || !e.current(x.generation) {
+		return entry{}, false
+	}
+	return *e, true
+}
+
+// superseded reports whether the entry for name is from an earlier data
+// generation.
+func (x *index) superseded(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[x.key(name)]
+	return ok && !e.current(x.generation)
+}
+
+// bump starts a new data generation and returns it.
+func (x *index) bump() uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.generation++
+	return x.generation
+}
+
+// currentGeneration returns the current data generation.
+func (x *index) currentGeneration() uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.generation
+}
+
+// complete records that the cache holds all size bytes of name, as fetched
+// in generation from a primary file last modified at modTime with mode,
+// both of which are zero if unknown. Hits and accesses recorded for an
+// earlier copy are kept, and completing the copy counts as an access.
+func (x *index) complete(name string, size int64, checksum string, generation uint64, modTime time.Time, mode os.FileMode) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.completeLocked(name, size, checksum, generation, modTime, mode)
+}
+
+// completeLocked is complete with x.mu held.
+func (x *index) completeLocked(name string, size int64, checksum string, generation uint64, modTime time.Time, mode os.FileMode) {
+	key := x.key(name)
+	now := x.clock.Now()
+	x.seq++
+	e := &entry{size: size, complete: true, checksum: checksum, fetched: now, modTime: modTime, mode: mode, generation: generation, filled: x.seq}
+	if name := path.Clean(name); name != key {
+		e.name = name
+	}
+	if old, ok := x.entries[key]; ok {
+		e.hits, e.freq, e.accessed = old.hits, old.freq, old.accessed
+	}
+	e.access(now, x.halfLife)
+	x.entries[key] = e
+}
+
+// hit records a read of name served from the cache.
+func (x *index) hit(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[x.key(name)]; ok {
+		e.hits++
+		e.access(x.clock.Now(), x.halfLife)
+	}
+}
+
+// bytes returns the total size of the complete and dirty entries.
+func (x *index) bytes() int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var total int64
+	for _, e := range x.entries {
+		if (e.complete || e.dirty) && e.current(x.generation) {
+			total += e.size
+		}
+	}
+	return total
+}
+
+// count returns the number of complete and dirty entries.
+func (x *index) count() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	n := 0
+	for _, e := range x.entries {
+		if (e.complete || e.dirty) && e.current(x.generation) {
+			n++
+		}
+	}
+	return n
+}
+
+// abandon records an interrupted fill of name. An existing complete entry
+// is left alone because fills never overwrite it until they finish.
+func (x *index) abandon(name string) {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.entries[key]; !ok {
+		x.entries[key] = &entry{}
+	}
+}
+
+// remove forgets name.
+func (x *index) remove(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, x.key(name))
+}
+
+// removeTree forgets dir and everything beneath it.
+func (x *index) removeTree(dir string) {
+	dir = x.key(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key := range x.entries {
+		if key == dir || strings.HasPrefix(key, prefix) {
+			delete(x.entries, key)
+		}
+	}
+}
+
+// rename moves the entries for oldpath and everything beneath it to newpath,
+// replacing whatever was recorded there.
+func (x *index) rename(oldpath, newpath string) {
+	oldpath, newpath = x.key(oldpath), x.key(newpath)
+	oldPrefix := strings.TrimSuffix(oldpath, "/") + "/"
+	newPrefix := strings.TrimSuffix(newpath, "/") + "/"
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key := range x.entries {
+		if key == newpath || strings.HasPrefix(key, newPrefix) {
+			delete(x.entries, key)
+		}
+	}
+	moved := make(map[string]*entry)
+	for key, e := range x.entries {
+		switch {
+		case key == oldpath:
+			moved[newpath] = e
+		case strings.HasPrefix(key, oldPrefix):
+			moved[newPrefix+strings.TrimPrefix(key, oldPrefix)] = e
+		default:
+			continue
+		}
+		e.name = ""
+		delete(x.entries, key)
+	}
+	for key, e := range moved {
+		x.entries[key] = e
+	}
+}
+
+// markDirty records that the cache holds size bytes of name which have not
+// been written to the primary yet.
+func (x *index) markDirty(name string, size int64) {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[key]
+	if !ok {
+		e = &entry{}
+		x.entries[key] = e
+	}
+	e.size, e.complete, e.checksum = size, true, ""
+	if name := path.Clean(name); name != key {
+		e.name = name
+	}
+	e.dirty = true
+	e.written = x.clock.Now()
+	e.version++
+	x.seq++
+	e.filled = x.seq
+	e.generation = x.generation
+}
+
+// clean records that version of name has been flushed to the primary. It
+// reports false, leaving the entry dirty, if name was written again since.
+func (x *index) clean(name string, version uint64) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[x.key(name)]
+	if !ok || !e.dirty || e.version != version {
+		return false
+	}
+	e.dirty = false
+	e.fetched = x.clock.Now() // The copy matches the primary as of now
+	e.generation = x.generation
+	return true
+}
+
+// hasDirty reports whether name or anything beneath it is dirty.
+func (x *index) hasDirty(name string) bool {
+	name = x.key(name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key, e := range x.entries {
+		if e.dirty && (key == name || strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirtyPaths returns the sorted paths of every dirty entry.
+func (x *index) dirtyPaths() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var names []string
+	for key, e := range x.entries {
+		if e.dirty {
+			names = append(names, e.path(key))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// idlePaths returns the sorted paths of the dirty entries last written no
+// later than before.
+func (x *index) idlePaths(before time.Time) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var names []string
+	for key, e := range x.entries {
+		if e.dirty && !e.written.After(before) {
+			names = append(names, e.path(key))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dirtyBytes returns the total size of the dirty entries.
+func (x *index) dirtyBytes() int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var total int64
+	for _, e := range x.entries {
+		if e.dirty {
+			total += e.size
+		}
+	}
+	return total
+}
+
+// completePaths returns the sorted paths of every complete entry that isn't
+// dirty.
+func (x *index) completePaths() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var names []string
+	for key, e := range x.entries {
+		if e.complete && !e.dirty && e.current(x.generation) {
+			names = append(names, e.path(key))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writing reports whether name has write handles open.
+func (x *index) writing(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, ok := x.writers[x.key(name)]
+	return ok
+}
+
+// openWriter records a write handle opened on name.
+func (x *index) openWriter(name string) {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	w, ok := x.writers[key]
+	if !ok {
+		w = &writers{}
+		x.writers[key] = w
+	}
+	w.open++
+	if w.open > 1 {
+		w.shared = true
+	}
+	x.changeLocked(key)
+}
+
+// change records that a writer changed the cached copy of name, so that
+// fills in progress on it don't replace the copy (see beginFill).
+func (x *index) change(name string) {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.changeLocked(key)
+}
+
+// changeLocked is change, for a key, with x.mu held.
+func (x *index) changeLocked(key string) {
+	x.epoch++
+	if x.fills[key] > 0 {
+		x.changed[key] = x.epoch
+	}
+}
+
+// beginFill records a fill of name starting and returns the write epoch it
+// starts in. A writer opened on name or changing its copy before the fill
+// ends makes the fill stale: its content may mix what was read before the
+// change with what was read after. So does a writer already open when the
+// fill ends, whose mirrored writes would go to the copy the fill replaces,
+// unless the fill sets up that writer's copy itself. Every fill begun must
+// be ended by commitFill failing, completeFill or endFill.
+func (x *index) beginFill(name string) uint64 {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.fills[key]++
+	return x.epoch
+}
+
+// staleLocked reports whether the fill of key begun in epoch is stale,
+// where writer tells whether the fill sets up the copy of a write handle
+// open on key. The caller must hold x.mu.
+func (x *index) staleLocked(key string, epoch uint64, writer bool) bool {
+	if _, open := x.writers[key]; open && !writer {
+		return true
+	}
+	return x.changed[key] > epoch
+}
+
+// commitFill calls rename to put the content of the fill of name begun in
+// epoch, for a writer or not (see staleLocked), in place, unless the fill
+// is stale, in which case it ends the fill and returns errFillStale. The
+// index stays locked during rename so no writer can open in the meantime.
+// If rename fails, the fill is ended.
+func (x *index) commitFill(name string, epoch uint64, writer bool, rename func() error) error {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	err := errFillStale
+	if !x.staleLocked(key, epoch, writer) {
+		err = rename()
+	}
+	if err != nil {
+		x.endFillLocked(key)
+	}
+	return err
+}
+
+// completeFill ends the fill of name begun in epoch, whose content has been
+// committed, and records the complete entry as complete does, unless the
+// fill went stale since its commit. It reports whether the entry was
+// recorded.
+func (x *index) completeFill(name string, epoch uint64, writer bool, size int64, checksum string, generation uint64, modTime time.Time, mode os.FileMode) bool {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	stale := x.staleLocked(key, epoch, writer)
+	x.endFillLocked(key)
+	if stale {
+		return false
+	}
+	x.completeLocked(name, size, checksum, generation, modTime, mode)
+	return true
+}
+
+// endFill ends a fill of name that is discarded.
+func (x *index) endFill(name string) {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.endFillLocked(key)
+}
+
+// endFillLocked is endFill, for a key, with x.mu held.
+func (x *index) endFillLocked(key string) {
+	x.fills[key]--
+	if x.fills[key] <= 0 {
+		delete(x.fills, key)
+		delete(x.changed, key)
+	}
+}
+
+// alone reports whether a single write handle has had name open since the
+// count was last zero.
+func (x *index) alone(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	w, ok := x.writers[x.key(name)]
+	return ok && w.open == 1 && !w.shared
+}
+
+// closeWriter records a write handle on name being closed and reports
+// whether it was the only one open during its lifetime.
+func (x *index) closeWriter(name string) bool {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	w, ok := x.writers[key]
+	if !ok {
+		return false
+	}
+	w.open--
+	if w.open == 0 {
+		delete(x.writers, key)
+	}
+	return !w.shared
+}
+
+// prune forgets name and calls remove to delete its cached copy, unless it
+// is dirty or open for writing. The index stays locked during remove so
+// neither can start in the meantime. It reports whether name was pruned.
+func (x *index) prune(name string, remove func()) bool {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[key]; ok && e.dirty {
+		return false
+	}
+	if _, ok := x.writers[key]; ok {
+		return false
+	}
+	delete(x.entries, key)
+	remove()
+	return true
+}
+
+// reset forgets every entry. Open write handles are still counted since
+// they outlive the cache they were opened against.
+func (x *index) reset() {
+	x.mu.Lock()
+	x.entries = make(map[string]*entry)
+	x.mu.Unlock()
+}
+
+// snapshot returns the current generation with a copy of every complete
+// entry of it that isn't dirty, keyed by path.
+func (x *index) snapshot() (uint64, map[string]entry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entries := make(map[string]entry)
+	for key, e := range x.entries {
+		if e.complete && !e.dirty && e.current(x.generation) {
+			entries[key] = *e
+		}
+	}
+	return x.generation, entries
+}
+
+// restore moves the index on to generation, unless it is already past it.
+func (x *index) restore(generation uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.generation = max(x.generation, generation)
+}
+
+// load records e as the entry for name unless one is recorded already, and
+// reports whether it was.
+func (x *index) load(name string, e entry) bool {
+	key := x.key(name)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.entries[key]; ok {
+		return false
+	}
+	x.seq++
+	e.filled = x.seq
+	x.entries[key] = &e
+	return true
+}
+
+// candidates returns the sorted paths of the complete entries of the
+// current generation that aren't dirty, other than keep, with their status
+// as of now.
+func (x *index) candidates(keep string, now time.Time) ([]string, []CacheStatus) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	keep = x.key(keep)
+	var keys []string
+	for key, e := range x.entries {
+		if key != keep && e.complete && !e.dirty && e.current(x.generation) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	names := make([]string, len(keys))
+	statuses := make([]CacheStatus, len(keys))
+	for i, key := range keys {
+		e := x.entries[key]
+		names[i], statuses[i] = e.path(key), e.status(now, x.halfLife)
+	}
+	return names, statuses
+}
@@ -0,0 +1,124 @@
+package corfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileReadCompletesEntry(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache, WithChecksums())
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := fs.index.get("/file.txt")
+	if !ok || !e.complete {
+		t.Fatalf("entry = %+v, %v; expected a complete entry", e, ok)
+	}
+	if e.size != int64(len("hello world")) {
+		t.Errorf("entry size = %d, expected %d", e.size, len("hello world"))
+	}
+	sum := sha256.Sum256([]byte("hello world"))
+	if e.checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("entry checksum = %q, expected %q", e.checksum, hex.EncodeToString(sum[:]))
+	}
+}
+
+func TestFileCloseBeforeEOFMarksIncomplete(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache)
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Read(make([]byte, 4))
+	f.Close()
+
+	e, ok := fs.index.get("/file.txt")
+	if !ok || e.complete {
+		t.Errorf("entry = %+v, %v; expected an incomplete entry", e, ok)
+	}
+}
+
+func TestIndexTracksMutations(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "aaa")
+	writeMemFile(t, primary, "/b.txt", "bbb")
+	fs := New(primary, cache)
+
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := fs.index.get(name); !ok || !e.complete || e.size != 3 {
+			t.Fatalf("entry for %s = %+v, %v; expected complete with size 3", name, e, ok)
+		}
+	}
+
+	if err := fs.Rename("/a.txt", "/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.index.get("/a.txt"); ok {
+		t.Error("entry for renamed path still present")
+	}
+	if e, ok := fs.index.get("/c.txt"); !ok || !e.complete {
+		t.Errorf("entry for rename target = %+v, %v; expected complete", e, ok)
+	}
+
+	if err := fs.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.index.get("/b.txt"); ok {
+		t.Error("entry for removed path still present")
+	}
+
+	w, err := fs.OpenFile("/c.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.index.get("/c.txt"); ok {
+		t.Error("entry for path opened for writing still present")
+	}
+	w.WriteAt([]byte("x"), 0)
+	w.Close()
+
+	// Every write was mirrored, so the entry is complete again
+	if e, ok := fs.index.get("/c.txt"); !ok || !e.complete || e.size != 3 {
+		t.Errorf("entry after closing writer = %+v, %v; expected complete with size 3", e, ok)
+	}
+}
+
+func TestIndexRenameTree(t *testing.T) {
+	x := newIndex()
+	x.complete("/dir/a", 1, "", 0, time.Time{}, 0)
+	x.complete("/dir/sub/b", 2, "", 0, time.Time{}, 0)
+	x.complete("/dirx", 3, "", 0, time.Time{}, 0)
+	x.complete("/new/stale", 4, "", 0, time.Time{}, 0)
+
+	x.rename("/dir", "/new")
+
+	for name, size := range map[string]int64{"/new/a": 1, "/new/sub/b": 2, "/dirx": 3} {
+		if e, ok := x.get(name); !ok || e.size != size {
+			t.Errorf("entry %s = %+v, %v; expected size %d", name, e, ok, size)
+		}
+	}
+	for _, name := range []string{"/dir/a", "/dir/sub/b", "/new/stale"} {
+		if _, ok := x.get(name); ok {
+			t.Errorf("entry %s still present", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package corfs
+
+import (
+	"context"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FileSystem implements fs.FS, fs.ReadFileFS, fs.StatFS, fs.ReadDirFS, and
+// fs.GlobFS so that io/fs consumers such as template.ParseFS and http.FS
+// read through the cache.
+var (
+	_ iofs.ReadFileFS = (*FileSystem)(nil)
+	_ iofs.StatFS     = (*FileSystem)(nil)
+	_ iofs.ReadDirFS  = (*FileSystem)(nil)
+	_ iofs.GlobFS     = (*FileSystem)(nil)
+)
+
+// rooted resolves an unrooted io/fs name against the root of the
+// filesystem. Rooted names are only cleaned.
+func rooted(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return path.Clean(name)
+	}
+	return path.Join("/", name)
+}
+
+// ioPath validates an io/fs name and returns the path it refers to.
+func ioPath(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	return rooted(name), nil
+}
+
+// Open opens the named file for reading, implementing fs.FS. Unlike the
+// other methods, Open follows io/fs naming: name must be unrooted and
+// satisfy fs.ValidPath, and is resolved against the root, with "." naming
+// the root itself. The returned file reads through the cache like one
+// opened with OpenFile.
+func (fs *FileSystem) Open(name string) (iofs.File, error) {
+	full, err := ioPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.OpenFile(full, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Glob returns the names of all files matching pattern, implementing
+// fs.GlobFS. Like Open, it follows io/fs naming, and the names it returns
+// are unrooted. A rooted pattern, such as "/data/*/*.json", is matched
+// against rooted names instead, as the other methods take them, and the
+// names returned are rooted too. Directories are listed with ReadDir, so
+// files written in WriteBack mode and not yet flushed match as well, and
+// names present in both filers are returned once. The names are sorted.
+func (fs *FileSystem) Glob(pattern string) ([]string, error) {
+	root := strings.HasPrefix(pattern, "/")
+	if root {
+		pattern = strings.TrimLeft(pattern, "/")
+		if pattern == "" {
+			pattern = "."
+		}
+	}
+	matches, err := iofs.Glob(globFS{fs: fs, off: fs.bypass()}, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if root {
+		for i, name := range matches {
+			matches[i] = rooted(name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// globFS presents a FileSystem to fs.Glob with io/fs naming and without its
+// own Glob method. The cache is left alone if off, as Glob found it.
+type globFS struct {
+	fs  *FileSystem
+	off bool
+}
+
+func (g globFS) Open(name string) (iofs.File, error) {
+	full, err := ioPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := g.fs.openFile(context.Background(), full, os.O_RDONLY, 0, g.off)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (g globFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	full, err := ioPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return g.fs.readDir(full, g.off)
+}
@@ -0,0 +1,108 @@
+package corfs
+
+import (
+	"io"
+	iofs "io/fs"
+	"path"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// newIOFSTree returns a FileSystem over a small primary tree.
+func newIOFSTree(t *testing.T) *FileSystem {
+	t.Helper()
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/dir/sub", 0755)
+	writeMemFile(t, primary, "/a.txt", "alpha")
+	writeMemFile(t, primary, "/dir/b.txt", "beta")
+	writeMemFile(t, primary, "/dir/sub/c.go", "package c")
+	return New(primary, cache)
+}
+
+func TestIOFSConformance(t *testing.T) {
+	fs := newIOFSTree(t)
+	expected := []string{"a.txt", "dir/b.txt", "dir/sub/c.go"}
+
+	// FileSystem also accepts rooted names in ReadFile, Stat, and ReadDir,
+	// which fstest rejects, so its Open and Glob are checked on their own
+	// and the remaining methods through Sub
+	if err := fstest.TestFS(struct{ iofs.GlobFS }{fs}, expected...); err != nil {
+		t.Errorf("Open and Glob: %v", err)
+	}
+	sub, err := fs.Sub("/")
+	if err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	if err := fstest.TestFS(sub, expected...); err != nil {
+		t.Errorf("Sub: %v", err)
+	}
+}
+
+func TestIOFSReadsThroughCache(t *testing.T) {
+	fs := newIOFSTree(t)
+
+	data, err := iofs.ReadFile(fs, "dir/b.txt")
+	if err != nil || string(data) != "beta" {
+		t.Fatalf("fs.ReadFile() = %q, %v, expected %q", data, err, "beta")
+	}
+	f, err := fs.Open("a.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	io.ReadAll(f)
+	f.Close()
+
+	for _, name := range []string{"/a.txt", "/dir/b.txt"} {
+		if e, ok := fs.index.get(name); !ok || !e.complete {
+			t.Errorf("%s not cached after reading through io/fs", name)
+		}
+	}
+}
+
+func TestIOFSNames(t *testing.T) {
+	fs := newIOFSTree(t)
+
+	if _, err := fs.Open("/a.txt"); err == nil {
+		t.Error("Open() accepted a rooted name")
+	}
+	if _, err := fs.Open("dir/../a.txt"); err == nil {
+		t.Error("Open() accepted an unclean name")
+	}
+
+	matches, err := fs.Glob("dir/*/*.go")
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	if !reflect.DeepEqual(matches, []string{"dir/sub/c.go"}) {
+		t.Errorf("Glob() = %v, expected [dir/sub/c.go]", matches)
+	}
+}
+
+func TestGlobRooted(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/a/sub", 0755)
+	primary.MkdirAll("/a.b", 0755)
+	writeMemFile(t, primary, "/a/x.txt", "primary")
+	writeMemFile(t, primary, "/a.b/x.txt", "primary")
+	writeMemFile(t, primary, "/a/sub/c.go", "package c")
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/a/x.txt", "unflushed")
+	writeMemFile(t, fs, "/a/y.txt", "unflushed")
+
+	for pattern, expected := range map[string][]string{
+		"/a/*.txt":  {"/a/x.txt", "/a/y.txt"},
+		"/*/x.txt":  {"/a.b/x.txt", "/a/x.txt"},
+		"/*/*/*.go": {"/a/sub/c.go"},
+		"/":         {"/"},
+		"a/*.txt":   {"a/x.txt", "a/y.txt"},
+	} {
+		matches, err := fs.Glob(pattern)
+		if err != nil || !reflect.DeepEqual(matches, expected) {
+			t.Errorf("Glob(%q) = %v, %v; expected %v", pattern, matches, err, expected)
+		}
+	}
+	if _, err := fs.Glob("/a/["); err != path.ErrBadPattern {
+		t.Errorf("Glob() of a malformed pattern error = %v, expected path.ErrBadPattern", err)
+	}
+}
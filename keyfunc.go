@@ -0,0 +1,143 @@
+package corfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// key returns the cache key of name: its clean path mapped by the key
+// function (see WithKeyFunc), if there is one.
+func (fs *FileSystem) key(name string) string {
+	name = path.Clean(name)
+	if fs.keyFunc == nil {
+		return name
+	}
+	return path.Clean(fs.keyFunc(name))
+}
+
+// keyFiler stores a FileSystem's cached copies under their keys (see
+// WithKeyFunc). Paths are mapped by the key function before being passed
+// to the filer, except for the names of corfs's own files, which are
+// derived from keys already.
+type keyFiler struct {
+	absfs.Filer
+	key func(string) string
+}
+
+// path returns the filer path of name.
+func (k *keyFiler) path(name string) string {
+	if isInternalName(path.Base(name)) {
+		return name
+	}
+	return k.key(name)
+}
+
+// blobsOf returns the content-addressed filer cache stores copies in, if
+// any (see WithDedup), with the function mapping the paths passed to cache
+// to those it is given.
+func blobsOf(cache absfs.Filer) (*blobFiler, func(string) string, bool) {
+	mapping := func(name string) string { return name }
+	if k, ok := cache.(*keyFiler); ok {
+		cache, mapping = k.Filer, k.path
+	}
+	b, ok := cache.(*blobFiler)
+	return b, mapping, ok
+}
+
+func (k *keyFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return k.Filer.OpenFile(k.path(name), flag, perm)
+}
+
+func (k *keyFiler) Mkdir(name string, perm os.FileMode) error {
+	return k.Filer.Mkdir(k.path(name), perm)
+}
+
+func (k *keyFiler) MkdirAll(name string, perm os.FileMode) error {
+	return mkdirAll(k.Filer, k.path(name), perm)
+}
+
+func (k *keyFiler) Remove(name string) error {
+	return k.Filer.Remove(k.path(name))
+}
+
+func (k *keyFiler) RemoveAll(name string) error {
+	return removeTree(k.Filer, k.path(name))
+}
+
+func (k *keyFiler) Rename(oldpath, newpath string) error {
+	return k.Filer.Rename(k.path(oldpath), k.path(newpath))
+}
+
+func (k *keyFiler) Stat(name string) (os.FileInfo, error) {
+	return k.Filer.Stat(k.path(name))
+}
+
+func (k *keyFiler) Chmod(name string, mode os.FileMode) error {
+	return k.Filer.Chmod(k.path(name), mode)
+}
+
+func (k *keyFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return k.Filer.Chtimes(k.path(name), atime, mtime)
+}
+
+func (k *keyFiler) Chown(name string, uid, gid int) error {
+	return k.Filer.Chown(k.path(name), uid, gid)
+}
+
+func (k *keyFiler) Truncate(name string, size int64) error {
+	return truncate(k.Filer, k.path(name), size)
+}
+
+func (k *keyFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	return k.Filer.ReadDir(k.path(name))
+}
+
+func (k *keyFiler) ReadFile(name string) ([]byte, error) {
+	return k.Filer.ReadFile(k.path(name))
+}
+
+func (k *keyFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(k, dir)
+}
+
+// Symbolic links are passed through when the filer supports them. Rooted
+// link targets are mapped to their keys.
+
+func (k *keyFiler) Lstat(name string) (os.FileInfo, error) {
+	l, ok := symlinker(k.Filer)
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: ErrNotSupported}
+	}
+	return l.Lstat(k.path(name))
+}
+
+func (k *keyFiler) Lchown(name string, uid, gid int) error {
+	l, ok := symlinker(k.Filer)
+	if !ok {
+		return &os.PathError{Op: "lchown", Path: name, Err: ErrNotSupported}
+	}
+	return l.Lchown(k.path(name), uid, gid)
+}
+
+func (k *keyFiler) Readlink(name string) (string, error) {
+	l, ok := symlinker(k.Filer)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: ErrNotSupported}
+	}
+	return l.Readlink(k.path(name))
+}
+
+func (k *keyFiler) Symlink(oldname, newname string) error {
+	l, ok := symlinker(k.Filer)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNotSupported}
+	}
+	if path.IsAbs(oldname) {
+		oldname = k.path(oldname)
+	}
+	return l.Symlink(oldname, k.path(newname))
+}
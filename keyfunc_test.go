@@ -0,0 +1,90 @@
+package corfs
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stripQuery keys versioned names such as /a.txt?v=1 by their plain path.
+func stripQuery(name string) string {
+	base, _, _ := strings.Cut(name, "?")
+	return base
+}
+
+func TestKeyFunc(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		mem, cache := newMemFilers(t)
+		primary := &readCountFiler{Filer: mem}
+		writeMemFile(t, mem, "/a.txt?v=1", "version 1")
+		writeMemFile(t, mem, "/a.txt?v=2", "version 2")
+		writeMemFile(t, mem, "/b.txt?v=1", "other")
+		opts := []Option{WithKeyFunc(stripQuery), WithMaxEntries(1)}
+		if dedup {
+			opts = append(opts, WithDedup())
+		}
+		fs := New(primary, cache, opts...)
+		fs.cacheFirst = true
+
+		// Fills and reads go through the key
+		if got := readString(fs, "/a.txt?v=1"); got != "version 1" {
+			t.Fatalf("dedup %v: ReadFile(/a.txt?v=1) = %q, expected %q", dedup, got, "version 1")
+		}
+		if got := readString(fs.Cache(), "/a.txt"); !dedup && got != "version 1" {
+			t.Errorf("cache /a.txt = %q, expected the copy under its key", got)
+		}
+		reads := primary.reads.Load()
+		if got := readString(fs, "/a.txt?v=2"); got != "version 1" {
+			t.Errorf("dedup %v: ReadFile(/a.txt?v=2) = %q, expected the copy cached under the same key", dedup, got)
+		}
+		if n := primary.reads.Load(); n != reads {
+			t.Errorf("dedup %v: primary read %d more times, expected the read to be served from the cache", dedup, n-reads)
+		}
+		if st := fs.CacheStatus("/a.txt?v=2"); !st.Complete {
+			t.Errorf("dedup %v: CacheStatus(/a.txt?v=2) = %+v, expected a complete copy", dedup, st)
+		}
+
+		// Eviction removes the copy under its key
+		readTimes(t, fs, "/b.txt?v=1", 1)
+		if st := fs.CacheStatus("/a.txt"); st.Complete {
+			t.Errorf("dedup %v: CacheStatus(/a.txt) = %+v, expected the copy to be evicted", dedup, st)
+		}
+		if _, err := fs.Cache().Stat("/a.txt"); !dedup && !os.IsNotExist(err) {
+			t.Errorf("cache Stat(/a.txt) error = %v, expected the evicted copy to be removed", err)
+		}
+
+		// Removal invalidates the copy under its key
+		if err := fs.Remove("/b.txt?v=1"); err != nil {
+			t.Fatalf("dedup %v: Remove() error = %v", dedup, err)
+		}
+		if st := fs.CacheStatus("/b.txt?v=2"); st.Complete {
+			t.Errorf("dedup %v: CacheStatus(/b.txt?v=2) = %+v, expected the removed copy to be gone", dedup, st)
+		}
+		if _, err := fs.Cache().Stat("/b.txt"); !dedup && !os.IsNotExist(err) {
+			t.Errorf("cache Stat(/b.txt) error = %v, expected the copy to be removed", err)
+		}
+	}
+}
+
+func TestKeyFuncWriteBack(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack), WithKeyFunc(stripQuery))
+
+	writeMemFile(t, fs, "/c.txt?v=3", "deferred")
+	if got := readString(cache, "/c.txt"); got != "deferred" {
+		t.Errorf("cache /c.txt = %q, expected the dirty copy under its key", got)
+	}
+	if got, want := fs.DirtyEntries(), []string{"/c.txt?v=3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DirtyEntries() = %v, expected %v", got, want)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got := readString(primary, "/c.txt?v=3"); got != "deferred" {
+		t.Errorf("primary /c.txt?v=3 = %q, expected the flush to go to the path written", got)
+	}
+	if _, err := primary.Stat("/c.txt"); !os.IsNotExist(err) {
+		t.Errorf("primary Stat(/c.txt) error = %v, expected the key not to be written", err)
+	}
+}
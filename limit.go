@@ -0,0 +1,144 @@
+package corfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter throttles reads from the primary. Wait blocks until n units may
+// be consumed, or returns an error if ctx is done first. Implementations
+// must be safe for concurrent use so that one Limiter can be shared by
+// several FileSystems.
+type Limiter interface {
+	Wait(ctx context.Context, n int) error
+}
+
+// TokenBucket is a Limiter allowing rate units per second on average, with
+// bursts of up to burst units. A request for more than burst units is
+// allowed once the bucket has had time to refill for it.
+type TokenBucket struct {
+	rate  float64 // Units added per second
+	burst float64 // Capacity of the bucket
+
+	mu     sync.Mutex
+	tokens float64 // Available units; negative while requests are waiting
+	last   time.Time
+}
+
+// NewTokenBucket returns a full TokenBucket refilling at rate units per
+// second up to burst units.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n units from the bucket, blocking until they have been earned.
+// If ctx is done first, or its deadline falls before the units will be
+// available, the units are returned to the bucket and ctx's error returned.
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(now) < delay {
+		b.refund(n)
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.refund(n)
+		return ctx.Err()
+	}
+}
+
+// refund returns n units taken by an abandoned Wait.
+func (b *TokenBucket) refund(n int) {
+	b.mu.Lock()
+	b.tokens += float64(n)
+	b.mu.Unlock()
+}
+
+// waitRequest blocks until the request limiter allows a call to the
+// primary.
+func (fs *FileSystem) waitRequest(ctx context.Context) error {
+	if fs.requestLimit == nil {
+		return nil
+	}
+	return fs.requestLimit.Wait(ctx, 1)
+}
+
+// waitBytes charges n bytes read from the primary to the byte limiter.
+func (fs *FileSystem) waitBytes(ctx context.Context, n int) error {
+	if fs.byteLimit == nil || n <= 0 {
+		return nil
+	}
+	return fs.byteLimit.Wait(ctx, n)
+}
+
+// readPrimary reads from the primary handle within the FileSystem's limits.
+func (f *File) readPrimary(b []byte) (int, error) {
+	return f.throttle(f.ctx, func() (int, error) { return f.primary.Read(b) })
+}
+
+// readPrimaryAt reads from the primary handle at off within the
+// FileSystem's limits.
+func (f *File) readPrimaryAt(b []byte, off int64) (int, error) {
+	return f.throttle(f.ctx, func() (int, error) { return f.primary.ReadAt(b, off) })
+}
+
+// throttle performs a primary read within the FileSystem's limits, under
+// ctx, normally the context the handle was opened with. Bytes are charged
+// once read, so a limiter error can accompany data.
+func (f *File) throttle(ctx context.Context, read func() (int, error)) (int, error) {
+	if f.fs == nil {
+		return read()
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := f.fs.waitRequest(ctx); err != nil {
+		return 0, err
+	}
+	var n int
+	var err error
+	f.fs.retry.do(ctx, func() error {
+		start := time.Now()
+		n, err = read()
+		f.fs.stats.primaryReads.since(start)
+		if n > 0 {
+			return nil // Data can't be read again
+		}
+		return err
+	})
+	f.fs.health.observe(err)
+	if werr := f.fs.waitBytes(ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
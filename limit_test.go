@@ -0,0 +1,128 @@
+package corfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countLimiter records the units waited for and fails once closed.
+type countLimiter struct {
+	mu     sync.Mutex
+	calls  int
+	units  int
+	closed bool
+}
+
+var errLimited = errors.New("limited")
+
+func (l *countLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errLimited
+	}
+	l.calls++
+	l.units += n
+	return nil
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(1000, 10)
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := b.Wait(ctx, 10); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if err := b.Wait(ctx, 20); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	// The burst is free; the next 20 units take about 20ms to earn
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("Wait() returned after %v, expected it to throttle", elapsed)
+	}
+}
+
+func TestTokenBucketContext(t *testing.T) {
+	b := NewTokenBucket(1, 1)
+	if err := b.Wait(context.Background(), 1); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() error = %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Wait() blocked for %v past an unreachable deadline", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() error = %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestRequestAndByteLimiters(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	requests, bytes := &countLimiter{}, &countLimiter{}
+	fs := New(primary, cache, WithRequestLimiter(requests), WithByteLimiter(bytes))
+
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if requests.calls != 1 || bytes.units != len("content") {
+		t.Errorf("after ReadFile: %d requests, %d bytes; expected 1, %d", requests.calls, bytes.units, len("content"))
+	}
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	io.ReadAll(f)
+	f.Close()
+	if requests.calls < 3 || bytes.units != 2*len("content") {
+		t.Errorf("after Read: %d requests, %d bytes; expected open and reads counted, %d bytes",
+			requests.calls, bytes.units, 2*len("content"))
+	}
+
+	// Writes aren't throttled
+	calls := requests.calls
+	writeMemFile(t, fs, "/other.txt", "x")
+	if requests.calls != calls {
+		t.Errorf("write made %d throttled requests, expected none", requests.calls-calls)
+	}
+}
+
+func TestLimitedReadFallsBackToCache(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	limiter := &countLimiter{}
+	fs := New(primary, cache, WithRequestLimiter(limiter))
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	limiter.closed = true
+	data, err := fs.ReadFileContext(context.Background(), "/file.txt")
+	if err != nil || string(data) != "content" {
+		t.Errorf("ReadFileContext() = %q, %v; expected the cached copy", data, err)
+	}
+	if _, err := fs.OpenFileContext(context.Background(), "/file.txt", os.O_RDONLY, 0); err != nil {
+		t.Errorf("OpenFileContext() error = %v, expected the cached copy", err)
+	}
+
+	writeMemFile(t, primary, "/uncached.txt", "content")
+	if _, err := fs.ReadFile("/uncached.txt"); !errors.Is(err, errLimited) {
+		t.Errorf("ReadFile() error = %v, expected %v", err, errLimited)
+	}
+}
@@ -0,0 +1,128 @@
+package corfs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// memCache holds the content of small cached copies in memory, in front of
+// the cache filer (see WithMemoryCache), and drops the copies read least
+// recently once it holds too many bytes. Each copy is stored with the fill
+// sequence number of the index entry it was read for and only served while
+// the entry still has it, so changes to the cache never need to reach it: a
+// copy refilled, written, removed or evicted is simply never served again
+// and ages out. A nil *memCache is valid and holds nothing.
+type memCache struct {
+	maxBytes int64 // Total size of the copies held
+	maxFile  int64 // Size of the largest copy held
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List // Of *memEntry, most recently read first
+	items map[string]*list.Element
+}
+
+// memEntry is a copy held in memory.
+type memEntry struct {
+	key    string
+	filled uint64 // Fill sequence number of the index entry the copy was read for
+	data   []byte
+}
+
+func newMemCache(maxBytes, maxFile int64) *memCache {
+	if maxFile <= 0 || maxFile > maxBytes {
+		maxFile = maxBytes
+	}
+	return &memCache{
+		maxBytes: maxBytes,
+		maxFile:  maxFile,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// holds reports whether a copy of size bytes may be held.
+func (c *memCache) holds(size int64) bool {
+	return c != nil && size <= c.maxFile
+}
+
+// get returns a copy of the content held for key if it was read for the
+// fill filled, and marks it read.
+func (c *memCache) get(key string, filled uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	m := el.Value.(*memEntry)
+	if m.filled != filled {
+		c.drop(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return append([]byte(nil), m.data...), true
+}
+
+// put holds a copy of data, the content of key as of the fill filled, and
+// drops the copies read least recently to make room for it.
+func (c *memCache) put(key string, filled uint64, data []byte) {
+	if !c.holds(int64(len(data))) {
+		return
+	}
+	m := &memEntry{key: key, filled: filled, data: append([]byte(nil), data...)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.drop(el)
+	}
+	c.items[key] = c.lru.PushFront(m)
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		c.drop(c.lru.Back())
+	}
+}
+
+// drop forgets the copy held in el. The caller must hold c.mu.
+func (c *memCache) drop(el *list.Element) {
+	m := c.lru.Remove(el).(*memEntry)
+	delete(c.items, m.key)
+	c.bytes -= int64(len(m.data))
+}
+
+// size returns the total size of the copies held.
+func (c *memCache) size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// reset forgets every copy.
+func (c *memCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	c.mu.Unlock()
+}
+
+// memoryEntry returns the index entry of name if the memory tier may hold
+// its content: a complete copy, small enough, with no writes yet to reach
+// the primary, whose content changes with every write.
+func (fs *FileSystem) memoryEntry(name string) (entry, bool) {
+	if fs.memory == nil {
+		return entry{}, false
+	}
+	e, ok := fs.index.get(name)
+	if !ok || !e.complete || e.dirty || !fs.memory.holds(e.size) {
+		return entry{}, false
+	}
+	return e, true
+}
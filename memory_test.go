@@ -0,0 +1,65 @@
+package corfs
+
+import "testing"
+
+func TestMemoryCache(t *testing.T) {
+	mem, cacheFiler := newMemFilers(t)
+	for name, content := range map[string]string{"/a": "aaaaa", "/b": "bbbbb", "/c": "ccccc", "/big": "bigfile!"} {
+		writeMemFile(t, mem, name, content)
+	}
+	cache := &readCountFiler{Filer: cacheFiler}
+	fs := New(mem, cache, WithMemoryCache(10, 6), WithCacheFirst())
+
+	// The first hit reads the cache filer, the next is served from memory
+	readTimes(t, fs, "/a", 1) // Fill
+	before := cache.reads.Load()
+	readTimes(t, fs, "/a", 2)
+	if n := cache.reads.Load() - before; n != 1 {
+		t.Errorf("cache filer read %d times, expected 1", n)
+	}
+	if st := fs.Stats(); st.Hits != 2 || st.MemoryHits != 1 || st.MemoryMisses != 1 || st.MemoryBytes != 5 {
+		t.Errorf("Stats() = %+v, expected 2 hits, 1 from memory, 1 memory miss and 5 bytes held", st)
+	}
+	if r := fs.Stats().MemoryHitRatio(); r != 0.5 {
+		t.Errorf("MemoryHitRatio() = %v, expected 0.5", r)
+	}
+
+	// Files over the per-file limit are never held
+	readTimes(t, fs, "/big", 1)
+	before = cache.reads.Load()
+	readTimes(t, fs, "/big", 2)
+	if n := cache.reads.Load() - before; n != 2 {
+		t.Errorf("cache filer read /big %d times, expected 2", n)
+	}
+
+	// The copy read least recently makes room
+	readTimes(t, fs, "/b", 2)
+	readTimes(t, fs, "/a", 1)
+	readTimes(t, fs, "/c", 2)
+	if st := fs.Stats(); st.MemoryBytes != 10 {
+		t.Errorf("MemoryBytes = %d, expected 10", st.MemoryBytes)
+	}
+	before = cache.reads.Load()
+	readTimes(t, fs, "/a", 1)
+	if n := cache.reads.Load() - before; n != 0 {
+		t.Errorf("cache filer read /a %d times, expected it held in memory", n)
+	}
+	readTimes(t, fs, "/b", 1)
+	if n := cache.reads.Load() - before; n != 1 {
+		t.Errorf("cache filer read /b %d times, expected it dropped from memory", n)
+	}
+
+	// A copy changed since it was held is never served from memory
+	writeMemFile(t, fs, "/a", "AAAAA")
+	readTimes(t, fs, "/a", 1)
+	if got := readString(fs, "/a"); got != "AAAAA" {
+		t.Errorf("ReadFile(/a) = %q, expected the new content", got)
+	}
+
+	if err := fs.ClearCache(); err != nil {
+		t.Fatal(err)
+	}
+	if st := fs.Stats(); st.MemoryBytes != 0 || st.MemoryHits != 0 {
+		t.Errorf("Stats() after ClearCache = %+v, expected the memory tier emptied", st)
+	}
+}
@@ -0,0 +1,149 @@
+package corfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// namespaceFiler confines a FileSystem's cache to a directory of a shared
+// cache filer (see WithNamespace). Paths are rooted in the namespace before
+// being passed to the filer.
+type namespaceFiler struct {
+	absfs.Filer
+	prefix string // Clean, rooted namespace directory
+}
+
+// namespaced returns cache confined to the FileSystem's namespace, or cache
+// itself without one.
+func (fs *FileSystem) namespaced(cache absfs.Filer) absfs.Filer {
+	if fs.namespace == "" {
+		return cache
+	}
+	return &namespaceFiler{Filer: cache, prefix: fs.namespace}
+}
+
+// path returns the filer path of name.
+func (n *namespaceFiler) path(name string) string {
+	return path.Join(n.prefix, path.Join("/", name))
+}
+
+// mkroot creates the namespace directory, which the filer may not have yet.
+func (n *namespaceFiler) mkroot() {
+	mkdirAll(n.Filer, n.prefix, 0755)
+}
+
+func (n *namespaceFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&os.O_CREATE != 0 {
+		n.mkroot()
+	}
+	return n.Filer.OpenFile(n.path(name), flag, perm)
+}
+
+func (n *namespaceFiler) Mkdir(name string, perm os.FileMode) error {
+	n.mkroot()
+	return n.Filer.Mkdir(n.path(name), perm)
+}
+
+func (n *namespaceFiler) MkdirAll(name string, perm os.FileMode) error {
+	return mkdirAll(n.Filer, n.path(name), perm)
+}
+
+func (n *namespaceFiler) Remove(name string) error {
+	return n.Filer.Remove(n.path(name))
+}
+
+func (n *namespaceFiler) RemoveAll(name string) error {
+	if remover, ok := n.Filer.(interface{ RemoveAll(string) error }); ok {
+		return remover.RemoveAll(n.path(name))
+	}
+	return removeAll(n.Filer, n.path(name))
+}
+
+func (n *namespaceFiler) Rename(oldpath, newpath string) error {
+	return n.Filer.Rename(n.path(oldpath), n.path(newpath))
+}
+
+func (n *namespaceFiler) Stat(name string) (os.FileInfo, error) {
+	return n.Filer.Stat(n.path(name))
+}
+
+func (n *namespaceFiler) Chmod(name string, mode os.FileMode) error {
+	return n.Filer.Chmod(n.path(name), mode)
+}
+
+func (n *namespaceFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return n.Filer.Chtimes(n.path(name), atime, mtime)
+}
+
+func (n *namespaceFiler) Chown(name string, uid, gid int) error {
+	return n.Filer.Chown(n.path(name), uid, gid)
+}
+
+func (n *namespaceFiler) Truncate(name string, size int64) error {
+	return truncate(n.Filer, n.path(name), size)
+}
+
+func (n *namespaceFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	return n.Filer.ReadDir(n.path(name))
+}
+
+func (n *namespaceFiler) ReadFile(name string) ([]byte, error) {
+	return n.Filer.ReadFile(n.path(name))
+}
+
+func (n *namespaceFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(n, dir)
+}
+
+// Symbolic links are passed through when the filer supports them. Rooted
+// link targets are kept inside the namespace.
+
+func (n *namespaceFiler) Lstat(name string) (os.FileInfo, error) {
+	l, ok := symlinker(n.Filer)
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: ErrNotSupported}
+	}
+	return l.Lstat(n.path(name))
+}
+
+func (n *namespaceFiler) Lchown(name string, uid, gid int) error {
+	l, ok := symlinker(n.Filer)
+	if !ok {
+		return &os.PathError{Op: "lchown", Path: name, Err: ErrNotSupported}
+	}
+	return l.Lchown(n.path(name), uid, gid)
+}
+
+func (n *namespaceFiler) Readlink(name string) (string, error) {
+	l, ok := symlinker(n.Filer)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: ErrNotSupported}
+	}
+	dest, err := l.Readlink(n.path(name))
+	if err != nil {
+		return "", err
+	}
+	if dest == n.prefix {
+		return "/", nil
+	}
+	if rest, ok := strings.CutPrefix(dest, n.prefix+"/"); ok {
+		return "/" + rest, nil
+	}
+	return dest, nil
+}
+
+func (n *namespaceFiler) Symlink(oldname, newname string) error {
+	l, ok := symlinker(n.Filer)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNotSupported}
+	}
+	if path.IsAbs(oldname) {
+		oldname = n.path(oldname)
+	}
+	return l.Symlink(oldname, n.path(newname))
+}
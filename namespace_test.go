@@ -0,0 +1,101 @@
+package corfs
+
+import (
+	iofs "io/fs"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func TestNamespaceIsolatesSharedCache(t *testing.T) {
+	shared := newTier(t)
+	primaryA, primaryB := newTier(t), newTier(t)
+	writeMemFile(t, primaryA, "/file.txt", "from a")
+	writeMemFile(t, primaryB, "/file.txt", "from b")
+	fsA := New(primaryA, shared, WithNamespace("a"))
+	fsB := New(primaryB, shared, WithNamespace("/b/"))
+
+	for fs, content := range map[*FileSystem]string{fsA: "from a", fsB: "from b"} {
+		if got := readString(fs, "/file.txt"); got != content {
+			t.Errorf("ReadFile() = %q, expected %q", got, content)
+		}
+	}
+	for name, content := range map[string]string{"/a/file.txt": "from a", "/b/file.txt": "from b"} {
+		if got := readString(shared, name); got != content {
+			t.Errorf("shared cache %s = %q, expected %q", name, got, content)
+		}
+	}
+	if _, err := shared.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("shared cache Stat(/file.txt) error = %v, expected not exist", err)
+	}
+	if fsA.Cache() != shared {
+		t.Error("Cache() did not return the shared filer")
+	}
+
+	// Writes and removals stay inside the namespace
+	if err := fsA.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	writeMemFile(t, fsA, "/dir/new.txt", "written")
+	if got := readString(shared, "/a/dir/new.txt"); got != "written" {
+		t.Errorf("shared cache /a/dir/new.txt = %q, expected %q", got, "written")
+	}
+	if err := fsA.Remove("/file.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if got := readString(shared, "/b/file.txt"); got != "from b" {
+		t.Errorf("Remove() in namespace a touched namespace b: %q", got)
+	}
+
+	// Primary failures fall back to the namespace
+	primaryB.Remove("/file.txt")
+	if got := readString(fsB, "/file.txt"); got != "from b" {
+		t.Errorf("fallback ReadFile() = %q, expected %q", got, "from b")
+	}
+}
+
+func TestNamespacePrewarmAndPrune(t *testing.T) {
+	shared := newTier(t)
+	primary := newTier(t)
+	primary.Mkdir("/root", 0755)
+	writeMemFile(t, primary, "/root/a.txt", "alpha")
+	shared.MkdirAll("/other", 0755)
+	writeMemFile(t, shared, "/other/.corfs-x.1.tmp", "partial")
+	fs := New(primary, shared, WithNamespace("ns"))
+
+	err := fs.Prewarm("/root", func(name string, d iofs.DirEntry, err error) error {
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Prewarm() error = %v", err)
+	}
+	if got := readString(shared, "/ns/root/a.txt"); got != "alpha" {
+		t.Errorf("shared cache /ns/root/a.txt = %q, expected %q", got, "alpha")
+	}
+
+	writeMemFile(t, shared, "/ns/.corfs-y.2.tmp", "partial")
+	if removed, err := fs.PruneTemp(); err != nil || removed != 1 {
+		t.Errorf("PruneTemp() = %d, %v, expected 1 file removed", removed, err)
+	}
+	if _, err := shared.Stat("/other/.corfs-x.1.tmp"); err != nil {
+		t.Errorf("PruneTemp() removed a file outside the namespace: %v", err)
+	}
+}
+
+func TestNamespaceSymlinkTargets(t *testing.T) {
+	shared := newTier(t)
+	primary := newTier(t)
+	writeMemFile(t, primary, "/target.txt", "content")
+	fs := New(primary, shared, WithNamespace("ns"))
+
+	if err := fs.Symlink("/target.txt", "/link.txt"); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+	if dest, err := shared.Readlink("/ns/link.txt"); err != nil || dest != "/ns/target.txt" {
+		t.Errorf("shared Readlink() = %q, %v, expected %q", dest, err, "/ns/target.txt")
+	}
+	if dest, err := fs.cache.(absfs.SymLinker).Readlink("/link.txt"); err != nil || dest != "/target.txt" {
+		t.Errorf("namespaced cache Readlink() = %q, %v, expected %q", dest, err, "/target.txt")
+	}
+}
@@ -0,0 +1,99 @@
+package corfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// flagRecordingFiler records the flags files are opened with.
+type flagRecordingFiler struct {
+	absfs.Filer
+	flags []int
+}
+
+func (r *flagRecordingFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	r.flags = append(r.flags, flag)
+	return r.Filer.OpenFile(name, flag, perm)
+}
+
+func readNoCache(t *testing.T, fs *FileSystem, name string) (string, error) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_RDONLY|O_NOCACHE, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestNoCacheSkipsPopulation(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &flagRecordingFiler{Filer: mem}
+	fs := New(primary, cache)
+
+	if got, err := readNoCache(t, fs, "/file.txt"); err != nil || got != "content" {
+		t.Fatalf("read = %q, %v, expected %q", got, err, "content")
+	}
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+	if st := fs.CacheStatus("/file.txt"); st.Cached {
+		t.Errorf("CacheStatus() = %+v, expected no entry", st)
+	}
+	for _, flag := range primary.flags {
+		if flag&O_NOCACHE != 0 {
+			t.Errorf("primary opened with flags %#x, expected O_NOCACHE stripped", flag)
+		}
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestNoCacheSkipsServing(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "old")
+	fs := New(primary, cache)
+	fs.cacheFirst = true
+	readString(fs, "/file.txt")
+
+	writeMemFile(t, primary, "/file.txt", "new")
+	if got, err := readNoCache(t, fs, "/file.txt"); err != nil || got != "new" {
+		t.Errorf("read = %q, %v, expected %q from the primary", got, err, "new")
+	}
+	if got := readString(cache, "/file.txt"); got != "old" {
+		t.Errorf("cache holds %q, expected the untouched %q", got, "old")
+	}
+	if st := fs.CacheStatus("/file.txt"); st.Hits != 0 {
+		t.Errorf("Hits = %d, expected 0", st.Hits)
+	}
+
+	// No fallback to the cache either
+	primary.Remove("/file.txt")
+	if _, err := readNoCache(t, fs, "/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("read error = %v, expected not exist", err)
+	}
+}
+
+func TestNoCacheWritesAround(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "old")
+	fs := New(primary, cache)
+	readString(fs, "/file.txt")
+
+	f, err := fs.OpenFile("/file.txt", os.O_WRONLY|os.O_TRUNC|O_NOCACHE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if got := readString(primary, "/file.txt"); got != "new" {
+		t.Errorf("primary holds %q, expected %q", got, "new")
+	}
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the stale copy discarded", err)
+	}
+}
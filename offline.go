@@ -0,0 +1,70 @@
+package corfs
+
+import (
+	iofs "io/fs"
+	"os"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// offlineFiler stands in for the primary of an offline FileSystem (see
+// WithOffline). Every operation fails with ErrPrimaryDown.
+type offlineFiler struct{}
+
+func (offlineFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return nil, primaryDown("open", name)
+}
+
+func (offlineFiler) Mkdir(name string, perm os.FileMode) error {
+	return primaryDown("mkdir", name)
+}
+
+func (offlineFiler) Remove(name string) error {
+	return primaryDown("remove", name)
+}
+
+func (offlineFiler) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrPrimaryDown}
+}
+
+func (offlineFiler) Stat(name string) (os.FileInfo, error) {
+	return nil, primaryDown("stat", name)
+}
+
+func (offlineFiler) Chmod(name string, mode os.FileMode) error {
+	return primaryDown("chmod", name)
+}
+
+func (offlineFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return primaryDown("chtimes", name)
+}
+
+func (offlineFiler) Chown(name string, uid, gid int) error {
+	return primaryDown("chown", name)
+}
+
+func (offlineFiler) ReadDir(name string) ([]iofs.DirEntry, error) {
+	return nil, primaryDown("readdir", name)
+}
+
+func (offlineFiler) ReadFile(name string) ([]byte, error) {
+	return nil, primaryDown("read", name)
+}
+
+func (offlineFiler) Sub(dir string) (iofs.FS, error) {
+	return nil, primaryDown("sub", dir)
+}
+
+// goOffline cuts the FileSystem off from its primary for good: the primary
+// is replaced with an offlineFiler, marked down with no probing, and
+// written in WriteBack mode so writes stay in the cache.
+func (fs *FileSystem) goOffline() {
+	fs.primary = offlineFiler{}
+	fs.mode = WriteBack
+	fs.health = &healthState{
+		pinned: true,
+		clock:  fs.clock,
+		health: Health{Down: true, Since: fs.clock.Now(), Err: ErrPrimaryDown},
+	}
+}
@@ -0,0 +1,83 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestOffline(t *testing.T) {
+	_, cache := newMemFilers(t)
+	if err := cache.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, cache, "/dir/cached.txt", "captured")
+	fs := New(nil, cache, WithOffline())
+
+	if h := fs.Health(); !h.Down || !errors.Is(h.Err, ErrPrimaryDown) {
+		t.Errorf("Health() = %+v, expected the primary down", h)
+	}
+	if got := readString(fs, "/dir/cached.txt"); got != "captured" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "captured")
+	}
+	if info, err := fs.Stat("/dir/cached.txt"); err != nil || info.Size() != 8 {
+		t.Errorf("Stat() = %v, %v; expected the cached file", info, err)
+	}
+	if _, err := fs.ReadFile("/missing.txt"); !errors.Is(err, ErrPrimaryDown) {
+		t.Errorf("ReadFile() of an uncached path error = %v, expected %v", err, ErrPrimaryDown)
+	}
+	if _, err := fs.OpenFile("/missing.txt", os.O_RDONLY, 0); !errors.Is(err, ErrPrimaryDown) {
+		t.Errorf("OpenFile() of an uncached path error = %v, expected %v", err, ErrPrimaryDown)
+	}
+}
+
+func TestOfflineWrites(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, cache, "/old.txt", "captured")
+	fs := New(primary, cache, WithOffline())
+
+	writeMemFile(t, fs, "/new.txt", "written")
+	if got := readString(fs, "/new.txt"); got != "written" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "written")
+	}
+	f, err := fs.OpenFile("/old.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte(" and appended"))
+	f.Close()
+	if got := readString(fs, "/old.txt"); got != "captured and appended" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "captured and appended")
+	}
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Errorf("Mkdir() error = %v", err)
+	}
+	if err := fs.Mkdir("/dir", 0755); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Mkdir() of an existing directory error = %v, expected %v", err, os.ErrExist)
+	}
+	if err := fs.Rename("/new.txt", "/dir/new.txt"); err != nil {
+		t.Errorf("Rename() error = %v", err)
+	}
+	if err := fs.Remove("/old.txt"); err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+	if err := fs.Remove("/old.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Remove() of a removed file error = %v, expected %v", err, os.ErrNotExist)
+	}
+	if err := fs.Chmod("/missing.txt", 0600); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Chmod() of an uncached path error = %v, expected %v", err, os.ErrNotExist)
+	}
+
+	entries, err := fs.ReadDir("/dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "new.txt" {
+		t.Errorf("ReadDir() = %v, %v; expected new.txt", entries, err)
+	}
+
+	// Nothing reaches the primary
+	if entries, _ := primary.ReadDir("/"); len(entries) != 0 {
+		t.Errorf("primary holds %d entries, expected none", len(entries))
+	}
+	if err := fs.Sync(); !errors.Is(err, ErrPrimaryDown) {
+		t.Errorf("Sync() error = %v, expected %v", err, ErrPrimaryDown)
+	}
+}
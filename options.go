@@ -0,0 +1,705 @@
+package corfs
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// Option configures optional behavior of a FileSystem. Options are passed
+// to New, which applies them in order, so a later option overrides an
+// earlier one setting the same thing. A FileSystem created without options
+// caches every file it reads, mirrors writes into the cache (WriteThrough),
+// and keeps cached copies until they are replaced or removed.
+type Option func(*FileSystem)
+
+// WithStatCacheTTL caches the results of successful Stat calls against the
+// primary for ttl. Cached entries are invalidated by any change made through
+// the FileSystem. Failed Stats, such as of missing files, are never cached,
+// so a file created on the primary behind the FileSystem's back is found by
+// the next Stat. A ttl of zero or less disables the Stat cache.
+func WithStatCacheTTL(ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		if ttl <= 0 {
+			fs.statCache = nil
+			return
+		}
+		fs.statCache = newStatCache(ttl)
+	}
+}
+
+// WithDirCacheTTL caches the listings ReadDir gets from the primary for
+// ttl, keyed by directory, so that listing the same directory again doesn't
+// reach the primary. Files written in WriteBack mode and not yet flushed
+// are merged into a cached listing as into one just read. A listing is
+// invalidated by any change made through the FileSystem within the
+// directory or beneath it, but not by changes made to the primary behind
+// its back, which show once the listing expires or is dropped by
+// ForgetNegative or Invalidate. A ttl of zero or less disables the ReadDir
+// cache.
+func WithDirCacheTTL(ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		if ttl <= 0 {
+			fs.dirCache = nil
+			return
+		}
+		fs.dirCache = newDirCache(ttl)
+	}
+}
+
+// WithMetadataOnly caches what Stat and ReadDir get from the primary for
+// ttl, as WithStatCacheTTL and WithDirCacheTTL do, but never file contents,
+// for workloads that look at many files but read few. Every OpenFile
+// behaves as if O_NOCACHE were given, whatever the Mode, so handles read
+// the primary alone and writes go to the primary alone, as in WriteAround
+// mode; ReadFile reads the primary alone; and CopyFile and Seed fail with
+// ErrNotCacheable, Prewarm only walks, and Prune removes any cached copies
+// left from before.
+//
+// Cached metadata is invalidated by every change made through the
+// FileSystem: a change to a path drops its Stat result and the listings of
+// its directory and those above it, and Rename and RemoveAll drop
+// everything cached beneath a directory too. Failed Stats are never cached.
+// Changes made to the primary behind the FileSystem's back show once the
+// entries expire or are dropped by ForgetNegative or Invalidate. A ttl of
+// zero or less caches nothing at all.
+func WithMetadataOnly(ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		WithStatCacheTTL(ttl)(fs)
+		WithDirCacheTTL(ttl)(fs)
+		fs.metadataOnly = true
+	}
+}
+
+// WithTTL expires cached copies ttl after they were fetched or last
+// flushed. Expired copies are no longer served by cache-first reads (see
+// WithCacheFirst and NewChain), are fetched again by Prewarm, and are
+// removed by Prune, but they are still served when the primary fails or is
+// down. Use SetTTL to override the TTL for some paths. A ttl of zero or
+// less means cached copies never expire.
+func WithTTL(ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		if ttl < 0 {
+			ttl = 0
+		}
+		fs.defaultTTL = ttl
+	}
+}
+
+// WithMemoryCache keeps the content of small cached copies in memory, up to
+// maxBytes in all and maxFileSize for each, in front of the cache filer.
+// Reads by ReadFile that the cache serves look in memory first and then in
+// the cache filer, and a copy read from the cache filer is held in memory
+// for the next read, dropping the copies read least recently to make room.
+// Dirty copies are always read from the cache filer, and so are copies
+// changed since they were held, so memory never serves stale content.
+// Stats reports the memory tier's hits and misses apart from the cache's.
+//
+// The memory tier only speeds up reads the cache serves, so it is meant to
+// be used with WithCacheFirst. Without it, ReadFile reads the primary
+// every time, and memory is only consulted when it falls back to the
+// cache, such as while the primary is down or slower than
+// WithPrimaryTimeout allows.
+//
+// A maxFileSize of zero or less holds files of up to maxBytes, and a
+// maxBytes of zero or less disables the memory tier.
+func WithMemoryCache(maxBytes, maxFileSize int64) Option {
+	return func(fs *FileSystem) {
+		fs.memory = nil
+		if maxBytes > 0 {
+			fs.memory = newMemCache(maxBytes, maxFileSize)
+		}
+	}
+}
+
+// WithBlockSize enables block caching with blocks of size bytes. Instead of
+// caching whole files, read-only handles cache the fixed-size blocks they
+// actually read through Read and ReadAt, and serve a range from the cache
+// only once every block covering it is present. This suits large files that
+// are accessed in ranges. ReadFile still caches whole files. A size of zero
+// or less disables block caching.
+func WithBlockSize(size int64) Option {
+	return func(fs *FileSystem) {
+		if size <= 0 {
+			fs.blocks = nil
+			return
+		}
+		fs.blocks = newBlockIndex(size)
+	}
+}
+
+// WithCacheFirst serves reads by ReadFile and read-only OpenFile from a
+// complete cached copy without consulting the primary at all, falling back
+// to the primary only if the cache holds no such copy or it has expired
+// (see WithTTL). Copies are then considered current once cached, so a file
+// changed on the primary other than through the FileSystem is not seen
+// until its copy expires or is dropped, such as by Reconcile. By default
+// reads are primary-first: the primary is opened or read on every read, and
+// the cache only serves reads the primary fails or times out on. The tiers
+// of a chain (see NewChain) are always cache-first.
+func WithCacheFirst() Option {
+	return func(fs *FileSystem) {
+		fs.cacheFirst = true
+	}
+}
+
+// WithChecksums records a SHA-256 checksum of the content of every complete
+// cache entry so later reads can verify it.
+func WithChecksums() Option {
+	return func(fs *FileSystem) {
+		fs.checksums = true
+	}
+}
+
+// WithPreservePermissions gives cached copies the permission bits of the
+// primary's files, instead of 0644, so that a Stat served from the cache
+// reports them too. The bits are set with Chmod once the copy is created,
+// so the umask of an OS-backed cache doesn't narrow them. With WithDedup,
+// paths sharing content share the permissions of the first copy cached.
+func WithPreservePermissions() Option {
+	return func(fs *FileSystem) {
+		fs.preservePerm = true
+	}
+}
+
+// WithPreserveTimes gives cached copies the access and modification times of
+// the primary's files, set with Chtimes once a fill has written the copy, so
+// that tools comparing times, such as make or rsync, see the primary's. The
+// access time is taken from what Stat's Sys reports, as a filer backed by
+// the operating system does, and is the modification time otherwise.
+// A failure to set the times is reported as a cache error and leaves the
+// copy in place. With WithDedup, paths sharing content share the times of
+// the first copy cached.
+func WithPreserveTimes() Option {
+	return func(fs *FileSystem) {
+		fs.preserveTime = true
+	}
+}
+
+// WithPreserveOwner gives cached copies the owner and group of the primary's
+// files, set with Chown once a fill has written the copy. The owner is taken
+// from what Stat's Sys reports, as a filer backed by the operating system
+// does; copies of files whose owner isn't known are left as they are.
+// Changing the owner of a file usually needs privileges the process doesn't
+// have: a failure is reported as a cache error and leaves the copy in place.
+// With WithDedup, paths sharing content share the owner of the first copy
+// cached.
+func WithPreserveOwner() Option {
+	return func(fs *FileSystem) {
+		fs.preserveOwn = true
+	}
+}
+
+// WithSparseFiles keeps cached copies of sparse files sparse. Fills skip
+// over every aligned 4 KiB block of zeros in the content instead of
+// writing it, so the cache filer can leave a hole, as an OS filesystem
+// that supports sparse files does; the copy reads back the same either
+// way. Where the cache's files can't seek or be truncated past their end,
+// the zeros are written after all. Copies mirrored by writes through the
+// FileSystem are written as they are. Without this option, holes in the
+// primary's files are expanded into zeros in the cache.
+func WithSparseFiles() Option {
+	return func(fs *FileSystem) {
+		fs.sparse = true
+	}
+}
+
+// WithCacheDirMode sets the permissions of the directories corfs creates in
+// the cache to hold the files it caches. By default, each such directory
+// mirrors the permissions of the primary's directory, with write and search
+// permission added for the owner, so the cache can be filled, and write
+// permission removed for others; directories the primary doesn't have get
+// 0755. The permissions are passed to Mkdir, so an OS-backed cache narrows
+// them by the umask. Directories created by Mkdir and MkdirAll get the
+// permissions they are called with. A perm of zero restores the default.
+func WithCacheDirMode(perm os.FileMode) Option {
+	return func(fs *FileSystem) {
+		fs.dirMode = perm.Perm()
+	}
+}
+
+// WithVerifyFlush checks that the primary stored what each write-back
+// flush sent it: the SHA-256 of the cached copy, computed as it is
+// copied, is compared with that of the primary's copy, which is read back
+// unless the primary is a Checksummer. A file whose copy doesn't match
+// stays dirty, listed by DirtyEntries for the next Sync or FlushFile to
+// retry; its flush fails with ErrFlushMismatch, which is also reported as
+// a "verify-flush" CacheError. Reading each file back doubles the primary
+// traffic of flushes.
+func WithVerifyFlush() Option {
+	return func(fs *FileSystem) {
+		fs.verifyFlush = true
+	}
+}
+
+// WithIdleFlush flushes dirty files in WriteBack mode in the background
+// once they haven't been written for idle, rather than only when Sync or
+// FlushFile is called. A goroutine started by New looks for such files
+// every idle/2 and flushes them one at a time, taking turns with flushes
+// of the same file by Sync and FlushFile so that none is written twice. A
+// file written while it is flushed stays dirty, to be flushed once it is
+// idle again. Files whose flush fails stay dirty and are tried again at the
+// next look, and nothing is flushed while the primary is down (see
+// WithHealthCheck). Stats counts the flushes made in the background. Call
+// Close to stop the goroutine. An idle of zero or less disables
+// background flushing.
+func WithIdleFlush(idle time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.idleFlush = nil
+		if idle > 0 {
+			fs.idleFlush = newIdleFlusher(idle)
+		}
+	}
+}
+
+// WithVerifyOnRead checks the content of a cached copy against its recorded
+// checksum every time the copy is served, guarding against silent
+// corruption of the cache's storage. A copy that fails the check is removed
+// from the cache and reported as a "verify" CacheError, and the read falls
+// back to the primary, whose content refills the cache. Only copies with a
+// checksum are checked, so it has no effect without WithChecksums or
+// WithDedup.
+//
+// Every hit then reads and hashes the whole cached copy: ReadFile hashes
+// the data it returns, and OpenFile reads the copy through once before
+// returning the handle, so opening a large cached file costs as much as
+// reading it. Verification is off by default.
+func WithVerifyOnRead() Option {
+	return func(fs *FileSystem) {
+		fs.verifyOnRead = true
+	}
+}
+
+// WithAsyncCacheWrites moves cache fills off the read path: Read returns as
+// soon as the primary read completes, and up to workers background workers
+// write the data to the cache. At most maxQueued bytes are buffered across
+// all fills; a fill whose data doesn't fit is dropped, leaving the file
+// uncached. Use WaitForCacheFlush to wait for queued writes. Writes made
+// through write handles and block caching remain synchronous. A workers or
+// maxQueued of zero or less disables background writes.
+func WithAsyncCacheWrites(workers int, maxQueued int64) Option {
+	return func(fs *FileSystem) {
+		if workers <= 0 || maxQueued <= 0 {
+			fs.writes = nil
+			return
+		}
+		fs.writes = newWriteQueue(workers, maxQueued)
+	}
+}
+
+// WithPromoteAfter caches a path only once it has been read n times by
+// ReadFile or read-only OpenFile; earlier reads go straight to the primary.
+// This keeps scan-once workloads from thrashing the cache. Paths with a
+// complete cache entry are always refreshed. Counts are kept in memory for
+// every path read fewer than n times and are reported by Stats. An n of one
+// or less caches on the first read.
+func WithPromoteAfter(n int) Option {
+	return func(fs *FileSystem) {
+		if n <= 1 {
+			fs.access = nil
+			return
+		}
+		fs.access = newAccessCounter(n)
+	}
+}
+
+// WithMinCacheSize caches only files of at least size bytes, since tiny
+// files aren't worth a cache round trip. Read handles go by the size the
+// primary reports when they start filling the cache, and by the bytes
+// actually read once they reach EOF; ReadFile goes by the bytes read. Write
+// handles discard their cached copy on Close if it is smaller. Block
+// caching and write-back files are not limited. A size of zero or less
+// caches files of any size.
+func WithMinCacheSize(size int64) Option {
+	return func(fs *FileSystem) {
+		if size < 0 {
+			size = 0
+		}
+		fs.minCacheSize = size
+	}
+}
+
+// WithMaxCacheSize caches only files of at most size bytes, so huge files
+// don't crowd everything else out of the cache. It applies like
+// WithMinCacheSize, except that read handles also discard their partial
+// entry as soon as more than size bytes have been read. A size of zero or
+// less caches files of any size.
+func WithMaxCacheSize(size int64) Option {
+	return func(fs *FileSystem) {
+		if size < 0 {
+			size = 0
+		}
+		fs.maxCacheSize = size
+	}
+}
+
+// WithReadAhead prefetches up to size bytes ahead of sequential reads. Once
+// a read-only handle has been read twice in a row without a Seek, a
+// background goroutine keeps reading the primary up to size bytes past the
+// handle's offset, so later reads are served from memory instead of waiting
+// on the primary, and the cache fill advances as they are. Prefetching
+// stops when the handle is closed or seeks elsewhere, discarding the unread
+// bytes. Prefetched reads count towards the read limiters. Handles caching
+// blocks (see WithBlockSize) don't read ahead. A size of zero or less
+// disables read-ahead.
+func WithReadAhead(size int64) Option {
+	return func(fs *FileSystem) {
+		if size < 0 {
+			size = 0
+		}
+		fs.readAhead = size
+	}
+}
+
+// WithMaxCacheHandles caps the cache files held open at once to fill the
+// cache from ReadFile and OpenFile handles and to cache blocks (see
+// WithBlockSize). A read that would exceed the cap is served from the
+// primary without caching rather than failing, unless WithCacheFullPolicy
+// says otherwise. Prewarm and write-back flushes are never refused, though
+// the files they hold open count towards the cap. The current and peak
+// counts are reported by Stats. A limit of zero or less means no cap.
+func WithMaxCacheHandles(n int) Option {
+	return func(fs *FileSystem) {
+		fs.handles.max = int64(max(n, 0))
+	}
+}
+
+// WithCacheFullPolicy sets what reads do when they would fill the cache but
+// the cap of WithMaxCacheHandles has been reached. With SkipWhenFull, the
+// default, they are served from the primary without caching. With
+// WaitWhenFull, they wait up to timeout for a handle to be released before
+// doing so; a timeout of zero or less is the same as SkipWhenFull. With
+// FailWhenFull, they fail with ErrCacheFull. Reads that skip or fail are
+// counted by Stats as CacheFullSkips, a sign that the cap is too low.
+func WithCacheFullPolicy(p CacheFullPolicy, timeout time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.handles.policy = p
+		fs.handles.wait = timeout
+	}
+}
+
+// WithCacheErrorHandler calls fn with every cache operation that fails
+// while the FileSystem carries on without it: changes applied to the cache
+// on a best-effort basis by Mkdir, Chmod, Chtimes, Chown, Truncate,
+// Symlink, and Lchown, cache fills that can't be started or committed or
+// given the primary's times or owner, and write-back flushes failing
+// WithVerifyFlush. Failures for paths the cache doesn't hold are expected
+// and not reported. fn may be called from background goroutines,
+// concurrently.
+func WithCacheErrorHandler(fn func(*CacheError)) Option {
+	return func(fs *FileSystem) {
+		fs.onCacheError = fn
+	}
+}
+
+// WithStrictCache makes the best-effort cache operations reported to
+// WithCacheErrorHandler return their errors too, as a *CacheError joined
+// with the primary's error if both failed. The primary has still been
+// changed when only the cache failed. Failed cache fills don't fail reads.
+func WithStrictCache() Option {
+	return func(fs *FileSystem) {
+		fs.strictCache = true
+	}
+}
+
+// WithDecisionLogger reports every cache decision to l: reads served from
+// the cache or the primary, files not cached because of a zero TTL or the
+// size limits, failed cache operations (those reported to
+// WithCacheErrorHandler), cached copies removed by Prune, Reconcile or
+// WithEviction, and files rejected by WithAdmission. Decisions are only
+// reported, never changed, so this is safe to enable on a live FileSystem
+// to find out why a file isn't cached. Use SlogDecisions to write them to a
+// log/slog Logger.
+func WithDecisionLogger(l DecisionLogger) Option {
+	return func(fs *FileSystem) {
+		fs.decisions = l
+	}
+}
+
+// WithRequestLimiter throttles calls that read the primary: read-only
+// opens, ReadFile, and each read through a File. Reads served from the
+// cache are not throttled. The Limiter may be shared with other
+// FileSystems.
+func WithRequestLimiter(l Limiter) Option {
+	return func(fs *FileSystem) {
+		fs.requestLimit = l
+	}
+}
+
+// WithByteLimiter throttles the number of bytes read from the primary.
+// Bytes are charged to l after each read, so a read may exceed the limit
+// but the next one waits for it. The Limiter may be shared with other
+// FileSystems.
+func WithByteLimiter(l Limiter) Option {
+	return func(fs *FileSystem) {
+		fs.byteLimit = l
+	}
+}
+
+// WithNamespace confines the FileSystem to the directory prefix of the cache
+// filer, so that several FileSystems fronting different primaries can share
+// one cache without their paths colliding. Every path used against the
+// cache, including by Prewarm and PruneTemp, is resolved inside the
+// namespace; paths used against the primary are unchanged. An empty prefix
+// or "/" uses the whole cache.
+func WithNamespace(prefix string) Option {
+	return func(fs *FileSystem) {
+		fs.namespace = path.Join("/", prefix)
+		if fs.namespace == "/" {
+			fs.namespace = ""
+		}
+	}
+}
+
+// WithKeyFunc keys cached copies by fn applied to their clean paths rather
+// than by the paths themselves, so that paths fn maps to the same key, such
+// as versions of an object named path?v=N, share one cached copy. Every use
+// of the cache, from fills and reads to invalidation and eviction, goes
+// through fn; paths used against the primary are unchanged, and so are the
+// Stat and ReadDir caches, which hold what the primary reports. Paths
+// listed by DirtyEntries and flushed to the primary are those last written
+// through.
+//
+// fn must return a key unchanged and should keep a path in its directory,
+// for instance by trimming a suffix. A nil fn keys copies by clean path.
+func WithKeyFunc(fn func(name string) string) Option {
+	return func(fs *FileSystem) {
+		fs.keyFunc = fn
+	}
+}
+
+// WithHealthCheck watches the primary for outages. Once the primary
+// returns an error that hc classifies as an outage, it is marked down:
+// reads, Stat, and ReadDir are served from whatever the cache holds, and
+// fail with ErrPrimaryDown if it holds nothing, without waiting on the
+// primary. While the primary is down it is probed at most once per
+// interval, and marked up again as soon as a probe succeeds. Writes still
+// go to the primary. Use FileSystem.Health to see the current state.
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(fs *FileSystem) {
+		fs.health = newHealthState(hc, fs)
+	}
+}
+
+// WithPrimaryTimeout gives up on a primary that is slow to answer while
+// the cache holds a complete copy of the file: if a read-only OpenFile, a
+// ReadFile, or a Read through a File hasn't heard back from the primary
+// within d, it is served from the cached copy instead. A Read carries on
+// from the same offset in the cached copy, as when the primary fails
+// mid-stream. Without a cached copy, or if the cached copy can't be read,
+// the call waits for the primary and returns its result. The abandoned
+// primary call is left to finish in the background, and any handle it
+// opens is closed. Files large enough for ReadFile to stream into the cache
+// are not subject to the timeout. Zero, the default, waits for the primary
+// indefinitely.
+func WithPrimaryTimeout(d time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.timeout = d
+	}
+}
+
+// WithEviction keeps the cache to maxBytes, as reported by CacheBytes: once
+// a copy cached makes the total larger, other copies are removed in the
+// order of policy until it fits again, or nothing more can be removed.
+// Copies with WriteBack writes not yet flushed and files open for writing
+// are never removed, so they can take the cache over maxBytes. A nil policy
+// is LRU. A maxBytes of zero or less, the default, keeps every copy.
+func WithEviction(maxBytes int64, policy EvictionPolicy) Option {
+	return func(fs *FileSystem) {
+		if policy == nil {
+			policy = LRU()
+		}
+		fs.maxBytes, fs.eviction = maxBytes, policy
+	}
+}
+
+// WithMaxEntries keeps the number of cached copies, as reported by
+// CacheEntries, to n, such as when many small files cost more in inodes
+// than in bytes. Copies are removed as with WithEviction, in the order of
+// its policy or else LRU, and both limits apply if both are set. A n of zero
+// or less, the default, keeps any number of copies.
+func WithMaxEntries(n int) Option {
+	return func(fs *FileSystem) {
+		fs.maxEntries = n
+	}
+}
+
+// WithAdmission consults a before the cache is filled with a file read
+// from the primary, keeping the files it rejects out of the cache rather
+// than caching them only to evict them again, such as with TinyLFU. Files
+// with a complete cached copy are always refreshed, and with
+// WithPromoteAfter, only promoted files are considered. Stats reports how
+// many fills were admitted and rejected. The primary is asked for the size
+// of each file considered, unless the Stat cache (see WithStatCacheTTL)
+// holds it. A nil a, the default, admits every file, like AlwaysAdmit.
+func WithAdmission(a Admission) Option {
+	return func(fs *FileSystem) {
+		fs.admission = a
+	}
+}
+
+// WithFrequencyHalfLife ages the access frequency of cached copies, as
+// reported by CacheStatus and used by the LFU eviction policy: each fetch
+// or read counts for half as much every halfLife after it was made. By
+// default, accesses never age.
+func WithFrequencyHalfLife(halfLife time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.index.halfLife = halfLife
+	}
+}
+
+// WithClock makes the FileSystem read the current time from clock rather
+// than the system clock, such as to test TTLs, the Stat cache, health
+// probes and the aging of access frequencies without waiting. Times
+// recorded for cached copies, such as when they were fetched, come from it
+// too. A clock that also has a method
+//
+//	After(d time.Duration) <-chan time.Time
+//
+// behaving like time.After times the waits of WithIdleFlush between looks
+// for idle files; other clocks leave them to the system clock. Other
+// timers, such as those of WithPrimaryTimeout and WithRetry, and Limiters
+// always run on the system clock.
+func WithClock(clock Clock) Option {
+	return func(fs *FileSystem) {
+		if clock == nil {
+			clock = systemClock{}
+		}
+		fs.clock = clock
+	}
+}
+
+// WithRetry retries primary calls that fail with a transient error before
+// falling back to the cache or returning the error: a read-only OpenFile,
+// a ReadFile, and a Read through a File that returned no data. Each call
+// is tried up to attempts times, waiting backoff before the first retry and
+// twice as long before each one after it. retryable classifies errors as
+// transient; if nil, every error is except those saying a file is missing,
+// exists, is invalid or is forbidden (os.ErrNotExist, os.ErrExist,
+// os.ErrInvalid and os.ErrPermission). io.EOF and context errors are never
+// retried, and a retry that would outlast the deadline of the call's
+// context (see OpenFileContext and ReadFileContext) isn't made. Writes are
+// only retried with WithRetryWrites. An attempts of one or less disables
+// retries.
+func WithRetry(attempts int, backoff time.Duration, retryable func(error) bool) Option {
+	return func(fs *FileSystem) {
+		if attempts <= 1 {
+			fs.retry = nil
+			return
+		}
+		fs.retry = &retrier{attempts: attempts, backoff: backoff, retryable: retryable}
+	}
+}
+
+// WithFillOnOpen copies the primary's content of a file opened for writing
+// without O_TRUNC, such as with O_RDWR to change part of it, into the cache
+// before the handle is returned, unless the cache already holds a complete
+// copy. The handle then mirrors its writes into that copy, which stays
+// complete once the handle is closed. Without it, only files the cache
+// already holds in full, or that are empty, are mirrored, and the cached
+// copy of any other file is discarded. The copy is made upfront, at the
+// cost of reading the whole file from the primary, and is subject to the
+// size limits. WriteBack handles always work on a full copy, and WriteAround
+// writes are never mirrored, so it only applies to WriteThrough.
+func WithFillOnOpen() Option {
+	return func(fs *FileSystem) {
+		fs.fillOnOpen = true
+	}
+}
+
+// WithRetryWrites applies the retries of WithRetry to writes as well: an
+// OpenFile for writing, and a Write, WriteAt or WriteString through a File
+// that wrote nothing. Only enable it if retrying such a write is harmless
+// with the primary, since a failed write may still have taken effect.
+func WithRetryWrites() Option {
+	return func(fs *FileSystem) {
+		fs.retryWrites = true
+	}
+}
+
+// WithOffline runs the FileSystem against its cache alone, as if the
+// primary were down for good, such as to reproduce a problem from a
+// captured cache in CI or an airgapped environment. The primary passed to
+// New is never used and may be nil. Reads, Stat and ReadDir are served from
+// whatever the cache holds, and fail with ErrPrimaryDown for paths it
+// doesn't. Writes go to the cache alone, in WriteBack mode whatever
+// WithMode says, and other changes such as Remove and Mkdir apply to the
+// cache and return its result. Sync and FlushFile fail with ErrPrimaryDown
+// for files written, and creating symbolic links is not supported. Health
+// always reports the primary down.
+func WithOffline() Option {
+	return func(fs *FileSystem) {
+		fs.offline = true
+	}
+}
+
+// WithReadOnlyPrimary declares the primary read-only, such as an embedded
+// filesystem, so that changes fail early with ErrReadOnly instead of with
+// whatever error the primary gives, and neither filer is touched. OpenFile
+// for writing, Mkdir, MkdirAll, Remove, RemoveAll, Rename, Truncate, Chmod,
+// Chtimes, Chown, Symlink and Lchown all fail this way. Reads still fill
+// the cache as usual, and operations on the cache alone, such as CopyFile,
+// Prewarm, Prune and SetCache, still work. Since nothing can be written,
+// WriteBack mode has no effect, and Sync and FlushFile have nothing to do.
+func WithReadOnlyPrimary() Option {
+	return func(fs *FileSystem) {
+		fs.readOnly = true
+	}
+}
+
+// WithDedup stores cached content once per distinct content, so paths with
+// identical content share one copy in the cache. Complete cached copies are
+// stored as blobs named by the SHA-256 of their content, and the cache
+// keeps each path's reference to its blob in memory; reads of any path
+// referring to a blob are served by it. A blob is reference counted and
+// removed with the last path referring to it, whether that path is
+// removed, renamed over, or refilled with different content. A path opened
+// for writing or truncated first gets a private copy of its content, so the
+// other paths are never affected. Blobs left behind when references are
+// lost, for example by a restart, are removed by Prune.
+func WithDedup() Option {
+	return func(fs *FileSystem) {
+		fs.dedup = true
+	}
+}
+
+// O_NOCACHE is a flag for OpenFile and OpenFileContext that bypasses the
+// cache for one handle. It is never passed on to the underlying filers. A
+// file opened for reading with O_NOCACHE is read straight from the primary:
+// it is neither served from nor added to the cache, and isn't counted
+// towards WithPromoteAfter. Only files with unflushed WriteBack writes are
+// still read from the cache, since the primary doesn't have their content
+// yet. A file opened for writing with O_NOCACHE is written as in
+// WriteAround mode, except in WriteBack mode where the flag is ignored.
+const O_NOCACHE = 1 << 30
+
+// oCacheFirst makes OpenFile serve a file opened for reading as with
+// WithCacheFirst (see CachedReader).
+const oCacheFirst = 1 << 29
+
+// Mode selects where writes made through a FileSystem go.
+type Mode int
+
+const (
+	// WriteThrough writes to the primary and mirrors every write into the
+	// cache. It is the default.
+	WriteThrough Mode = iota
+
+	// WriteAround writes to the primary only and discards any cached copy
+	// of the file, which is cached again when it is next read.
+	WriteAround
+
+	// WriteBack writes file contents to the cache only and marks them
+	// dirty. Dirty files reach the primary when they are flushed with
+	// FileSystem.Sync, FileSystem.FlushFile or FileSystem.Close, or in the
+	// background once idle (see WithIdleFlush). Directory and metadata
+	// operations still apply to both filesystems immediately.
+	WriteBack
+)
+
+// WithMode sets how writes are handled. The default is WriteThrough.
+func WithMode(mode Mode) Option {
+	return func(fs *FileSystem) {
+		fs.mode = mode
+	}
+}
@@ -0,0 +1,29 @@
+package corfs
+
+import (
+	"hash/fnv"
+	"path"
+	"sync"
+)
+
+// pathLockStripes is the number of locks pathLocks spreads paths across.
+const pathLockStripes = 64
+
+// pathLocks orders the writes of write-back handles against reads of the
+// cached copies they write, per path, so that no read sees part of a write.
+// Paths share a fixed set of locks by hash, so unrelated paths occasionally
+// wait on each other, but the set never grows.
+type pathLocks [pathLockStripes]sync.RWMutex
+
+// of returns the lock of name.
+func (l *pathLocks) of(name string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(path.Clean(name)))
+	return &l[h.Sum32()%pathLockStripes]
+}
+
+// writingBack reports whether name has a write handle open in WriteBack
+// mode, whose writes go to its cached copy alone.
+func (fs *FileSystem) writingBack(name string) bool {
+	return fs.mode == WriteBack && fs.index.writing(name)
+}
@@ -0,0 +1,67 @@
+package corfs
+
+import (
+	"os"
+	"reflect"
+	"time"
+)
+
+// The access time and owner of a file aren't part of os.FileInfo. Filers
+// backed by the operating system report them in a *syscall.Stat_t from Sys
+// on Unix systems, whose fields differ in name and type from one system to
+// the next, so they are looked up by name.
+
+// accessTime returns the access time of the file info describes, if its Sys
+// reports one, and its modification time otherwise.
+func accessTime(info os.FileInfo) time.Time {
+	if sys, ok := sysStruct(info); ok {
+		for _, field := range []string{"Atim", "Atimespec"} {
+			ts := sys.FieldByName(field)
+			if ts.Kind() != reflect.Struct {
+				continue
+			}
+			sec, ok1 := intField(ts, "Sec")
+			nsec, ok2 := intField(ts, "Nsec")
+			if ok1 && ok2 {
+				return time.Unix(sec, nsec)
+			}
+		}
+	}
+	return info.ModTime()
+}
+
+// fileOwner returns the owner and group of the file info describes, if its
+// Sys reports them.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	sys, ok := sysStruct(info)
+	if !ok {
+		return 0, 0, false
+	}
+	u, ok1 := intField(sys, "Uid")
+	g, ok2 := intField(sys, "Gid")
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	return int(u), int(g), true
+}
+
+// sysStruct returns the struct info's Sys returns or points to.
+func sysStruct(info os.FileInfo) (reflect.Value, bool) {
+	if info == nil || info.Sys() == nil {
+		return reflect.Value{}, false
+	}
+	v := reflect.Indirect(reflect.ValueOf(info.Sys()))
+	return v, v.Kind() == reflect.Struct
+}
+
+// intField returns the integer field name of the struct v.
+func intField(v reflect.Value, name string) (int64, bool) {
+	f := v.FieldByName(name)
+	switch {
+	case f.CanInt():
+		return f.Int(), true
+	case f.CanUint():
+		return int64(f.Uint()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,110 @@
+package corfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Metrics are exported in the Prometheus text exposition format without
+// depending on the Prometheus client library. Programs already using the
+// client can scrape PrometheusHandler, or wrap Stats in their own
+// prometheus.Collector.
+
+// promMetric describes one exported metric.
+type promMetric struct {
+	name  string // Name without the prefix
+	kind  string // Prometheus metric type
+	help  string
+	value func(Stats) float64
+}
+
+var promMetrics = []promMetric{
+	{"primary_reads_total", "counter", "Primary reads by ReadFile and read-only OpenFile.",
+		func(s Stats) float64 { return float64(s.Reads) }},
+	{"cache_hits_total", "counter", "Reads served from the cache.",
+		func(s Stats) float64 { return float64(s.Hits) }},
+	{"cache_hit_ratio", "gauge", "Fraction of reads served from the cache.",
+		func(s Stats) float64 { return s.HitRatio() }},
+	{"cache_bytes", "gauge", "Total size of the complete and dirty cached copies.",
+		func(s Stats) float64 { return float64(s.CacheBytes) }},
+	{"evictions_total", "counter", "Files removed from the cache by Prune, Reconcile and eviction.",
+		func(s Stats) float64 { return float64(s.Evictions) }},
+	{"cache_entries", "gauge", "Number of complete and dirty cached copies.",
+		func(s Stats) float64 { return float64(s.CacheEntries) }},
+	{"entry_evictions_total", "counter", "Evictions made to keep to the maximum number of cached copies.",
+		func(s Stats) float64 { return float64(s.EntryEvictions) }},
+	{"cache_errors_total", "counter", "Failed cache operations.",
+		func(s Stats) float64 { return float64(s.CacheErrors) }},
+	{"cache_handles", "gauge", "Cache files open for fills and blocks.",
+		func(s Stats) float64 { return float64(s.CacheHandles) }},
+	{"cache_handles_peak", "gauge", "Most cache files open at once for fills and blocks.",
+		func(s Stats) float64 { return float64(s.PeakCacheHandles) }},
+	{"cache_full_skips_total", "counter", "Reads not cached or failed at the cache handle limit.",
+		func(s Stats) float64 { return float64(s.CacheFullSkips) }},
+	{"disabled_ops_total", "counter", "Operations performed while the cache was disabled.",
+		func(s Stats) float64 { return float64(s.DisabledOps) }},
+	{"promotions_total", "counter", "Paths that reached the promotion threshold.",
+		func(s Stats) float64 { return float64(s.Promotions) }},
+	{"pending_promotions", "gauge", "Paths read but not yet promoted.",
+		func(s Stats) float64 { return float64(s.Pending) }},
+	{"admitted_total", "counter", "Fills the admission policy allowed.",
+		func(s Stats) float64 { return float64(s.Admitted) }},
+	{"rejected_total", "counter", "Fills the admission policy refused.",
+		func(s Stats) float64 { return float64(s.Rejected) }},
+	{"memory_hits_total", "counter", "Reads served from the in-memory tier.",
+		func(s Stats) float64 { return float64(s.MemoryHits) }},
+	{"memory_misses_total", "counter", "Reads the in-memory tier could have served but read from the cache.",
+		func(s Stats) float64 { return float64(s.MemoryMisses) }},
+	{"memory_hit_ratio", "gauge", "Fraction of the reads the in-memory tier could serve that it did.",
+		func(s Stats) float64 { return s.MemoryHitRatio() }},
+	{"memory_bytes", "gauge", "Total size of the copies held in memory.",
+		func(s Stats) float64 { return float64(s.MemoryBytes) }},
+	{"flushes_total", "counter", "Dirty files written back to the primary.",
+		func(s Stats) float64 { return float64(s.Flushes) }},
+	{"idle_flushes_total", "counter", "Dirty files written back in the background once idle.",
+		func(s Stats) float64 { return float64(s.IdleFlushes) }},
+	{"flush_errors_total", "counter", "Write-back flushes that failed.",
+		func(s Stats) float64 { return float64(s.FlushErrors) }},
+	{"primary_read_calls_total", "counter", "Read calls to the primary timed.",
+		func(s Stats) float64 { return float64(s.PrimaryReadLatency.Count) }},
+	{"primary_read_seconds_total", "counter", "Time spent in read calls to the primary.",
+		func(s Stats) float64 { return s.PrimaryReadLatency.Total.Seconds() }},
+	{"primary_read_seconds_min", "gauge", "Shortest read call to the primary.",
+		func(s Stats) float64 { return s.PrimaryReadLatency.Min.Seconds() }},
+	{"primary_read_seconds_max", "gauge", "Longest read call to the primary.",
+		func(s Stats) float64 { return s.PrimaryReadLatency.Max.Seconds() }},
+	{"cache_write_calls_total", "counter", "Writes to cache fills timed.",
+		func(s Stats) float64 { return float64(s.CacheWriteLatency.Count) }},
+	{"cache_write_seconds_total", "counter", "Time spent writing to cache fills.",
+		func(s Stats) float64 { return s.CacheWriteLatency.Total.Seconds() }},
+	{"cache_write_seconds_min", "gauge", "Shortest write to a cache fill.",
+		func(s Stats) float64 { return s.CacheWriteLatency.Min.Seconds() }},
+	{"cache_write_seconds_max", "gauge", "Longest write to a cache fill.",
+		func(s Stats) float64 { return s.CacheWriteLatency.Max.Seconds() }},
+}
+
+// WritePrometheus writes the FileSystem's current Stats to w in the
+// Prometheus text exposition format, with every metric name starting with
+// prefix and an underscore, such as "corfs_cache_hits_total" for the
+// prefix "corfs".
+func (fs *FileSystem) WritePrometheus(w io.Writer, prefix string) error {
+	s := fs.Stats()
+	for _, m := range promMetrics {
+		name := prefix + "_" + m.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n",
+			name, m.help, name, m.kind, name, m.value(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrometheusHandler returns an http.Handler serving the FileSystem's Stats
+// for Prometheus to scrape, as written by WritePrometheus.
+func (fs *FileSystem) PrometheusHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fs.WritePrometheus(w, prefix)
+	})
+}
@@ -0,0 +1,79 @@
+package corfs
+
+import (
+	"path"
+	"sync"
+)
+
+// accessCounter counts reads of paths that have not yet reached the
+// promotion threshold (see WithPromoteAfter). A nil *accessCounter is valid
+// and promotes every path on its first read.
+type accessCounter struct {
+	threshold int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newAccessCounter(threshold int) *accessCounter {
+	return &accessCounter{threshold: threshold, counts: make(map[string]int)}
+}
+
+// promote counts a read of name and reports whether it has now been read
+// often enough to be cached. A path stops being counted once promoted.
+func (c *accessCounter) promote(name string) bool {
+	if c == nil {
+		return true
+	}
+	key := path.Clean(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+	if c.counts[key] < c.threshold {
+		return false
+	}
+	delete(c.counts, key)
+	return true
+}
+
+// pending returns the number of paths being counted.
+func (c *accessCounter) pending() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.counts)
+}
+
+// reset forgets every count.
+func (c *accessCounter) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.counts = make(map[string]int)
+	c.mu.Unlock()
+}
+
+// promote counts a read of name and reports whether the read should fill
+// the cache, once promoted and admitted (see WithAdmission). Paths with a
+// complete cache entry are always refreshed.
+func (fs *FileSystem) promote(name string) bool {
+	fs.miss(name)
+	if fs.uncacheable(name) {
+		fs.decide(DecisionSkipExcluded, name, nil)
+		return false
+	}
+	if e, ok := fs.index.get(name); ok && e.complete {
+		return true
+	}
+	if fs.access != nil {
+		if !fs.access.promote(name) {
+			return false
+		}
+		fs.stats.promotions.Add(1)
+	}
+	return fs.admit(name)
+}
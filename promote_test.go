@@ -0,0 +1,56 @@
+package corfs
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestPromoteAfter(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	fs := New(primary, cache, WithPromoteAfter(3))
+
+	for i := 1; i <= 3; i++ {
+		if _, err := fs.ReadFile("/./file.txt"); err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		_, err := cache.Stat("/file.txt")
+		if cached := err == nil; cached != (i == 3) {
+			t.Errorf("after read %d cached = %v, expected %v", i, cached, i == 3)
+		}
+	}
+
+	stats := fs.Stats()
+	if stats.Reads != 3 || stats.Promotions != 1 || stats.Pending != 0 {
+		t.Errorf("Stats() = %+v, expected 3 reads, 1 promotion, 0 pending", stats)
+	}
+}
+
+func TestPromoteAfterOpenFile(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	fs := New(primary, cache, WithPromoteAfter(2))
+
+	read := func() {
+		f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		io.ReadAll(f)
+		f.Close()
+	}
+
+	read()
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v after one read, expected not exist", err)
+	}
+	if stats := fs.Stats(); stats.Pending != 1 {
+		t.Errorf("Stats().Pending = %d, expected 1", stats.Pending)
+	}
+
+	read()
+	if got := readString(cache, "/file.txt"); got != "content" {
+		t.Errorf("cache content = %q after two reads, expected %q", got, "content")
+	}
+}
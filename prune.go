@@ -0,0 +1,274 @@
+package corfs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// Prune removes what the cache no longer needs: copies of files deleted
+// from the primary, replaced there by a directory, or recorded with a size
+// the primary no longer has; files outside the size limits (see
+// WithMinCacheSize and WithMaxCacheSize); block files of deleted files;
+// temporary files left by interrupted fills; directories deleted from the
+// primary once they are empty; and, with WithDedup, blobs no path refers
+// to. It returns the number of files removed.
+//
+// Prune can run alongside other operations. Dirty write-back files, files
+// open for writing, and fills in progress are left alone. It stops at the
+// first error other than a file not existing, including errors from the
+// primary, so an unreachable primary never causes cached copies to be
+// removed.
+func (fs *FileSystem) Prune() (int, error) {
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	removed, err := fs.prune(cache, "/")
+	if b, _, ok := blobsOf(cache); ok && err == nil {
+		var n int
+		n, err = b.pruneBlobs()
+		removed += n
+	}
+	fs.stats.evictions.Add(uint64(removed))
+	return removed, err
+}
+
+// prune recursively prunes the cache under dir. The caller must hold the
+// cache.
+func (fs *FileSystem) prune(cache absfs.Filer, dir string) (int, error) {
+	entries, err := cache.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+		full := path.Join(dir, name)
+		var n int
+		switch {
+		case entry.IsDir():
+			n, err = fs.prune(cache, full)
+			if err == nil {
+				err = fs.pruneDir(cache, full)
+			}
+		case isTempName(name):
+			if _, live := liveTemps.Load(full); !live {
+				n, err = removed1(cache.Remove(full))
+			}
+		case isInternalName(name) && strings.HasSuffix(name, blockSuffix):
+			n, err = fs.pruneBlocks(cache, full)
+		default:
+			n, err = fs.pruneFile(cache, full, entry)
+		}
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// pruneFile removes the cached copy name if it is stale or outside the size
+// limits.
+func (fs *FileSystem) pruneFile(cache absfs.Filer, name string, entry iofs.DirEntry) (int, error) {
+	info, err := fs.primary.Stat(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist), err == nil && info.IsDir():
+		// Deleted or replaced in the primary
+	case err != nil:
+		return 0, err
+	case fs.outdated(name, info.Size()):
+	case fs.stale(name):
+	case fs.sizeLimited() && !fs.fits(entry):
+	default:
+		return 0, nil
+	}
+
+	var rerr error
+	pruned := fs.index.prune(name, func() {
+		rerr = cache.Remove(name)
+	})
+	if !pruned {
+		return 0, nil
+	}
+	fs.blocks.drop(cache, name)
+	if rerr == nil {
+		fs.decide(DecisionEvict, name, nil)
+	}
+	return removed1(rerr)
+}
+
+// outdated reports whether the index records a complete copy of name whose
+// size differs from the primary's size.
+func (fs *FileSystem) outdated(name string, size int64) bool {
+	e, ok := fs.index.get(name)
+	return ok && e.complete && !e.dirty && e.size != size
+}
+
+// changed reports whether the index records a complete copy of name that
+// doesn't match info, the primary's FileInfo for it: either its size
+// differs, or the primary's modification time was recorded for the copy
+// and differs too.
+func (fs *FileSystem) changed(name string, info os.FileInfo) bool {
+	if fs.outdated(name, info.Size()) {
+		return true
+	}
+	e, ok := fs.index.get(name)
+	return ok && e.complete && !e.dirty && !e.modTime.IsZero() && !e.modTime.Equal(info.ModTime())
+}
+
+// stale reports whether name's cached copy has expired, shouldn't be
+// cached at all (see SetTTL), or is from an earlier data generation (see
+// Bump).
+func (fs *FileSystem) stale(name string) bool {
+	e, ok := fs.index.get(name)
+	return ok && fs.expired(name, e) || fs.uncacheable(name) || fs.index.superseded(name)
+}
+
+// fits reports whether the cached file entry is within the size limits.
+func (fs *FileSystem) fits(entry iofs.DirEntry) bool {
+	info, err := entry.Info()
+	return err != nil || fs.cacheable(info.Size())
+}
+
+// pruneBlocks removes the block file full if the file it holds blocks of was
+// deleted from the primary.
+func (fs *FileSystem) pruneBlocks(cache absfs.Filer, full string) (int, error) {
+	base := strings.TrimSuffix(strings.TrimPrefix(path.Base(full), tempPrefix), blockSuffix)
+	name := path.Join(path.Dir(full), base)
+	_, err := fs.primary.Stat(name)
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	fs.blocks.drop(cache, name)
+	return removed1(cache.Remove(full))
+}
+
+// pruneDir removes the cache directory dir if it was deleted from the
+// primary and nothing is left in it.
+func (fs *FileSystem) pruneDir(cache absfs.Filer, dir string) error {
+	info, err := fs.primary.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case info.IsDir():
+		return nil
+	}
+	entries, err := cache.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.Name() != "." && entry.Name() != ".." {
+			return nil // Dirty files or fills in progress remain
+		}
+	}
+	cache.Remove(dir)
+	return nil
+}
+
+// removed1 counts the result of removing one file, treating a file that is
+// already gone as removed by someone else.
+func removed1(err error) (int, error) {
+	switch {
+	case err == nil:
+		return 1, nil
+	case errors.Is(err, os.ErrNotExist):
+		return 0, nil
+	}
+	return 0, err
+}
+
+// Reconcile walks the primary's tree rooted at root and removes the cached
+// copies of files that changed there since they were fetched, such as by
+// bulk changes made behind the FileSystem's back, so they are fetched again
+// when next read. A copy has changed if the primary's size differs from the
+// one recorded for it, or its modification time differs from the one
+// recorded when it was fetched; copies recorded without one, such as those
+// written through a File, are only compared by size. Only copies the index
+// records as complete are compared. Unlike Prune, copies of files deleted
+// from the primary are left for Prune to remove. It returns the number of
+// copies removed.
+//
+// Like Prune, Reconcile leaves dirty write-back files and files open for
+// writing alone, doesn't follow symbolic links, and stops at the first
+// error other than a file not existing.
+func (fs *FileSystem) Reconcile(root string) (int, error) {
+	root = cleanPath(root)
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	info, err := fs.primary.Stat(root)
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	if info.IsDir() {
+		removed, err = fs.reconcileDir(cache, root)
+	} else {
+		removed, err = fs.reconcileFile(cache, root, info)
+	}
+	fs.stats.evictions.Add(uint64(removed))
+	return removed, err
+}
+
+// reconcileDir reconciles the cached copies of the files under the primary
+// directory dir. The caller must hold the cache.
+func (fs *FileSystem) reconcileDir(cache absfs.Filer, dir string) (int, error) {
+	entries, err := fs.primary.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+		full := path.Join(dir, name)
+		var n int
+		switch {
+		case entry.IsDir():
+			n, err = fs.reconcileDir(cache, full)
+		case entry.Type().IsRegular():
+			var info os.FileInfo
+			if info, err = entry.Info(); err == nil {
+				n, err = fs.reconcileFile(cache, full, info)
+			}
+		}
+		removed += n
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// reconcileFile removes the cached copy of name if it doesn't match info,
+// the primary's FileInfo for it. The caller must hold the cache.
+func (fs *FileSystem) reconcileFile(cache absfs.Filer, name string, info os.FileInfo) (int, error) {
+	if !fs.changed(name, info) {
+		return 0, nil
+	}
+	var rerr error
+	pruned := fs.index.prune(name, func() {
+		rerr = cache.Remove(name)
+	})
+	if !pruned {
+		return 0, nil
+	}
+	fs.invalidateMeta(name)
+	fs.blocks.drop(cache, name)
+	if rerr == nil {
+		fs.decide(DecisionEvict, name, nil)
+	}
+	return removed1(rerr)
+}
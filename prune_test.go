@@ -0,0 +1,161 @@
+package corfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/dir", 0755)
+	primary.MkdirAll("/old", 0755)
+	for _, name := range []string{"/keep.txt", "/dir/keep.txt", "/gone.txt", "/old/gone.txt", "/changed.txt"} {
+		writeMemFile(t, primary, name, "content")
+	}
+	fs := New(primary, cache)
+	for _, name := range []string{"/keep.txt", "/dir/keep.txt", "/gone.txt", "/old/gone.txt", "/changed.txt"} {
+		readString(fs, name)
+	}
+
+	// Changes made to the primary behind the FileSystem's back
+	primary.Remove("/gone.txt")
+	primary.RemoveAll("/old")
+	writeMemFile(t, primary, "/changed.txt", "new content")
+	writeMemFile(t, cache, "/dir/.corfs-keep.txt.7.tmp", "partial")
+	writeMemFile(t, cache, blockName("/gone.txt"), "blocks")
+
+	removed, err := fs.Prune()
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if removed != 5 {
+		t.Errorf("Prune() removed %d files, expected 5", removed)
+	}
+	for _, name := range []string{"/keep.txt", "/dir/keep.txt"} {
+		if got := readString(cache, name); got != "content" {
+			t.Errorf("cache %s = %q, expected %q", name, got, "content")
+		}
+	}
+	for _, name := range []string{"/gone.txt", "/old/gone.txt", "/old", "/changed.txt", blockName("/gone.txt")} {
+		if _, err := cache.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("cache Stat(%s) error = %v, expected not exist", name, err)
+		}
+	}
+	if st := fs.CacheStatus("/changed.txt"); st.Cached {
+		t.Errorf("CacheStatus() of a pruned file = %+v, expected no entry", st)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestPruneKeepsDirtyAndLiveFiles(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/dirty.txt", "deferred")
+
+	// A fill in progress and a file open for writing, neither in the primary
+	fill, err := fs.newFill(cache, "/filling.txt", 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fill.abort()
+	f, err := fs.OpenFile("/open.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+
+	if removed, err := fs.Prune(); err != nil || removed != 0 {
+		t.Errorf("Prune() = %d, %v, expected nothing removed", removed, err)
+	}
+	for _, name := range []string{"/dirty.txt", "/open.txt", fill.tmp} {
+		if _, err := cache.Stat(name); err != nil {
+			t.Errorf("cache Stat(%s) error = %v after Prune", name, err)
+		}
+	}
+}
+
+func TestPruneSizeLimits(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/small.txt", "ab")
+	writeMemFile(t, primary, "/large.txt", "abcdefghijkl")
+	writeMemFile(t, cache, "/small.txt", "ab")
+	writeMemFile(t, cache, "/large.txt", "abcdefghijkl")
+	fs := New(primary, cache, WithMaxCacheSize(8))
+
+	if removed, err := fs.Prune(); err != nil || removed != 1 {
+		t.Errorf("Prune() = %d, %v, expected 1 file removed", removed, err)
+	}
+	if _, err := cache.Stat("/large.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/large.txt) error = %v, expected not exist", err)
+	}
+	if got := readString(cache, "/small.txt"); got != "ab" {
+		t.Errorf("cache /small.txt = %q, expected %q", got, "ab")
+	}
+}
+
+func TestPruneStopsOnPrimaryErrors(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	outage := &outageFiler{Filer: primary}
+	fs := New(outage, cache)
+	readString(fs, "/file.txt")
+
+	outage.down.Store(true)
+	if _, err := fs.Prune(); err != errUnreachable {
+		t.Errorf("Prune() error = %v, expected %v", err, errUnreachable)
+	}
+	if got := readString(cache, "/file.txt"); got != "content" {
+		t.Errorf("cache /file.txt = %q after a failed Prune, expected %q", got, "content")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/dir", 0755)
+	for _, name := range []string{"/keep.txt", "/dir/resized.txt", "/dir/touched.txt", "/gone.txt"} {
+		writeMemFile(t, primary, name, "content")
+	}
+	fs := New(primary, cache)
+	for _, name := range []string{"/keep.txt", "/dir/resized.txt", "/dir/touched.txt", "/gone.txt"} {
+		readString(fs, name)
+	}
+	if fs.CacheStatus("/dir/touched.txt").ModTime.IsZero() {
+		t.Fatal("no modification time recorded for the cached copy")
+	}
+
+	// Changes made to the primary behind the FileSystem's back
+	writeMemFile(t, primary, "/dir/resized.txt", "new content")
+	later := time.Now().Add(time.Hour)
+	primary.Chtimes("/dir/touched.txt", later, later)
+	primary.Remove("/gone.txt")
+
+	removed, err := fs.Reconcile("/")
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Reconcile() removed %d files, expected 2", removed)
+	}
+	for _, name := range []string{"/keep.txt", "/gone.txt"} {
+		if got := readString(cache, name); got != "content" {
+			t.Errorf("cache %s = %q, expected %q", name, got, "content")
+		}
+	}
+	for _, name := range []string{"/dir/resized.txt", "/dir/touched.txt"} {
+		if _, err := cache.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("cache Stat(%s) error = %v, expected not exist", name, err)
+		}
+	}
+	if got := readString(fs, "/dir/resized.txt"); got != "new content" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "new content")
+	}
+
+	// A subtree, and nothing left to remove
+	if removed, err := fs.Reconcile("/dir"); err != nil || removed != 0 {
+		t.Errorf("Reconcile(/dir) = %d, %v; expected 0, nil", removed, err)
+	}
+	if _, err := fs.Reconcile("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Reconcile(/missing) error = %v, expected not exist", err)
+	}
+}
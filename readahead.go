@@ -0,0 +1,129 @@
+package corfs
+
+import (
+	"context"
+	"sync"
+)
+
+// readAheadAfter is the number of consecutive reads from a handle, with no
+// Seek in between, after which its reads are considered sequential and
+// read-ahead starts (see WithReadAhead).
+const readAheadAfter = 2
+
+// readAhead prefetches a read-only handle's primary content in the
+// background, up to limit bytes ahead of what the handle has consumed.
+// Once started it owns the primary handle's offset until it is stopped.
+type readAhead struct {
+	limit  int
+	cancel context.CancelFunc
+	done   chan struct{} // Closed when the prefetching goroutine exits
+
+	mu   sync.Mutex
+	cond sync.Cond // Signalled when data arrives or room is made
+	buf  []byte    // Prefetched bytes not yet consumed
+	err  error     // Error that ended prefetching, such as io.EOF
+}
+
+// startReadAhead begins prefetching from the handle's current offset.
+func (f *File) startReadAhead() {
+	ctx := f.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	a := &readAhead{
+		limit:  int(f.fs.readAhead),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	a.cond.L = &a.mu
+	f.ahead = a
+	go a.run(ctx, func(b []byte) (int, error) {
+		return f.throttle(ctx, func() (int, error) { return f.primary.Read(b) })
+	})
+}
+
+// stopReadAhead cancels prefetching and waits for it to finish, discarding
+// whatever was prefetched but not consumed. The primary handle's offset is
+// then past the handle's own.
+func (f *File) stopReadAhead() {
+	a := f.ahead
+	if a == nil {
+		return
+	}
+	f.ahead = nil
+	a.mu.Lock()
+	a.cancel()
+	a.cond.Broadcast()
+	a.mu.Unlock()
+	<-a.done
+}
+
+// readSequential reads the primary at the handle's offset, through the
+// read-ahead buffer once reads have proven sequential.
+func (f *File) readSequential(b []byte) (int, error) {
+	if f.ahead != nil {
+		return f.ahead.read(b)
+	}
+	n, err := f.readPrimaryWithin(b)
+	if err == nil && f.primary != nil && f.fs != nil && f.fs.readAhead > 0 && !f.writer {
+		if f.sequential++; f.sequential >= readAheadAfter {
+			f.startReadAhead()
+		}
+	}
+	return n, err
+}
+
+// run reads from the primary with read until the buffer is full, waits for
+// the handle to consume some of it, and repeats until the primary returns
+// an error or ctx is canceled.
+func (a *readAhead) run(ctx context.Context, read func([]byte) (int, error)) {
+	defer close(a.done)
+	chunk := make([]byte, min(a.limit, copyBufferSize))
+	for {
+		a.mu.Lock()
+		for len(a.buf) >= a.limit && ctx.Err() == nil {
+			a.cond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			a.err = err
+			a.cond.Broadcast()
+			a.mu.Unlock()
+			return
+		}
+		room := min(a.limit-len(a.buf), len(chunk))
+		a.mu.Unlock()
+
+		n, err := read(chunk[:room])
+
+		a.mu.Lock()
+		a.buf = append(a.buf, chunk[:n]...)
+		a.err = err
+		a.cond.Broadcast()
+		a.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read consumes prefetched data into b, waiting for some to arrive if none
+// is buffered. The error that ended prefetching is returned along with the
+// last of the data.
+func (a *readAhead) read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.buf) == 0 && a.err == nil {
+		a.cond.Wait()
+	}
+	n := copy(b, a.buf)
+	a.buf = a.buf[n:]
+	a.cond.Broadcast()
+	if len(a.buf) == 0 && a.err != nil {
+		return n, a.err
+	}
+	return n, nil
+}
@@ -0,0 +1,187 @@
+package corfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// readBytesFiler counts the bytes read through Read on its files.
+type readBytesFiler struct {
+	absfs.Filer
+	read atomic.Int64
+}
+
+func (c *readBytesFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := c.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readBytesFile{File: f, filer: c}, nil
+}
+
+type readBytesFile struct {
+	absfs.File
+	filer *readBytesFiler
+}
+
+func (f *readBytesFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.filer.read.Add(int64(n))
+	return n, err
+}
+
+// waitForBytes waits for the primary to have had want bytes read from it.
+func waitForBytes(t *testing.T, primary *readBytesFiler, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for primary.read.Load() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("primary bytes read = %d, expected %d", primary.read.Load(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	content := testContent(1000)
+	writeMemFile(t, mem, "/data.bin", string(content))
+	primary := &readBytesFiler{Filer: mem}
+	fs := New(primary, cache, WithReadAhead(300))
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 10)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Prefetching stops once size bytes are buffered
+	waitForBytes(t, primary, 320)
+	time.Sleep(10 * time.Millisecond)
+	if n := primary.read.Load(); n != 320 {
+		t.Errorf("primary bytes read = %d, expected 320", n)
+	}
+
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 20 {
+		t.Errorf("Seek() = %d, %v; expected 20", pos, err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, content[20:]) {
+		t.Error("content read ahead doesn't match the primary")
+	}
+	if st := fs.CacheStatus("/data.bin"); !st.Complete || st.Size != 1000 {
+		t.Errorf("CacheStatus() = %+v, expected a complete entry", st)
+	}
+}
+
+func TestReadAheadSeek(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	content := testContent(1000)
+	writeMemFile(t, mem, "/data.bin", string(content))
+	primary := &readBytesFiler{Filer: mem}
+	fs := New(primary, cache, WithReadAhead(300))
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 10)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBytes(t, primary, 320)
+
+	// Relative seeks are from the handle's offset, not the prefetched one
+	if pos, err := f.Seek(5, io.SeekCurrent); err != nil || pos != 25 {
+		t.Fatalf("Seek() = %d, %v; expected 25", pos, err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, content[25:35]) {
+		t.Errorf("Read() after Seek = %v, expected %v", buf, content[25:35])
+	}
+	if _, err := f.Seek(900, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, content[900:]) {
+		t.Error("content read after Seek doesn't match the primary")
+	}
+}
+
+// blockingLimiter allows a number of waits and then blocks until the
+// waiter's context is done.
+type blockingLimiter struct {
+	allow    atomic.Int64
+	blocked  chan struct{} // Receives once per blocked waiter
+	canceled atomic.Bool
+}
+
+func (l *blockingLimiter) Wait(ctx context.Context, n int) error {
+	if l.allow.Add(-1) >= 0 {
+		return nil
+	}
+	l.blocked <- struct{}{}
+	<-ctx.Done()
+	l.canceled.Store(true)
+	return ctx.Err()
+}
+
+func TestReadAheadCanceledOnClose(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/data.bin", string(testContent(1000)))
+	limiter := &blockingLimiter{blocked: make(chan struct{}, 1)}
+	limiter.allow.Store(3) // The open and two reads
+	fs := New(mem, cache, WithReadAhead(300), WithRequestLimiter(limiter))
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-limiter.blocked // Prefetching is waiting on the limiter
+
+	closed := make(chan error, 1)
+	go func() { closed <- f.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() didn't cancel the blocked prefetch")
+	}
+	if !limiter.canceled.Load() {
+		t.Error("prefetch wasn't waiting on the limiter when closed")
+	}
+}
@@ -0,0 +1,76 @@
+package corfs
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// visibleEntries filters corfs' bookkeeping files out of a cache listing.
+func visibleEntries(entries []fs.DirEntry) []fs.DirEntry {
+	visible := entries[:0:0]
+	for _, e := range entries {
+		if !isInternalName(e.Name()) {
+			visible = append(visible, e)
+		}
+	}
+	return visible
+}
+
+// mergeEntries returns the primary listing with the cache entries for which
+// dirty reports true added or substituted, sorted by name.
+func mergeEntries(primary, cached []fs.DirEntry, dirty func(base string) bool) []fs.DirEntry {
+	byName := make(map[string]fs.DirEntry, len(primary))
+	for _, e := range primary {
+		byName[e.Name()] = e
+	}
+	for _, e := range cached {
+		if dirty(e.Name()) {
+			byName[e.Name()] = e
+		}
+	}
+
+	merged := make([]fs.DirEntry, 0, len(byName))
+	for _, e := range byName {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name() < merged[j].Name()
+	})
+	return merged
+}
+
+// readEntries returns the next n entries of the directory listing of a
+// handle, or all that remain if n <= 0. The listing is read through the
+// FileSystem on the first call, so it is merged like FileSystem.ReadDir,
+// and sorted by name so that pages never repeat or skip entries. With
+// n > 0, io.EOF is returned once no entries remain.
+func (f *File) readEntries(n int) ([]fs.DirEntry, error) {
+	if f.entries == nil {
+		// The handle's open was counted if the cache is disabled
+		listed, err := f.fs.readDir(f.name, f.fs.cacheOff.Load())
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]fs.DirEntry, 0, len(listed))
+		for _, e := range listed {
+			if e.Name() != "." && e.Name() != ".." {
+				entries = append(entries, e)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+		f.entries = entries
+	}
+
+	if n <= 0 || n > len(f.entries) {
+		if n > 0 && len(f.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(f.entries)
+	}
+	page := f.entries[:n:n]
+	f.entries = f.entries[n:]
+	return page, nil
+}
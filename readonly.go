@@ -0,0 +1,27 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrReadOnly is returned by operations that would change a primary made
+// read-only with WithReadOnlyPrimary.
+var ErrReadOnly = errors.New("corfs: primary is read-only")
+
+// readOnlyError returns the error for op on name if the primary is read-only,
+// and nil otherwise.
+func (fs *FileSystem) readOnlyError(op, name string) error {
+	if !fs.readOnly {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: name, Err: ErrReadOnly}
+}
+
+// readOnlyLinkError is like readOnlyError for operations on two paths.
+func (fs *FileSystem) readOnlyLinkError(op, oldname, newname string) error {
+	if !fs.readOnly {
+		return nil
+	}
+	return &os.LinkError{Op: op, Old: oldname, New: newname, Err: ErrReadOnly}
+}
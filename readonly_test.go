@@ -0,0 +1,68 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+func TestReadOnlyPrimary(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "content")
+	fs := New(primary, cache, WithReadOnlyPrimary())
+
+	// Reads still fill the cache
+	if got := readString(fs, "/file.txt"); got != "content" {
+		t.Fatalf("ReadFile() = %q, expected %q", got, "content")
+	}
+	if got := readString(cache, "/file.txt"); got != "content" {
+		t.Errorf("cache /file.txt = %q, expected %q", got, "content")
+	}
+
+	now := time.Now()
+	ops := map[string]func() error{
+		"OpenFile": func() error {
+			_, err := fs.OpenFile("/new.txt", os.O_CREATE|os.O_WRONLY, 0644)
+			return err
+		},
+		"Mkdir":     func() error { return fs.Mkdir("/dir", 0755) },
+		"MkdirAll":  func() error { return fs.MkdirAll("/dir/sub", 0755) },
+		"Remove":    func() error { return fs.Remove("/file.txt") },
+		"RemoveAll": func() error { return fs.RemoveAll("/file.txt") },
+		"Rename":    func() error { return fs.Rename("/file.txt", "/moved.txt") },
+		"Truncate":  func() error { return fs.Truncate("/file.txt", 0) },
+		"Chmod":     func() error { return fs.Chmod("/file.txt", 0600) },
+		"Chtimes":   func() error { return fs.Chtimes("/file.txt", now, now) },
+		"Chown":     func() error { return fs.Chown("/file.txt", 1, 1) },
+		"Symlink":   func() error { return fs.Symlink("/file.txt", "/link") },
+		"Lchown":    func() error { return fs.Lchown("/file.txt", 1, 1) },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s() error = %v, expected ErrReadOnly", name, err)
+		}
+	}
+
+	// Neither filer was changed
+	for _, filer := range []absfs.Filer{primary, cache} {
+		info, err := filer.Stat("/file.txt")
+		if err != nil || info.Size() != 7 || info.Mode().Perm() == 0600 {
+			t.Errorf("Stat(/file.txt) = %v, %v; expected the file unchanged", info, err)
+		}
+		for _, name := range []string{"/new.txt", "/dir", "/moved.txt", "/link"} {
+			if _, err := filer.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("Stat(%s) error = %v, expected not exist", name, err)
+			}
+		}
+	}
+
+	// Read-only opens are unaffected
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(O_RDONLY) error = %v", err)
+	}
+	f.Close()
+}
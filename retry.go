@@ -0,0 +1,108 @@
+package corfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// retrier retries calls to the primary failing with transient errors (see
+// WithRetry). A nil *retrier tries each call once.
+type retrier struct {
+	attempts  int
+	backoff   time.Duration
+	retryable func(error) bool
+}
+
+// transient reports whether err is worth retrying by default: the
+// primary's answer about a file, such as that it is missing, won't change
+// by asking again.
+func transient(err error) bool {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrExist),
+		errors.Is(err, os.ErrPermission), errors.Is(err, os.ErrInvalid):
+		return false
+	}
+	return true
+}
+
+// do calls op until it succeeds, fails with an error that isn't retryable,
+// or has been tried attempts times, waiting backoff before the first retry
+// and twice as long before each one after it. It returns op's last error,
+// giving up early if ctx is done or its deadline would pass during a wait.
+// io.EOF and context errors are never retried.
+func (r *retrier) do(ctx context.Context, op func() error) error {
+	err := op()
+	if r == nil {
+		return err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	backoff := r.backoff
+	for attempt := 1; attempt < r.attempts && r.retries(err); attempt++ {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+// retries reports whether a call failing with err is tried again.
+func (r *retrier) retries(err error) bool {
+	switch {
+	case err == nil, err == io.EOF,
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case r.retryable != nil:
+		return r.retryable(err)
+	}
+	return transient(err)
+}
+
+// openPrimaryFile opens name in the primary for reading, retrying
+// transient errors.
+func (fs *FileSystem) openPrimaryFile(ctx context.Context, name string, flag int, perm os.FileMode) (absfs.File, error) {
+	var f absfs.File
+	err := fs.retry.do(ctx, func() (err error) {
+		f, err = openFile(fs.primary, name, flag, perm)
+		return err
+	})
+	fs.health.observe(err)
+	return f, err
+}
+
+// readPrimaryData reads name from the primary, retrying transient errors.
+func (fs *FileSystem) readPrimaryData(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := fs.retry.do(ctx, func() (err error) {
+		start := time.Now()
+		data, err = fs.primary.ReadFile(name)
+		fs.stats.primaryReads.since(start)
+		return err
+	})
+	fs.health.observe(err)
+	return data, err
+}
+
+// retryWrite calls op, a write to the primary, retrying it like a read
+// with WithRetryWrites.
+func (fs *FileSystem) retryWrite(ctx context.Context, op func() error) error {
+	if !fs.retryWrites {
+		return op()
+	}
+	return fs.retry.do(ctx, op)
+}
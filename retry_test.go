@@ -0,0 +1,162 @@
+package corfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+var errFlaky = errors.New("transient failure")
+
+// flakyFiler fails the next failures calls of OpenFile, ReadFile, and Read
+// and Write through its files with errFlaky, counting every call.
+type flakyFiler struct {
+	absfs.Filer
+	failures atomic.Int64
+	calls    atomic.Int64
+}
+
+// fail reports whether the current call fails.
+func (f *flakyFiler) fail() bool {
+	f.calls.Add(1)
+	return f.failures.Add(-1) >= 0
+}
+
+func (f *flakyFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if f.fail() {
+		return nil, errFlaky
+	}
+	file, err := f.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyFile{File: file, filer: f}, nil
+}
+
+func (f *flakyFiler) ReadFile(name string) ([]byte, error) {
+	if f.fail() {
+		return nil, errFlaky
+	}
+	return f.Filer.ReadFile(name)
+}
+
+type flakyFile struct {
+	absfs.File
+	filer *flakyFiler
+}
+
+func (f *flakyFile) Read(b []byte) (int, error) {
+	if f.filer.fail() {
+		return 0, errFlaky
+	}
+	return f.File.Read(b)
+}
+
+func (f *flakyFile) Write(b []byte) (int, error) {
+	if f.filer.fail() {
+		return 0, errFlaky
+	}
+	return f.File.Write(b)
+}
+
+func TestRetry(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &flakyFiler{Filer: mem}
+	fs := New(primary, cache, WithRetry(3, time.Millisecond, nil), WithMaxCacheSize(1))
+
+	// Each call succeeds on its last attempt
+	primary.failures.Store(2)
+	if data, err := fs.ReadFile("/file.txt"); err != nil || string(data) != "content" {
+		t.Errorf("ReadFile() = %q, %v; expected the content", data, err)
+	}
+	primary.failures.Store(2)
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	primary.failures.Store(2)
+	if data, err := io.ReadAll(f); err != nil || string(data) != "content" {
+		t.Errorf("ReadAll() = %q, %v; expected the content", data, err)
+	}
+
+	// Failing once more than the attempts allow
+	primary.failures.Store(3)
+	primary.calls.Store(0)
+	if _, err := fs.ReadFile("/file.txt"); !errors.Is(err, errFlaky) {
+		t.Errorf("ReadFile() error = %v, expected %v", err, errFlaky)
+	}
+	if n := primary.calls.Load(); n != 3 {
+		t.Errorf("primary called %d times, expected 3", n)
+	}
+	primary.failures.Store(0)
+
+	// Errors that aren't transient are returned at once
+	primary.calls.Store(0)
+	if _, err := fs.ReadFile("/missing.txt"); !os.IsNotExist(err) || primary.calls.Load() != 1 {
+		t.Errorf("ReadFile() error = %v after %d calls, expected not exist after 1", err, primary.calls.Load())
+	}
+}
+
+func TestRetryClassifier(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &flakyFiler{Filer: mem}
+	fs := New(primary, cache, WithRetry(3, time.Millisecond, func(err error) bool { return false }))
+
+	primary.failures.Store(1)
+	if _, err := fs.ReadFile("/file.txt"); !errors.Is(err, errFlaky) || primary.calls.Load() != 1 {
+		t.Errorf("ReadFile() error = %v after %d calls, expected %v after 1", err, primary.calls.Load(), errFlaky)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &flakyFiler{Filer: mem}
+	fs := New(primary, cache, WithRetry(3, time.Hour, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	primary.failures.Store(1)
+	if _, err := fs.ReadFileContext(ctx, "/file.txt"); !errors.Is(err, errFlaky) || primary.calls.Load() != 1 {
+		t.Errorf("ReadFileContext() error = %v after %d calls, expected %v without a retry past the deadline",
+			err, primary.calls.Load(), errFlaky)
+	}
+}
+
+func TestRetryWrites(t *testing.T) {
+	for _, writes := range []bool{false, true} {
+		mem, cache := newMemFilers(t)
+		primary := &flakyFiler{Filer: mem}
+		opts := []Option{WithRetry(2, time.Millisecond, nil)}
+		if writes {
+			opts = append(opts, WithRetryWrites())
+		}
+		fs := New(primary, cache, opts...)
+
+		primary.failures.Store(1)
+		f, err := fs.OpenFile("/file.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if (err == nil) != writes {
+			t.Fatalf("writes=%v: OpenFile() error = %v", writes, err)
+		}
+		if !writes {
+			continue
+		}
+		primary.failures.Store(1)
+		if n, err := f.Write([]byte("content")); n != 7 || err != nil {
+			t.Errorf("Write() = %d, %v; expected all of it to be written", n, err)
+		}
+		f.Close()
+		if got := readString(fs, "/file.txt"); got != "content" {
+			t.Errorf("ReadFile() = %q, expected %q", got, "content")
+		}
+	}
+}
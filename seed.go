@@ -0,0 +1,64 @@
+package corfs
+
+import (
+	"io"
+	"os"
+)
+
+// Seed stores the content read from r in the cache as the complete copy of
+// name, without reading the primary, such as to warm the cache from a batch
+// export. info describes the primary's file and must not be nil: the
+// content must be info.Size() bytes long, and info's modification time
+// and, with WithPreservePermissions, permissions are recorded for the
+// copy. The copy replaces any cached copy atomically, is checksummed with
+// WithChecksums, and counts towards CacheBytes like any other. Reads served
+// from the cache, such as those of a chain (see NewChain), then find it
+// without touching the primary.
+//
+// Files outside the size limits of WithMinCacheSize and WithMaxCacheSize,
+// or with a TTL of zero (see SetTTL), are not seeded, and neither is
+// anything while the cache is disabled: Seed fails with ErrNotCacheable,
+// without reading r. A file with WriteBack writes not yet flushed is left
+// alone, since its cached copy is newer than the primary's, and Seed
+// returns nil. A write handle opened on name while the copy is stored
+// supersedes it: the copy is discarded and Seed fails.
+func (fs *FileSystem) Seed(name string, r io.Reader, info os.FileInfo) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if info == nil {
+		return &os.PathError{Op: "seed", Path: name, Err: os.ErrInvalid}
+	}
+	if off || fs.skipped(name, info.Size()) {
+		return &os.PathError{Op: "seed", Path: name, Err: ErrNotCacheable}
+	}
+	if fs.dirty(name) {
+		return nil
+	}
+
+	generation := fs.index.currentGeneration()
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fill, err := fs.newFill(cache, name, generation, false, info)
+	if err != nil {
+		return err
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	if _, err := io.CopyBuffer(fill, r, *buf); err != nil {
+		fill.abort()
+		return err
+	}
+	if fill.size != info.Size() {
+		fill.abort()
+		return &os.PathError{Op: "seed", Path: name, Err: errSizeMismatch}
+	}
+	if err := fill.commit(); err != nil {
+		return err
+	}
+	fs.blocks.drop(cache, name)
+	if !fill.complete() {
+		return &os.PathError{Op: "seed", Path: name, Err: errFillStale}
+	}
+	fs.evict(cache, name)
+	return nil
+}
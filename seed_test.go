@@ -0,0 +1,78 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedInfo returns the FileInfo of a file with content, modified at
+// modified, from a scratch filer.
+func seedInfo(t *testing.T, content string, modified time.Time) os.FileInfo {
+	t.Helper()
+	scratch, _ := newMemFilers(t)
+	writeMemFile(t, scratch, "/file", content)
+	if err := scratch.Chtimes("/file", modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	info, err := scratch.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestSeed(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	primary := &readCountFiler{Filer: mem}
+	fs := New(primary, cache, WithChecksums())
+	fs.cacheFirst = true
+
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Seed("/dir/file.txt", strings.NewReader("seeded"), seedInfo(t, "seeded", modified)); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+	st := fs.CacheStatus("/dir/file.txt")
+	if !st.Complete || st.Size != 6 || st.Checksum == "" || !st.ModTime.Equal(modified) {
+		t.Errorf("CacheStatus() = %+v, expected a complete entry of 6 bytes", st)
+	}
+	if got := fs.Stats().CacheBytes; got != 6 {
+		t.Errorf("CacheBytes = %d, expected 6", got)
+	}
+
+	if got := readString(fs, "/dir/file.txt"); got != "seeded" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "seeded")
+	}
+	if n := primary.reads.Load(); n != 0 {
+		t.Errorf("primary reads = %d, expected none", n)
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestSeedRejected(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMaxCacheSize(8))
+
+	// Content that doesn't match the size given
+	err := fs.Seed("/short.txt", strings.NewReader("short"), seedInfo(t, "longer", time.Now()))
+	if !errors.Is(err, errSizeMismatch) {
+		t.Errorf("Seed() with short content error = %v, expected a size mismatch", err)
+	}
+	// Outside the size limits
+	err = fs.Seed("/large.txt", strings.NewReader("too large"), seedInfo(t, "too large", time.Now()))
+	if !errors.Is(err, ErrNotCacheable) {
+		t.Errorf("Seed() of a large file error = %v, expected ErrNotCacheable", err)
+	}
+
+	for _, name := range []string{"/short.txt", "/large.txt"} {
+		if _, err := cache.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("cache Stat(%s) error = %v, expected not exist", name, err)
+		}
+		if st := fs.CacheStatus(name); st.Complete {
+			t.Errorf("CacheStatus(%s) = %+v, expected no complete entry", name, st)
+		}
+	}
+	assertNoTempFiles(t, fs)
+}
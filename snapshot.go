@@ -0,0 +1,137 @@
+package corfs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// indexSnapshot is the JSON form of the index written by ExportIndex.
+type indexSnapshot struct {
+	Generation uint64          `json:"generation"`
+	Entries    []snapshotEntry `json:"entries"`
+}
+
+// snapshotEntry is the JSON form of one complete entry.
+type snapshotEntry struct {
+	Path       string      `json:"path"`
+	Size       int64       `json:"size"`
+	ModTime    time.Time   `json:"modTime"`
+	Mode       os.FileMode `json:"mode,omitempty"`
+	Fetched    time.Time   `json:"fetchedAt"`
+	Checksum   string      `json:"checksum,omitempty"`
+	Generation uint64      `json:"generation"`
+}
+
+// Index is a snapshot of what a FileSystem knows about the copies in its
+// cache, for SwapCache to install along with that cache.
+type Index struct {
+	snapshot indexSnapshot
+}
+
+// Index returns a snapshot of the FileSystem's index, with the entries
+// ExportIndex would write, such as of a FileSystem that filled a cache
+// offline for another to take over with SwapCache.
+func (fs *FileSystem) Index() *Index {
+	return &Index{snapshot: fs.snapshotIndex()}
+}
+
+// ReadIndex reads an index written by ExportIndex from r.
+func ReadIndex(r io.Reader) (*Index, error) {
+	var s indexSnapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &Index{snapshot: s}, nil
+}
+
+// ExportIndex writes what the FileSystem knows about its cached copies to w
+// as JSON, for ImportIndex to restore, such as after a restart: the current
+// data generation and, for each complete copy sorted by path, its size, the
+// primary's modification time and mode, when it was fetched, its checksum
+// with WithChecksums, and the generation it was fetched in. Copies with
+// WriteBack writes not yet flushed, and copies from earlier generations,
+// are left out.
+func (fs *FileSystem) ExportIndex(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(fs.snapshotIndex())
+}
+
+// snapshotIndex returns the index as ExportIndex writes it.
+func (fs *FileSystem) snapshotIndex() indexSnapshot {
+	generation, entries := fs.index.snapshot()
+	s := indexSnapshot{Generation: generation, Entries: make([]snapshotEntry, 0, len(entries))}
+	for name, e := range entries {
+		s.Entries = append(s.Entries, snapshotEntry{
+			Path:       name,
+			Size:       e.size,
+			ModTime:    e.modTime,
+			Mode:       e.mode,
+			Fetched:    e.fetched,
+			Checksum:   e.checksum,
+			Generation: e.generation,
+		})
+	}
+	sort.Slice(s.Entries, func(i, j int) bool {
+		return s.Entries[i].Path < s.Entries[j].Path
+	})
+	return s
+}
+
+// ImportIndex reads an index written by ExportIndex from r, so the cached
+// copies it lists are trusted as complete, with their recorded sizes,
+// modification times and checksums, without fetching them again. The data
+// generation moves on to the exported one if it is behind. An entry is
+// only imported if the cache holds a regular file of its recorded size at
+// its path and it belongs to the resulting generation; entries for paths
+// the FileSystem already knows about are skipped as well, since what it
+// knows is at least as recent. ImportIndex imports nothing while the cache
+// is disabled. It fails only if r can't be read or decoded, in which case
+// nothing is imported.
+func (fs *FileSystem) ImportIndex(r io.Reader) error {
+	off := fs.bypass()
+	var s indexSnapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if off {
+		return nil
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.loadIndex(cache, s)
+	return nil
+}
+
+// loadIndex records the entries of s whose copies cache holds, as
+// ImportIndex describes. The caller must hold the cache.
+func (fs *FileSystem) loadIndex(cache absfs.Filer, s indexSnapshot) {
+	fs.index.restore(s.Generation)
+	generation := fs.index.currentGeneration()
+	for _, se := range s.Entries {
+		name := cleanPath(se.Path)
+		if se.Generation != generation || se.Size < 0 {
+			continue
+		}
+		info, err := cache.Stat(name)
+		if err != nil || !info.Mode().IsRegular() || info.Size() != se.Size {
+			continue
+		}
+		fs.index.load(name, entry{
+			size:       se.Size,
+			complete:   true,
+			checksum:   se.Checksum,
+			fetched:    se.Fetched,
+			modTime:    se.ModTime,
+			mode:       se.Mode,
+			generation: se.Generation,
+		})
+	}
+	fs.evict(cache, "")
+}
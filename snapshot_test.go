@@ -0,0 +1,173 @@
+package corfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+func TestExportImportIndex(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/a.txt", "alpha")
+	writeMemFile(t, mem, "/b.txt", "bravo")
+	writeMemFile(t, mem, "/c.txt", "charlie")
+	fs := New(mem, cache, WithChecksums())
+	fs.cacheFirst = true
+	fs.Bump()
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		readString(fs, name)
+	}
+
+	var buf bytes.Buffer
+	if err := fs.ExportIndex(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var s indexSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Generation != 1 || len(s.Entries) != 3 || s.Entries[0].Path != "/a.txt" || s.Entries[0].Size != 5 ||
+		s.Entries[0].Checksum == "" || s.Entries[0].Fetched.IsZero() {
+		t.Fatalf("exported %+v, expected three entries of generation 1", s)
+	}
+
+	// A copy that no longer has its recorded size isn't trusted
+	writeMemFile(t, cache, "/b.txt", "truncated")
+	cache.Remove("/c.txt")
+
+	primary := &readCountFiler{Filer: mem}
+	restarted := New(primary, cache, WithChecksums())
+	restarted.cacheFirst = true
+	if err := restarted.ImportIndex(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if g := restarted.Generation(); g != 1 {
+		t.Errorf("Generation() = %d, expected 1", g)
+	}
+	st := restarted.CacheStatus("/a.txt")
+	if !st.Complete || st.Size != 5 || st.Checksum != s.Entries[0].Checksum || !st.LastFetched.Equal(s.Entries[0].Fetched) {
+		t.Errorf("CacheStatus(/a.txt) = %+v, expected the exported entry", st)
+	}
+	for _, name := range []string{"/b.txt", "/c.txt"} {
+		if st := restarted.CacheStatus(name); st.Complete {
+			t.Errorf("CacheStatus(%s) = %+v, expected no entry", name, st)
+		}
+	}
+	if got := readString(restarted, "/a.txt"); got != "alpha" || primary.reads.Load() != 0 {
+		t.Errorf("ReadFile() = %q with %d primary reads, expected %q from the cache", got, primary.reads.Load(), "alpha")
+	}
+}
+
+func TestImportIndexSkips(t *testing.T) {
+	_, cache := newMemFilers(t)
+	writeMemFile(t, cache, "/old.txt", "old")
+	writeMemFile(t, cache, "/known.txt", "known")
+	primary, _ := newMemFilers(t)
+	writeMemFile(t, primary, "/known.txt", "known")
+	fs := New(primary, cache)
+	fs.cacheFirst = true
+	fs.Bump()
+	fs.Bump()
+	readString(fs, "/known.txt")
+	before := fs.CacheStatus("/known.txt")
+
+	fetched := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := `{"generation": 1, "entries": [
+		{"path": "/old.txt", "size": 3, "fetchedAt": "2020-01-02T03:04:05Z", "generation": 1},
+		{"path": "/known.txt", "size": 5, "fetchedAt": "2020-01-02T03:04:05Z", "generation": 1}
+	]}`
+	if err := fs.ImportIndex(strings.NewReader(s)); err != nil {
+		t.Fatal(err)
+	}
+	if g := fs.Generation(); g != 2 {
+		t.Errorf("Generation() = %d, expected it to stay 2", g)
+	}
+	if st := fs.CacheStatus("/old.txt"); st.Complete {
+		t.Errorf("CacheStatus(/old.txt) = %+v, expected an entry from an earlier generation to be skipped", st)
+	}
+	if st := fs.CacheStatus("/known.txt"); st.LastFetched.Equal(fetched) || !st.LastFetched.Equal(before.LastFetched) {
+		t.Errorf("CacheStatus(/known.txt) = %+v, expected the entry already known", st)
+	}
+
+	if err := fs.ImportIndex(strings.NewReader("not json")); err == nil {
+		t.Error("ImportIndex() = nil, expected a decoding error")
+	}
+}
+
+// closeFiler records whether it was closed.
+type closeFiler struct {
+	absfs.Filer
+	closed bool
+}
+
+func (c *closeFiler) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSwapCache(t *testing.T) {
+	mem, oldCache := newMemFilers(t)
+	_, newCache := newMemFilers(t)
+	writeMemFile(t, mem, "/a.txt", "alpha")
+	writeMemFile(t, mem, "/b.txt", "bravo")
+	primary := &readCountFiler{Filer: mem}
+	old := &closeFiler{Filer: oldCache}
+	fs := New(primary, old, WithAsyncCacheWrites(2, 1<<20))
+	fs.cacheFirst = true
+	readString(fs, "/b.txt")
+
+	// Filled offline by a FileSystem of its own
+	staging := New(mem, newCache)
+	readString(staging, "/a.txt")
+	if err := fs.SwapCache(newCache, staging.Index(), true); err != nil {
+		t.Fatal(err)
+	}
+	if !old.closed {
+		t.Error("old cache not closed")
+	}
+	if fs.Cache() != newCache {
+		t.Errorf("Cache() = %v, expected the new cache", fs.Cache())
+	}
+	primary.reads.Store(0)
+	if got := readString(fs, "/a.txt"); got != "alpha" || primary.reads.Load() != 0 {
+		t.Errorf("ReadFile(/a.txt) = %q with %d primary reads, expected %q from the new cache", got, primary.reads.Load(), "alpha")
+	}
+	if st := fs.CacheStatus("/b.txt"); st.Cached {
+		t.Errorf("CacheStatus(/b.txt) = %+v, expected the old cache's entry to be gone", st)
+	}
+
+	// Without an index, the new cache is filled afresh
+	if err := fs.SwapCache(oldCache, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if st := fs.CacheStatus("/a.txt"); st.Cached {
+		t.Errorf("CacheStatus(/a.txt) = %+v, expected no entry", st)
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/a.txt", "alpha")
+	fs := New(mem, cache)
+	readString(fs, "/a.txt")
+
+	var buf bytes.Buffer
+	if err := fs.ExportIndex(&buf); err != nil {
+		t.Fatal(err)
+	}
+	index, err := ReadIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := index.snapshot, fs.Index().snapshot; len(got.Entries) != 1 || got.Entries[0].Path != want.Entries[0].Path ||
+		got.Entries[0].Size != want.Entries[0].Size || !got.Entries[0].Fetched.Equal(want.Entries[0].Fetched) {
+		t.Errorf("ReadIndex() = %+v, expected %+v", got, want)
+	}
+	if _, err := ReadIndex(strings.NewReader("not json")); err == nil {
+		t.Error("ReadIndex() = nil, expected a decoding error")
+	}
+}
@@ -0,0 +1,72 @@
+package corfs
+
+import (
+	"bytes"
+	"io"
+)
+
+// sparseBlockSize is the size of the blocks of zeros a sparse fill leaves
+// as holes (see WithSparseFiles). Holes are only made of whole blocks
+// aligned to it, the usual granularity of filesystems that support them.
+const sparseBlockSize = 4096
+
+// zeroBlock is a block of zeros, to find and write holes with.
+var zeroBlock [sparseBlockSize]byte
+
+// writeSparse writes b to the temporary file like writeData, except that
+// aligned blocks of zeros are skipped over, leaving a hole, rather than
+// written.
+func (c *cacheFill) writeSparse(b []byte) {
+	for len(b) > 0 {
+		// Find the content before the next block of zeros
+		n := 0
+		for n < len(b) {
+			m := min(sparseBlockSize-int((c.offset+int64(n))%sparseBlockSize), len(b)-n)
+			if m == sparseBlockSize && bytes.Equal(b[n:n+m], zeroBlock[:]) {
+				break
+			}
+			n += m
+		}
+		if n == 0 {
+			n = sparseBlockSize
+			c.hole += int64(n)
+		} else {
+			c.skipHole()
+			c.writeData(b[:n])
+		}
+		c.offset += int64(n)
+		b = b[n:]
+	}
+}
+
+// skipHole moves the temporary file's offset past the hole pending before
+// the next write, or writes the hole's zeros if the file can't seek.
+func (c *cacheFill) skipHole() {
+	if c.hole == 0 || c.err != nil {
+		return
+	}
+	if _, err := c.file.Seek(c.hole, io.SeekCurrent); err != nil {
+		c.writeHole()
+	}
+	c.hole = 0
+}
+
+// endHole extends the temporary file over a hole the content ends with,
+// which no write follows, or writes its zeros if the file can't be
+// truncated.
+func (c *cacheFill) endHole() {
+	if c.hole == 0 || c.err != nil {
+		return
+	}
+	if err := c.file.Truncate(c.offset); err != nil {
+		c.writeHole()
+	}
+	c.hole = 0
+}
+
+// writeHole writes the zeros of the pending hole to the temporary file.
+func (c *cacheFill) writeHole() {
+	for n := c.hole; n > 0; n -= sparseBlockSize {
+		c.writeData(zeroBlock[:min(n, sparseBlockSize)])
+	}
+}
@@ -0,0 +1,98 @@
+package corfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// writtenBytesFiler counts the bytes written to its files. Unless holes is
+// set, its files can neither seek nor be truncated, so they can't have
+// holes.
+type writtenBytesFiler struct {
+	absfs.Filer
+	holes   bool
+	written atomic.Int64
+}
+
+func (w *writtenBytesFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := w.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &writtenBytesFile{File: f, filer: w}, nil
+}
+
+type writtenBytesFile struct {
+	absfs.File
+	filer *writtenBytesFiler
+}
+
+func (f *writtenBytesFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.filer.written.Add(int64(n))
+	return n, err
+}
+
+func (f *writtenBytesFile) Seek(offset int64, whence int) (int64, error) {
+	if !f.filer.holes {
+		return 0, errors.New("seek not supported")
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *writtenBytesFile) Truncate(size int64) error {
+	if !f.filer.holes {
+		return errors.New("truncate not supported")
+	}
+	return f.File.Truncate(size)
+}
+
+// sparseContent returns seven blocks of content: a block starting with
+// 100 bytes of data, a hole of three blocks, another such block, and a
+// trailing hole of two blocks.
+func sparseContent() []byte {
+	content := make([]byte, 7*sparseBlockSize)
+	copy(content, testContent(100))
+	copy(content[4*sparseBlockSize:], testContent(100))
+	return content
+}
+
+func TestSparseFiles(t *testing.T) {
+	for _, holes := range []bool{true, false} {
+		mem, memCache := newMemFilers(t)
+		content := sparseContent()
+		writeMemFile(t, mem, "/sparse.bin", string(content))
+		cache := &writtenBytesFiler{Filer: memCache, holes: holes}
+		fs := New(mem, cache, WithSparseFiles(), WithChecksums())
+		fs.cacheFirst = true
+
+		if _, err := fs.ReadFile("/sparse.bin"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := memCache.ReadFile("/sparse.bin")
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("holes=%v: cached copy = %d bytes, %v; expected the content", holes, len(got), err)
+		}
+
+		// The data around the holes is written in whole blocks
+		want := int64(len(content))
+		if holes {
+			want = 2 * sparseBlockSize
+		}
+		if n := cache.written.Load(); n != want {
+			t.Errorf("holes=%v: wrote %d bytes to the cache, expected %d", holes, n, want)
+		}
+
+		// The copy's checksum covers the zeros
+		data, err := fs.ReadFile("/sparse.bin")
+		if err != nil || !bytes.Equal(data, content) || fs.Stats().Hits != 1 {
+			t.Errorf("holes=%v: ReadFile() = %d bytes, %v with %d hits; expected the content from the cache",
+				holes, len(data), err, fs.Stats().Hits)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package corfs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statCache holds primary Stat results for a short window. A nil
+// *statCache is valid and caches nothing.
+type statCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]statEntry
+	clock   Clock
+}
+
+type statEntry struct {
+	info    os.FileInfo
+	expires time.Time
+}
+
+func newStatCache(ttl time.Duration) *statCache {
+	return &statCache{ttl: ttl, entries: make(map[string]statEntry), clock: systemClock{}}
+}
+
+// get returns the cached info for name if it hasn't expired.
+func (c *statCache) get(name string) (os.FileInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := path.Clean(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.clock.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.info, true
+}
+
+// put records info for name.
+func (c *statCache) put(name string, info os.FileInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries[path.Clean(name)] = statEntry{info: info, expires: c.clock.Now().Add(c.ttl)}
+	c.mu.Unlock()
+}
+
+// invalidate drops the entries for names.
+func (c *statCache) invalidate(names ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for _, name := range names {
+		delete(c.entries, path.Clean(name))
+	}
+	c.mu.Unlock()
+}
+
+// invalidateTree drops the entry for dir and everything beneath it.
+func (c *statCache) invalidateTree(dir string) {
+	if c == nil {
+		return
+	}
+	dir = path.Clean(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	c.mu.Lock()
+	for key := range c.entries {
+		if key == dir || strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+}
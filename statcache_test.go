@@ -0,0 +1,129 @@
+package corfs
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// statCountFiler counts Stat calls made against the wrapped filer.
+type statCountFiler struct {
+	absfs.Filer
+	stats atomic.Int64
+}
+
+func (c *statCountFiler) Stat(name string) (os.FileInfo, error) {
+	c.stats.Add(1)
+	return c.Filer.Stat(name)
+}
+
+func TestStatCache(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &statCountFiler{Filer: mem}
+	fs := New(primary, cache, WithStatCacheTTL(time.Hour))
+
+	for i := 0; i < 3; i++ {
+		if _, err := fs.Stat("/file.txt"); err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+	}
+	if n := primary.stats.Load(); n != 1 {
+		t.Errorf("primary Stat called %d times, expected 1", n)
+	}
+
+	// Equivalent spellings share an entry
+	if _, err := fs.Stat("/./file.txt"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if n := primary.stats.Load(); n != 1 {
+		t.Errorf("primary Stat called %d times, expected 1", n)
+	}
+}
+
+func TestStatCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(t *testing.T, fs *FileSystem)
+	}{
+		{"Chmod", func(t *testing.T, fs *FileSystem) { fs.Chmod("/file.txt", 0600) }},
+		{"Chtimes", func(t *testing.T, fs *FileSystem) {
+			fs.Chtimes("/file.txt", time.Now(), time.Now().Add(-time.Hour))
+		}},
+		{"Chown", func(t *testing.T, fs *FileSystem) { fs.Chown("/file.txt", 0, 0) }},
+		{"Truncate", func(t *testing.T, fs *FileSystem) { fs.Truncate("/file.txt", 2) }},
+		{"Remove", func(t *testing.T, fs *FileSystem) { fs.Remove("/file.txt") }},
+		{"Rename", func(t *testing.T, fs *FileSystem) { fs.Rename("/file.txt", "/other.txt") }},
+		{"RemoveAll", func(t *testing.T, fs *FileSystem) { fs.RemoveAll("/file.txt") }},
+		{"Write", func(t *testing.T, fs *FileSystem) {
+			f, err := fs.OpenFile("/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(" appended"))
+			f.Close()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem, cache := newMemFilers(t)
+			writeMemFile(t, mem, "/file.txt", "content")
+			primary := &statCountFiler{Filer: mem}
+			fs := New(primary, cache, WithStatCacheTTL(time.Hour))
+
+			if _, err := fs.Stat("/file.txt"); err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			tt.mutate(t, fs)
+
+			before := primary.stats.Load()
+			fs.Stat("/file.txt")
+			if primary.stats.Load() == before {
+				t.Errorf("Stat() after %s was served from the Stat cache", tt.name)
+			}
+		})
+	}
+}
+
+func TestStatCacheExpiry(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "content")
+	primary := &statCountFiler{Filer: mem}
+	clock := newFakeClock()
+	fs := New(primary, cache, WithStatCacheTTL(time.Second), WithClock(clock))
+
+	fs.Stat("/file.txt")
+	clock.advance(time.Second)
+	fs.Stat("/file.txt")
+	if n := primary.stats.Load(); n != 1 {
+		t.Errorf("primary Stat called %d times, expected 1", n)
+	}
+	clock.advance(time.Nanosecond)
+	fs.Stat("/file.txt")
+	if n := primary.stats.Load(); n != 2 {
+		t.Errorf("primary Stat called %d times, expected 2", n)
+	}
+}
+
+func TestStatCacheMissNotCached(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	primary := &statCountFiler{Filer: mem}
+	fs := New(primary, cache, WithStatCacheTTL(time.Hour))
+
+	if _, err := fs.Stat("/new.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat() error = %v, expected not exist", err)
+	}
+
+	// Created out of band, behind the FileSystem's back
+	writeMemFile(t, mem, "/new.txt", "content")
+	if info, err := fs.Stat("/new.txt"); err != nil || info.Size() != 7 {
+		t.Fatalf("Stat() = %v, %v; expected the new file", info, err)
+	}
+	if n := primary.stats.Load(); n != 2 {
+		t.Errorf("primary Stat called %d times, expected 2", n)
+	}
+}
@@ -0,0 +1,207 @@
+package corfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a FileSystem's activity counters.
+type Stats struct {
+	Reads       uint64 // Primary reads by ReadFile and read-only OpenFile
+	Hits        uint64 // Reads by ReadFile and OpenFile served from the cache
+	Promotions  uint64 // Paths that reached the WithPromoteAfter threshold
+	Pending     int    // Paths read but not yet promoted
+	CacheBytes  int64  // Total size of the complete and dirty cached copies
+	Evictions   uint64 // Files removed from the cache by Prune, Reconcile and WithEviction
+	CacheErrors uint64 // Failed cache operations (see WithCacheErrorHandler)
+
+	CacheEntries   int    // Number of complete and dirty cached copies
+	EntryEvictions uint64 // Evictions made to keep to WithMaxEntries, also counted in Evictions
+
+	CacheHandles     int64  // Cache files open for fills and blocks
+	PeakCacheHandles int64  // Most cache files open at once for fills and blocks
+	CacheFullSkips   uint64 // Reads not cached, or failed, at the cache handle limit
+
+	DisabledOps uint64 // Operations performed while the cache was disabled
+
+	Admitted uint64 // Fills the WithAdmission policy allowed
+	Rejected uint64 // Fills the WithAdmission policy refused
+
+	MemoryHits   uint64 // Hits served from the WithMemoryCache tier, also counted in Hits
+	MemoryMisses uint64 // Hits the memory tier could have served but had to read from the cache
+	MemoryBytes  int64  // Total size of the copies held in memory
+
+	Flushes     uint64 // Dirty files written to the primary by Sync, FlushFile, Close and WithIdleFlush
+	IdleFlushes uint64 // Flushes made in the background by WithIdleFlush, also counted in Flushes
+	FlushErrors uint64 // Flushes that failed, leaving the file dirty
+
+	PrimaryReadLatency Latency // Read calls to the primary, each attempt timed on its own
+	CacheWriteLatency  Latency // Writes of content read from the primary to cache fills
+}
+
+// Latency summarizes how long a kind of call took, without keeping the
+// duration of each.
+type Latency struct {
+	Count uint64        // Calls timed
+	Total time.Duration // Sum of their durations
+	Min   time.Duration // Shortest call, or zero before any
+	Max   time.Duration // Longest call, or zero before any
+}
+
+// Mean returns the average duration of a call, or zero before any.
+func (l Latency) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// HitRatio returns the fraction of reads served from the cache, or zero
+// before any reads.
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Reads
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// MemoryHitRatio returns the fraction of the reads the memory tier could
+// serve that it did (see WithMemoryCache), or zero before any.
+func (s Stats) MemoryHitRatio() float64 {
+	total := s.MemoryHits + s.MemoryMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.MemoryHits) / float64(total)
+}
+
+// counters holds the live values behind Stats.
+type counters struct {
+	reads       atomic.Uint64
+	hits        atomic.Uint64
+	promotions  atomic.Uint64
+	evictions   atomic.Uint64
+	entryEvicts atomic.Uint64
+	cacheErrors atomic.Uint64
+	disabledOps atomic.Uint64
+	admitted    atomic.Uint64
+	rejected    atomic.Uint64
+	memHits     atomic.Uint64
+	memMisses   atomic.Uint64
+	flushes     atomic.Uint64
+	idleFlushes atomic.Uint64
+	flushErrors atomic.Uint64
+
+	primaryReads latency
+	cacheWrites  latency
+}
+
+// reset zeroes every counter.
+func (c *counters) reset() {
+	for _, n := range []*atomic.Uint64{
+		&c.reads, &c.hits, &c.promotions, &c.evictions, &c.entryEvicts,
+		&c.cacheErrors, &c.disabledOps, &c.admitted, &c.rejected,
+		&c.memHits, &c.memMisses, &c.flushes, &c.idleFlushes, &c.flushErrors,
+	} {
+		n.Store(0)
+	}
+	c.primaryReads.reset()
+	c.cacheWrites.reset()
+}
+
+// latency accumulates the durations behind a Latency. Its methods may be
+// called concurrently.
+type latency struct {
+	count atomic.Uint64
+	total atomic.Int64
+	min   atomic.Int64 // Zero before any call
+	max   atomic.Int64
+}
+
+// since records a call that started at start.
+func (l *latency) since(start time.Time) {
+	d := int64(time.Since(start))
+	if d <= 0 {
+		d = 1 // Zero means no call for min
+	}
+	l.count.Add(1)
+	l.total.Add(d)
+	for cur := l.min.Load(); (cur == 0 || d < cur) && !l.min.CompareAndSwap(cur, d); cur = l.min.Load() {
+	}
+	for cur := l.max.Load(); d > cur && !l.max.CompareAndSwap(cur, d); cur = l.max.Load() {
+	}
+}
+
+// reset forgets the durations recorded so far.
+func (l *latency) reset() {
+	l.count.Store(0)
+	l.total.Store(0)
+	l.min.Store(0)
+	l.max.Store(0)
+}
+
+// snapshot returns the durations recorded so far.
+func (l *latency) snapshot() Latency {
+	return Latency{
+		Count: l.count.Load(),
+		Total: time.Duration(l.total.Load()),
+		Min:   time.Duration(l.min.Load()),
+		Max:   time.Duration(l.max.Load()),
+	}
+}
+
+// Stats returns a snapshot of the FileSystem's activity counters.
+func (fs *FileSystem) Stats() Stats {
+	return Stats{
+		Reads:       fs.stats.reads.Load(),
+		Hits:        fs.stats.hits.Load(),
+		Promotions:  fs.stats.promotions.Load(),
+		Pending:     fs.access.pending(),
+		CacheBytes:  fs.index.bytes(),
+		Evictions:   fs.stats.evictions.Load(),
+		CacheErrors: fs.stats.cacheErrors.Load(),
+
+		CacheEntries:   fs.index.count(),
+		EntryEvictions: fs.stats.entryEvicts.Load(),
+
+		CacheHandles:     fs.handles.open.Load(),
+		PeakCacheHandles: fs.handles.peak.Load(),
+		CacheFullSkips:   fs.handles.full.Load(),
+
+		DisabledOps: fs.stats.disabledOps.Load(),
+
+		Admitted: fs.stats.admitted.Load(),
+		Rejected: fs.stats.rejected.Load(),
+
+		MemoryHits:   fs.stats.memHits.Load(),
+		MemoryMisses: fs.stats.memMisses.Load(),
+		MemoryBytes:  fs.memory.size(),
+
+		Flushes:     fs.stats.flushes.Load(),
+		IdleFlushes: fs.stats.idleFlushes.Load(),
+		FlushErrors: fs.stats.flushErrors.Load(),
+
+		PrimaryReadLatency: fs.stats.primaryReads.snapshot(),
+		CacheWriteLatency:  fs.stats.cacheWrites.snapshot(),
+	}
+}
+
+// hit records a read of name served from the cache.
+func (fs *FileSystem) hit(name string) {
+	fs.stats.hits.Add(1)
+	if fs.admission != nil {
+		fs.admission.Record(name)
+	}
+	fs.index.hit(name)
+	fs.decide(DecisionHit, name, nil)
+}
+
+// miss records a read of name from the primary.
+func (fs *FileSystem) miss(name string) {
+	fs.stats.reads.Add(1)
+	if fs.admission != nil {
+		fs.admission.Record(name)
+	}
+	fs.decide(DecisionMiss, name, nil)
+}
@@ -0,0 +1,121 @@
+package corfs
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStatsHitsAndBytes(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "hello")
+	writeMemFile(t, primary, "/b.txt", "world!")
+	fs := NewChain(cache, primary)
+
+	for _, name := range []string{"/a.txt", "/b.txt", "/a.txt", "/a.txt"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := fs.Stats()
+	if stats.Reads != 2 || stats.Hits != 2 || stats.CacheBytes != 11 {
+		t.Errorf("Stats() = %+v, expected 2 reads, 2 hits, 11 cache bytes", stats)
+	}
+	if ratio := stats.HitRatio(); ratio != 0.5 {
+		t.Errorf("HitRatio() = %v, expected 0.5", ratio)
+	}
+	if ratio := (Stats{}).HitRatio(); ratio != 0 {
+		t.Errorf("HitRatio() without reads = %v, expected 0", ratio)
+	}
+
+	primary.Remove("/b.txt")
+	if _, err := fs.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := fs.Stats(); stats.Evictions != 1 || stats.CacheBytes != 5 {
+		t.Errorf("Stats() after Prune = %+v, expected 1 eviction, 5 cache bytes", stats)
+	}
+}
+
+func TestStatsLatency(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "hello")
+	writeMemFile(t, primary, "/b.txt", "world!")
+	fs := New(primary, cache)
+	if st := fs.Stats(); st.PrimaryReadLatency != (Latency{}) || st.PrimaryReadLatency.Mean() != 0 {
+		t.Errorf("PrimaryReadLatency = %+v before any reads, expected zero", st.PrimaryReadLatency)
+	}
+
+	readString(fs, "/a.txt")
+	f, err := fs.OpenFile("/b.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	st := fs.Stats()
+	// One ReadFile call, and Read calls up to the one returning io.EOF
+	if l := st.PrimaryReadLatency; l.Count < 3 || l.Min <= 0 || l.Min > l.Mean() || l.Mean() > l.Max || l.Total < l.Max {
+		t.Errorf("PrimaryReadLatency = %+v, expected at least 3 timed reads", l)
+	}
+	if l := st.CacheWriteLatency; l.Count != 2 || l.Min <= 0 || l.Min > l.Max {
+		t.Errorf("CacheWriteLatency = %+v, expected a timed write for each fill", l)
+	}
+}
+
+// expvarRuns tells apart the expvar names of repeated test runs, since
+// expvar names can't be reused.
+var expvarRuns atomic.Int64
+
+func TestPublishExpvar(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "hello")
+	fs := New(primary, cache)
+	name := fmt.Sprintf("%s_%d", t.Name(), expvarRuns.Add(1))
+	fs.PublishExpvar(name)
+
+	if _, err := fs.ReadFile("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	// The variable reflects reads made after it was published
+	if got["reads"] != 1 || got["cacheBytes"] != 5 {
+		t.Errorf("expvar = %v, expected 1 read and 5 cache bytes", got)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.txt", "hello")
+	fs := New(primary, cache)
+	if _, err := fs.ReadFile("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	fs.PrometheusHandler("corfs").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE corfs_primary_reads_total counter\ncorfs_primary_reads_total 1\n",
+		"# TYPE corfs_cache_bytes gauge\ncorfs_cache_bytes 5\n",
+		"corfs_cache_hit_ratio 0\n",
+		"# TYPE corfs_primary_read_calls_total counter\ncorfs_primary_read_calls_total 1\n",
+		"# TYPE corfs_cache_write_calls_total counter\ncorfs_cache_write_calls_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package corfs
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// CacheStatus is what a FileSystem knows about one path in its cache.
+type CacheStatus struct {
+	Cached      bool      // The path has an entry in the cache index
+	Complete    bool      // The cache holds the whole file
+	Dirty       bool      // The cached copy has writes not yet flushed (WriteBack)
+	Size        int64     // Size of the complete copy
+	LastFetched time.Time // When the copy last became complete; TTLs run from it
+	ModTime     time.Time // The primary's modification time of the content, if known
+	Checksum    string    // Hex SHA-256 of the content (see WithChecksums)
+	Hits        int       // Reads served from the cached copy
+	LastAccess  time.Time // When the copy was last fetched or read
+	Frequency   float64   // Fetches and reads of the copy, aged (see WithFrequencyHalfLife)
+}
+
+// CacheStatus reports what the cache index records about name. It doesn't
+// consult either filer, so it reflects only what this FileSystem has seen
+// since it was created or its cache was last replaced. LastFetched and
+// ModTime are kept by the index rather than read from the cached copy, so
+// Chtimes doesn't change them.
+func (fs *FileSystem) CacheStatus(name string) CacheStatus {
+	e, ok := fs.index.get(rooted(name))
+	if !ok {
+		return CacheStatus{}
+	}
+	return e.status(fs.clock.Now(), fs.index.halfLife)
+}
+
+// status returns the CacheStatus of the entry as of now, with its
+// frequency aged by halfLife.
+func (e *entry) status(now time.Time, halfLife time.Duration) CacheStatus {
+	return CacheStatus{
+		Cached:      true,
+		Complete:    e.complete,
+		Dirty:       e.dirty,
+		Size:        e.size,
+		LastFetched: e.fetched,
+		ModTime:     e.modTime,
+		Checksum:    e.checksum,
+		Hits:        e.hits,
+		LastAccess:  e.accessed,
+		Frequency:   e.frequency(now, halfLife),
+	}
+}
+
+// FillProgress reports how much of name is cached. Once the cache holds a
+// complete copy, cachedBytes and totalBytes are both its size and done is
+// true. While a fill is in progress, from a read, ReadFile or Prewarm,
+// cachedBytes is what it has filled so far and totalBytes the size of the
+// file, or -1 if that isn't known, and done is false. With background cache
+// writes (see WithAsyncCacheWrites), only bytes the workers have written
+// are counted. Otherwise FillProgress returns zeros.
+func (fs *FileSystem) FillProgress(name string) (cachedBytes, totalBytes int64, done bool) {
+	name = rooted(name)
+	if e, ok := fs.index.get(name); ok && e.complete {
+		return e.size, e.size, true
+	}
+	if call, ok := fs.flight.lookup(path.Clean(name)); ok {
+		return call.cached.Load(), call.total.Load(), false
+	}
+	// The fill may have just completed
+	if e, ok := fs.index.get(name); ok && e.complete {
+		return e.size, e.size, true
+	}
+	return 0, 0, false
+}
+
+// readCached reads name from cache, provided the cached copy is intact and,
+// with WithVerifyOnRead, matches its checksum, and records a hit if it
+// succeeds. No write-back write is applied halfway through the read. With
+// WithMemoryCache, the copy is read from memory if held there, and held
+// there once read otherwise. The caller must hold the cache.
+func (fs *FileSystem) readCached(cache absfs.Filer, name string) ([]byte, error) {
+	e, inMemory := fs.memoryEntry(name)
+	if inMemory {
+		if data, ok := fs.memory.get(fs.key(name), e.filled); ok {
+			fs.stats.memHits.Add(1)
+			fs.hit(name)
+			return data, nil
+		}
+		fs.stats.memMisses.Add(1)
+	}
+
+	l := fs.paths.of(fs.key(name))
+	l.RLock()
+	data, err := cache.ReadFile(name)
+	l.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !fs.intact(cache, name, int64(len(data))) {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errSizeMismatch}
+	}
+	if !fs.matchesChecksum(cache, name, bytes.NewReader(data)) {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errChecksumMismatch}
+	}
+	fs.hit(name)
+	if inMemory {
+		// Read after e, so the data is e's content or newer, which is
+		// never served since it was filled later than e
+		fs.memory.put(fs.key(name), e.filled, data)
+	}
+	return data, nil
+}
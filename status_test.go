@@ -0,0 +1,150 @@
+package corfs
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCacheStatus(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache, WithChecksums())
+
+	if got := fs.CacheStatus("/file.txt"); got != (CacheStatus{}) {
+		t.Errorf("CacheStatus() before reading = %+v, expected zero", got)
+	}
+
+	before := time.Now()
+	readString(fs, "/file.txt")
+	got := fs.CacheStatus("file.txt")
+	if !got.Cached || !got.Complete || got.Dirty || got.Size != int64(len("hello world")) || got.Hits != 0 {
+		t.Errorf("CacheStatus() after filling = %+v", got)
+	}
+	if got.LastFetched.Before(before) {
+		t.Errorf("LastFetched = %v, expected after %v", got.LastFetched, before)
+	}
+	if len(got.Checksum) != 64 {
+		t.Errorf("Checksum = %q, expected a hex SHA-256", got.Checksum)
+	}
+
+	// Reads served by the cache are counted as hits
+	primary.Remove("/file.txt")
+	readString(fs, "/file.txt")
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Close()
+	if got := fs.CacheStatus("/file.txt"); got.Hits != 2 {
+		t.Errorf("Hits = %d, expected 2", got.Hits)
+	}
+}
+
+func TestCacheStatusTimes(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/read.txt", "content")
+	writeMemFile(t, primary, "/opened.txt", "content")
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"/read.txt", "/opened.txt"} {
+		if err := primary.Chtimes(name, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := New(primary, cache)
+
+	before := time.Now()
+	readString(fs, "/read.txt")
+	f, err := fs.OpenFile("/opened.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, name := range []string{"/read.txt", "/opened.txt"} {
+		got := fs.CacheStatus(name)
+		if !got.ModTime.Equal(modified) {
+			t.Errorf("%s ModTime = %v, expected %v", name, got.ModTime, modified)
+		}
+		if got.LastFetched.Before(before) {
+			t.Errorf("%s LastFetched = %v, expected after %v", name, got.LastFetched, before)
+		}
+
+		// Changing the times of the copies leaves the index alone
+		later := time.Now().Add(time.Hour)
+		if err := fs.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if after := fs.CacheStatus(name); after != got {
+			t.Errorf("%s CacheStatus() after Chtimes = %+v, expected %+v", name, after, got)
+		}
+	}
+}
+
+func TestCacheStatusDirty(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/file.txt", "deferred")
+
+	got := fs.CacheStatus("/file.txt")
+	if !got.Cached || !got.Complete || !got.Dirty || got.Size != int64(len("deferred")) {
+		t.Errorf("CacheStatus() = %+v, expected a complete dirty entry", got)
+	}
+	readString(fs, "/file.txt")
+	if got := fs.CacheStatus("/file.txt"); got.Hits != 1 {
+		t.Errorf("Hits = %d, expected 1", got.Hits)
+	}
+}
+
+func TestFillProgress(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/data.bin", string(testContent(1000)))
+	fs := New(primary, cache)
+
+	if c, n, done := fs.FillProgress("/data.bin"); c != 0 || n != 0 || done {
+		t.Errorf("FillProgress() = %d, %d, %v before any read, expected zeros", c, n, done)
+	}
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.ReadFull(f, make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if c, n, done := fs.FillProgress("/data.bin"); c != 300 || n != 1000 || done {
+		t.Errorf("FillProgress() = %d, %d, %v mid-fill, expected 300, 1000, false", c, n, done)
+	}
+
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if c, n, done := fs.FillProgress("/data.bin"); c != 1000 || n != 1000 || !done {
+		t.Errorf("FillProgress() = %d, %d, %v once filled, expected 1000, 1000, true", c, n, done)
+	}
+}
+
+func TestFillProgressAsync(t *testing.T) {
+	primary, mem := newMemFilers(t)
+	writeMemFile(t, primary, "/data.bin", "queued content")
+	cache := &slowWriteFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithAsyncCacheWrites(1, 1<<20))
+
+	if _, err := fs.ReadFile("/data.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, n, done := fs.FillProgress("/data.bin"); n != 14 || done {
+		t.Errorf("FillProgress() = %d, %v while queued, expected 14 bytes in total, not done", n, done)
+	}
+
+	close(cache.gate)
+	fs.WaitForCacheFlush()
+	if c, n, done := fs.FillProgress("/data.bin"); c != 14 || n != 14 || !done {
+		t.Errorf("FillProgress() = %d, %d, %v once written, expected 14, 14, true", c, n, done)
+	}
+}
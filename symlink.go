@@ -0,0 +1,141 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrNotSupported is returned by operations neither underlying filer
+// implements.
+var ErrNotSupported = errors.New("corfs: operation not supported")
+
+// FileSystem implements absfs.SymLinker, passing symlink operations through
+// to the underlying filers that support them.
+var _ absfs.SymLinker = (*FileSystem)(nil)
+
+// symlinker reports whether filer implements absfs.SymLinker.
+func symlinker(filer absfs.Filer) (absfs.SymLinker, bool) {
+	l, ok := filer.(absfs.SymLinker)
+	return l, ok
+}
+
+// Lstat returns file info for name without following a final symbolic link.
+// It tries the primary first and falls back to the cache, like Stat, and
+// returns ErrNotSupported if neither filer implements absfs.SymLinker.
+func (fs *FileSystem) Lstat(name string) (os.FileInfo, error) {
+	name = cleanPath(name)
+	off := fs.bypass()
+	var err error = &os.PathError{Op: "lstat", Path: name, Err: ErrNotSupported}
+	if l, ok := symlinker(fs.primary); ok {
+		info, perr := l.Lstat(name)
+		if perr == nil {
+			return info, nil
+		}
+		err = perr
+	}
+	if off {
+		return nil, err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	if l, ok := symlinker(cache); ok {
+		if info, cerr := l.Lstat(name); cerr == nil {
+			return fs.fallbackInfo(name, info), nil
+		} else if errors.Is(err, ErrNotSupported) {
+			err = cerr
+		}
+	}
+	return nil, err
+}
+
+// Readlink returns the destination of the symbolic link name. It tries the
+// primary first and falls back to the cache, and returns ErrNotSupported if
+// neither filer implements absfs.SymLinker.
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	name = cleanPath(name)
+	off := fs.bypass()
+	var err error = &os.PathError{Op: "readlink", Path: name, Err: ErrNotSupported}
+	if l, ok := symlinker(fs.primary); ok {
+		dest, perr := l.Readlink(name)
+		if perr == nil {
+			return dest, nil
+		}
+		err = perr
+	}
+	if off {
+		return "", err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	if l, ok := symlinker(cache); ok {
+		if dest, cerr := l.Readlink(name); cerr == nil {
+			return dest, nil
+		} else if errors.Is(err, ErrNotSupported) {
+			err = cerr
+		}
+	}
+	return "", err
+}
+
+// Symlink creates newname as a symbolic link to oldname in the primary, and
+// in the cache on a best-effort basis. The link is made in the primary, so
+// it returns ErrNotSupported if the primary doesn't implement
+// absfs.SymLinker.
+func (fs *FileSystem) Symlink(oldname, newname string) error {
+	newname = cleanPath(newname)
+	off := fs.bypass()
+	if err := fs.readOnlyLinkError("symlink", oldname, newname); err != nil {
+		return err
+	}
+	l, ok := symlinker(fs.primary)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNotSupported}
+	}
+	err := l.Symlink(oldname, newname)
+	fs.invalidateMeta(newname)
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.blocks.drop(cache, newname)
+	fs.index.remove(newname)
+	// Whatever was cached under newname is stale
+	err = fs.cacheResult(err, "remove", newname, cache.Remove(newname))
+	if cl, ok := symlinker(cache); ok && err == nil && !off {
+		fs.mkdirCache(cache, path.Dir(newname))
+		err = fs.cacheResult(err, "symlink", newname, cl.Symlink(oldname, newname))
+	}
+	return err
+}
+
+// Lchown changes the owner and group of name without following a final
+// symbolic link, in the primary and, on a best-effort basis, in the cache.
+// It returns ErrNotSupported if the primary doesn't implement
+// absfs.SymLinker.
+func (fs *FileSystem) Lchown(name string, uid, gid int) error {
+	name = cleanPath(name)
+	off := fs.bypass()
+	if err := fs.readOnlyError("lchown", name); err != nil {
+		return err
+	}
+	l, ok := symlinker(fs.primary)
+	if !ok {
+		return &os.PathError{Op: "lchown", Path: name, Err: ErrNotSupported}
+	}
+	err := l.Lchown(name, uid, gid)
+	fs.invalidateMeta(name)
+	if off && !fs.dirty(name) {
+		return err
+	}
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	if cl, ok := symlinker(cache); ok {
+		return fs.metaResult(err, "lchown", name, cl.Lchown(name, uid, gid))
+	}
+	return err
+}
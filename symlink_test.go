@@ -0,0 +1,89 @@
+package corfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// plainFiler hides every method of a filer beyond absfs.Filer.
+type plainFiler struct {
+	absfs.Filer
+}
+
+func TestSymlinkPassthrough(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/target.txt", "content")
+	fs := New(primary, cache)
+
+	if err := fs.Symlink("/target.txt", "/dir/link.txt"); err == nil {
+		t.Fatal("Symlink() into a missing primary directory succeeded")
+	}
+	if err := fs.Symlink("/target.txt", "/link.txt"); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+	for name, filer := range map[string]absfs.SymLinker{"primary": primary, "cache": cache} {
+		if dest, err := filer.Readlink("/link.txt"); err != nil || dest != "/target.txt" {
+			t.Errorf("%s Readlink() = %q, %v, expected %q", name, dest, err, "/target.txt")
+		}
+	}
+
+	if dest, err := fs.Readlink("/link.txt"); err != nil || dest != "/target.txt" {
+		t.Errorf("Readlink() = %q, %v, expected %q", dest, err, "/target.txt")
+	}
+	info, err := fs.Lstat("/link.txt")
+	if err != nil {
+		t.Fatalf("Lstat() error = %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat() mode = %v, expected a symlink", info.Mode())
+	}
+	if err := fs.Lchown("/link.txt", os.Getuid(), os.Getgid()); err != nil {
+		t.Errorf("Lchown() error = %v", err)
+	}
+}
+
+func TestSymlinkFallsBackToCache(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	if err := cache.Symlink("/target.txt", "/link.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fs := range map[string]*FileSystem{
+		"primary missing link":     New(primary, cache),
+		"primary without symlinks": New(plainFiler{primary}, cache),
+	} {
+		if dest, err := fs.Readlink("/link.txt"); err != nil || dest != "/target.txt" {
+			t.Errorf("%s: Readlink() = %q, %v, expected %q", name, dest, err, "/target.txt")
+		}
+		if _, err := fs.Lstat("/link.txt"); err != nil {
+			t.Errorf("%s: Lstat() error = %v", name, err)
+		}
+	}
+
+	// A miss on both sides reports the primary's error
+	fs := New(primary, cache)
+	if _, err := fs.Readlink("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Readlink() error = %v, expected not exist", err)
+	}
+}
+
+func TestSymlinkNotSupported(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(plainFiler{primary}, plainFiler{cache})
+
+	if _, err := fs.Lstat("/link.txt"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Lstat() error = %v, expected ErrNotSupported", err)
+	}
+	if _, err := fs.Readlink("/link.txt"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Readlink() error = %v, expected ErrNotSupported", err)
+	}
+	if err := fs.Symlink("/target.txt", "/link.txt"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Symlink() error = %v, expected ErrNotSupported", err)
+	}
+	if err := fs.Lchown("/link.txt", 0, 0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Lchown() error = %v, expected ErrNotSupported", err)
+	}
+}
@@ -0,0 +1,154 @@
+package corfs
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// timesOut reports whether calls to the primary for name give up at the
+// primary timeout: one is set and the cache holds a complete copy of name
+// to serve instead (see WithPrimaryTimeout).
+func (fs *FileSystem) timesOut(name string) bool {
+	if fs.timeout <= 0 {
+		return false
+	}
+	e, ok := fs.index.get(name)
+	return ok && e.complete
+}
+
+// awaitPrimary waits for done to be closed by a call to the primary, for
+// no longer than the primary timeout. It reports whether the call finished.
+func (fs *FileSystem) awaitPrimary(done <-chan struct{}) bool {
+	timer := time.NewTimer(fs.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// openPrimary opens name in the primary for reading. If the primary doesn't
+// answer within the primary timeout, the cached copy of name is returned as
+// cached instead, and the primary's handle is closed once it arrives.
+func (fs *FileSystem) openPrimary(ctx context.Context, name string, flag int, perm os.FileMode) (primary, cached absfs.File, err error) {
+	if !fs.timesOut(name) {
+		primary, err = fs.openPrimaryFile(ctx, name, flag, perm)
+		return primary, nil, err
+	}
+
+	// The opener writes only its own results, which are read once done is
+	// closed, by the caller or by the closer of a handle arriving late
+	var opened absfs.File
+	var openErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		opened, openErr = fs.openPrimaryFile(ctx, name, flag, perm)
+	}()
+	if fs.awaitPrimary(done) {
+		return opened, nil, openErr
+	}
+
+	cache := fs.acquireCache()
+	cacheFile, cacheErr := fs.openVerified(cache, name, flag, perm)
+	if cacheErr != nil {
+		fs.releaseCache()
+		<-done
+		return opened, nil, openErr
+	}
+	fs.hit(name)
+	cached = fs.cachedFile(cacheFile, name)
+	fs.releaseCache()
+	go func() {
+		<-done
+		if opened != nil {
+			opened.Close()
+		}
+	}()
+	return nil, cached, nil
+}
+
+// readPrimaryFile reads name from the primary. If the primary doesn't
+// answer within the primary timeout, the cached copy of name is returned
+// instead, and cached is true.
+func (fs *FileSystem) readPrimaryFile(ctx context.Context, name string) (data []byte, cached bool, err error) {
+	if !fs.timesOut(name) {
+		data, err = fs.readPrimaryData(ctx, name)
+		return data, false, err
+	}
+
+	var primaryData []byte
+	var primaryErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		primaryData, primaryErr = fs.readPrimaryData(ctx, name)
+	}()
+	if fs.awaitPrimary(done) {
+		return primaryData, false, primaryErr
+	}
+
+	cache := fs.acquireCache()
+	data, err = fs.readCached(cache, name)
+	fs.releaseCache()
+	if err != nil {
+		<-done
+		return primaryData, false, primaryErr
+	}
+	return data, true, nil
+}
+
+// readPrimaryWithin reads from the primary handle within the FileSystem's
+// limits. If the read doesn't return within the primary timeout, the handle
+// switches to the cached copy, as it does when the primary fails, and
+// readPrimaryWithin returns no data and no error; the primary handle is
+// closed once the abandoned read returns. Without a cached copy to switch
+// to, it waits for the read.
+func (f *File) readPrimaryWithin(b []byte) (int, error) {
+	if f.fs == nil || f.writer || !f.fs.timesOut(f.name) {
+		return f.readPrimary(b)
+	}
+
+	// The abandoned read mustn't write to b once Read has returned
+	buf := make([]byte, len(b))
+	primary := f.primary
+	var n int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = f.throttle(f.ctx, func() (int, error) { return primary.Read(buf) })
+	}()
+	if f.fs.awaitPrimary(done) {
+		return copy(b, buf[:n]), err
+	}
+
+	f.primary = &abandonedFile{File: primary, done: done}
+	if f.switchToCache() {
+		return 0, nil
+	}
+	f.primary = primary
+	<-done
+	return copy(b, buf[:n]), err
+}
+
+// abandonedFile stands in for a primary handle with a read in progress
+// that was abandoned at the primary timeout. Closing it closes the handle
+// once the read has returned.
+type abandonedFile struct {
+	absfs.File
+	done <-chan struct{} // Closed when the read returns
+}
+
+func (a *abandonedFile) Close() error {
+	go func() {
+		<-a.done
+		a.File.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,226 @@
+package corfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// stallFiler holds read-only opens, ReadFile calls, and reads through its
+// files while stalled, until gate is closed. It counts the files closed.
+type stallFiler struct {
+	absfs.Filer
+	stalled atomic.Bool
+	gate    chan struct{}
+	closed  atomic.Int64
+}
+
+func (s *stallFiler) wait() {
+	if s.stalled.Load() {
+		<-s.gate
+	}
+}
+
+func (s *stallFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		s.wait()
+	}
+	f, err := s.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &stallFile{File: f, filer: s}, nil
+}
+
+func (s *stallFiler) ReadFile(name string) ([]byte, error) {
+	s.wait()
+	return s.Filer.ReadFile(name)
+}
+
+type stallFile struct {
+	absfs.File
+	filer *stallFiler
+}
+
+func (f *stallFile) Read(b []byte) (int, error) {
+	f.filer.wait()
+	return f.File.Read(b)
+}
+
+func (f *stallFile) Close() error {
+	f.filer.closed.Add(1)
+	return f.File.Close()
+}
+
+// newStallFS returns a FileSystem with a primary timeout over a stallFiler
+// holding content at /data.bin, already cached.
+func newStallFS(t *testing.T, content []byte) (*FileSystem, *stallFiler) {
+	t.Helper()
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/data.bin", string(content))
+	primary := &stallFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithPrimaryTimeout(20*time.Millisecond))
+	if _, err := fs.ReadFile("/data.bin"); err != nil {
+		t.Fatal(err)
+	}
+	return fs, primary
+}
+
+// waitForClosed waits for the primary to have had want files closed.
+func waitForClosed(t *testing.T, primary *stallFiler, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for primary.closed.Load() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("primary files closed = %d, expected %d", primary.closed.Load(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrimaryTimeoutOpenFile(t *testing.T) {
+	content := testContent(100)
+	fs, primary := newStallFS(t, content)
+	primary.stalled.Store(true)
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("ReadAll() = %d bytes, %v; expected the cached copy", len(data), err)
+	}
+
+	// The abandoned open's handle is closed once it arrives
+	close(primary.gate)
+	waitForClosed(t, primary, 1)
+}
+
+func TestPrimaryTimeoutReadFile(t *testing.T) {
+	content := testContent(100)
+	fs, primary := newStallFS(t, content)
+	primary.stalled.Store(true)
+	defer close(primary.gate)
+
+	data, err := fs.ReadFile("/data.bin")
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("ReadFile() = %d bytes, %v; expected the cached copy", len(data), err)
+	}
+}
+
+func TestPrimaryTimeoutRead(t *testing.T) {
+	content := testContent(100)
+	fs, primary := newStallFS(t, content)
+
+	f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.stalled.Store(true)
+	rest, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, content[10:]) {
+		t.Fatalf("ReadAll() = %d bytes, %v; expected the rest of the cached copy", len(rest), err)
+	}
+
+	close(primary.gate)
+	waitForClosed(t, primary, 1)
+}
+
+func TestPrimaryTimeoutWithoutCachedCopy(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/data.bin", "content")
+	primary := &stallFiler{Filer: mem, gate: make(chan struct{})}
+	fs := New(primary, cache, WithPrimaryTimeout(time.Millisecond))
+	primary.stalled.Store(true)
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := fs.ReadFile("/data.bin")
+		done <- result{data, err}
+	}()
+	select {
+	case r := <-done:
+		t.Fatalf("ReadFile() = %q, %v before the primary answered", r.data, r.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(primary.gate)
+	if r := <-done; r.err != nil || string(r.data) != "content" {
+		t.Errorf("ReadFile() = %q, %v; expected %q", r.data, r.err, "content")
+	}
+}
+
+// lateFiler answers read-only opens after delay, counting the files it
+// opens and closes.
+type lateFiler struct {
+	absfs.Filer
+	delay  time.Duration
+	opened atomic.Int64
+	closed atomic.Int64
+}
+
+func (l *lateFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		time.Sleep(l.delay)
+	}
+	f, err := l.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	l.opened.Add(1)
+	return &lateFile{File: f, filer: l}, nil
+}
+
+type lateFile struct {
+	absfs.File
+	filer *lateFiler
+}
+
+func (f *lateFile) Close() error {
+	f.filer.closed.Add(1)
+	return f.File.Close()
+}
+
+func TestPrimaryTimeoutLateOpenClosed(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/data.bin", "content")
+	primary := &lateFiler{Filer: mem}
+	fs := New(primary, cache, WithPrimaryTimeout(time.Millisecond))
+	if _, err := fs.ReadFile("/data.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opens answered around the timeout are either returned or closed
+	primary.delay = time.Millisecond + 100*time.Microsecond
+	for i := 0; i < 100; i++ {
+		f, err := fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		f.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for primary.closed.Load() < primary.opened.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("primary files closed = %d, expected all %d opened", primary.closed.Load(), primary.opened.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,60 @@
+package corfs
+
+import "context"
+
+// DisableCache turns the FileSystem into a passthrough to its primary until
+// EnableCache is called, such as during maintenance of the cache. While the
+// cache is disabled, every OpenFile behaves as if O_NOCACHE were given,
+// including in WriteBack mode, and ReadFile, Stat, ReadDir, Lstat and
+// Readlink go to the primary alone, neither served from the cache nor
+// falling back to it. Mkdir, Chmod, Chtimes, Chown and Lchown leave the
+// cache alone, and Symlink only discards what it held under the new name.
+//
+// Cached data is kept for when the cache is enabled again. Remove,
+// RemoveAll, Rename and Truncate still update it, and files written while
+// the cache is disabled have their cached copies discarded, so nothing
+// stale is served afterwards. Files with unflushed WriteBack writes are
+// still read and written in the cache, which holds their only up-to-date
+// copy.
+//
+// Each call of a FileSystem method that reads or changes files, such as
+// OpenFile, Stat, Remove, WalkDir, Glob or Verify, made while the cache is
+// disabled is counted once in Stats.DisabledOps, however many files it
+// visits. Calls on the handles it returns are not counted. DisableCache is
+// safe to call concurrently with other operations, which finish as they
+// started.
+func (fs *FileSystem) DisableCache() {
+	fs.cacheOff.Store(true)
+}
+
+// EnableCache ends the passthrough started by DisableCache.
+func (fs *FileSystem) EnableCache() {
+	fs.cacheOff.Store(false)
+}
+
+// bypass reports whether the cache is disabled, counting the operation
+// asking if so. Exported operations call it once, on entry, and pass the
+// answer to the internals they share rather than calling each other.
+func (fs *FileSystem) bypass() bool {
+	if !fs.cacheOff.Load() {
+		return false
+	}
+	fs.stats.disabledOps.Add(1)
+	return true
+}
+
+// readUncached reads name from the primary alone.
+func (fs *FileSystem) readUncached(ctx context.Context, name string) ([]byte, error) {
+	fs.miss(name)
+	if err := fs.waitRequest(ctx); err != nil {
+		return nil, err
+	}
+	data, err := fs.readPrimaryData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.waitBytes(ctx, len(data)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
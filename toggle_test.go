@@ -0,0 +1,187 @@
+package corfs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+func TestDisableCache(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/kept.txt", "kept")
+	writeMemFile(t, mem, "/written.txt", "old")
+	writeMemFile(t, mem, "/uncached.txt", "uncached")
+	primary := &readCountFiler{Filer: mem}
+	fs := NewChain(cache, primary)
+	for _, name := range []string{"/kept.txt", "/written.txt"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.DisableCache()
+	reads := primary.reads.Load()
+	if got := readString(fs, "/kept.txt"); got != "kept" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "kept")
+	}
+	if n := primary.reads.Load() - reads; n != 1 {
+		t.Errorf("primary reads = %d, expected the cached copy to be bypassed", n)
+	}
+	if got := readString(fs, "/uncached.txt"); got != "uncached" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "uncached")
+	}
+	if st := fs.CacheStatus("/uncached.txt"); st.Cached {
+		t.Errorf("CacheStatus() = %+v, expected nothing cached while disabled", st)
+	}
+	writeMemFile(t, fs, "/written.txt", "new")
+
+	// Nothing is served from the cache, even when the primary fails
+	if err := mem.Remove("/kept.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile("/kept.txt"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile() error = %v, expected the primary's", err)
+	}
+	if _, err := fs.Stat("/kept.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat() error = %v, expected the primary's", err)
+	}
+	if n := fs.Stats().DisabledOps; n != 5 {
+		t.Errorf("DisabledOps = %d, expected 5", n)
+	}
+
+	fs.EnableCache()
+	if got := readString(fs, "/kept.txt"); got != "kept" {
+		t.Errorf("ReadFile() = %q, expected the preserved cached copy", got)
+	}
+	if got := readString(fs, "/written.txt"); got != "new" {
+		t.Errorf("ReadFile() = %q, expected the content written while disabled", got)
+	}
+	if n := fs.Stats().DisabledOps; n != 5 {
+		t.Errorf("DisabledOps = %d after EnableCache, expected 5", n)
+	}
+}
+
+func TestDisableCacheWriteBack(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/dirty.txt", "unflushed")
+
+	fs.DisableCache()
+	writeMemFile(t, fs, "/direct.txt", "direct")
+	if got := readString(primary, "/direct.txt"); got != "direct" {
+		t.Errorf("primary content = %q, expected writes to go straight to it", got)
+	}
+	if got := readString(fs, "/dirty.txt"); got != "unflushed" {
+		t.Errorf("ReadFile() = %q, expected the unflushed copy", got)
+	}
+}
+
+func TestDisableCacheCountsOnce(t *testing.T) {
+	open := func(f absfs.File, err error) error {
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	walked := func(string, iofs.DirEntry, error) error { return nil }
+	tests := []struct {
+		name string
+		op   func(fs *FileSystem) error
+	}{
+		{"OpenFile", func(fs *FileSystem) error { return open(fs.OpenFile("/dir/a.txt", os.O_RDONLY, 0)) }},
+		{"OpenFileWrite", func(fs *FileSystem) error { return open(fs.OpenFile("/dir/a.txt", os.O_WRONLY, 0)) }},
+		{"Open", func(fs *FileSystem) error {
+			f, err := fs.Open("dir/a.txt")
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}},
+		{"CachedReader", func(fs *FileSystem) error {
+			r, err := fs.CachedReader("/dir/a.txt")
+			if err != nil {
+				return err
+			}
+			return r.Close()
+		}},
+		{"ReadFile", func(fs *FileSystem) error { _, err := fs.ReadFile("/dir/a.txt"); return err }},
+		{"Stat", func(fs *FileSystem) error { _, err := fs.Stat("/dir/a.txt"); return err }},
+		{"Exists", func(fs *FileSystem) error { _, err := fs.Exists("/dir/a.txt"); return err }},
+		{"IsDir", func(fs *FileSystem) error { _, err := fs.IsDir("/dir"); return err }},
+		{"ReadDir", func(fs *FileSystem) error { _, err := fs.ReadDir("/dir"); return err }},
+		{"HandleReadDir", func(fs *FileSystem) error {
+			f, err := fs.OpenFile("/dir", os.O_RDONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Readdir(0)
+			return err
+		}},
+		{"Glob", func(fs *FileSystem) error { _, err := fs.Glob("*/*.txt"); return err }},
+		{"GlobLiteral", func(fs *FileSystem) error { _, err := fs.Glob("dir/a.txt"); return err }},
+		{"WalkDir", func(fs *FileSystem) error { return fs.WalkDir("/", walked) }},
+		{"Prewarm", func(fs *FileSystem) error { return fs.Prewarm("/", walked) }},
+		{"Lstat", func(fs *FileSystem) error { _, err := fs.Lstat("/link.txt"); return err }},
+		{"Readlink", func(fs *FileSystem) error { _, err := fs.Readlink("/link.txt"); return err }},
+		{"Symlink", func(fs *FileSystem) error { return fs.Symlink("/dir/b.txt", "/other.txt") }},
+		{"Lchown", func(fs *FileSystem) error { return fs.Lchown("/link.txt", 1, 1) }},
+		{"Mkdir", func(fs *FileSystem) error { return fs.Mkdir("/new", 0755) }},
+		{"MkdirAll", func(fs *FileSystem) error { return fs.MkdirAll("/new/sub", 0755) }},
+		{"Chmod", func(fs *FileSystem) error { return fs.Chmod("/dir/a.txt", 0600) }},
+		{"Chtimes", func(fs *FileSystem) error { return fs.Chtimes("/dir/a.txt", time.Now(), time.Now()) }},
+		{"Chown", func(fs *FileSystem) error { return fs.Chown("/dir/a.txt", 1, 1) }},
+		{"Remove", func(fs *FileSystem) error { return fs.Remove("/dir/b.txt") }},
+		{"RemoveAll", func(fs *FileSystem) error { return fs.RemoveAll("/dir") }},
+		{"Rename", func(fs *FileSystem) error { return fs.Rename("/dir/a.txt", "/moved.txt") }},
+		{"Truncate", func(fs *FileSystem) error { return fs.Truncate("/dir/a.txt", 0) }},
+		{"CopyFile", func(fs *FileSystem) error {
+			if _, err := fs.CopyFile("/dir/a.txt"); !errors.Is(err, ErrNotCacheable) {
+				return err
+			}
+			return nil
+		}},
+		{"Seed", func(fs *FileSystem) error {
+			info, err := fs.primary.Stat("/dir/a.txt")
+			if err != nil {
+				return err
+			}
+			if err := fs.Seed("/dir/a.txt", strings.NewReader("a"), info); !errors.Is(err, ErrNotCacheable) {
+				return err
+			}
+			return nil
+		}},
+		{"Verify", func(fs *FileSystem) error { _, err := fs.Verify(true); return err }},
+		{"ImportIndex", func(fs *FileSystem) error { return fs.ImportIndex(strings.NewReader("{}")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem, cache := newMemFilers(t)
+			if err := mem.Mkdir("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeMemFile(t, mem, "/dir/a.txt", "a")
+			writeMemFile(t, mem, "/dir/b.txt", "b")
+			if err := mem.Symlink("/dir/a.txt", "/link.txt"); err != nil {
+				t.Fatal(err)
+			}
+			fs := New(mem, cache)
+			if err := fs.Prewarm("/", walked); err != nil {
+				t.Fatal(err)
+			}
+
+			fs.DisableCache()
+			if err := tt.op(fs); err != nil {
+				t.Fatalf("%s error = %v", tt.name, err)
+			}
+			if n := fs.Stats().DisabledOps; n != 1 {
+				t.Errorf("DisabledOps = %d, expected 1", n)
+			}
+		})
+	}
+}
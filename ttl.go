@@ -0,0 +1,149 @@
+package corfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ttlRule overrides the TTL of the paths matching pattern (see SetTTL).
+type ttlRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// ttlRules holds the TTL overrides of a FileSystem, in the order they were
+// set.
+type ttlRules struct {
+	mu    sync.RWMutex
+	rules []ttlRule
+}
+
+// SetTTL overrides the TTL set by WithTTL for the paths matching pattern.
+// A ttl of zero means matching paths are never cached, and a negative ttl
+// means their cached copies never expire. Setting a pattern again replaces
+// its TTL. SetTTL returns path.ErrBadPattern if pattern is malformed.
+//
+// Patterns use the syntax of path.Match. A rooted pattern is matched
+// against the clean path and each of its parent directories, so "/data"
+// and "/data/*" both cover everything beneath /data. An unrooted pattern,
+// such as "*.json", is matched against the base name alone.
+//
+// When several patterns match, the most specific wins: a pattern matching
+// the path itself, including by its base name, beats one matching a parent
+// directory, and a nearer parent beats a farther one. Among patterns
+// matching at the same level, the one with more literal characters wins,
+// and the most recently set breaks any remaining tie.
+func (fs *FileSystem) SetTTL(pattern string, ttl time.Duration) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	if strings.HasPrefix(pattern, "/") {
+		pattern = path.Clean(pattern)
+	}
+
+	fs.ttls.mu.Lock()
+	defer fs.ttls.mu.Unlock()
+	for i, r := range fs.ttls.rules {
+		if r.pattern == pattern {
+			fs.ttls.rules = append(fs.ttls.rules[:i], fs.ttls.rules[i+1:]...)
+			break
+		}
+	}
+	fs.ttls.rules = append(fs.ttls.rules, ttlRule{pattern: pattern, ttl: ttl})
+	return nil
+}
+
+// ttl returns the TTL of name: that of the most specific matching pattern
+// set with SetTTL, or else the one set with WithTTL. Negative TTLs never
+// expire.
+func (fs *FileSystem) ttl(name string) time.Duration {
+	name = path.Clean(name)
+
+	fs.ttls.mu.RLock()
+	defer fs.ttls.mu.RUnlock()
+	best, bestDepth, bestLiteral := -1, -1, -1
+	for i, r := range fs.ttls.rules {
+		depth := r.depth(name)
+		if depth < 0 {
+			continue
+		}
+		literal := literalLen(r.pattern)
+		if depth > bestDepth || depth == bestDepth && literal >= bestLiteral {
+			best, bestDepth, bestLiteral = i, depth, literal
+		}
+	}
+	if best >= 0 {
+		return fs.ttls.rules[best].ttl
+	}
+	if fs.defaultTTL > 0 {
+		return fs.defaultTTL
+	}
+	return -1
+}
+
+// depth returns how specifically the rule matches the clean path name: the
+// depth of the path or parent directory it matches, or -1 if it matches
+// neither.
+func (r ttlRule) depth(name string) int {
+	if !strings.HasPrefix(r.pattern, "/") {
+		if ok, _ := path.Match(r.pattern, path.Base(name)); ok {
+			return pathDepth(name)
+		}
+		return -1
+	}
+	for p := name; ; p = path.Dir(p) {
+		if ok, _ := path.Match(r.pattern, p); ok {
+			return pathDepth(p)
+		}
+		if p == "/" || p == "." {
+			return -1
+		}
+	}
+}
+
+// pathDepth returns the number of elements in the clean path name.
+func pathDepth(name string) int {
+	if name == "/" {
+		return 0
+	}
+	return strings.Count(name, "/")
+}
+
+// literalLen returns the number of characters of pattern that aren't part
+// of a wildcard or character class.
+func literalLen(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			for i < len(pattern) && pattern[i] != ']' {
+				i++
+			}
+		case '\\':
+			i++
+			n++
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// uncacheable reports whether name has a zero TTL, or no file is, so it
+// is never cached.
+func (fs *FileSystem) uncacheable(name string) bool {
+	return fs.metadataOnly || fs.ttl(name) == 0
+}
+
+// expired reports whether e, the index entry of name, is a complete copy
+// that has outlived its TTL. Dirty copies never expire.
+func (fs *FileSystem) expired(name string, e entry) bool {
+	if !e.complete || e.dirty {
+		return false
+	}
+	ttl := fs.ttl(name)
+	return ttl >= 0 && fs.clock.Now().Sub(e.fetched) >= ttl
+}
@@ -0,0 +1,101 @@
+package corfs
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTTLPrecedence(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithTTL(time.Hour))
+	for pattern, ttl := range map[string]time.Duration{
+		"/data":               -1,
+		"/data/*.json":        0,
+		"*.json":              time.Minute,
+		"/data/manifest.json": 2 * time.Minute,
+	} {
+		if err := fs.SetTTL(pattern, ttl); err != nil {
+			t.Fatalf("SetTTL(%q) error = %v", pattern, err)
+		}
+	}
+
+	for name, want := range map[string]time.Duration{
+		"/other/x.bin":        time.Hour,
+		"/data/blocks/x.bin":  -1,
+		"/data/a.json":        0,
+		"/data/manifest.json": 2 * time.Minute,
+		"/x.json":             time.Minute,
+		"/data/sub/a.json":    time.Minute,
+		"/data/./a.json/":     0,
+	} {
+		if got := fs.ttl(name); got != want {
+			t.Errorf("ttl(%q) = %v, expected %v", name, got, want)
+		}
+	}
+
+	// Setting a pattern again replaces its TTL
+	fs.SetTTL("*.json", 3*time.Minute)
+	if got := fs.ttl("/x.json"); got != 3*time.Minute {
+		t.Errorf("ttl(/x.json) = %v after replacing, expected %v", got, 3*time.Minute)
+	}
+
+	if err := fs.SetTTL("[", time.Minute); err != path.ErrBadPattern {
+		t.Errorf("SetTTL([) error = %v, expected %v", err, path.ErrBadPattern)
+	}
+}
+
+func TestTTLExpiresCachedCopies(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/manifest.json", "v1")
+	primary := &readCountFiler{Filer: mem}
+	fs := NewChain(cache, primary)
+	fs.SetTTL("*.json", 20*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := fs.ReadFile("/manifest.json"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := primary.reads.Load(); n != 1 {
+		t.Fatalf("primary reads = %d before expiry, expected 1", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	writeMemFile(t, mem, "/manifest.json", "v2")
+	data, err := fs.ReadFile("/manifest.json")
+	if err != nil || string(data) != "v2" {
+		t.Errorf("ReadFile() = %q, %v after expiry; expected %q", data, err, "v2")
+	}
+	if n := primary.reads.Load(); n != 2 {
+		t.Errorf("primary reads = %d after expiry, expected 2", n)
+	}
+}
+
+func TestTTLZeroNeverCaches(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/a.log", "log")
+	writeMemFile(t, primary, "/b.log", "log")
+	fs := New(primary, cache)
+
+	if _, err := fs.ReadFile("/a.log"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTTL("*.log", 0)
+
+	if _, err := fs.ReadFile("/b.log"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Stat("/b.log"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/b.log) error = %v, expected it not cached", err)
+	}
+
+	// Copies cached before the override are pruned
+	if n, err := fs.Prune(); err != nil || n != 1 {
+		t.Errorf("Prune() = %d, %v; expected 1 file removed", n, err)
+	}
+	if _, err := cache.Stat("/a.log"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/a.log) error = %v, expected it pruned", err)
+	}
+}
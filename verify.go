@@ -0,0 +1,279 @@
+package corfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/absfs/absfs"
+)
+
+// errSizeMismatch rejects a cached copy whose size differs from the size
+// recorded for the file.
+var errSizeMismatch = errors.New("corfs: cached copy has the wrong size")
+
+// errChecksumMismatch rejects a cached copy whose content doesn't match the
+// checksum recorded for it (see WithVerifyOnRead).
+var errChecksumMismatch = errors.New("corfs: cached copy fails its checksum")
+
+// intact reports whether a cached copy of name holding size bytes can be
+// served. Its size must match the size recorded for a complete entry, or
+// else the size the primary reports; a copy that can't be checked either
+// way, such as one with unflushed writes, is served as is. A copy from an
+// earlier data generation is never served. A copy that fails the check is
+// removed from the cache. The caller must hold the
+// cache.
+func (fs *FileSystem) intact(cache absfs.Filer, name string, size int64) bool {
+	if want, ok := fs.recordedSize(name); (!ok || size == want) && !fs.index.superseded(name) {
+		return true
+	}
+	fs.index.prune(name, func() {
+		cache.Remove(name)
+	})
+	return false
+}
+
+// matchesChecksum reports whether the content of the cached copy of name,
+// read from r, matches the checksum recorded for it. It always does unless
+// WithVerifyOnRead is set and a checksum was recorded. A copy that fails
+// the check is removed from the cache and reported as a cache error. The
+// caller must hold the cache.
+func (fs *FileSystem) matchesChecksum(cache absfs.Filer, name string, r io.Reader) bool {
+	if !fs.verifyOnRead {
+		return true
+	}
+	e, ok := fs.index.get(name)
+	if !ok || e.dirty || e.checksum == "" {
+		return true
+	}
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err == nil && hex.EncodeToString(h.Sum(nil)) == e.checksum {
+		return true
+	}
+	if err == nil {
+		err = errChecksumMismatch
+	}
+	fs.index.prune(name, func() {
+		cache.Remove(name)
+	})
+	fs.reportCacheError("verify", name, err)
+	return false
+}
+
+// recordedSize returns the size name is known to have, if any.
+func (fs *FileSystem) recordedSize(name string) (int64, bool) {
+	if e, ok := fs.index.get(name); ok && (e.dirty || e.complete) {
+		return e.size, !e.dirty
+	}
+	if fs.health.get().Down {
+		return 0, false
+	}
+	info, ok := fs.statCache.get(name)
+	if !ok {
+		var err error
+		if info, err = fs.primary.Stat(name); err != nil {
+			return 0, false
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// openVerified opens the cached copy of name, provided it is intact and,
+// with WithVerifyOnRead, matches its checksum. The caller must hold the
+// cache.
+func (fs *FileSystem) openVerified(cache absfs.Filer, name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := openFile(cache, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return f, nil
+	}
+	if !fs.intact(cache, name, info.Size()) {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: errSizeMismatch}
+	}
+	if !fs.matchesChecksum(cache, name, f) {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: errChecksumMismatch}
+	}
+	if fs.verifyOnRead {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// VerifyReport lists the problems Verify found in the cache. Paths are
+// sorted within each list.
+type VerifyReport struct {
+	Checked    int      // Cached copies checked
+	Truncated  []string // Copies whose size differs from the recorded size or the primary's
+	Mismatched []string // Complete copies failing their recorded checksum
+	Missing    []string // Complete entries whose cached copy is gone
+	Orphans    []string // Copies of files the primary no longer has, unknown to the index
+	Repaired   []string // Paths removed from the cache or fetched again, with repair
+}
+
+// OK reports whether Verify found no problems.
+func (r *VerifyReport) OK() bool {
+	return len(r.Truncated)+len(r.Mismatched)+len(r.Missing)+len(r.Orphans) == 0
+}
+
+// Verify checks every cached copy, for maintenance such as after a crash or
+// a disk incident. The size of each copy is compared with the size
+// recorded for it, or for copies the FileSystem doesn't know about, such
+// as those cached before it was created, with the primary's size; complete
+// copies with a recorded checksum (see WithChecksums) have their content
+// read and checked against it, whether or not WithVerifyOnRead is set.
+// Copies of files deleted from the primary that the FileSystem doesn't
+// know about are orphans. Dirty write-back copies, files open for writing,
+// and fills in progress are left alone.
+//
+// With repair, bad copies and orphans are removed and, unless they are
+// orphans, fetched again from the primary, as are complete entries whose
+// copy is missing; files not cacheable any more are only removed. Verify
+// stops at the first error other than a file not existing, including errors
+// from the primary, so an unreachable primary never causes cached copies to
+// be removed, and returns the report so far.
+func (fs *FileSystem) Verify(repair bool) (VerifyReport, error) {
+	off := fs.bypass()
+	var r VerifyReport
+	seen := make(map[string]bool)
+	cache := fs.acquireCache()
+	err := fs.verifyDir(cache, "/", &r, seen)
+	if err == nil {
+		for _, name := range fs.index.completePaths() {
+			if !seen[name] {
+				r.Missing = append(r.Missing, name)
+			}
+		}
+	}
+	fs.releaseCache()
+	if err != nil || !repair {
+		return r, err
+	}
+	return r, fs.repair(&r, off)
+}
+
+// verifyDir verifies the cached copies under dir, adding them to seen. The
+// caller must hold the cache.
+func (fs *FileSystem) verifyDir(cache absfs.Filer, dir string, r *VerifyReport, seen map[string]bool) error {
+	entries, err := cache.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "." || name == ".." || isInternalName(name) {
+			continue
+		}
+		full := path.Join(dir, name)
+		if entry.IsDir() {
+			err = fs.verifyDir(cache, full, r, seen)
+		} else if entry.Type().IsRegular() {
+			seen[full] = true
+			err = fs.verifyFile(cache, full, entry, r)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyFile verifies the cached copy name. The caller must hold the cache.
+func (fs *FileSystem) verifyFile(cache absfs.Filer, name string, entry iofs.DirEntry, r *VerifyReport) error {
+	e, ok := fs.index.get(name)
+	if ok && e.dirty || fs.index.writing(name) {
+		return nil
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return err
+	}
+	r.Checked++
+
+	if !ok || !e.complete {
+		primary, err := fs.primary.Stat(name)
+		switch {
+		case errors.Is(err, os.ErrNotExist), err == nil && primary.IsDir():
+			r.Orphans = append(r.Orphans, name)
+		case err != nil:
+			return err
+		case primary.Size() != info.Size():
+			r.Truncated = append(r.Truncated, name)
+		}
+		return nil
+	}
+	if info.Size() != e.size {
+		r.Truncated = append(r.Truncated, name)
+		return nil
+	}
+	if e.checksum == "" {
+		return nil
+	}
+	f, err := openFile(cache, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.checksum {
+		r.Mismatched = append(r.Mismatched, name)
+	}
+	return nil
+}
+
+// repair removes the bad copies and orphans found by Verify, and fetches
+// the files other than orphans again unless the cache is off.
+func (fs *FileSystem) repair(r *VerifyReport, off bool) error {
+	orphans := make(map[string]bool)
+	for _, name := range r.Orphans {
+		orphans[name] = true
+	}
+	var names []string
+	names = append(names, r.Truncated...)
+	names = append(names, r.Mismatched...)
+	names = append(names, r.Missing...)
+	names = append(names, r.Orphans...)
+	sort.Strings(names)
+
+	// Each path is in one list, so is repaired once
+	for _, name := range names {
+		cache := fs.acquireCache()
+		pruned := fs.index.prune(name, func() {
+			cache.Remove(name)
+		})
+		if pruned {
+			fs.blocks.drop(cache, name)
+		}
+		fs.releaseCache()
+		if !pruned {
+			continue // Written since it was checked
+		}
+		r.Repaired = append(r.Repaired, name)
+		if orphans[name] || off {
+			continue
+		}
+		if _, err := fs.copyFile(name); err != nil && !errors.Is(err, ErrNotCacheable) && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package corfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+var errReadFailed = errors.New("read failed")
+
+// readFailFiler fails every read while still answering Stat.
+type readFailFiler struct {
+	absfs.Filer
+}
+
+func (r readFailFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return nil, errReadFailed
+}
+
+func (r readFailFiler) ReadFile(name string) ([]byte, error) {
+	return nil, errReadFailed
+}
+
+func TestTruncatedCopyIsRefetched(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache)
+	fs.cacheFirst = true
+	readString(fs, "/file.txt")
+
+	writeMemFile(t, cache, "/file.txt", "hello")
+	if got := readString(fs, "/file.txt"); got != "hello world" {
+		t.Errorf("ReadFile() = %q, expected %q from the primary", got, "hello world")
+	}
+	if got := readString(cache, "/file.txt"); got != "hello world" {
+		t.Errorf("cache holds %q, expected it refilled", got)
+	}
+
+	writeMemFile(t, cache, "/file.txt", "hello")
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	if f.(*File).primary == nil {
+		t.Error("OpenFile() served the truncated cached copy")
+	}
+}
+
+func TestTruncatedCopyIsNotAFallback(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache)
+	readString(fs, "/file.txt")
+	writeMemFile(t, cache, "/file.txt", "hello")
+
+	fs.primary = readFailFiler{primary}
+	if _, err := fs.ReadFile("/file.txt"); err != errReadFailed {
+		t.Errorf("ReadFile() error = %v, expected the primary's error", err)
+	}
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the truncated copy removed", err)
+	}
+}
+
+func TestUnindexedCopyIsCheckedAgainstPrimary(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	writeMemFile(t, primary, "/other.txt", "intact")
+	writeMemFile(t, cache, "/file.txt", "hello")
+	writeMemFile(t, cache, "/other.txt", "intact")
+	fs := New(readFailFiler{primary}, cache)
+
+	if _, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0); err != errReadFailed {
+		t.Errorf("OpenFile() error = %v, expected the primary's error", err)
+	}
+	if got := readString(fs, "/other.txt"); got != "intact" {
+		t.Errorf("ReadFile() = %q, expected the intact cached copy", got)
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "original content")
+	var got cacheErrors
+	fs := New(primary, cache, WithChecksums(), WithVerifyOnRead(), WithCacheErrorHandler(got.handle))
+	fs.cacheFirst = true
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corruption that keeps the size is caught by the checksum
+	writeMemFile(t, cache, "/file.txt", "corrupt content!")
+	if got := readString(fs, "/file.txt"); got != "original content" {
+		t.Errorf("ReadFile() = %q, expected the primary's content", got)
+	}
+	if got := readString(cache, "/file.txt"); got != "original content" {
+		t.Errorf("cache content = %q, expected it repaired", got)
+	}
+
+	writeMemFile(t, cache, "/file.txt", "corrupt content!")
+	f, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "original content" {
+		t.Errorf("ReadAll() = %q, %v; expected the primary's content", data, err)
+	}
+	if got := readString(cache, "/file.txt"); got != "original content" {
+		t.Errorf("cache content = %q, expected it repaired", got)
+	}
+
+	// Intact copies are served from the cache
+	f, err = fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	data, err = io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "original content" {
+		t.Errorf("ReadAll() = %q, %v; expected the cached content", data, err)
+	}
+	if st := fs.CacheStatus("/file.txt"); st.Hits != 1 {
+		t.Errorf("CacheStatus().Hits = %d, expected 1", st.Hits)
+	}
+
+	ops := got.ops()
+	if len(ops) != 2 || ops[0] != "verify" || ops[1] != "verify" {
+		t.Errorf("reported ops = %v, expected [verify verify]", ops)
+	}
+	for _, err := range got.errs {
+		if !errors.Is(err, errChecksumMismatch) {
+			t.Errorf("reported %v, expected %v", err, errChecksumMismatch)
+		}
+	}
+}
+
+func TestVerifyOnReadOffByDefault(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "original content")
+	fs := New(primary, cache, WithChecksums())
+	fs.cacheFirst = true
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeMemFile(t, cache, "/file.txt", "corrupt content!")
+	if got := readString(fs, "/file.txt"); got != "corrupt content!" {
+		t.Errorf("ReadFile() = %q, expected the cached copy unchecked", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/sub", 0755)
+	for _, name := range []string{"/good.txt", "/short.txt", "/corrupt.txt", "/missing.txt", "/sub/unknown.txt"} {
+		writeMemFile(t, primary, name, "content of "+name)
+	}
+	fs := New(primary, cache, WithChecksums())
+	for _, name := range []string{"/good.txt", "/short.txt", "/corrupt.txt", "/missing.txt"} {
+		if _, err := fs.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, cache, "/short.txt", "content")
+	writeMemFile(t, cache, "/corrupt.txt", "CONTENT of /corrupt.txt")
+	cache.Remove("/missing.txt")
+	writeMemFile(t, cache, "/orphan.txt", "gone from the primary")
+	cache.MkdirAll("/sub", 0755)
+	writeMemFile(t, cache, "/sub/unknown.txt", "content of /sub/unknown.txt")
+
+	want := VerifyReport{
+		Checked:    5,
+		Truncated:  []string{"/short.txt"},
+		Mismatched: []string{"/corrupt.txt"},
+		Missing:    []string{"/missing.txt"},
+		Orphans:    []string{"/orphan.txt"},
+	}
+	r, err := fs.Verify(false)
+	if err != nil || !reflect.DeepEqual(r, want) {
+		t.Fatalf("Verify(false) = %+v, %v; expected %+v", r, err, want)
+	}
+	if got := readString(cache, "/corrupt.txt"); got != "CONTENT of /corrupt.txt" {
+		t.Errorf("cache /corrupt.txt = %q, expected it left alone without repair", got)
+	}
+
+	want.Repaired = []string{"/corrupt.txt", "/missing.txt", "/orphan.txt", "/short.txt"}
+	r, err = fs.Verify(true)
+	if err != nil || !reflect.DeepEqual(r, want) {
+		t.Fatalf("Verify(true) = %+v, %v; expected %+v", r, err, want)
+	}
+	for _, name := range []string{"/short.txt", "/corrupt.txt", "/missing.txt"} {
+		if got := readString(cache, name); got != "content of "+name {
+			t.Errorf("cache %s = %q, expected it fetched again", name, got)
+		}
+	}
+	if _, err := cache.Stat("/orphan.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat(/orphan.txt) error = %v, expected the orphan removed", err)
+	}
+
+	r, err = fs.Verify(false)
+	if err != nil || !r.OK() || r.Checked != 5 {
+		t.Errorf("Verify(false) after repair = %+v, %v; expected 5 copies checked and no problems", r, err)
+	}
+}
+
+func TestVerifyPrimaryDown(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, cache, "/unknown.txt", "content")
+	fs := New(primary, cache)
+	fs.primary = &mockFilerWithError{err: errReadFailed}
+
+	if _, err := fs.Verify(true); !errors.Is(err, errReadFailed) {
+		t.Errorf("Verify() error = %v, expected the primary's error", err)
+	}
+	if got := readString(cache, "/unknown.txt"); got != "content" {
+		t.Errorf("cache /unknown.txt = %q, expected it left alone", got)
+	}
+}
@@ -0,0 +1,160 @@
+package corfs
+
+import (
+	"context"
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path"
+)
+
+// WalkDir walks the file tree rooted at root, calling fn for each file or
+// directory in the tree, including root, in lexical order. It follows the
+// contract of io/fs.WalkDir: errors reading a directory are passed to fn,
+// which may return fs.SkipDir or fs.SkipAll. Directories are listed with
+// ReadDir, so files written in WriteBack mode and not yet flushed are visited
+// too. Symbolic links are reported but not followed, so link cycles can't
+// trap the walk. A directory a filer reports as containing itself, or
+// nested too deep, is passed to fn with an ErrDirCycle error in place of
+// its listing, and isn't descended into.
+func (fs *FileSystem) WalkDir(root string, fn iofs.WalkDirFunc) error {
+	return fs.walk(root, fn, false)
+}
+
+// Prewarm walks the tree rooted at root like WalkDir and copies every
+// regular file that is not already cached into the cache before passing it
+// to fn. If caching a file fails, fn is called for it with the error instead
+// of nil; returning nil continues the walk.
+func (fs *FileSystem) Prewarm(root string, fn iofs.WalkDirFunc) error {
+	return fs.walk(root, fn, true)
+}
+
+func (fs *FileSystem) walk(root string, fn iofs.WalkDirFunc, fill bool) error {
+	off := fs.bypass()
+	info, err := fs.stat(rooted(root), off)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fs.walkDir(root, iofs.FileInfoToDirEntry(info), fn, fill, off, nil)
+	}
+	if err == iofs.SkipDir || err == iofs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkDir visits name and, if it is a directory, everything beneath it,
+// without involving the cache if off. ancestors are the directories above
+// it (see descend).
+func (fs *FileSystem) walkDir(name string, d iofs.DirEntry, fn iofs.WalkDirFunc, fill, off bool, ancestors []os.FileInfo) error {
+	var fillErr error
+	if fill && d.Type().IsRegular() {
+		fillErr = fs.prewarm(name, off)
+	}
+	if err := fn(name, d, fillErr); err != nil || !d.IsDir() {
+		if err == iofs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	info, _ := d.Info()
+	ancestors, err := descend("walk", name, info, ancestors)
+	var entries []iofs.DirEntry
+	if err == nil {
+		entries, err = fs.readDir(rooted(name), off)
+	}
+	if err != nil {
+		// Second call, reporting the cycle or ReadDir failure
+		if err := fn(name, d, err); err != nil {
+			if err == iofs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if e.Name() == "." || e.Name() == ".." {
+			continue
+		}
+		if err := fs.walkDir(path.Join(name, e.Name()), e, fn, fill, off, ancestors); err != nil {
+			if err == iofs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyFile copies the whole of name from the primary into the cache,
+// atomically replacing any cached copy, and records the complete entry
+// with its size and, with WithChecksums, its checksum. It returns the
+// number of bytes copied. If a ReadFile or Prewarm of name is already
+// filling the cache, CopyFile waits for it and returns the size it cached
+// rather than copying name again.
+//
+// Files outside the size limits of WithMinCacheSize and WithMaxCacheSize,
+// or with a TTL of zero (see SetTTL), are not copied, and neither is
+// anything while the cache is disabled: CopyFile fails with
+// ErrNotCacheable. A file with WriteBack writes not yet flushed is left
+// alone, since its cached copy is newer than the primary's, and CopyFile
+// returns 0 and no error. A copy overlapping a write handle opened on name
+// is discarded, since it may mix content from before and after the write,
+// and CopyFile fails.
+func (fs *FileSystem) CopyFile(name string) (int64, error) {
+	name = cleanPath(name)
+	if fs.bypass() {
+		return 0, &os.PathError{Op: "copy", Path: name, Err: ErrNotCacheable}
+	}
+	return fs.copyFile(name)
+}
+
+// copyFile implements CopyFile once the cache is known to be enabled.
+func (fs *FileSystem) copyFile(name string) (int64, error) {
+	key := path.Clean(name)
+	if fs.dirty(key) {
+		return 0, nil
+	}
+	if fs.uncacheable(key) {
+		fs.decide(DecisionSkipExcluded, name, nil)
+		return 0, &os.PathError{Op: "copy", Path: name, Err: ErrNotCacheable}
+	}
+	if fs.sizeLimited() {
+		if info, err := fs.primary.Stat(name); err == nil && !fs.cacheable(info.Size()) {
+			fs.decide(DecisionSkipSize, name, nil)
+			return 0, &os.PathError{Op: "copy", Path: name, Err: ErrNotCacheable}
+		}
+	}
+
+	call, leader := fs.flight.begin(key, true)
+	if !leader {
+		if call.wait() {
+			if e, ok := fs.index.get(key); ok && e.complete {
+				return e.size, nil
+			}
+		}
+		// The fill failed or is driven by a File; copy alongside it
+		call = nil
+	}
+	cache := fs.acquireCache()
+	n, err := fs.copyToCache(context.Background(), cache, name, call, false, false)
+	fs.releaseCache()
+	if call != nil {
+		fs.flight.end(key, call, err)
+	}
+	return n, err
+}
+
+// prewarm copies name into the cache unless a complete copy is already
+// there or the cache is off. It shares in-flight fills of the same path.
+func (fs *FileSystem) prewarm(name string, off bool) error {
+	if fs.offline || off || fs.fresh(name) {
+		return nil
+	}
+	if _, err := fs.copyFile(name); err != nil && !errors.Is(err, ErrNotCacheable) && !errors.Is(err, errFillStale) {
+		return err
+	}
+	return nil
+}
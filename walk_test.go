@@ -0,0 +1,223 @@
+package corfs
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// readDirFailFiler fails ReadDir for one directory.
+type readDirFailFiler struct {
+	absfs.Filer
+	name string
+	err  error
+}
+
+func (r *readDirFailFiler) ReadDir(name string) ([]iofs.DirEntry, error) {
+	if name == r.name {
+		return nil, r.err
+	}
+	return r.Filer.ReadDir(name)
+}
+
+// walkPaths returns the paths fs.WalkDir visits under root.
+func walkPaths(t *testing.T, fs *FileSystem, root string) []string {
+	t.Helper()
+	var paths []string
+	err := fs.WalkDir(root, func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir() error = %v", err)
+	}
+	return paths
+}
+
+func TestWalkDir(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/root/sub", 0755)
+	writeMemFile(t, primary, "/root/a.txt", "a")
+	writeMemFile(t, primary, "/root/sub/b.txt", "b")
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/root/sub/c.txt", "c") // Only in the cache
+
+	got := walkPaths(t, fs, "/root")
+	want := []string{"/root", "/root/a.txt", "/root/sub", "/root/sub/b.txt", "/root/sub/c.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkDir() visited %v, expected %v", got, want)
+	}
+}
+
+func TestWalkDirReadDirError(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	mem.MkdirAll("/root/locked", 0755)
+	mem.MkdirAll("/root/open", 0755)
+	writeMemFile(t, mem, "/root/open/file.txt", "x")
+	primary := &readDirFailFiler{Filer: mem, name: "/root/locked", err: os.ErrPermission}
+	fs := New(primary, cache)
+
+	var reported []string
+	err := fs.WalkDir("/root", func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			reported = append(reported, name)
+			return iofs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir() error = %v", err)
+	}
+	if !reflect.DeepEqual(reported, []string{"/root/locked"}) {
+		t.Errorf("errors reported for %v, expected [/root/locked]", reported)
+	}
+
+	err = fs.WalkDir("/root", func(name string, d iofs.DirEntry, err error) error {
+		return err
+	})
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("WalkDir() error = %v, expected %v", err, os.ErrPermission)
+	}
+}
+
+func TestWalkDirCycle(t *testing.T) {
+	primary, cache := newLoopFiler(t)
+	fs := New(primary, cache)
+
+	var visited int
+	var reported []error
+	err := fs.WalkDir("/loop", func(name string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			reported = append(reported, err)
+			return nil
+		}
+		visited++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir() error = %v", err)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrDirCycle) {
+		t.Errorf("errors reported %v, expected one ErrDirCycle", reported)
+	}
+	if visited != maxTreeDepth+1 {
+		t.Errorf("visited %d directories, expected %d", visited, maxTreeDepth+1)
+	}
+}
+
+func TestWalkDirMissingRoot(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache)
+
+	err := fs.WalkDir("/missing", func(name string, d iofs.DirEntry, err error) error {
+		if d != nil {
+			t.Errorf("fn called with entry %v for missing root", d)
+		}
+		return err
+	})
+	if !os.IsNotExist(err) {
+		t.Errorf("WalkDir() error = %v, expected not exist", err)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/root/sub", 0755)
+	writeMemFile(t, primary, "/root/a.txt", "alpha")
+	writeMemFile(t, primary, "/root/sub/b.txt", "beta")
+	fs := New(primary, cache)
+
+	err := fs.Prewarm("/root", func(name string, d iofs.DirEntry, err error) error {
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Prewarm() error = %v", err)
+	}
+
+	for name, content := range map[string]string{"/root/a.txt": "alpha", "/root/sub/b.txt": "beta"} {
+		if got := readString(cache, name); got != content {
+			t.Errorf("cache %s = %q, expected %q", name, got, content)
+		}
+		if e, ok := fs.index.get(name); !ok || !e.complete {
+			t.Errorf("index entry for %s = %+v, expected complete", name, e)
+		}
+	}
+	assertNoTempFiles(t, fs)
+}
+
+func TestCopyFile(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "old")
+	fs := New(primary, cache, WithChecksums())
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A complete cached copy is replaced with the primary's content
+	writeMemFile(t, primary, "/file.txt", "new content")
+	n, err := fs.CopyFile("/file.txt")
+	if err != nil || n != 11 {
+		t.Fatalf("CopyFile() = %d, %v; expected 11", n, err)
+	}
+	if got := readString(cache, "/file.txt"); got != "new content" {
+		t.Errorf("cache /file.txt = %q, expected %q", got, "new content")
+	}
+	if st := fs.CacheStatus("/file.txt"); !st.Complete || st.Size != 11 || st.Checksum == "" {
+		t.Errorf("CacheStatus() = %+v, expected a complete entry with a checksum", st)
+	}
+	assertNoTempFiles(t, fs)
+
+	if _, err := fs.CopyFile("/missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CopyFile(/missing.txt) error = %v, expected not exist", err)
+	}
+}
+
+func TestCopyFileNotCacheable(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	primary.MkdirAll("/tmp", 0755)
+	writeMemFile(t, primary, "/large.txt", "too large")
+	writeMemFile(t, primary, "/tmp/file.txt", "excluded")
+	fs := New(primary, cache, WithMaxCacheSize(4))
+	if err := fs.SetTTL("/tmp", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/large.txt", "/tmp/file.txt"} {
+		if n, err := fs.CopyFile(name); n != 0 || !errors.Is(err, ErrNotCacheable) {
+			t.Errorf("CopyFile(%s) = %d, %v; expected ErrNotCacheable", name, n, err)
+		}
+		if _, err := cache.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("cache Stat(%s) error = %v, expected not exist", name, err)
+		}
+	}
+}
+
+func TestReadDirHidesInternalFiles(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	cache.MkdirAll("/dir", 0755)
+	writeMemFile(t, cache, "/dir/file.txt", "cached")
+	writeMemFile(t, cache, "/dir/"+tempPrefix+"file.txt.1"+tempSuffix, "partial")
+	fs := New(primary, cache)
+
+	// The primary has no /dir, so the listing falls back to the cache
+	entries, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Name() != "." && e.Name() != ".." {
+			names = append(names, e.Name())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"file.txt"}) {
+		t.Errorf("ReadDir() = %v, expected [file.txt]", names)
+	}
+}
@@ -0,0 +1,300 @@
+package corfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// SyncError is returned by Sync when some dirty files could not be flushed
+// to the primary. Every other dirty file was flushed.
+type SyncError struct {
+	Errs map[string]error // Flush error keyed by path
+}
+
+// paths returns the failed paths in sorted order.
+func (e *SyncError) paths() []string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *SyncError) Error() string {
+	var b strings.Builder
+	b.WriteString("corfs: failed to flush ")
+	b.WriteString(strconv.Itoa(len(e.Errs)))
+	b.WriteString(" file(s)")
+	for i, name := range e.paths() {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(e.Errs[name].Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the individual flush errors for errors.Is and errors.As.
+func (e *SyncError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, name := range e.paths() {
+		errs = append(errs, e.Errs[name])
+	}
+	return errs
+}
+
+// ErrFlushMismatch is returned, wrapped in an *os.PathError, by Sync and
+// FlushFile for a file whose copy on the primary doesn't match what was
+// flushed (see WithVerifyFlush).
+var ErrFlushMismatch = errors.New("corfs: flushed file doesn't match its cached copy")
+
+// Checksummer is implemented by primary filers able to report the SHA-256
+// of a file's content, as a hex string, without it being read, such as
+// object stores recording one with each object. WithVerifyFlush uses it
+// rather than read flushed files back.
+type Checksummer interface {
+	Checksum(name string) (string, error)
+}
+
+// Sync writes every dirty file in the cache to the primary. A failure to
+// flush one file doesn't stop the others; if any fail, Sync returns a
+// *SyncError naming them, and they stay dirty so a later Sync can retry.
+// Outside WriteBack mode there is never anything to flush.
+func (fs *FileSystem) Sync() error {
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+
+	var errs map[string]error
+	for _, name := range fs.index.dirtyPaths() {
+		if _, err := fs.flush(cache, name); err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[name] = err
+		}
+	}
+	if errs != nil {
+		return &SyncError{Errs: errs}
+	}
+	return nil
+}
+
+// DirtyEntries returns the sorted paths of the files whose WriteBack writes
+// haven't been flushed to the primary yet, which Sync would flush,
+// including those whose last flush failed WithVerifyFlush. Outside
+// WriteBack mode it is always empty.
+func (fs *FileSystem) DirtyEntries() []string {
+	return fs.index.dirtyPaths()
+}
+
+// DirtyBytes returns the total size of the files DirtyEntries reports: the
+// data that would be lost if the cache were lost before a Sync. Each file
+// counts at its size after the last write made to it.
+func (fs *FileSystem) DirtyBytes() int64 {
+	return fs.index.dirtyBytes()
+}
+
+// FlushFile writes name to the primary if its cached copy is dirty. Reads
+// of name while it is flushed are served from the cached copy, so they
+// never see the primary's copy half written.
+func (fs *FileSystem) FlushFile(name string) error {
+	name = cleanPath(name)
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	_, err := fs.flush(cache, name)
+	return err
+}
+
+// flush copies the dirty cached copy of name to the primary, reporting
+// whether it did. If name is written again while the copy is in progress
+// it stays dirty. The caller must hold the cache.
+//
+// Reads go to the cached copy for as long as name is dirty, which it stays
+// until the copy has been written, synced and closed, so no reader sees the
+// primary half written. Flushes of the same path take turns: otherwise one
+// could mark name clean, sending reads to the primary, while another was
+// still rewriting it. A flush that finds name clean once its turn comes,
+// because the one before it flushed it already, writes nothing.
+func (fs *FileSystem) flush(cache absfs.Filer, name string) (flushed bool, err error) {
+	key := fs.key(name)
+	for {
+		call, leader := fs.flushes.begin(key, true)
+		if leader {
+			defer fs.flushes.end(key, call, nil)
+			break
+		}
+		<-call.done
+	}
+
+	e, ok := fs.index.get(name)
+	if !ok || !e.dirty {
+		return false, nil
+	}
+	defer func() {
+		if err != nil {
+			fs.stats.flushErrors.Add(1)
+		}
+	}()
+
+	src, err := openFile(cache, name, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	mkdirAll(fs.primary, path.Dir(name), 0755)
+	dst, err := openFile(fs.primary, name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	var r io.Reader = src
+	var h hash.Hash
+	if fs.verifyFlush {
+		h = sha256.New()
+		r = io.TeeReader(src, h)
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	_, err = io.CopyBuffer(dst, r, *buf)
+	copyBuffers.Put(buf)
+	if syncErr := dst.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	fs.invalidateMeta(name)
+	if err != nil {
+		return false, err
+	}
+	if h != nil {
+		if err := fs.verifyFlushed(name, hex.EncodeToString(h.Sum(nil))); err != nil {
+			fs.reportCacheError("verify-flush", name, err)
+			return false, err
+		}
+	}
+	fs.stats.flushes.Add(1)
+	fs.index.clean(name, e.version)
+	return true, nil
+}
+
+// verifyFlushed checks that the primary's copy of name, just flushed, has
+// the checksum sum, asking the primary for it if it is a Checksummer and
+// reading the copy back otherwise.
+func (fs *FileSystem) verifyFlushed(name, sum string) error {
+	var got string
+	if c, ok := fs.primary.(Checksummer); ok {
+		var err error
+		if got, err = c.Checksum(name); err != nil {
+			return err
+		}
+	} else {
+		f, err := openFile(fs.primary, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		buf := copyBuffers.Get().(*[]byte)
+		_, err = io.CopyBuffer(h, f, *buf)
+		copyBuffers.Put(buf)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		got = hex.EncodeToString(h.Sum(nil))
+	}
+	if !strings.EqualFold(got, sum) {
+		return &os.PathError{Op: "flush", Path: name, Err: ErrFlushMismatch}
+	}
+	return nil
+}
+
+// dirty reports whether name has writes in the cache not yet flushed.
+func (fs *FileSystem) dirty(name string) bool {
+	e, ok := fs.index.get(name)
+	return ok && e.dirty
+}
+
+// openWriteBack opens name for writing in WriteBack mode. The handle works
+// on the cached copy alone. Unless the file is being truncated, the
+// primary's content is copied into the cache first so that partial writes
+// apply to the whole file.
+func (fs *FileSystem) openWriteBack(name string, flag int, perm os.FileMode) (_ absfs.File, err error) {
+	fs.invalidateMeta(name)
+
+	cache := fs.acquireCache()
+	defer fs.releaseCache()
+	fs.blocks.drop(cache, name)
+
+	// Counted from the start so Prune leaves the copy being set up alone
+	fs.index.openWriter(name)
+	defer func() {
+		if err != nil {
+			fs.index.closeWriter(name)
+		}
+	}()
+
+	if e, ok := fs.index.get(name); !fs.offline && (!ok || !e.complete) {
+		// Only a complete entry matches the primary's current content
+		info, err := fs.primary.Stat(name)
+		switch {
+		case err != nil && !os.IsNotExist(err):
+			return nil, err
+		case err != nil:
+			// Don't let a stale cached copy stand in for a missing file
+			cache.Remove(name)
+			fs.index.remove(name)
+		case info.IsDir():
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		case flag&os.O_TRUNC != 0:
+			flag |= os.O_CREATE // The content is discarded anyway
+		default:
+			if _, err := fs.copyToCache(context.Background(), cache, name, nil, false, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if flag&os.O_CREATE != 0 {
+		fs.mkdirCache(cache, path.Dir(name))
+	}
+	cacheFile, err := openFile(cache, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{
+		cache:   cacheFile,
+		name:    name,
+		fs:      fs,
+		cached:  true,
+		gen:     fs.cacheGen,
+		writer:  true,
+		appends: flag&os.O_APPEND != 0,
+	}
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		f.markDirty()
+	}
+	return f, nil
+}
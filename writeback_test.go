@@ -0,0 +1,533 @@
+package corfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// openFailFiler fails to open one path for writing.
+type openFailFiler struct {
+	absfs.Filer
+	name string
+	err  error
+}
+
+func (o *openFailFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if name == o.name && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, o.err
+	}
+	return o.Filer.OpenFile(name, flag, perm)
+}
+
+// readString reads name from filer, or returns "" if it can't be read.
+func readString(filer absfs.Filer, name string) string {
+	data, err := filer.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestWriteBackDefersPrimary(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	writeMemFile(t, fs, "/dir/file.txt", "deferred")
+
+	if _, err := primary.Stat("/dir/file.txt"); !os.IsNotExist(err) {
+		t.Fatalf("primary Stat() error = %v, expected not exist before flush", err)
+	}
+	if got := readString(fs, "/dir/file.txt"); got != "deferred" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "deferred")
+	}
+	info, err := fs.Stat("/dir/file.txt")
+	if err != nil || info.Size() != int64(len("deferred")) {
+		t.Errorf("Stat() = %v, %v, expected size %d", info, err, len("deferred"))
+	}
+
+	if err := fs.FlushFile("/dir/file.txt"); err != nil {
+		t.Fatalf("FlushFile() error = %v", err)
+	}
+	if got := readString(primary, "/dir/file.txt"); got != "deferred" {
+		t.Errorf("primary content = %q, expected %q", got, "deferred")
+	}
+	if fs.dirty("/dir/file.txt") {
+		t.Error("file still dirty after FlushFile")
+	}
+}
+
+func TestWriteBackPartialWrite(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	f, err := fs.OpenFile("/file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := f.WriteAt([]byte("WORLD"), 6); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	f.Close()
+
+	if got := readString(primary, "/file.txt"); got != "hello world" {
+		t.Errorf("primary content = %q before Sync, expected it unchanged", got)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got := readString(primary, "/file.txt"); got != "hello WORLD" {
+		t.Errorf("primary content = %q, expected %q", got, "hello WORLD")
+	}
+}
+
+func TestWriteBackTruncate(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "hello world")
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	if err := fs.Truncate("/file.txt", 5); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	if got := readString(fs, "/file.txt"); got != "hello" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "hello")
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got := readString(primary, "/file.txt"); got != "hello" {
+		t.Errorf("primary content = %q, expected %q", got, "hello")
+	}
+}
+
+func TestSyncReportsFailures(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	errDown := errors.New("primary down")
+	primary := &openFailFiler{Filer: mem, name: "/bad.txt", err: errDown}
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	writeMemFile(t, fs, "/bad.txt", "bad")
+	writeMemFile(t, fs, "/good.txt", "good")
+
+	err := fs.Sync()
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) {
+		t.Fatalf("Sync() error = %v, expected *SyncError", err)
+	}
+	if len(syncErr.Errs) != 1 || syncErr.Errs["/bad.txt"] != errDown {
+		t.Errorf("SyncError.Errs = %v, expected only /bad.txt", syncErr.Errs)
+	}
+	if !errors.Is(err, errDown) {
+		t.Error("errors.Is(Sync(), errDown) = false")
+	}
+
+	// The failure didn't stop the other file, and the failed one stays dirty
+	if got := readString(mem, "/good.txt"); got != "good" {
+		t.Errorf("primary /good.txt = %q, expected %q", got, "good")
+	}
+	if !fs.dirty("/bad.txt") {
+		t.Error("/bad.txt not dirty after failed flush")
+	}
+
+	primary.name = ""
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("retried Sync() error = %v", err)
+	}
+	if got := readString(mem, "/bad.txt"); got != "bad" {
+		t.Errorf("primary /bad.txt = %q, expected %q", got, "bad")
+	}
+}
+
+func TestDirtyEntries(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	writeMemFile(t, fs, "/b.txt", "bravo")
+	writeMemFile(t, fs, "/a.txt", "alpha!")
+	if got, want := fs.DirtyEntries(), []string{"/a.txt", "/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DirtyEntries() = %q, expected %q", got, want)
+	}
+	if n := fs.DirtyBytes(); n != 11 {
+		t.Errorf("DirtyBytes() = %d, expected 11", n)
+	}
+
+	if err := fs.FlushFile("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fs.DirtyEntries(), []string{"/b.txt"}; !reflect.DeepEqual(got, want) || fs.DirtyBytes() != 5 {
+		t.Errorf("DirtyEntries() = %q with %d bytes, expected %q with 5", got, fs.DirtyBytes(), want)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.DirtyEntries(); len(got) != 0 || fs.DirtyBytes() != 0 {
+		t.Errorf("DirtyEntries() = %q with %d bytes, expected none after Sync", got, fs.DirtyBytes())
+	}
+}
+
+func TestFlushKeepsLaterWritesDirty(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	writeMemFile(t, fs, "/file.txt", "one")
+	e, _ := fs.index.get("/file.txt")
+	writeMemFile(t, fs, "/file.txt", "two")
+
+	if fs.index.clean("/file.txt", e.version) {
+		t.Error("clean() succeeded for an outdated version")
+	}
+	if !fs.dirty("/file.txt") {
+		t.Error("file not dirty after a write newer than the flushed version")
+	}
+}
+
+// heldWriteFiler holds opens for writing and writes until the test
+// releases them. Each held call sends a channel on held and waits for it to
+// be closed.
+type heldWriteFiler struct {
+	absfs.Filer
+	held chan chan struct{}
+}
+
+func (h *heldWriteFiler) hold() {
+	release := make(chan struct{})
+	h.held <- release
+	<-release
+}
+
+func (h *heldWriteFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return h.Filer.OpenFile(name, flag, perm)
+	}
+	h.hold()
+	f, err := h.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &heldWriteFile{File: f, filer: h}, nil
+}
+
+type heldWriteFile struct {
+	absfs.File
+	filer *heldWriteFiler
+}
+
+func (f *heldWriteFile) Write(b []byte) (int, error) {
+	f.filer.hold()
+	return f.File.Write(b)
+}
+
+func TestReadDuringFlush(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	writeMemFile(t, mem, "/file.txt", "old content")
+	primary := &heldWriteFiler{Filer: mem, held: make(chan chan struct{})}
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/file.txt", "new content")
+
+	first := make(chan error, 1)
+	go func() { first <- fs.FlushFile("/file.txt") }()
+	close(<-primary.held) // The primary's copy is truncated
+	release := <-primary.held
+
+	// Readers see the cached copy while the primary's is half written
+	readers := make(chan string, 10)
+	for i := 0; i < cap(readers); i++ {
+		go func() { readers <- readString(fs, "/file.txt") }()
+	}
+	for i := 0; i < cap(readers); i++ {
+		if got := <-readers; got != "new content" {
+			t.Errorf("ReadFile() during flush = %q, expected %q", got, "new content")
+		}
+	}
+
+	// A second flush waits for the first rather than rewriting the primary
+	second := make(chan error, 1)
+	go func() { second <- fs.FlushFile("/file.txt") }()
+	select {
+	case r := <-primary.held:
+		t.Error("second flush wrote the primary while the first was in progress")
+		go func() {
+			for ; ; r = <-primary.held {
+				close(r)
+			}
+		}()
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	for _, done := range []chan error{first, second} {
+		if err := <-done; err != nil {
+			t.Errorf("FlushFile() error = %v", err)
+		}
+	}
+	if got := readString(mem, "/file.txt"); got != "new content" {
+		t.Errorf("primary content = %q, expected %q", got, "new content")
+	}
+	if fs.dirty("/file.txt") {
+		t.Error("file still dirty after FlushFile")
+	}
+}
+
+func TestWriteAround(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "old")
+	fs := New(primary, cache, WithMode(WriteAround))
+
+	if _, err := fs.ReadFile("/file.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	writeMemFile(t, fs, "/file.txt", "new")
+
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected the cached copy to be discarded", err)
+	}
+	if got := readString(primary, "/file.txt"); got != "new" {
+		t.Errorf("primary content = %q, expected %q", got, "new")
+	}
+	if got := readString(fs, "/file.txt"); got != "new" {
+		t.Errorf("ReadFile() = %q, expected %q", got, "new")
+	}
+}
+
+func TestWriteBackCoherentReaders(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	writeMemFile(t, primary, "/file.txt", "aaaaaaaa")
+	fs := New(primary, cache, WithMode(WriteBack))
+
+	before, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	w, err := fs.OpenFile("/file.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Opened while the writer is, before it writes anything
+	after, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if _, err := w.WriteAt([]byte("bbbbbbbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := after.ReadAt(buf, 0); err != nil || string(buf) != "bbbbbbbb" {
+		t.Errorf("ReadAt() after the write = %q, %v; expected the written content", buf, err)
+	}
+	if _, err := before.ReadAt(buf, 0); err != nil || string(buf) != "aaaaaaaa" {
+		t.Errorf("ReadAt() opened before the writer = %q, %v; expected the primary's content", buf, err)
+	}
+
+	// Reads never see half of a write
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			w.WriteAt(bytes.Repeat([]byte{"ab"[i%2]}, 8), 0)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if _, err := after.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		data, err := fs.ReadFile("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range [][]byte{buf, data} {
+			if !bytes.Equal(got, bytes.Repeat(got[:1], 8)) {
+				t.Fatalf("read %q, expected one write or the other", got)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestWriteBackRemoveUnflushed(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/file.txt", "deferred")
+
+	if err := fs.Remove("/file.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := cache.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+	if fs.dirty("/file.txt") {
+		t.Error("removed file still dirty")
+	}
+	if err := fs.Remove("/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("second Remove() error = %v, expected not exist", err)
+	}
+}
+
+func TestWriteBackRenameUnflushed(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/old.txt", "deferred")
+
+	if err := fs.Rename("/old.txt", "/new.txt"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got := readString(primary, "/new.txt"); got != "deferred" {
+		t.Errorf("primary /new.txt = %q, expected %q", got, "deferred")
+	}
+	if _, err := primary.Stat("/old.txt"); !os.IsNotExist(err) {
+		t.Errorf("primary Stat(/old.txt) error = %v, expected not exist", err)
+	}
+}
+
+func TestWriteBackRemoveAllUnflushed(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/dir/file.txt", "deferred")
+	primary.RemoveAll("/dir")
+
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if _, err := cache.Stat("/dir"); !os.IsNotExist(err) {
+		t.Errorf("cache Stat() error = %v, expected not exist", err)
+	}
+	if err := fs.Sync(); err != nil {
+		t.Errorf("Sync() error = %v, expected nothing left to flush", err)
+	}
+}
+
+func TestWriteBackMetadataUnflushed(t *testing.T) {
+	primary, cache := newMemFilers(t)
+	fs := New(primary, cache, WithMode(WriteBack))
+	writeMemFile(t, fs, "/file.txt", "deferred")
+
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for op, err := range map[string]error{
+		"Chmod":   fs.Chmod("/file.txt", 0600),
+		"Chtimes": fs.Chtimes("/file.txt", modified, modified),
+		"Chown":   fs.Chown("/file.txt", os.Getuid(), os.Getgid()),
+	} {
+		if err != nil {
+			t.Errorf("%s() error = %v, expected the cached copy to be changed", op, err)
+		}
+	}
+	info, err := cache.Stat("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(modified) {
+		t.Errorf("cache Stat() = %v %v, expected the new mode and time", info.Mode(), info.ModTime())
+	}
+	if err := fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := primary.Stat("/file.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("primary Stat() = %v, %v; expected the flushed copy's mode", info, err)
+	}
+
+	// Neither filesystem holds the file
+	if err := fs.Chmod("/missing.txt", 0600); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Chmod(/missing.txt) error = %v, expected not exist", err)
+	}
+}
+
+// lossyFiler silently drops the first byte of each write to its files
+// while lossy is set, as a primary corrupting what it stores would.
+type lossyFiler struct {
+	absfs.Filer
+	lossy bool
+	sum   string // Reported as the checksum of every file, if set
+}
+
+func (l *lossyFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := l.Filer.OpenFile(name, flag, perm)
+	if err != nil || !l.lossy || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &lossyFile{File: f}, nil
+}
+
+type lossyFile struct {
+	absfs.File
+}
+
+func (f *lossyFile) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	_, err := f.File.Write(b[1:])
+	return len(b), err
+}
+
+// checksumFiler is a lossyFiler that is also a Checksummer.
+type checksumFiler struct {
+	lossyFiler
+}
+
+func (c *checksumFiler) Checksum(name string) (string, error) {
+	return c.sum, nil
+}
+
+func TestVerifyFlush(t *testing.T) {
+	mem, cache := newMemFilers(t)
+	primary := &lossyFiler{Filer: mem, lossy: true}
+	var reported []*CacheError
+	fs := New(primary, cache, WithMode(WriteBack), WithVerifyFlush(),
+		WithCacheErrorHandler(func(ce *CacheError) { reported = append(reported, ce) }))
+
+	writeMemFile(t, fs, "/file.txt", "content")
+	if err := fs.Sync(); !errors.Is(err, ErrFlushMismatch) {
+		t.Fatalf("Sync() error = %v, expected ErrFlushMismatch", err)
+	}
+	if got := fs.DirtyEntries(); !reflect.DeepEqual(got, []string{"/file.txt"}) {
+		t.Errorf("DirtyEntries() = %v, expected the file that failed verification", got)
+	}
+	if len(reported) != 1 || reported[0].Op != "verify-flush" || !errors.Is(reported[0], ErrFlushMismatch) {
+		t.Errorf("reported %v, expected one verify-flush CacheError", reported)
+	}
+
+	// Once the primary stores what it is sent, the retried flush succeeds
+	primary.lossy = false
+	if err := fs.FlushFile("/file.txt"); err != nil {
+		t.Fatalf("FlushFile() error = %v", err)
+	}
+	if got := fs.DirtyEntries(); len(got) != 0 {
+		t.Errorf("DirtyEntries() = %v after a verified flush, expected none", got)
+	}
+	if got := readString(mem, "/file.txt"); got != "content" {
+		t.Errorf("primary /file.txt = %q, expected %q", got, "content")
+	}
+}
+
+func TestVerifyFlushChecksummer(t *testing.T) {
+	const sum = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73" // SHA-256 of "content"
+	mem, cache := newMemFilers(t)
+	primary := &checksumFiler{lossyFiler{Filer: mem, lossy: true, sum: sum}}
+	fs := New(primary, cache, WithMode(WriteBack), WithVerifyFlush())
+
+	// The primary's checksum is trusted over its content
+	writeMemFile(t, fs, "/file.txt", "content")
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v, expected the primary's checksum to match", err)
+	}
+
+	primary.sum = "0000"
+	writeMemFile(t, fs, "/file.txt", "content")
+	if err := fs.Sync(); !errors.Is(err, ErrFlushMismatch) {
+		t.Errorf("Sync() error = %v, expected ErrFlushMismatch", err)
+	}
+}